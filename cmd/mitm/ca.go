@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream"
+	"github.com/ddkwork/mitmproxy/internal/ca"
+)
+
+const caUsage = `usage: mitm ca <command> [flags]
+
+commands:
+  generate  create a new root CA
+  show      print fingerprint and expiry of the root CA
+  export    write the root CA as pem, der, p12 or mobileconfig
+  rotate    replace the root CA, keeping the old one published for a grace period
+  serve     serve the root CA on a mitm.it style landing page
+`
+
+// caFiles are the flags every ca command shares.
+type caFiles struct {
+	dir string
+}
+
+func (f *caFiles) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", stream.HomeDir(), "directory holding ca.crt and ca.key")
+}
+
+func (f *caFiles) certFile() string { return filepath.Join(f.dir, "ca.crt") }
+func (f *caFiles) keyFile() string  { return filepath.Join(f.dir, "ca.key") }
+
+func (f *caFiles) load() *x509.Certificate {
+	cert, _, ok := ca.LoadCA(f.certFile(), f.keyFile())
+	if !ok {
+		mylog.Check(fmt.Errorf("no CA in %s, run mitm ca generate first", f.dir))
+	}
+	return cert
+}
+
+// caOptions are the flags describing a CA to generate.
+type caOptions struct {
+	name         string
+	organization string
+	validity     time.Duration
+	algorithm    string
+}
+
+func (o *caOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.name, "name", "github.com/ddkwork/mitmproxy ca", "common name of the CA")
+	fs.StringVar(&o.organization, "org", "github.com/ddkwork/mitmproxy", "organization of the CA")
+	fs.DurationVar(&o.validity, "validity", 365*24*time.Hour, "validity of the CA")
+	fs.StringVar(&o.algorithm, "alg", string(ca.RSA2048), fmt.Sprint("key algorithm, one of ", ca.RSA2048.EnumTypes()))
+}
+
+func (o *caOptions) apply(c *ca.Option) {
+	c.Name = o.name
+	c.Organization = o.organization
+	c.Validity = o.validity
+	c.Algorithm = ca.KeyAlgorithm(o.algorithm)
+}
+
+func runCa(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		os.Exit(2)
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("mitm ca "+cmd, flag.ExitOnError)
+	files := &caFiles{}
+	files.register(fs)
+	switch cmd {
+	case "generate":
+		options := &caOptions{}
+		options.register(fs)
+		force := fs.Bool("force", false, "overwrite an existing CA")
+		mylog.Check(fs.Parse(args))
+		if stream.FileExists(files.certFile()) && !*force {
+			mylog.Check(fmt.Errorf("%s already exists, use -force to overwrite or mitm ca rotate", files.certFile()))
+		}
+		cert, key := ca.NewCA(options.apply)
+		ca.SaveCA(files.certFile(), files.keyFile(), cert, key)
+		printCa(cert)
+	case "show":
+		mylog.Check(fs.Parse(args))
+		printCa(files.load())
+		for _, p := range ca.LoadPreviousCA(files.certFile()) {
+			fmt.Println()
+			fmt.Println("previous root, published until", p.GraceUntil.Format(time.RFC3339))
+			printCa(p.Certificate)
+		}
+	case "export":
+		format := fs.String("format", string(ca.PemFormat), fmt.Sprint("export format, one of ", ca.PemFormat.EnumTypes()))
+		out := fs.String("out", "", "output file, defaults to mitmproxy-ca.<ext> in the current directory, - for stdout")
+		password := fs.String("password", "", "password of the p12 file")
+		mylog.Check(fs.Parse(args))
+		f := ca.ExportFormat(*format)
+		b := mylog.Check2(ca.Export(files.load(), f, *password))
+		switch *out {
+		case "-":
+			mylog.Check2(os.Stdout.Write(b))
+			return
+		case "":
+			*out = "mitmproxy-ca" + f.Ext()
+		}
+		mylog.Check(os.WriteFile(*out, b, 0o644))
+		fmt.Println("written", *out)
+	case "rotate":
+		options := &caOptions{}
+		options.register(fs)
+		grace := fs.Duration("grace", 30*24*time.Hour, "how long the old root stays published")
+		mylog.Check(fs.Parse(args))
+		cert, _ := ca.RotateCA(files.certFile(), files.keyFile(), *grace, options.apply)
+		printCa(cert)
+	case "serve":
+		addr := fs.String("addr", "127.0.0.1:7777", "listen address of the landing page")
+		mylog.Check(fs.Parse(args))
+		fmt.Println("serving CA on http://" + *addr)
+		mylog.Check(http.ListenAndServe(*addr, ca.NewLandingHandler(files.load(), ca.LoadPreviousCA(files.certFile()))))
+	default:
+		fmt.Fprint(os.Stderr, caUsage)
+		os.Exit(2)
+	}
+}
+
+func printCa(cert *x509.Certificate) {
+	fmt.Println("subject:    ", cert.Subject.String())
+	fmt.Println("serial:     ", strings.ToUpper(cert.SerialNumber.Text(16)))
+	fmt.Println("algorithm:  ", cert.PublicKeyAlgorithm.String())
+	fmt.Println("not before: ", cert.NotBefore.Format(time.RFC3339))
+	fmt.Println("not after:  ", cert.NotAfter.Format(time.RFC3339))
+	if left := time.Until(cert.NotAfter); left > 0 {
+		fmt.Println("expires in: ", left.Round(time.Hour))
+	} else {
+		fmt.Println("expires in:  expired")
+	}
+	fmt.Println("sha256:     ", ca.Fingerprint(cert))
+	fmt.Println("sha1:       ", ca.FingerprintSHA1(cert))
+}
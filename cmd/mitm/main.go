@@ -1,6 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/golibrary/std/stream"
 	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
@@ -12,7 +20,51 @@ import (
 //go:generate  go run -x .
 
 func main() {
-	mitmproxy.New("7890", func(session *packet.Session) {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		runCa(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ws" {
+		runWs(os.Args[2:])
+		return
+	}
+	fs := flag.NewFlagSet("mitm", flag.ExitOnError)
+	htpasswd := fs.String("htpasswd", "", "require proxy authentication by the users of this htpasswd file")
+	dns := fs.String("dns", "", "resolve upstream hosts with this DNS server, an https:// URL is asked as DNS-over-HTTPS")
+	envProxy := fs.Bool("env-proxy", false, "send http flows upstream through the proxy of HTTP_PROXY and HTTPS_PROXY")
+	var forwards forwardFlag
+	fs.Var(&forwards, "forward", "relay listen=target as raw tcp, a tls:// prefix on either side speaks tls there (repeatable)")
+	http3 := fs.Bool("http3", false, "serve http/3 on the udp ports of the proxy")
+	stripAltSvc := fs.Bool("strip-alt-svc", false, "remove Alt-Svc from responses so clients stay on tcp")
+	control := fs.String("control", "", "serve the control api on this address, like "+mitmproxy.DefaultControlAddr)
+	controlToken := fs.String("control-token", "", "require this bearer token on calls of the control api")
+	bodyLimit := fs.Int64("body-limit", mitmproxy.DefaultBodyLimit, "bytes of each http body kept in sessions")
+	spillDir := fs.String("spill-dir", "", "write http bodies over -body-limit whole to temp files in this directory")
+	keepSpills := fs.Bool("keep-spills", false, "leave the files of -spill-dir instead of removing them after each exchange")
+	recordChunks := fs.Bool("record-chunks", false, "record the chunks of chunked responses on sessions")
+	preserveChunks := fs.Bool("preserve-chunks", false, "forward chunked responses in the chunks the server sent, implies -record-chunks")
+	mylog.Check(fs.Parse(os.Args[1:]))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	cfg := mitmproxy.DefaultConfig()
+	if *htpasswd != "" {
+		cfg.Auth.Users = mylog.Check2(mitmproxy.LoadHtpasswd(*htpasswd))
+	}
+	if strings.HasPrefix(*dns, "https://") {
+		cfg.DNS.DoH = *dns
+	} else {
+		cfg.DNS.Server = *dns
+	}
+	cfg.ProxyFromEnvironment = *envProxy
+	cfg.Forwards = forwards
+	cfg.HTTP3.Enabled = *http3
+	cfg.HTTP3.StripAltSvc = *stripAltSvc
+	cfg.Control = mitmproxy.Control{Enabled: *control != "", Addr: *control, Token: *controlToken}
+	cfg.BodyCapture = mitmproxy.BodyCapture{Limit: *bodyLimit, SpillDir: *spillDir, KeepSpills: *keepSpills}
+	cfg.RecordChunks = *recordChunks
+	cfg.PreserveChunks = *preserveChunks
+	cfg.SessionEventCallBack = func(session *packet.Session) {
 		switch session.SchemerType {
 		case httpClient.HttpType:
 			if session.StreamDirection == packet.Outbound {
@@ -20,7 +72,7 @@ func main() {
 				return
 			}
 			mylog.Request(session.Request, false)
-		case httpClient.HttpsType:
+		case httpClient.HttpsType, httpClient.QuicType:
 			if session.StreamDirection == packet.Outbound {
 				mylog.Response(session.Response, false)
 				return
@@ -49,9 +101,27 @@ func main() {
 		case httpClient.UdpType:
 		case httpClient.KcpType:
 		case httpClient.PipeType:
-		case httpClient.QuicType:
 		case httpClient.RpcType:
 		case httpClient.SshType:
 		}
-	}).ListenAndServe()
+	}
+	mylog.CheckIgnore(mitmproxy.NewWithConfig(cfg).ListenAndServe(ctx))
+}
+
+// forwardFlag collects -forward listen=target, like
+// tls://127.0.0.1:6380=redis.internal:6379.
+type forwardFlag []mitmproxy.Forward
+
+func (f *forwardFlag) String() string { return fmt.Sprint(*f) }
+
+func (f *forwardFlag) Set(v string) error {
+	listen, target, ok := strings.Cut(v, "=")
+	if !ok {
+		return errors.New("want listen=target")
+	}
+	var forward mitmproxy.Forward
+	forward.Listen, forward.TerminateTLS = strings.CutPrefix(listen, "tls://")
+	forward.Target, forward.OriginateTLS = strings.CutPrefix(target, "tls://")
+	*f = append(*f, forward)
+	return nil
 }
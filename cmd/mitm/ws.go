@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/internal/mitmproxy"
+)
+
+const wsUsage = `usage: mitm ws <command> [flags]
+
+commands:
+  list  print the live websocket relays of a proxy started with -control
+  send  inject a message into a relay: mitm ws send [flags] <id> <client|server> [payload]
+`
+
+func runWs(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, wsUsage)
+		os.Exit(2)
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("mitm ws "+cmd, flag.ExitOnError)
+	control := fs.String("control", mitmproxy.DefaultControlAddr, "address of the control endpoint of the proxy")
+	token := fs.String("token", "", "bearer token of the control endpoint, see -control-token")
+	switch cmd {
+	case "list":
+		mylog.Check(fs.Parse(args))
+		resp := callControl(*token, mylog.Check2(http.NewRequest(http.MethodGet, "http://"+*control+"/websockets", nil)))
+		defer func() { mylog.CheckIgnore(resp.Body.Close()) }()
+		checkControl(resp)
+		var relays []mitmproxy.WebSocketRelay
+		mylog.Check(json.NewDecoder(resp.Body).Decode(&relays))
+		for _, r := range relays {
+			fmt.Printf("%-6d %-22s %-8s %s\n", r.ID, r.Client, time.Since(r.Start).Round(time.Second), r.URL)
+		}
+	case "send":
+		typ := fs.String("type", "text", "message type, one of text, binary, ping, pong, close")
+		code := fs.Int("code", 1000, "status code of a close message")
+		reason := fs.String("reason", "", "reason of a close message")
+		mylog.Check(fs.Parse(args))
+		if fs.NArg() < 2 {
+			fmt.Fprint(os.Stderr, wsUsage)
+			os.Exit(2)
+		}
+		query := url.Values{"type": {*typ}}
+		if *typ == "close" {
+			query.Set("code", fmt.Sprint(*code))
+			query.Set("reason", *reason)
+		}
+		target := "http://" + *control + "/websockets/" + url.PathEscape(fs.Arg(0)) + "/" + url.PathEscape(fs.Arg(1)) + "?" + query.Encode()
+		req := mylog.Check2(http.NewRequest(http.MethodPost, target, bytes.NewBufferString(fs.Arg(2))))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp := callControl(*token, req)
+		defer func() { mylog.CheckIgnore(resp.Body.Close()) }()
+		checkControl(resp)
+	default:
+		fmt.Fprint(os.Stderr, wsUsage)
+		os.Exit(2)
+	}
+}
+
+// callControl sends req to the control endpoint with the bearer token.
+func callControl(token string, req *http.Request) *http.Response {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return mylog.Check2(http.DefaultClient.Do(req))
+}
+
+// checkControl fails on an error answer of the control endpoint.
+func checkControl(resp *http.Response) {
+	if resp.StatusCode < 300 {
+		return
+	}
+	b := mylog.Check2(io.ReadAll(resp.Body))
+	mylog.Check(fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b)))
+}
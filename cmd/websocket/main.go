@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"net"
 	"net/http"
@@ -25,15 +28,32 @@ func main() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
+	cert, privateKey := ca.NewCA()
 	go func() {
 		http.HandleFunc("/", echo)
-		mylog.Check(http.ListenAndServeTLS("localhost:12345", ca.CertFile, ca.KeyFile, nil))
+		server := &http.Server{
+			Addr: "localhost:12345",
+			TLSConfig: ca.NewConfig(func(o *ca.Options) {
+				o.Certificate = cert
+				o.PrivateKey = privateKey
+			}).NewTlsConfigForHost("localhost"),
+		}
+		mylog.Check(server.ListenAndServeTLS("", ""))
 	}()
-	go mitmproxy.New(ca.ProxyPort, nil).ListenAndServe()
+	p := mitmproxy.NewWithConfig(mitmproxy.Config{
+		Addrs: []string{net.JoinHostPort(httpClient.Localhost, ca.DefaultProxyPort)},
+		CA:    mitmproxy.CASource{Certificate: cert, PrivateKey: privateKey},
+	})
+	mylog.Check(p.Listen())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { mylog.CheckIgnore(p.Serve(ctx)) }()
 
 	endpointURL := "wss://localhost:12345"
 	// proxyURL := "http://localhost:6666"
-	proxyURL := "http://" + net.JoinHostPort(httpClient.Localhost, ca.ProxyPort)
+	proxyURL := "http://" + p.Addrs()[0].String()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
 
 	surl := mylog.Check2(url.Parse(proxyURL))
 	dialer := websocket.Dialer{
@@ -41,8 +61,7 @@ func main() {
 		NetDialContext:    nil,
 		NetDialTLSContext: nil,
 		Proxy:             http.ProxyURL(surl),
-		TLSClientConfig:   ca.Cfg.NewTlsConfigForHost(ca.ProxyServeAddress()),
-		// TLSClientConfig:   ca.Cfg.NewTlsConfigForHost("localhost"),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
 		HandshakeTimeout:  0,
 		ReadBufferSize:    0,
 		WriteBufferSize:   0,
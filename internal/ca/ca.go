@@ -3,12 +3,15 @@ package ca
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"net/http"
 	"os"
@@ -28,27 +31,61 @@ type Option struct {
 	Name         string
 	Organization string
 	Validity     time.Duration
+	Algorithm    KeyAlgorithm
+}
+
+// KeyAlgorithm selects the key type of a generated CA.
+type KeyAlgorithm string
+
+const (
+	RSA2048   KeyAlgorithm = "rsa2048"
+	RSA4096   KeyAlgorithm = "rsa4096"
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+)
+
+func (a KeyAlgorithm) EnumTypes() []KeyAlgorithm {
+	return []KeyAlgorithm{RSA2048, RSA4096, ECDSAP256, ECDSAP384}
+}
+
+func (a KeyAlgorithm) GenerateKey() (crypto.Signer, error) {
+	switch a {
+	case RSA2048, "":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", string(a))
 }
 
 // NewCA creates a new Certificate and associated private key.
-func NewCA(optFns ...func(*Option)) (*x509.Certificate, *rsa.PrivateKey) {
+func NewCA(optFns ...func(*Option)) (*x509.Certificate, crypto.Signer) {
 	options := Option{
 		Name:         "github.com/ddkwork/mitmproxy ca",
 		Organization: "github.com/ddkwork/mitmproxy",
 		Validity:     24 * time.Hour,
+		Algorithm:    RSA2048,
 	}
 	for _, fn := range optFns {
 		fn(&options)
 	}
-	privateKey := mylog.Check2(rsa.GenerateKey(rand.Reader, 2048))
+	privateKey := mylog.Check2(options.Algorithm.GenerateKey())
 	publicKey := privateKey.Public()
+	keyUsage := x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	if _, ok := privateKey.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
 	tmpl := &x509.Certificate{
 		SerialNumber: mylog.Check2(rand.Int(rand.Reader, MaxSerialNumber)),
 		Subject: pkix.Name{
 			CommonName:   options.Name,
 			Organization: []string{options.Organization},
 		},
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              keyUsage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		NotBefore:             time.Now().Add(-options.Validity),
@@ -76,6 +113,13 @@ func LoadOrCreateCA(certFile, keyFile string, optFns ...func(*Option)) (cert *x5
 	if !ok {
 		cert, privateKey = NewCA(optFns...)
 	}
+	SaveCA(certFile, keyFile, cert, privateKey)
+	return cert, privateKey
+}
+
+// SaveCA writes the certificate and its PKCS#8 private key as PEM files,
+// the key being readable by the owner only.
+func SaveCA(certFile, keyFile string, cert *x509.Certificate, privateKey crypto.PrivateKey) {
 	certOut := mylog.Check2(os.Create(certFile))
 	defer func() { mylog.Check(certOut.Close()) }()
 	keyOut := mylog.Check2(os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600))
@@ -83,7 +127,6 @@ func LoadOrCreateCA(certFile, keyFile string, optFns ...func(*Option)) (cert *x5
 	mylog.Check(pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
 	keyBytes := mylog.Check2(x509.MarshalPKCS8PrivateKey(privateKey))
 	mylog.Check(pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}))
-	return cert, privateKey
 }
 
 type certHandler struct{ cert []byte }
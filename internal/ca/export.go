@@ -0,0 +1,164 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1" // nolint: gosec // ok
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+)
+
+// ExportFormat is an encoding the CA certificate can be exported in.
+type ExportFormat string
+
+const (
+	PemFormat          ExportFormat = "pem"
+	DerFormat          ExportFormat = "der"
+	P12Format          ExportFormat = "p12"
+	MobileConfigFormat ExportFormat = "mobileconfig"
+)
+
+func (f ExportFormat) EnumTypes() []ExportFormat {
+	return []ExportFormat{PemFormat, DerFormat, P12Format, MobileConfigFormat}
+}
+
+// Ext returns the file extension clients expect for the format.
+func (f ExportFormat) Ext() string {
+	switch f {
+	case PemFormat:
+		return ".pem"
+	case DerFormat:
+		return ".cer"
+	case P12Format:
+		return ".p12"
+	case MobileConfigFormat:
+		return ".mobileconfig"
+	}
+	return ""
+}
+
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case PemFormat, DerFormat:
+		return "application/x-x509-ca-cert"
+	case P12Format:
+		return "application/x-pkcs12"
+	case MobileConfigFormat:
+		return "application/x-apple-aspen-config"
+	}
+	return "application/octet-stream"
+}
+
+// Export encodes the certificate in the given format. The password is only
+// used to protect the integrity of p12 files and may be empty.
+func Export(cert *x509.Certificate, format ExportFormat, password string) ([]byte, error) {
+	switch format {
+	case PemFormat:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+	case DerFormat:
+		return cert.Raw, nil
+	case P12Format:
+		return EncodeTrustStore(cert, password)
+	case MobileConfigFormat:
+		return EncodeMobileConfig(cert)
+	}
+	return nil, fmt.Errorf("unsupported export format %q", string(format))
+}
+
+// Fingerprint returns the colon separated SHA-256 hash of the DER certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return formatFingerprint(sum[:])
+}
+
+// FingerprintSHA1 is the fingerprint format older trust stores display.
+func FingerprintSHA1(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw) // nolint: gosec // ok
+	return formatFingerprint(sum[:])
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, ":")
+}
+
+var mobileConfigTemplate = template.Must(template.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>{{.Name}}.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Data}}</data>
+			<key>PayloadDescription</key>
+			<string>Adds a CA root certificate</string>
+			<key>PayloadDisplayName</key>
+			<string>{{.Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.github.ddkwork.mitmproxy.cert.{{.CertUUID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{.Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>com.github.ddkwork.mitmproxy.{{.UUID}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.UUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// EncodeMobileConfig wraps the certificate in an Apple configuration profile
+// that installs it as a root on iOS and macOS.
+func EncodeMobileConfig(cert *x509.Certificate) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	e := mobileConfigTemplate.Execute(buf, struct {
+		Name     string
+		Data     string
+		UUID     string
+		CertUUID string
+	}{
+		Name:     template.HTMLEscapeString(cert.Subject.CommonName),
+		Data:     base64.StdEncoding.EncodeToString(cert.Raw),
+		UUID:     newUUID(),
+		CertUUID: newUUID(),
+	})
+	if e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	mylog.Check2(rand.Read(b))
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
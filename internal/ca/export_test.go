@@ -0,0 +1,163 @@
+package ca_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/internal/ca"
+)
+
+func TestExport(t *testing.T) {
+	cert, _ := ca.NewCA(func(o *ca.Option) { o.Algorithm = ca.ECDSAP256 })
+	assert.Equal(t, x509.ECDSA, cert.PublicKeyAlgorithm)
+	assert.Equal(t, 32*3-1, len(ca.Fingerprint(cert)))
+
+	b := mylog.Check2(ca.Export(cert, ca.PemFormat, ""))
+	block, _ := pem.Decode(b)
+	assert.Equal(t, cert.Raw, block.Bytes)
+
+	b = mylog.Check2(ca.Export(cert, ca.DerFormat, ""))
+	assert.Equal(t, cert.Raw, b)
+
+	b = mylog.Check2(ca.Export(cert, ca.MobileConfigFormat, ""))
+	assert.True(t, strings.Contains(string(b), base64.StdEncoding.EncodeToString(cert.Raw)))
+
+	// the p12 is a trust store: it carries the root and never its key
+	b = mylog.Check2(ca.Export(cert, ca.P12Format, "secret"))
+	certs := mylog.Check2(decodeTrustStore(b, "secret"))
+	assert.Equal(t, 1, len(certs))
+	assert.Equal(t, cert.Raw, certs[0].Raw)
+	_, e := decodeTrustStore(b, "wrong")
+	assert.NotNil(t, e)
+
+	_, e = ca.Export(cert, "zip", "")
+	assert.NotNil(t, e)
+}
+
+// decodeTrustStore reads a certificate-only p12 the way RFC 7292 lays it
+// out. x/crypto/pkcs12 only decodes a single key and certificate pair, so the
+// test walks the structure itself and checks the password based MAC.
+func decodeTrustStore(pfxData []byte, password string) ([]*x509.Certificate, error) {
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+	}
+	var pfx struct {
+		Version  int
+		AuthSafe contentInfo
+		MacData  struct {
+			Mac struct {
+				Algorithm struct {
+					Algorithm  asn1.ObjectIdentifier
+					Parameters asn1.RawValue `asn1:"optional"`
+				}
+				Digest []byte
+			}
+			MacSalt    []byte
+			Iterations int `asn1:"optional,default:1"`
+		}
+	}
+	if _, e := asn1.Unmarshal(pfxData, &pfx); e != nil {
+		return nil, e
+	}
+	var authenticatedSafe []byte
+	if _, e := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); e != nil {
+		return nil, e
+	}
+
+	// RFC 7292 appendix B.2 with SHA-1 and ID 3, a single 20 byte block
+	utf16Password := append(utf16.Encode([]rune(password)), 0)
+	passwordBytes := make([]byte, 0, 2*len(utf16Password))
+	for _, r := range utf16Password {
+		passwordBytes = append(passwordBytes, byte(r>>8), byte(r))
+	}
+	input := bytes.Repeat([]byte{3}, 64)
+	for _, b := range [][]byte{pfx.MacData.MacSalt, passwordBytes} {
+		n := 64 * ((len(b) + 63) / 64)
+		input = append(input, bytes.Repeat(b, n/len(b)+1)[:n]...)
+	}
+	key := sha1.Sum(input)
+	for i := 1; i < pfx.MacData.Iterations; i++ {
+		key = sha1.Sum(key[:])
+	}
+	mac := hmac.New(sha1.New, key[:])
+	mac.Write(authenticatedSafe)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		return nil, errors.New("pkcs12: mac mismatch, wrong password")
+	}
+
+	var safes []contentInfo
+	if _, e := asn1.Unmarshal(authenticatedSafe, &safes); e != nil {
+		return nil, e
+	}
+	var certs []*x509.Certificate
+	for _, safe := range safes {
+		var data []byte
+		if _, e := asn1.Unmarshal(safe.Content.Bytes, &data); e != nil {
+			return nil, e
+		}
+		var bags []struct {
+			Id         asn1.ObjectIdentifier
+			Value      asn1.RawValue `asn1:"tag:0,explicit"`
+			Attributes asn1.RawValue `asn1:"set,optional"`
+		}
+		if _, e := asn1.Unmarshal(data, &bags); e != nil {
+			return nil, e
+		}
+		for _, bag := range bags {
+			if !bag.Id.Equal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}) {
+				return nil, fmt.Errorf("pkcs12: unexpected bag %v", bag.Id)
+			}
+			var certBag struct {
+				Id   asn1.ObjectIdentifier
+				Data []byte `asn1:"tag:0,explicit"`
+			}
+			if _, e := asn1.Unmarshal(bag.Value.Bytes, &certBag); e != nil {
+				return nil, e
+			}
+			cert, e := x509.ParseCertificate(certBag.Data)
+			if e != nil {
+				return nil, e
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+func TestRotateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	first, _ := ca.LoadOrCreateCA(certFile, keyFile)
+	assert.Equal(t, 0, len(ca.LoadPreviousCA(certFile)))
+
+	second, _ := ca.RotateCA(certFile, keyFile, time.Hour)
+	loaded, _, ok := ca.LoadCA(certFile, keyFile)
+	assert.True(t, ok)
+	assert.Equal(t, second.Raw, loaded.Raw)
+
+	previous := ca.LoadPreviousCA(certFile)
+	assert.Equal(t, 1, len(previous))
+	assert.Equal(t, first.Raw, previous[0].Certificate.Raw)
+
+	// an expired grace period drops the old root on the next rotation
+	ca.RotateCA(certFile, keyFile, -time.Hour)
+	previous = ca.LoadPreviousCA(certFile)
+	assert.Equal(t, 1, len(previous))
+	assert.Equal(t, first.Raw, previous[0].Certificate.Raw)
+}
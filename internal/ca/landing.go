@@ -0,0 +1,101 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+)
+
+// LandingHost is the magic host name that the proxy answers itself with the
+// certificate landing page, like mitm.it for mitmproxy.
+const LandingHost = "mitm.it"
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mitmproxy certificate</title></head>
+<body>
+<h1>Install the mitmproxy root certificate</h1>
+<p>{{.Current.Subject.CommonName}}<br>
+SHA-256 {{.Fingerprint}}<br>
+valid until {{.Current.NotAfter.Format "2006-01-02 15:04 MST"}}</p>
+<ul>
+<li><a href="/cert/pem">PEM</a> - Linux, Firefox, curl</li>
+<li><a href="/cert/der">DER</a> - Windows, Android</li>
+<li><a href="/cert/p12">PKCS#12</a> - Android, Java, Windows</li>
+<li><a href="/cert/mobileconfig">mobileconfig</a> - iOS, macOS</li>
+</ul>
+{{if .Previous}}
+<h2>Previous roots</h2>
+<p>These roots were rotated out and are still published until their grace period ends.
+<a href="/cert/previous.pem">Download all as PEM</a></p>
+<ul>
+{{range .Previous}}<li>{{.Certificate.Subject.CommonName}} - {{.Certificate.NotAfter.Format "2006-01-02"}}, retired {{.GraceUntil.Format "2006-01-02"}}</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>
+`))
+
+type landingHandler struct {
+	*http.ServeMux
+	current  *x509.Certificate
+	previous []Previous
+}
+
+// NewLandingHandler serves an install page for the CA and the CA alone in
+// every ExportFormat under /cert/.
+func NewLandingHandler(current *x509.Certificate, previous []Previous) http.Handler {
+	h := &landingHandler{
+		ServeMux: http.NewServeMux(),
+		current:  current,
+		previous: previous,
+	}
+	h.HandleFunc("GET /{$}", h.index)
+	h.HandleFunc("GET /cert/previous.pem", h.previousBundle)
+	h.HandleFunc("GET /cert/{format}", h.cert)
+	return h
+}
+
+func (h *landingHandler) index(rw http.ResponseWriter, _ *http.Request) {
+	var previous []Previous
+	for _, p := range h.previous {
+		if time.Now().Before(p.GraceUntil) {
+			previous = append(previous, p)
+		}
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mylog.Check(landingTemplate.Execute(rw, struct {
+		Current     *x509.Certificate
+		Fingerprint string
+		Previous    []Previous
+	}{
+		Current:     h.current,
+		Fingerprint: Fingerprint(h.current),
+		Previous:    previous,
+	}))
+}
+
+func (h *landingHandler) cert(rw http.ResponseWriter, req *http.Request) {
+	format := ExportFormat(req.PathValue("format"))
+	b, e := Export(h.current, format, "")
+	if e != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("Content-Type", format.ContentType())
+	rw.Header().Set("Content-Disposition", `attachment; filename="mitmproxy-ca`+format.Ext()+`"`)
+	mylog.Check2(rw.Write(b))
+}
+
+func (h *landingHandler) previousBundle(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", PemFormat.ContentType())
+	for _, p := range h.previous {
+		if time.Now().Before(p.GraceUntil) {
+			mylog.Check2(rw.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.Certificate.Raw})))
+		}
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"slices"
 	"time"
 
 	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/safemap"
 )
 
 var DefaultTLSServerConfig = &tls.Config{
@@ -58,6 +60,8 @@ type Config struct {
 	organization    string
 	tlsServerConfig *tls.Config
 	certTemplateGen CertTemplateGenFunc
+	// certs caches the generated domain certificates by hostname
+	certs *safemap.M[string, *tls.Certificate]
 }
 
 func NewConfig(optFns ...func(*Options)) *Config {
@@ -118,6 +122,7 @@ func NewConfig(optFns ...func(*Options)) *Config {
 		tlsServerConfig: options.TLSServerConfig,
 		certTemplateGen: options.CertTemplateGen,
 		roots:           certPool,
+		certs:           safemap.New[string, *tls.Certificate](),
 	}
 }
 
@@ -144,7 +149,16 @@ func (c *Config) NewTlsConfigForHost(hostname string) *tls.Config {
 		if info.ServerName == "" {
 			info.ServerName = hostname
 		}
-		return nil, nil
+		// a client of another protocol over tls, like mqtt or imap, would
+		// fail the handshake on http/1.1, it gets its own protocols back
+		if len(info.SupportedProtos) == 0 || slices.ContainsFunc(info.SupportedProtos, func(proto string) bool {
+			return slices.Contains(tlsConfig.NextProtos, proto)
+		}) {
+			return nil, nil
+		}
+		config := tlsConfig.Clone()
+		config.NextProtos = info.SupportedProtos
+		return config, nil
 	}
 	mylog.Struct(tlsConfig)
 	return tlsConfig
@@ -157,7 +171,7 @@ func (c *Config) GetOrCreateCert(hostname string) (*tls.Certificate, error) {
 	if e == nil {
 		hostname = host
 	}
-	tlsCertificate, b := CertPool.Get(hostname)
+	tlsCertificate, b := c.certs.Get(hostname)
 	if b {
 		mylog.Info("Cache hit for", hostname)
 		// Check validity of the certificate for hostname match, expiry, etc. In
@@ -180,7 +194,7 @@ func (c *Config) GetOrCreateCert(hostname string) (*tls.Certificate, error) {
 		PrivateKey:  c.privateKey,
 		Leaf:        x509c,
 	}
-	CertPool.Update(hostname, tlsCertificate)
+	c.certs.Update(hostname, tlsCertificate)
 	return tlsCertificate, nil
 }
 
@@ -0,0 +1,190 @@
+package ca
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // nolint: gosec // pkcs12 mac
+	"crypto/x509"
+	"encoding/asn1"
+	"unicode/utf16"
+)
+
+// A minimal PKCS#12 (RFC 7292) encoder for certificate-only trust stores.
+// The safe contents are left unencrypted, only the integrity MAC is keyed
+// with the password, which is what Android, Windows and Java expect when
+// importing a trusted root.
+
+var (
+	oidDataContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidJavaTrustStore    = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUse = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const pkcs12MacIterations = 2048
+
+type (
+	pfxPdu struct {
+		Version  int
+		AuthSafe contentInfo
+		MacData  macData
+	}
+	contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}
+	safeBag struct {
+		Id         asn1.ObjectIdentifier
+		Value      asn1.RawValue
+		Attributes []pkcs12Attribute `asn1:"set"`
+	}
+	pkcs12Attribute struct {
+		Id    asn1.ObjectIdentifier
+		Value asn1.RawValue `asn1:"set"`
+	}
+	certBag struct {
+		Id   asn1.ObjectIdentifier
+		Data asn1.RawValue
+	}
+	macData struct {
+		Mac        digestInfo
+		MacSalt    []byte
+		Iterations int
+	}
+	digestInfo struct {
+		Algorithm algorithmIdentifier
+		Digest    []byte
+	}
+	algorithmIdentifier struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+)
+
+// EncodeTrustStore returns a p12 file holding cert as a trusted certificate.
+func EncodeTrustStore(cert *x509.Certificate, password string) ([]byte, error) {
+	certValue, e := asn1.Marshal(cert.Raw)
+	if e != nil {
+		return nil, e
+	}
+	bagValue, e := asn1.Marshal(certBag{Id: oidCertTypeX509, Data: explicitTag0(certValue)})
+	if e != nil {
+		return nil, e
+	}
+	friendlyName, e := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(cert.Subject.CommonName, false)})
+	if e != nil {
+		return nil, e
+	}
+	trustedUsage, e := asn1.Marshal(oidAnyExtendedKeyUse)
+	if e != nil {
+		return nil, e
+	}
+	safeContents, e := asn1.Marshal([]safeBag{{
+		Id:    oidCertBag,
+		Value: explicitTag0(bagValue),
+		Attributes: []pkcs12Attribute{
+			{Id: oidFriendlyName, Value: asn1.RawValue{FullBytes: setOf(friendlyName)}},
+			{Id: oidJavaTrustStore, Value: asn1.RawValue{FullBytes: setOf(trustedUsage)}},
+		},
+	}})
+	if e != nil {
+		return nil, e
+	}
+	safeContentsData, e := dataContentInfo(safeContents)
+	if e != nil {
+		return nil, e
+	}
+	authenticatedSafe, e := asn1.Marshal([]contentInfo{safeContentsData})
+	if e != nil {
+		return nil, e
+	}
+	authSafe, e := dataContentInfo(authenticatedSafe)
+	if e != nil {
+		return nil, e
+	}
+
+	salt := make([]byte, 8)
+	if _, e = rand.Read(salt); e != nil {
+		return nil, e
+	}
+	key := pkcs12MacKey(bmpString(password, true), salt, pkcs12MacIterations)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(authenticatedSafe)
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: authSafe,
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: algorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12MacIterations,
+		},
+	})
+}
+
+func dataContentInfo(data []byte) (contentInfo, error) {
+	octets, e := asn1.Marshal(data)
+	if e != nil {
+		return contentInfo{}, e
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicitTag0(octets)}, nil
+}
+
+func explicitTag0(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func setOf(der []byte) []byte {
+	b, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der})
+	return b
+}
+
+// bmpString encodes s as big-endian UTF-16, optionally with the two byte
+// terminator the PKCS#12 key derivation requires for passwords.
+func bmpString(s string, terminate bool) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 0, 2*len(u)+2)
+	for _, r := range u {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	if terminate {
+		b = append(b, 0, 0)
+	}
+	return b
+}
+
+// pkcs12MacKey implements the RFC 7292 appendix B.2 key derivation with
+// SHA-1 and ID 3. The MAC key is exactly one hash block long, so a single
+// round of the construction is enough.
+func pkcs12MacKey(password, salt []byte, iterations int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = 3
+	}
+	h := sha1.New() // nolint: gosec // pkcs12 mac
+	h.Write(d)
+	h.Write(fill(salt))
+	h.Write(fill(password))
+	a := h.Sum(nil)
+	for i := 1; i < iterations; i++ {
+		sum := sha1.Sum(a) // nolint: gosec // pkcs12 mac
+		a = sum[:]
+	}
+	return a
+}
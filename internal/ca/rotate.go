@@ -0,0 +1,92 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream"
+)
+
+// graceHeader is stored in the PEM headers of retired roots and holds the
+// time until which they are still published next to the current root.
+const graceHeader = "Grace-Until"
+
+// PreviousCertFile is where RotateCA keeps the roots it retired.
+func PreviousCertFile(certFile string) string {
+	ext := filepath.Ext(certFile)
+	return strings.TrimSuffix(certFile, ext) + ".prev" + ext
+}
+
+// Previous is a retired root that clients may still trust.
+type Previous struct {
+	Certificate *x509.Certificate
+	GraceUntil  time.Time
+}
+
+// RotateCA replaces the CA at certFile/keyFile with a freshly generated one.
+// The old root is appended to PreviousCertFile and stays published for the
+// grace period so devices can be migrated before it disappears.
+func RotateCA(certFile, keyFile string, grace time.Duration, optFns ...func(*Option)) (*x509.Certificate, crypto.PrivateKey) {
+	previous := LoadPreviousCA(certFile)
+	if old, _, ok := LoadCA(certFile, keyFile); ok {
+		previous = append(previous, Previous{Certificate: old, GraceUntil: time.Now().Add(grace)})
+	}
+	savePreviousCA(certFile, previous)
+	cert, privateKey := NewCA(optFns...)
+	SaveCA(certFile, keyFile, cert, privateKey)
+	return cert, privateKey
+}
+
+// LoadPreviousCA returns the retired roots whose grace period has not ended.
+func LoadPreviousCA(certFile string) (previous []Previous) {
+	name := PreviousCertFile(certFile)
+	if !stream.FileExists(name) {
+		return nil
+	}
+	rest := mylog.Check2(os.ReadFile(name))
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		until, e := time.Parse(time.RFC3339, block.Headers[graceHeader])
+		if e != nil || time.Now().After(until) {
+			continue
+		}
+		cert, e := x509.ParseCertificate(block.Bytes)
+		if e != nil {
+			continue
+		}
+		previous = append(previous, Previous{Certificate: cert, GraceUntil: until})
+	}
+	return previous
+}
+
+func savePreviousCA(certFile string, previous []Previous) {
+	name := PreviousCertFile(certFile)
+	if len(previous) == 0 {
+		if stream.FileExists(name) {
+			mylog.Check(os.Remove(name))
+		}
+		return
+	}
+	out := mylog.Check2(os.Create(name))
+	defer func() { mylog.Check(out.Close()) }()
+	for _, p := range previous {
+		mylog.Check(pem.Encode(out, &pem.Block{
+			Type:    "CERTIFICATE",
+			Headers: map[string]string{graceHeader: p.GraceUntil.Format(time.RFC3339)},
+			Bytes:   p.Certificate.Raw,
+		}))
+	}
+}
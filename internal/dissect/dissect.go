@@ -0,0 +1,248 @@
+// Package dissect parses the streams of raw tunnels into the messages of
+// the protocol they carry. Protocols are picked by the port of the tunnel or
+// by the first bytes it carries, every message becomes a child session of
+// the tunnel.
+package dissect
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// DefaultMaxBuffer is how much of one direction is buffered waiting for the
+// end of a message.
+const DefaultMaxBuffer = 1 << 20
+
+// detectWindow is how many bytes of a direction are tried against the
+// signatures before the stream is given up on.
+const detectWindow = 64
+
+// errEncrypted ends the dissection of a stream that switched to tls.
+var errEncrypted = errors.New("the stream switched to tls")
+
+type (
+	// Message is one message of a protocol.
+	Message struct {
+		// Method is the command or the kind of the message, like SET or
+		// Query.
+		Method string
+		// Path is what the message is about, like a key, a topic or the
+		// text of a query.
+		Path string
+		// Status sums up a reply, like OK or the text of an error.
+		Status string
+		// ID ties a message to its answer, like the ack id of socket.io
+		// or the invocation id of signalr.
+		ID      string
+		Payload []byte
+	}
+
+	// Protocol is a protocol the registry can dissect.
+	Protocol interface {
+		Name() string
+		// Detect reports whether the first bytes of a stream, read in
+		// direction, look like the protocol.
+		Detect(direction packet.StreamDirection, p []byte) bool
+		// New returns the parser of one stream.
+		New() Parser
+	}
+
+	// Parser splits the two directions of one stream into messages.
+	Parser interface {
+		// Split cuts the first message of direction off p, n is 0 while it
+		// is incomplete.
+		Split(direction packet.StreamDirection, p []byte) (m Message, n int, err error)
+	}
+
+	// Registry maps ports and signatures to protocols. It is not safe to
+	// register protocols while tunnels are dissected.
+	Registry struct {
+		// MaxBuffer replaces DefaultMaxBuffer.
+		MaxBuffer int
+
+		ports     map[uint16]Protocol
+		protocols []Protocol
+	}
+
+	// dissector is the state of one stream.
+	dissector struct {
+		registry *Registry
+		protocol Protocol
+		parser   Parser
+		done     bool
+		buffers  map[packet.StreamDirection][]byte
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{ports: make(map[uint16]Protocol)}
+}
+
+// Default returns a registry with every built-in protocol on its usual
+// ports. Length prefixed frames have neither, they are registered per port.
+func Default() *Registry {
+	r := NewRegistry()
+	r.Register(RESP{}, 6379)
+	r.Register(MySQL{}, 3306)
+	r.Register(Postgres{}, 5432)
+	r.Register(MQTT{}, 1883)
+	r.Register(Lines{Label: "smtp"}, 25, 587, 2525)
+	r.Register(Lines{Label: "pop3"}, 110)
+	r.Register(Lines{Label: "imap", Tagged: true}, 143)
+	r.Register(Lines{Label: "ftp"}, 21)
+	return r
+}
+
+// Register adds p for ports. Streams on none of the registered ports are
+// tried against every protocol in the order they were registered.
+func (r *Registry) Register(p Protocol, ports ...uint16) {
+	for _, port := range ports {
+		r.ports[port] = p
+	}
+	r.protocols = append(r.protocols, p)
+}
+
+// Lookup returns the protocol of a stream to port whose first bytes are p,
+// nil when p matches nothing yet.
+func (r *Registry) Lookup(port uint16, direction packet.StreamDirection, p []byte) Protocol {
+	if protocol, ok := r.ports[port]; ok {
+		return protocol
+	}
+	for _, protocol := range r.protocols {
+		if protocol.Detect(direction, p) {
+			return protocol
+		}
+	}
+	return nil
+}
+
+// NewDissector returns the dissector of one stream, it is what
+// packet.Stream.NewDissector expects.
+func (r *Registry) NewDissector() packet.Dissector {
+	return &dissector{registry: r, buffers: make(map[packet.StreamDirection][]byte)}
+}
+
+func (r *Registry) maxBuffer() int {
+	if r.MaxBuffer > 0 {
+		return r.MaxBuffer
+	}
+	return DefaultMaxBuffer
+}
+
+// Dissect picks the protocol once the first bytes match one and gives up
+// on the stream when none does, a message fails to parse or grows too
+// large.
+func (d *dissector) Dissect(s *packet.Session, c packet.Chunk, emit packet.SessionEventCallBack) {
+	if d.done {
+		return
+	}
+	if d.parser != nil {
+		d.parse(s, c.StreamDirection, c.Payload, emit)
+		return
+	}
+	buf := append(d.buffers[c.StreamDirection], c.Payload...)
+	d.buffers[c.StreamDirection] = buf
+	d.protocol = d.registry.Lookup(port(s), c.StreamDirection, buf)
+	if d.protocol == nil {
+		if len(buf) >= detectWindow {
+			d.done = true
+			d.buffers = nil
+		}
+		return
+	}
+	d.parser = d.protocol.New()
+	// what the other direction sent while nothing matched came first
+	for _, direction := range []packet.StreamDirection{otherDirection(c.StreamDirection), c.StreamDirection} {
+		d.parse(s, direction, nil, emit)
+	}
+}
+
+// parse splits the messages completed by p off the buffer of direction.
+func (d *dissector) parse(s *packet.Session, direction packet.StreamDirection, p []byte, emit packet.SessionEventCallBack) {
+	if d.done {
+		return
+	}
+	buf := append(d.buffers[direction], p...)
+	for len(buf) > 0 {
+		m, n, e := d.parser.Split(direction, buf)
+		if e != nil {
+			d.done = true
+			d.buffers = nil
+			if !errors.Is(e, errEncrypted) {
+				d.emit(s, direction, Message{Payload: buf}, e, emit)
+			}
+			return
+		}
+		if n == 0 {
+			break
+		}
+		m.Payload = buf[:n:n]
+		d.emit(s, direction, m, nil, emit)
+		buf = buf[n:]
+	}
+	if len(buf) > d.registry.maxBuffer() {
+		d.done = true
+		d.buffers = nil
+		mylog.Warning("dissect", d.protocol.Name()+" message larger than "+strconv.Itoa(d.registry.maxBuffer())+" bytes")
+		return
+	}
+	// the rest is copied so the consumed messages are not kept alive by it
+	d.buffers[direction] = append([]byte(nil), buf...)
+}
+
+func otherDirection(direction packet.StreamDirection) packet.StreamDirection {
+	if direction == packet.Inbound {
+		return packet.Outbound
+	}
+	return packet.Inbound
+}
+
+// emit sends m as a child session of the tunnel.
+func (d *dissector) emit(s *packet.Session, direction packet.StreamDirection, m Message, err error, emit packet.SessionEventCallBack) {
+	child := s.NewChild(httpClient.TcpType)
+	child.StreamDirection = direction
+	child.Host = target(s)
+	child.ResolvedIP = s.ResolvedIP
+	child.ContentType = d.protocol.Name()
+	child.Method = m.Method
+	child.Path = m.Path
+	child.Status = m.Status
+	child.ContentLength = len(m.Payload)
+	child.Err = err
+	if err != nil {
+		child.Status = err.Error()
+	}
+	switch direction {
+	case packet.Inbound:
+		child.ReqBodyDecoder.Payload = m.Payload
+	case packet.Outbound:
+		child.RespBodyDecoder.Payload = m.Payload
+	}
+	emit(child)
+}
+
+// target returns the host:port the tunnel of s goes to.
+func target(s *packet.Session) string {
+	if s.Host == "" && s.Request != nil {
+		return s.Request.Host
+	}
+	return s.Host
+}
+
+// port returns the port the tunnel of s goes to, 0 when it is not known.
+func port(s *packet.Session) uint16 {
+	_, p, e := net.SplitHostPort(target(s))
+	if e != nil {
+		return 0
+	}
+	n, e := strconv.ParseUint(p, 10, 16)
+	if e != nil {
+		return 0
+	}
+	return uint16(n)
+}
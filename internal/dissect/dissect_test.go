@@ -0,0 +1,306 @@
+package dissect
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+type segment struct {
+	direction packet.StreamDirection
+	data      string
+}
+
+// dissect records the conversation one byte at a time and returns the
+// messages as direction, method, path and status.
+func dissect(r *Registry, host string, conversation []segment) [][4]string {
+	var got [][4]string
+	s := &packet.Session{
+		Stream: &packet.Stream{NewDissector: r.NewDissector},
+		EventCallBack: func(s *packet.Session) {
+			if s.Parent != nil {
+				got = append(got, [4]string{s.StreamDirection.String(), s.Method, s.Path, s.Status})
+			}
+		},
+	}
+	s.Host = host
+	for _, seg := range conversation {
+		for i := range len(seg.data) {
+			s.Record(seg.direction, []byte{seg.data[i]}, nil)
+		}
+	}
+	return got
+}
+
+func mysqlPackets(payloads ...string) string {
+	var b []byte
+	for i, p := range payloads {
+		b = append(b, byte(len(p)), byte(len(p)>>8), byte(len(p)>>16), byte(i))
+		b = append(b, p...)
+	}
+	return string(b)
+}
+
+func postgresMsg(kind byte, body string) string {
+	b := []byte{kind, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(4+len(body)))
+	return string(b) + body
+}
+
+func TestDissect(t *testing.T) {
+	out, in := packet.Outbound.String(), packet.Inbound.String()
+	login := make([]byte, 32)
+	binary.LittleEndian.PutUint32(login, mysqlClientDeprecateEOF)
+	startup := make([]byte, 8)
+	params := "user\x00bob\x00database\x00shop\x00\x00"
+	binary.BigEndian.PutUint32(startup, uint32(8+len(params)))
+	binary.BigEndian.PutUint32(startup[4:], postgresProtocol3)
+
+	for _, tt := range []struct {
+		name         string
+		registry     *Registry
+		host         string
+		conversation []segment
+		want         [][4]string
+	}{
+		{
+			name:     "redis",
+			registry: Default(),
+			host:     "cache:7000",
+			conversation: []segment{
+				{packet.Outbound, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+				{packet.Inbound, "+OK\r\n"},
+				{packet.Outbound, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"},
+				{packet.Inbound, "$1\r\nv\r\n"},
+				{packet.Outbound, "PING\r\n"},
+				{packet.Inbound, "-ERR unknown\r\n"},
+			},
+			want: [][4]string{
+				{out, "SET", "k", ""},
+				{in, "", "", "OK"},
+				{out, "GET", "k", ""},
+				{in, "", "", "1 bytes"},
+				{out, "PING", "", ""},
+				{in, "", "", "ERR unknown"},
+			},
+		},
+		{
+			name:     "mysql",
+			registry: Default(),
+			host:     "db:3307",
+			conversation: []segment{
+				{packet.Inbound, mysqlPackets("\x0a8.0.36\x00rest")},
+				{packet.Outbound, mysqlPackets(string(login) + "app\x00")},
+				{packet.Inbound, mysqlPackets("\x00\x00\x00\x02\x00\x00\x00")},
+				{packet.Outbound, mysqlPackets("\x03SELECT 1")},
+				{packet.Inbound, mysqlPackets("\x01", "column", "\x011", "\xfe\x00\x00\x02\x00\x00\x00")},
+				{packet.Outbound, mysqlPackets("\x03DROP x")},
+				{packet.Inbound, mysqlPackets("\xff\x28\x04#42000denied")},
+			},
+			want: [][4]string{
+				{in, "Handshake", "8.0.36", ""},
+				{out, "Login", "app", ""},
+				{in, "OK", "", "OK"},
+				{out, "Query", "SELECT 1", ""},
+				{in, "ResultSet", "", "1 rows"},
+				{out, "Query", "DROP x", ""},
+				{in, "ERR", "", "ERR 1064 denied"},
+			},
+		},
+		{
+			name:     "postgres",
+			registry: Default(),
+			host:     "db:6000",
+			conversation: []segment{
+				{packet.Outbound, string(startup) + params},
+				{packet.Inbound, postgresMsg('R', "\x00\x00\x00\x00") + postgresMsg('Z', "I")},
+				{packet.Outbound, postgresMsg('Q', "SELECT 1\x00")},
+				{packet.Inbound, postgresMsg('T', "x") + postgresMsg('D', "1") + postgresMsg('D', "2") + postgresMsg('C', "SELECT 2\x00")},
+			},
+			want: [][4]string{
+				{out, "Startup", "bob@shop", ""},
+				{in, "Authentication", "", ""},
+				{in, "ReadyForQuery", "", "I"},
+				{out, "Query", "SELECT 1", ""},
+				{in, "Rows", "", "SELECT 2"},
+			},
+		},
+		{
+			name:     "mqtt",
+			registry: Default(),
+			host:     "broker:8883",
+			conversation: []segment{
+				{packet.Outbound, "\x10\x10\x00\x04MQTT\x04\x02\x00\x3c\x00\x04dev1"},
+				{packet.Inbound, "\x20\x02\x00\x00"},
+				{packet.Outbound, "\x32\x0a\x00\x04a/b1\x00\x01hi"},
+				{packet.Outbound, "\xc0\x00"},
+			},
+			want: [][4]string{
+				{out, "CONNECT", "dev1", ""},
+				{in, "CONNACK", "", "0x00"},
+				{out, "PUBLISH", "a/b1", "qos 1"},
+				{out, "PINGREQ", "", ""},
+			},
+		},
+		{
+			name: "frames",
+			registry: func() *Registry {
+				r := NewRegistry()
+				r.Register(LengthPrefixed{Label: "game", Offset: 1, Size: 2, LittleEndian: true}, 9000)
+				return r
+			}(),
+			host: "game:9000",
+			conversation: []segment{
+				{packet.Outbound, "\x01\x02\x00hi\x02\x00\x00"},
+				{packet.Inbound, "\x03\x01\x00!"},
+			},
+			want: [][4]string{
+				{out, "Frame", "", "5 bytes"},
+				{out, "Frame", "", "3 bytes"},
+				{in, "Frame", "", "4 bytes"},
+			},
+		},
+		{
+			name:     "imap",
+			registry: Default(),
+			host:     "mail:143",
+			conversation: []segment{
+				{packet.Inbound, "* OK ready\r\n"},
+				{packet.Outbound, "a1 login bob secret\r\n"},
+				{packet.Inbound, "a1 OK done\r\n"},
+			},
+			want: [][4]string{
+				{in, "", "", "* OK ready"},
+				{out, "LOGIN", "bob secret", ""},
+				{in, "", "", "a1 OK done"},
+			},
+		},
+		{
+			name:         "unknown",
+			registry:     Default(),
+			host:         "web:80",
+			conversation: []segment{{packet.Outbound, "GET / HTTP/1.1\r\n\r\n"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dissect(tt.registry, tt.host, tt.conversation))
+		})
+	}
+}
+
+func TestDissectError(t *testing.T) {
+	s := &packet.Session{Stream: &packet.Stream{NewDissector: Default().NewDissector}}
+	var failed []*packet.Session
+	s.EventCallBack = func(s *packet.Session) {
+		if s.Failed() {
+			failed = append(failed, s)
+		}
+	}
+	s.Host = "cache:6379"
+	s.Record(packet.Outbound, []byte("*1\r\n$x\r\n"), nil)
+	s.Record(packet.Outbound, []byte("*1\r\n$4\r\nPING\r\n"), nil)
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "redis", failed[0].ContentType)
+}
+
+type wsMessage struct {
+	direction packet.StreamDirection
+	binary    bool
+	data      string
+}
+
+func TestFraming(t *testing.T) {
+	out, in := packet.Outbound.String(), packet.Inbound.String()
+	// a signalr messagepack invocation and a completion with an error
+	invocation := "\x96\x01\x80\xa1\x37\xa4Send\x91\xa2hi\x90"
+	completion := "\x95\x03\x80\xa1\x37\x01\xa4oops"
+	messagePack := string([]byte{byte(len(invocation))}) + invocation + string([]byte{byte(len(completion))}) + completion
+
+	for _, tt := range []struct {
+		name        string
+		subprotocol string
+		messages    []wsMessage
+		want        [][5]string
+	}{
+		{
+			name: "socket.io",
+			messages: []wsMessage{
+				{packet.Inbound, false, `0{"sid":"abc","upgrades":[],"pingInterval":25000}`},
+				{packet.Outbound, false, "40"},
+				{packet.Outbound, false, `42/chat,7["message","hi"]`},
+				{packet.Inbound, false, `43/chat,7["ok"]`},
+				{packet.Outbound, false, `451-["upload",{"_placeholder":true,"num":0}]`},
+				{packet.Outbound, true, "\x01\x02"},
+				{packet.Inbound, false, "2"},
+			},
+			want: [][5]string{
+				{in, "open", "", "", ""},
+				{out, "CONNECT", "/", "", ""},
+				{out, "EVENT", "/chat message", "", "7"},
+				{in, "ACK", "", "", "7"},
+				{out, "BINARY_EVENT", "upload", "", ""},
+				{out, "ATTACHMENT", "", "", ""},
+				{in, "ping", "", "", ""},
+			},
+		},
+		{
+			name:        "stomp",
+			subprotocol: "v12.stomp",
+			messages: []wsMessage{
+				{packet.Outbound, false, "CONNECT\naccept-version:1.2\nhost:x\n\n\x00"},
+				{packet.Inbound, false, "CONNECTED\nversion:1.2\n\n\x00\n"},
+				{packet.Outbound, false, "SUBSCRIBE\nid:sub-0\ndestination:/topic/news\n\n\x00SEND\ndestination:/app/hi\nreceipt:r1\ncontent-length:4\n\na\x00bc\x00"},
+				{packet.Inbound, false, "ERROR\nmessage:no\n\n\x00"},
+			},
+			want: [][5]string{
+				{out, "CONNECT", "", "", ""},
+				{in, "CONNECTED", "", "1.2", ""},
+				{in, "HEARTBEAT", "", "", ""},
+				{out, "SUBSCRIBE", "/topic/news", "", "sub-0"},
+				{out, "SEND", "/app/hi", "", "r1"},
+				{in, "ERROR", "", "no", ""},
+			},
+		},
+		{
+			name: "signalr",
+			messages: []wsMessage{
+				{packet.Outbound, false, `{"protocol":"json","version":1}` + "\x1e"},
+				{packet.Inbound, false, "{}\x1e"},
+				{packet.Outbound, false, `{"type":1,"target":"Send","invocationId":"1","arguments":["hi"]}` + "\x1e" + `{"type":6}` + "\x1e"},
+				{packet.Inbound, false, `{"type":3,"invocationId":"1","error":"denied"}` + "\x1e"},
+				{packet.Inbound, true, messagePack},
+			},
+			want: [][5]string{
+				{out, "Handshake", "json", "", ""},
+				{in, "Handshake", "", "", ""},
+				{out, "Invocation", "Send", "", "1"},
+				{out, "Ping", "", "", ""},
+				{in, "Completion", "", "denied", "1"},
+				{in, "Invocation", "Send", "", "7"},
+				{in, "Completion", "", "oops", "7"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var parser FramingParser
+			var got [][5]string
+			for _, m := range tt.messages {
+				if parser == nil {
+					framing := DefaultFramings().Lookup(tt.subprotocol, m.direction, []byte(m.data))
+					assert.Equal(t, tt.name, framing.Name())
+					parser = framing.New()
+				}
+				messages, e := parser.Decode(m.direction, m.binary, []byte(m.data))
+				mylog.Check(e)
+				for _, message := range messages {
+					got = append(got, [5]string{m.direction.String(), message.Method, message.Path, message.Status, message.ID})
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.True(t, DefaultFramings().Lookup("", packet.Outbound, []byte("hello")) == nil)
+}
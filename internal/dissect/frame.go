@@ -0,0 +1,78 @@
+package dissect
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// LengthPrefixed splits streams of binary frames carrying their length in a
+// header, like many game and RPC protocols. It detects nothing, it is
+// registered for the ports that speak it.
+type LengthPrefixed struct {
+	// Label names the protocol, empty is "frames".
+	Label string
+	// Offset is where the length starts in the header, like after a type
+	// byte.
+	Offset int
+	// Size is how many bytes the length takes: 1, 2, 4 or 8.
+	Size int
+	// LittleEndian reads the length as little endian, it is big endian
+	// otherwise.
+	LittleEndian bool
+	// Inclusive is set when the length counts the header too, otherwise it
+	// counts what follows the length.
+	Inclusive bool
+	// Max is the largest frame, zero is DefaultMaxBuffer.
+	Max int
+}
+
+func (f LengthPrefixed) Name() string {
+	if f.Label == "" {
+		return "frames"
+	}
+	return f.Label
+}
+
+func (LengthPrefixed) Detect(packet.StreamDirection, []byte) bool { return false }
+
+func (f LengthPrefixed) New() Parser { return f }
+
+func (f LengthPrefixed) Split(_ packet.StreamDirection, p []byte) (Message, int, error) {
+	header := f.Offset + f.Size
+	if len(p) < header {
+		return Message{}, 0, nil
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if f.LittleEndian {
+		order = binary.LittleEndian
+	}
+	var size uint64
+	switch b := p[f.Offset:header]; f.Size {
+	case 1:
+		size = uint64(b[0])
+	case 2:
+		size = uint64(order.Uint16(b))
+	case 4:
+		size = uint64(order.Uint32(b))
+	case 8:
+		size = order.Uint64(b)
+	default:
+		return Message{}, 0, fmt.Errorf("%s: length of %d bytes", f.Name(), f.Size)
+	}
+	if !f.Inclusive {
+		size += uint64(header)
+	}
+	limit := f.Max
+	if limit <= 0 {
+		limit = DefaultMaxBuffer
+	}
+	if size < uint64(header) || size > uint64(limit) {
+		return Message{}, 0, fmt.Errorf("%s: bad frame length %d", f.Name(), size)
+	}
+	if uint64(len(p)) < size {
+		return Message{}, 0, nil
+	}
+	return Message{Method: "Frame", Status: fmt.Sprintf("%d bytes", size)}, int(size), nil
+}
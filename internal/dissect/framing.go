@@ -0,0 +1,73 @@
+package dissect
+
+import (
+	"strings"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+type (
+	// Framing is a protocol carried in the messages of a websocket relay,
+	// one websocket message holds one or more of its messages.
+	Framing interface {
+		Name() string
+		// Subprotocol reports whether name, the Sec-WebSocket-Protocol the
+		// server picked, is the framing.
+		Subprotocol(name string) bool
+		// Detect reports whether a data message of a relay, read in
+		// direction, looks like the framing.
+		Detect(direction packet.StreamDirection, p []byte) bool
+		// New returns the decoder of one relay.
+		New() FramingParser
+	}
+
+	// FramingParser splits the data messages of one relay, in the order
+	// they were relayed, into the messages of the framing.
+	FramingParser interface {
+		Decode(direction packet.StreamDirection, binary bool, p []byte) ([]Message, error)
+	}
+
+	// Framings are tried in order, the subprotocol of a relay wins over
+	// what its messages look like.
+	Framings []Framing
+)
+
+// DefaultFramings returns every built-in framing.
+func DefaultFramings() Framings {
+	return Framings{STOMP{}, SignalR{}, SocketIO{}}
+}
+
+// Lookup returns the framing of a relay whose server picked subprotocol and
+// that relayed p in direction, nil when nothing matches.
+func (f Framings) Lookup(subprotocol string, direction packet.StreamDirection, p []byte) Framing {
+	if subprotocol != "" {
+		for _, framing := range f {
+			if framing.Subprotocol(subprotocol) {
+				return framing
+			}
+		}
+	}
+	for _, framing := range f {
+		if framing.Detect(direction, p) {
+			return framing
+		}
+	}
+	return nil
+}
+
+// String labels m with what is set of its method, path, id and status.
+func (m Message) String() string {
+	var fields []string
+	for _, field := range []string{m.Method, m.Path} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if m.ID != "" {
+		fields = append(fields, "#"+m.ID)
+	}
+	if m.Status != "" {
+		fields = append(fields, m.Status)
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,39 @@
+package dissect
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// Lines is a text protocol of command lines and reply lines, like smtp,
+// pop3, imap and ftp. The verb of a command is its Method and the rest its
+// Path, a reply line is its Status.
+type Lines struct {
+	Label string
+	// Tagged skips the tag in front of commands, like the one of imap.
+	Tagged bool
+}
+
+func (l Lines) Name() string { return l.Label }
+
+func (Lines) Detect(packet.StreamDirection, []byte) bool { return false }
+
+func (l Lines) New() Parser { return l }
+
+func (l Lines) Split(direction packet.StreamDirection, p []byte) (Message, int, error) {
+	i := bytes.IndexByte(p, '\n')
+	if i < 0 {
+		return Message{}, 0, nil
+	}
+	line := strings.TrimRight(string(p[:i]), "\r")
+	if direction == packet.Inbound {
+		return Message{Status: line}, i + 1, nil
+	}
+	if l.Tagged {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	method, path, _ := strings.Cut(line, " ")
+	return Message{Method: strings.ToUpper(method), Path: path}, i + 1, nil
+}
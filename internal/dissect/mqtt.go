@@ -0,0 +1,128 @@
+package dissect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+const mqttVersion5 = 5
+
+var mqttTypes = [16]string{
+	"Reserved", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+// MQTT is the MQTT protocol, versions 3.1, 3.1.1 and 5.
+type MQTT struct{}
+
+type mqttParser struct {
+	// version is the protocol level of CONNECT, version 5 puts properties
+	// in front of the payloads
+	version byte
+}
+
+func (MQTT) Name() string { return "mqtt" }
+
+// Detect matches the CONNECT packet a client opens with.
+func (MQTT) Detect(direction packet.StreamDirection, p []byte) bool {
+	if direction != packet.Outbound || len(p) < 2 || p[0] != 0x10 {
+		return false
+	}
+	_, k, e := mqttVarint(p[1:])
+	if e != nil || k == 0 {
+		return false
+	}
+	name, _, ok := mqttString(p[1+k:])
+	return ok && (name == "MQTT" || name == "MQIsdp")
+}
+
+func (MQTT) New() Parser { return &mqttParser{} }
+
+func (m *mqttParser) Split(direction packet.StreamDirection, p []byte) (Message, int, error) {
+	size, k, e := mqttVarint(p[1:])
+	if e != nil || k == 0 {
+		return Message{}, 0, e
+	}
+	n := 1 + k + size
+	if len(p) < n {
+		return Message{}, 0, nil
+	}
+	kind := p[0] >> 4
+	body := p[1+k : n]
+	msg := Message{Method: mqttTypes[kind]}
+	switch kind {
+	case 0:
+		return Message{}, 0, errors.New("mqtt: reserved packet type")
+	case 1:
+		msg.Path = m.connect(body)
+	case 2:
+		if len(body) >= 2 {
+			msg.Status = fmt.Sprintf("0x%02x", body[1])
+		}
+	case 3:
+		topic, _, _ := mqttString(body)
+		msg.Path = topic
+		msg.Status = fmt.Sprintf("qos %d", p[0]>>1&3)
+	case 8, 10:
+		// a packet identifier, the properties of version 5 and the first
+		// topic filter
+		if len(body) >= 2 {
+			rest := m.skipProperties(body[2:])
+			topic, _, _ := mqttString(rest)
+			msg.Path = topic
+		}
+	}
+	return msg, n, nil
+}
+
+// connect returns the client identifier of a CONNECT packet and remembers
+// its protocol level.
+func (m *mqttParser) connect(body []byte) string {
+	_, rest, ok := mqttString(body)
+	if !ok || len(rest) < 4 {
+		return ""
+	}
+	m.version = rest[0]
+	id, _, _ := mqttString(m.skipProperties(rest[4:]))
+	return id
+}
+
+func (m *mqttParser) skipProperties(p []byte) []byte {
+	if m.version != mqttVersion5 {
+		return p
+	}
+	size, k, e := mqttVarint(p)
+	if e != nil || k == 0 || len(p) < k+size {
+		return nil
+	}
+	return p[k+size:]
+}
+
+// mqttVarint reads a variable byte integer, k is 0 while it is incomplete.
+func mqttVarint(p []byte) (v, k int, err error) {
+	for i := 0; i < 4; i++ {
+		if i >= len(p) {
+			return 0, 0, nil
+		}
+		v |= int(p[i]&0x7f) << (7 * i)
+		if p[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("mqtt: variable byte integer longer than 4 bytes")
+}
+
+// mqttString reads a string prefixed with its 16 bit length.
+func mqttString(p []byte) (string, []byte, bool) {
+	if len(p) < 2 {
+		return "", nil, false
+	}
+	size := int(binary.BigEndian.Uint16(p))
+	if len(p) < 2+size {
+		return "", nil, false
+	}
+	return string(p[2 : 2+size]), p[2+size:], true
+}
@@ -0,0 +1,205 @@
+package dissect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+const (
+	mysqlClientSSL          = 0x800
+	mysqlClientDeprecateEOF = 1 << 24
+	mysqlMaxPayload         = 1<<24 - 1
+)
+
+// mysqlCommands names the commands a client sends after logging in.
+var mysqlCommands = map[byte]string{
+	0x01: "Quit",
+	0x02: "InitDB",
+	0x03: "Query",
+	0x04: "FieldList",
+	0x05: "CreateDB",
+	0x06: "DropDB",
+	0x07: "Refresh",
+	0x08: "Shutdown",
+	0x09: "Statistics",
+	0x0a: "ProcessInfo",
+	0x0c: "ProcessKill",
+	0x0d: "Debug",
+	0x0e: "Ping",
+	0x11: "ChangeUser",
+	0x12: "BinlogDump",
+	0x16: "StmtPrepare",
+	0x17: "StmtExecute",
+	0x18: "StmtSendLongData",
+	0x19: "StmtClose",
+	0x1a: "StmtReset",
+	0x1b: "SetOption",
+	0x1c: "StmtFetch",
+	0x1f: "ResetConnection",
+}
+
+// MySQL is the client/server protocol of MySQL and MariaDB. Result sets are
+// one message from the column count to the packet that ends them.
+type MySQL struct{}
+
+type mysqlParser struct {
+	loggedIn     bool
+	deprecateEOF bool
+	// command is the last command sent, result sets only answer queries
+	// and statement executions
+	command byte
+}
+
+func (MySQL) Name() string { return "mysql" }
+
+// Detect matches the greeting of protocol version 10 the server opens with.
+func (MySQL) Detect(direction packet.StreamDirection, p []byte) bool {
+	return direction == packet.Inbound && len(p) > 5 && p[3] == 0 && p[4] == 0x0a
+}
+
+func (MySQL) New() Parser { return &mysqlParser{} }
+
+// mysqlPacket returns the payload of the first packet of p and its size
+// with the header, n is 0 while it is incomplete.
+func mysqlPacket(p []byte) (payload []byte, n int) {
+	if len(p) < 4 {
+		return nil, 0
+	}
+	size := int(p[0]) | int(p[1])<<8 | int(p[2])<<16
+	if len(p) < 4+size {
+		return nil, 0
+	}
+	return p[4 : 4+size], 4 + size
+}
+
+func (m *mysqlParser) Split(direction packet.StreamDirection, p []byte) (Message, int, error) {
+	payload, n := mysqlPacket(p)
+	if n == 0 {
+		return Message{}, 0, nil
+	}
+	if direction == packet.Outbound {
+		return m.request(payload), n, m.encrypted(payload)
+	}
+	if len(payload) == 0 {
+		return Message{Method: "Data"}, n, nil
+	}
+	switch {
+	case !m.loggedIn && payload[0] == 0x0a:
+		version, _, _ := bytes.Cut(payload[1:], []byte{0})
+		return Message{Method: "Handshake", Path: string(version)}, n, nil
+	case payload[0] == 0x00 && len(payload) >= 7:
+		m.loggedIn = true
+		return Message{Method: "OK", Status: "OK"}, n, nil
+	case payload[0] == 0xff:
+		return Message{Method: "ERR", Status: mysqlError(payload)}, n, nil
+	case payload[0] == 0xfe && len(payload) < 9:
+		return Message{Method: "EOF", Status: "EOF"}, n, nil
+	case m.loggedIn && (m.command == 0x03 || m.command == 0x17):
+		return m.resultSet(p, payload, n)
+	}
+	return Message{Method: "Data"}, n, nil
+}
+
+// encrypted ends the dissection after an SSL request, the rest is tls.
+func (m *mysqlParser) encrypted(payload []byte) error {
+	if !m.loggedIn && len(payload) == 32 && binary.LittleEndian.Uint32(payload)&mysqlClientSSL != 0 {
+		return errEncrypted
+	}
+	return nil
+}
+
+func (m *mysqlParser) request(payload []byte) Message {
+	if !m.loggedIn {
+		// HandshakeResponse41: capabilities, max packet size, charset, 23
+		// bytes of filler and the user name
+		if len(payload) < 32 {
+			return Message{Method: "Login"}
+		}
+		m.deprecateEOF = binary.LittleEndian.Uint32(payload)&mysqlClientDeprecateEOF != 0
+		user, _, _ := bytes.Cut(payload[32:], []byte{0})
+		return Message{Method: "Login", Path: string(user)}
+	}
+	if len(payload) == 0 {
+		return Message{}
+	}
+	m.command = payload[0]
+	name, ok := mysqlCommands[payload[0]]
+	if !ok {
+		name = fmt.Sprintf("Command 0x%02x", payload[0])
+	}
+	msg := Message{Method: name}
+	switch payload[0] {
+	case 0x02, 0x03, 0x16:
+		msg.Path = string(payload[1:])
+	}
+	return msg
+}
+
+// resultSet takes the packets of a result set up to the EOF, OK or ERR
+// packet ending it. Without CLIENT_DEPRECATE_EOF an EOF packet also ends the
+// column definitions.
+func (m *mysqlParser) resultSet(p, first []byte, n int) (Message, int, error) {
+	columns, _ := lengthEncodedInt(first)
+	ends := 2
+	if m.deprecateEOF {
+		ends = 1
+	}
+	packets := 1
+	for {
+		payload, k := mysqlPacket(p[n:])
+		if k == 0 {
+			return Message{}, 0, nil
+		}
+		n += k
+		packets++
+		switch {
+		case len(payload) > 0 && payload[0] == 0xff:
+			return Message{Method: "ResultSet", Status: mysqlError(payload)}, n, nil
+		case len(payload) > 0 && payload[0] == 0xfe && len(payload) < mysqlMaxPayload && (len(payload) < 9 || m.deprecateEOF):
+			ends--
+		}
+		if ends == 0 {
+			rows := packets - 1 - int(columns) - 1
+			if !m.deprecateEOF {
+				rows--
+			}
+			return Message{Method: "ResultSet", Status: strconv.Itoa(rows) + " rows"}, n, nil
+		}
+	}
+}
+
+// mysqlError formats an ERR packet as its code and message.
+func mysqlError(payload []byte) string {
+	if len(payload) < 3 {
+		return "ERR"
+	}
+	code := binary.LittleEndian.Uint16(payload[1:])
+	msg := payload[3:]
+	if len(msg) > 0 && msg[0] == '#' && len(msg) >= 6 {
+		msg = msg[6:]
+	}
+	return fmt.Sprintf("ERR %d %s", code, msg)
+}
+
+// lengthEncodedInt reads the integer MySQL prefixes counts and strings
+// with.
+func lengthEncodedInt(p []byte) (uint64, int) {
+	if len(p) == 0 {
+		return 0, 0
+	}
+	switch {
+	case p[0] < 0xfb:
+		return uint64(p[0]), 1
+	case p[0] == 0xfc && len(p) >= 3:
+		return uint64(binary.LittleEndian.Uint16(p[1:])), 3
+	case p[0] == 0xfd && len(p) >= 4:
+		return uint64(p[1]) | uint64(p[2])<<8 | uint64(p[3])<<16, 4
+	case p[0] == 0xfe && len(p) >= 9:
+		return binary.LittleEndian.Uint64(p[1:]), 9
+	}
+	return 0, 0
+}
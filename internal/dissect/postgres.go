@@ -0,0 +1,245 @@
+package dissect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+const (
+	postgresProtocol3  = 196608
+	postgresSSLRequest = 80877103
+	postgresGSSRequest = 80877104
+	postgresCancel     = 80877102
+	postgresMaxMessage = 1 << 30
+)
+
+var (
+	postgresRequests = map[byte]string{
+		'Q': "Query",
+		'P': "Parse",
+		'B': "Bind",
+		'E': "Execute",
+		'D': "Describe",
+		'C': "Close",
+		'S': "Sync",
+		'H': "Flush",
+		'F': "FunctionCall",
+		'p': "Password",
+		'd': "CopyData",
+		'c': "CopyDone",
+		'f': "CopyFail",
+		'X': "Terminate",
+	}
+	postgresReplies = map[byte]string{
+		'R': "Authentication",
+		'S': "ParameterStatus",
+		'K': "BackendKeyData",
+		'Z': "ReadyForQuery",
+		'T': "RowDescription",
+		'D': "DataRow",
+		'C': "CommandComplete",
+		'E': "ErrorResponse",
+		'N': "NoticeResponse",
+		'A': "NotificationResponse",
+		'1': "ParseComplete",
+		'2': "BindComplete",
+		'3': "CloseComplete",
+		'I': "EmptyQueryResponse",
+		'n': "NoData",
+		's': "PortalSuspended",
+		't': "ParameterDescription",
+		'V': "FunctionCallResponse",
+		'G': "CopyInResponse",
+		'H': "CopyOutResponse",
+		'W': "CopyBothResponse",
+		'd': "CopyData",
+		'c': "CopyDone",
+		'v': "NegotiateProtocolVersion",
+	}
+)
+
+// Postgres is the frontend/backend protocol version 3 of PostgreSQL. The
+// rows of a result are one message together with the CommandComplete that
+// ends them.
+type Postgres struct{}
+
+type postgresParser struct {
+	// started is set once the startup message went out, the messages
+	// before it carry no type
+	started bool
+	// negotiating is set while the answer to an SSLRequest or a
+	// GSSENCRequest is due, it is a single byte
+	negotiating bool
+}
+
+func (Postgres) Name() string { return "postgres" }
+
+// Detect matches the startup, SSL, GSS and cancel requests a client opens
+// with.
+func (Postgres) Detect(direction packet.StreamDirection, p []byte) bool {
+	if direction != packet.Outbound || len(p) < 8 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(p[4:]) {
+	case postgresProtocol3, postgresSSLRequest, postgresGSSRequest, postgresCancel:
+		return binary.BigEndian.Uint32(p) >= 8
+	}
+	return false
+}
+
+func (Postgres) New() Parser { return &postgresParser{} }
+
+func (m *postgresParser) Split(direction packet.StreamDirection, p []byte) (Message, int, error) {
+	if direction == packet.Outbound && !m.started {
+		return m.startup(p)
+	}
+	if direction == packet.Inbound && m.negotiating {
+		m.negotiating = false
+		if p[0] == 'S' || p[0] == 'G' {
+			return Message{}, 0, errEncrypted
+		}
+		return Message{Method: "Negotiation", Status: string(p[:1])}, 1, nil
+	}
+	kind, body, n, e := postgresMessage(p)
+	if e != nil || n == 0 {
+		return Message{}, 0, e
+	}
+	if direction == packet.Outbound {
+		name, ok := postgresRequests[kind]
+		if !ok {
+			return Message{}, 0, fmt.Errorf("postgres: unknown message %q", kind)
+		}
+		msg := Message{Method: name}
+		switch kind {
+		case 'Q':
+			msg.Path = cString(body)
+		case 'P':
+			_, query, _ := bytes.Cut(body, []byte{0})
+			msg.Path = cString(query)
+		}
+		return msg, n, nil
+	}
+	name, ok := postgresReplies[kind]
+	if !ok {
+		return Message{}, 0, fmt.Errorf("postgres: unknown message %q", kind)
+	}
+	switch kind {
+	case 'T', 'D':
+		return postgresRows(p, n)
+	case 'C':
+		return Message{Method: name, Status: cString(body)}, n, nil
+	case 'E', 'N':
+		return Message{Method: name, Status: postgresError(body)}, n, nil
+	case 'Z':
+		return Message{Method: name, Status: string(body)}, n, nil
+	}
+	return Message{Method: name}, n, nil
+}
+
+// startup splits the untyped messages a client starts with.
+func (m *postgresParser) startup(p []byte) (Message, int, error) {
+	if len(p) < 8 {
+		return Message{}, 0, nil
+	}
+	size := int(binary.BigEndian.Uint32(p))
+	if size < 8 || size > postgresMaxMessage {
+		return Message{}, 0, fmt.Errorf("postgres: bad startup length %d", size)
+	}
+	if len(p) < size {
+		return Message{}, 0, nil
+	}
+	switch code := binary.BigEndian.Uint32(p[4:]); code {
+	case postgresSSLRequest:
+		m.negotiating = true
+		return Message{Method: "SSLRequest"}, size, nil
+	case postgresGSSRequest:
+		m.negotiating = true
+		return Message{Method: "GSSENCRequest"}, size, nil
+	case postgresCancel:
+		return Message{Method: "CancelRequest"}, size, nil
+	default:
+		if code>>16 != 3 {
+			return Message{}, 0, fmt.Errorf("postgres: unsupported protocol %d.%d", code>>16, code&0xffff)
+		}
+		m.started = true
+		params := make(map[string]string)
+		fields := bytes.Split(p[8:size], []byte{0})
+		for i := 0; i+1 < len(fields); i += 2 {
+			params[string(fields[i])] = string(fields[i+1])
+		}
+		path := params["user"]
+		if db := params["database"]; db != "" {
+			path += "@" + db
+		}
+		return Message{Method: "Startup", Path: path}, size, nil
+	}
+}
+
+// postgresMessage splits a typed message, n is 0 while it is incomplete.
+func postgresMessage(p []byte) (kind byte, body []byte, n int, err error) {
+	if len(p) < 5 {
+		return 0, nil, 0, nil
+	}
+	size := int(binary.BigEndian.Uint32(p[1:]))
+	if size < 4 || size > postgresMaxMessage {
+		return 0, nil, 0, fmt.Errorf("postgres: bad length %d", size)
+	}
+	if len(p) < 1+size {
+		return 0, nil, 0, nil
+	}
+	return p[0], p[5 : 1+size], 1 + size, nil
+}
+
+// postgresRows takes a RowDescription or the first DataRow and the rows
+// after it up to the CommandComplete or ErrorResponse ending them. Any other
+// message ends them too and is left for the next call.
+func postgresRows(p []byte, n int) (Message, int, error) {
+	rows := 0
+	if p[0] == 'D' {
+		rows++
+	}
+	for {
+		kind, body, k, e := postgresMessage(p[n:])
+		if e != nil || k == 0 {
+			return Message{}, 0, e
+		}
+		switch kind {
+		case 'D':
+			rows++
+			n += k
+			continue
+		case 'C':
+			return Message{Method: "Rows", Status: cString(body)}, n + k, nil
+		case 'E':
+			return Message{Method: "Rows", Status: postgresError(body)}, n + k, nil
+		}
+		return Message{Method: "Rows", Status: strconv.Itoa(rows) + " rows"}, n, nil
+	}
+}
+
+// postgresError returns the severity and message fields of an error or a
+// notice.
+func postgresError(body []byte) string {
+	var severity, msg string
+	for _, field := range bytes.Split(body, []byte{0}) {
+		if len(field) == 0 {
+			continue
+		}
+		switch field[0] {
+		case 'S':
+			severity = string(field[1:])
+		case 'M':
+			msg = string(field[1:])
+		}
+	}
+	return severity + " " + msg
+}
+
+func cString(p []byte) string {
+	s, _, _ := bytes.Cut(p, []byte{0})
+	return string(s)
+}
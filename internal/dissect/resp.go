@@ -0,0 +1,156 @@
+package dissect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// respMaxDepth bounds the nesting of aggregates, real replies stay far below.
+const respMaxDepth = 32
+
+var crlf = []byte("\r\n")
+
+// RESP is the protocol of Redis and its clones, versions 2 and 3 and the
+// inline commands of telnet sessions.
+type RESP struct{}
+
+func (RESP) Name() string { return "redis" }
+
+func (RESP) Detect(direction packet.StreamDirection, p []byte) bool {
+	return direction == packet.Outbound && len(p) > 1 && p[0] == '*' && p[1] >= '0' && p[1] <= '9'
+}
+
+func (RESP) New() Parser { return RESP{} }
+
+func (RESP) Split(direction packet.StreamDirection, p []byte) (Message, int, error) {
+	if direction == packet.Outbound && !strings.ContainsRune("*$+-:_,#(!=%~>|", rune(p[0])) {
+		return respInline(p)
+	}
+	n, value, e := respValue(p, 0)
+	if e != nil || n == 0 {
+		return Message{}, 0, e
+	}
+	if direction == packet.Inbound {
+		return Message{Status: respStatus(p[0], value)}, n, nil
+	}
+	// a command is an array of bulk strings, the name and usually a key
+	var m Message
+	if p[0] == '*' {
+		_, header := respLine(p)
+		for i := 0; i < 2 && header < n; i++ {
+			k, arg, _ := respValue(p[header:], 1)
+			if k == 0 {
+				break
+			}
+			header += k
+			if i == 0 {
+				m.Method = strings.ToUpper(string(arg))
+			} else {
+				m.Path = string(arg)
+			}
+		}
+	}
+	return m, n, nil
+}
+
+// respInline splits a command sent as a line of words.
+func respInline(p []byte) (Message, int, error) {
+	i := bytes.IndexByte(p, '\n')
+	if i < 0 {
+		return Message{}, 0, nil
+	}
+	fields := strings.Fields(string(p[:i]))
+	var m Message
+	if len(fields) > 0 {
+		m.Method = strings.ToUpper(fields[0])
+	}
+	if len(fields) > 1 {
+		m.Path = fields[1]
+	}
+	return m, i + 1, nil
+}
+
+func respLine(p []byte) ([]byte, int) {
+	i := bytes.Index(p, crlf)
+	if i < 0 {
+		return nil, 0
+	}
+	return p[:i], i + 2
+}
+
+// respValue returns the size of the first value of p and the content of
+// scalars, n is 0 while the value is incomplete.
+func respValue(p []byte, depth int) (n int, value []byte, err error) {
+	if depth > respMaxDepth {
+		return 0, nil, errors.New("resp: nesting too deep")
+	}
+	line, n := respLine(p)
+	if n == 0 {
+		return 0, nil, nil
+	}
+	if len(line) == 0 {
+		return 0, nil, errors.New("resp: empty line")
+	}
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return n, line[1:], nil
+	case '$', '!', '=':
+		size, e := strconv.Atoi(string(line[1:]))
+		if e != nil || size < -1 {
+			return 0, nil, fmt.Errorf("resp: bad length %q", line)
+		}
+		if size == -1 {
+			return n, nil, nil
+		}
+		if len(p) < n+size+2 {
+			return 0, nil, nil
+		}
+		if !bytes.Equal(p[n+size:n+size+2], crlf) {
+			return 0, nil, errors.New("resp: bulk string without crlf")
+		}
+		return n + size + 2, p[n : n+size], nil
+	case '*', '~', '>', '%', '|':
+		count, e := strconv.Atoi(string(line[1:]))
+		if e != nil || count < -1 || count > 1<<20 {
+			return 0, nil, fmt.Errorf("resp: bad length %q", line)
+		}
+		if line[0] == '%' || line[0] == '|' {
+			count *= 2
+		}
+		if line[0] == '|' { // attributes come in front of a value
+			count++
+		}
+		for range count {
+			k, _, e := respValue(p[n:], depth+1)
+			if e != nil || k == 0 {
+				return 0, nil, e
+			}
+			n += k
+		}
+		return n, nil, nil
+	}
+	return 0, nil, fmt.Errorf("resp: unknown type %q", line[0])
+}
+
+// respStatus sums up a reply.
+func respStatus(kind byte, value []byte) string {
+	switch kind {
+	case '+', '-', ':', ',', '#', '(', '!':
+		return string(value)
+	case '_':
+		return "null"
+	case '$', '=':
+		if value == nil {
+			return "null"
+		}
+		return strconv.Itoa(len(value)) + " bytes"
+	case '*', '~', '>':
+		return "array"
+	}
+	return "map"
+}
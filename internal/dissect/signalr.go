@@ -0,0 +1,274 @@
+package dissect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// signalRSeparator ends every record of the json protocol and the
+// handshake.
+const signalRSeparator = 0x1e
+
+var signalRTypes = [...]string{
+	1: "Invocation", 2: "StreamItem", 3: "Completion", 4: "StreamInvocation",
+	5: "CancelInvocation", 6: "Ping", 7: "Close", 8: "Ack", 9: "Sequence",
+}
+
+// SignalR is the hub protocol of ASP.NET SignalR, record separated json
+// and length prefixed MessagePack. Messages are labeled with their type,
+// invocation target and invocation id.
+type SignalR struct{}
+
+func (SignalR) Name() string { return "signalr" }
+
+// Subprotocol is always false, signalr negotiates its protocol in a
+// handshake.
+func (SignalR) Subprotocol(string) bool { return false }
+
+// Detect matches json records, like the handshake of the client.
+func (SignalR) Detect(_ packet.StreamDirection, p []byte) bool {
+	return len(p) > 2 && p[0] == '{' && p[len(p)-1] == signalRSeparator
+}
+
+func (SignalR) New() FramingParser { return SignalR{} }
+
+// Decode reads text messages as json records and binary ones as
+// MessagePack, the handshake is json either way.
+func (SignalR) Decode(_ packet.StreamDirection, binary bool, p []byte) ([]Message, error) {
+	var messages []Message
+	for len(p) > 0 {
+		var m Message
+		var n int
+		var e error
+		if binary {
+			m, n, e = signalRMessagePack(p)
+		} else {
+			m, n, e = signalRJSON(p)
+		}
+		if e != nil {
+			return messages, e
+		}
+		m.Payload = p[:n:n]
+		messages = append(messages, m)
+		p = p[n:]
+	}
+	return messages, nil
+}
+
+func signalRJSON(p []byte) (Message, int, error) {
+	end := bytes.IndexByte(p, signalRSeparator)
+	if end < 0 {
+		return Message{}, 0, errors.New("signalr: record without its separator")
+	}
+	var record struct {
+		Type         int
+		Target       string
+		InvocationID string `json:"invocationId"`
+		Error        string
+		Protocol     string
+	}
+	if e := json.Unmarshal(p[:end], &record); e != nil {
+		return Message{}, 0, fmt.Errorf("signalr: %w", e)
+	}
+	m := Message{Path: record.Target, ID: record.InvocationID, Status: record.Error}
+	switch {
+	case record.Type == 0:
+		// the handshake request names the protocol, its answer is {} or
+		// an error
+		m.Method, m.Path = "Handshake", record.Protocol
+	case record.Type < len(signalRTypes):
+		m.Method = signalRTypes[record.Type]
+	default:
+		return Message{}, 0, fmt.Errorf("signalr: unknown message type %d", record.Type)
+	}
+	return m, end + 1, nil
+}
+
+// signalRMessagePack reads a message prefixed with its varint size, an array
+// of the type, the headers, the invocation id and the target for
+// invocations.
+func signalRMessagePack(p []byte) (Message, int, error) {
+	size, k := 0, 0
+	for ; ; k++ {
+		if k == len(p) || k == 5 {
+			return Message{}, 0, errors.New("signalr: bad message size")
+		}
+		size |= int(p[k]&0x7f) << (7 * k)
+		if p[k]&0x80 == 0 {
+			k++
+			break
+		}
+	}
+	if len(p) < k+size {
+		return Message{}, 0, errors.New("signalr: message shorter than its size")
+	}
+	r := &msgpackReader{p: p[k : k+size]}
+	fields := r.arrayLen()
+	kind := int(r.int())
+	if r.err != nil || fields == 0 || kind < 1 || kind >= len(signalRTypes) {
+		return Message{}, 0, errors.New("signalr: bad messagepack message")
+	}
+	m := Message{Method: signalRTypes[kind]}
+	switch kind {
+	case 1, 2, 3, 4, 5:
+		r.skip() // headers
+		m.ID = r.str()
+		switch kind {
+		case 1, 4:
+			m.Path = r.str()
+		case 3:
+			if r.int() == 1 { // the error result kind
+				m.Status = r.str()
+			}
+		}
+	case 7:
+		m.Status = r.str()
+	}
+	if r.err != nil {
+		return Message{}, 0, fmt.Errorf("signalr: %s: %w", m.Method, r.err)
+	}
+	return m, k + size, nil
+}
+
+var errMsgpackShort = errors.New("messagepack value cut short")
+
+// msgpackReader reads the few MessagePack values signalr needs, the first
+// error sticks and every later read returns a zero value.
+type msgpackReader struct {
+	p   []byte
+	err error
+}
+
+func (r *msgpackReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.p) < n {
+		r.err = errMsgpackShort
+		r.p = nil
+		return nil
+	}
+	b := r.p[:n]
+	r.p = r.p[n:]
+	return b
+}
+
+func (r *msgpackReader) uint(n int) uint64 {
+	b := r.next(n)
+	if b == nil {
+		return 0
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (r *msgpackReader) tag() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0xc1 // never used
+	}
+	return b[0]
+}
+
+func (r *msgpackReader) arrayLen() int {
+	switch t := r.tag(); {
+	case t&0xf0 == 0x90:
+		return int(t & 0x0f)
+	case t == 0xdc:
+		return int(r.uint(2))
+	case t == 0xdd:
+		return int(r.uint(4))
+	}
+	r.fail("array")
+	return 0
+}
+
+func (r *msgpackReader) int() int64 {
+	switch t := r.tag(); {
+	case t <= 0x7f:
+		return int64(t)
+	case t >= 0xe0:
+		return int64(int8(t))
+	case t >= 0xcc && t <= 0xcf:
+		return int64(r.uint(1 << (t - 0xcc)))
+	case t >= 0xd0 && t <= 0xd3:
+		n := 1 << (t - 0xd0)
+		return int64(r.uint(n)<<(64-8*n)) >> (64 - 8*n)
+	}
+	r.fail("integer")
+	return 0
+}
+
+// str reads a string or nil.
+func (r *msgpackReader) str() string {
+	var n int
+	switch t := r.tag(); {
+	case t == 0xc0:
+		return ""
+	case t&0xe0 == 0xa0:
+		n = int(t & 0x1f)
+	case t >= 0xd9 && t <= 0xdb:
+		n = int(r.uint(1 << (t - 0xd9)))
+	default:
+		r.fail("string")
+		return ""
+	}
+	return string(r.next(n))
+}
+
+// skip reads over one value of any type.
+func (r *msgpackReader) skip() {
+	t := r.tag()
+	switch {
+	case t <= 0x7f, t >= 0xe0, t == 0xc0, t == 0xc2, t == 0xc3:
+	case t&0xe0 == 0xa0:
+		r.next(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		r.skipN(int(t & 0x0f))
+	case t&0xf0 == 0x80:
+		r.skipN(2 * int(t&0x0f))
+	case t >= 0xc4 && t <= 0xc6: // bin
+		r.next(int(r.uint(1 << (t - 0xc4))))
+	case t >= 0xc7 && t <= 0xc9: // ext
+		r.next(int(r.uint(1<<(t-0xc7))) + 1)
+	case t == 0xca:
+		r.next(4)
+	case t == 0xcb:
+		r.next(8)
+	case t >= 0xcc && t <= 0xd3:
+		r.next(1 << ((t - 0xcc) & 3))
+	case t >= 0xd4 && t <= 0xd8: // fixext
+		r.next(1 + 1<<(t-0xd4))
+	case t >= 0xd9 && t <= 0xdb:
+		r.next(int(r.uint(1 << (t - 0xd9))))
+	case t == 0xdc, t == 0xdd:
+		r.skipN(int(r.uint(2 << (t - 0xdc))))
+	case t == 0xde, t == 0xdf:
+		r.skipN(2 * int(r.uint(2<<(t-0xde))))
+	default:
+		r.fail("value")
+	}
+}
+
+func (r *msgpackReader) skipN(n int) {
+	if n > len(r.p) { // every value takes a byte at least
+		r.fail("container")
+		return
+	}
+	for range n {
+		r.skip()
+	}
+}
+
+func (r *msgpackReader) fail(want string) {
+	if r.err == nil {
+		r.err = errors.New("messagepack: want " + want)
+	}
+}
@@ -0,0 +1,130 @@
+package dissect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+var (
+	engineIOTypes = [...]string{"open", "close", "ping", "pong", "message", "upgrade", "noop"}
+	socketIOTypes = [...]string{"CONNECT", "DISCONNECT", "EVENT", "ACK", "CONNECT_ERROR", "BINARY_EVENT", "BINARY_ACK"}
+)
+
+// SocketIO is Socket.IO over the websocket transport of Engine.IO. Events
+// are labeled with their name and ack id, binary attachments follow their
+// event as messages of their own.
+type SocketIO struct{}
+
+type socketIOParser struct {
+	// attachments are the binary messages announced by the last binary
+	// event or ack of each direction that have not been seen yet
+	attachments map[packet.StreamDirection]int
+}
+
+func (SocketIO) Name() string { return "socket.io" }
+
+// Subprotocol is always false, socket.io negotiates none.
+func (SocketIO) Subprotocol(string) bool { return false }
+
+// Detect matches the open packet of the server and socket.io packets.
+func (SocketIO) Detect(_ packet.StreamDirection, p []byte) bool {
+	if len(p) < 2 {
+		return false
+	}
+	switch p[0] {
+	case '0':
+		return p[1] == '{' && bytes.Contains(p, []byte(`"sid"`))
+	case '4':
+		return p[1] >= '0' && p[1] <= '6' && (len(p) == 2 || bytes.IndexByte([]byte("[{/-0123456789"), p[2]) >= 0)
+	}
+	return false
+}
+
+func (SocketIO) New() FramingParser {
+	return &socketIOParser{attachments: make(map[packet.StreamDirection]int)}
+}
+
+func (s *socketIOParser) Decode(direction packet.StreamDirection, binary bool, p []byte) ([]Message, error) {
+	if binary {
+		if s.attachments[direction] > 0 {
+			s.attachments[direction]--
+			return []Message{{Method: "ATTACHMENT", Payload: p}}, nil
+		}
+		return []Message{{Method: "message", Payload: p}}, nil
+	}
+	if len(p) == 0 {
+		return nil, errors.New("socket.io: empty engine.io packet")
+	}
+	kind := int(p[0] - '0')
+	if kind < 0 || kind >= len(engineIOTypes) {
+		return nil, fmt.Errorf("socket.io: unknown engine.io packet type %q", p[0])
+	}
+	if kind != 4 || len(p) == 1 {
+		return []Message{{Method: engineIOTypes[kind], Payload: p}}, nil
+	}
+	m, e := s.packet(direction, p[1:])
+	if e != nil {
+		return nil, e
+	}
+	m.Payload = p
+	return []Message{m}, nil
+}
+
+// packet labels a socket.io packet, type[attachments-][namespace,][ack id][data].
+func (s *socketIOParser) packet(direction packet.StreamDirection, p []byte) (Message, error) {
+	kind := int(p[0] - '0')
+	if kind < 0 || kind >= len(socketIOTypes) {
+		return Message{}, fmt.Errorf("socket.io: unknown packet type %q", p[0])
+	}
+	m := Message{Method: socketIOTypes[kind]}
+	rest := p[1:]
+	if kind == 5 || kind == 6 {
+		count, after, ok := bytes.Cut(rest, []byte("-"))
+		n, e := strconv.Atoi(string(count))
+		if !ok || e != nil {
+			return Message{}, errors.New("socket.io: binary packet without attachment count")
+		}
+		s.attachments[direction] = n
+		rest = after
+	}
+	namespace := "/"
+	if len(rest) > 0 && rest[0] == '/' {
+		end := bytes.IndexByte(rest, ',')
+		if end < 0 {
+			end = len(rest)
+		}
+		namespace = string(rest[:end])
+		rest = rest[min(end+1, len(rest)):]
+	}
+	i := 0
+	for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+		i++
+	}
+	m.ID, rest = string(rest[:i]), rest[i:]
+	switch kind {
+	case 0, 1:
+		m.Path = namespace
+	case 2, 5:
+		var args []json.RawMessage
+		var event string
+		if e := json.Unmarshal(rest, &args); e != nil || len(args) == 0 || json.Unmarshal(args[0], &event) != nil {
+			return Message{}, fmt.Errorf("socket.io: event without a name: %.32q", rest)
+		}
+		m.Path = event
+		if namespace != "/" {
+			m.Path = namespace + " " + event
+		}
+	case 4:
+		m.Path = namespace
+		var refusal struct{ Message string }
+		if json.Unmarshal(rest, &refusal) == nil {
+			m.Status = refusal.Message
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,109 @@
+package dissect
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+var stompCommands = map[string]bool{
+	"CONNECT": true, "STOMP": true, "CONNECTED": true, "SEND": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "ACK": true, "NACK": true, "BEGIN": true, "COMMIT": true,
+	"ABORT": true, "DISCONNECT": true, "MESSAGE": true, "RECEIPT": true, "ERROR": true,
+}
+
+// stompIDs are the headers that tie frames together, the first one a frame
+// has is its ID.
+var stompIDs = []string{"receipt-id", "message-id", "receipt", "id"}
+
+// STOMP is STOMP 1.0 to 1.2 over websockets, frames are labeled with their
+// command, destination and receipt or message id. Heart-beats between
+// frames are messages of their own.
+type STOMP struct{}
+
+func (STOMP) Name() string { return "stomp" }
+
+// Subprotocol matches stomp and the versioned v12.stomp names.
+func (STOMP) Subprotocol(name string) bool {
+	return name == "stomp" || strings.HasSuffix(name, ".stomp")
+}
+
+// Detect matches a frame that starts with a command.
+func (STOMP) Detect(_ packet.StreamDirection, p []byte) bool {
+	command, _, ok := bytes.Cut(p, []byte("\n"))
+	return ok && stompCommands[string(bytes.TrimSuffix(command, []byte("\r")))] && bytes.IndexByte(p, 0) >= 0
+}
+
+func (STOMP) New() FramingParser { return STOMP{} }
+
+func (STOMP) Decode(_ packet.StreamDirection, _ bool, p []byte) ([]Message, error) {
+	var messages []Message
+	for len(p) > 0 {
+		if p[0] == '\n' || p[0] == '\r' {
+			n := 0
+			for n < len(p) && (p[n] == '\n' || p[n] == '\r') {
+				n++
+			}
+			messages = append(messages, Message{Method: "HEARTBEAT", Payload: p[:n:n]})
+			p = p[n:]
+			continue
+		}
+		m, n, e := stompFrame(p)
+		if e != nil {
+			return messages, e
+		}
+		m.Payload = p[:n:n]
+		messages = append(messages, m)
+		p = p[n:]
+	}
+	return messages, nil
+}
+
+// stompFrame labels the frame p starts with, n is its size with the NUL
+// that ends it.
+func stompFrame(p []byte) (m Message, n int, err error) {
+	end := bytes.Index(p, []byte("\n\n"))
+	bodyAt := end + 2
+	if crlf := bytes.Index(p, []byte("\r\n\r\n")); crlf >= 0 && (end < 0 || crlf < end) {
+		end, bodyAt = crlf, crlf+4
+	}
+	if end < 0 {
+		return Message{}, 0, errors.New("stomp: frame without the end of its headers")
+	}
+	lines := strings.Split(strings.ReplaceAll(string(p[:end]), "\r\n", "\n"), "\n")
+	m.Method = lines[0]
+	if !stompCommands[m.Method] {
+		return Message{}, 0, errors.New("stomp: unknown command " + strconv.Quote(m.Method))
+	}
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, ":")
+		if _, ok := headers[k]; !ok { // the first of repeated headers counts
+			headers[k] = v
+		}
+	}
+	m.Path = headers["destination"]
+	for _, k := range stompIDs {
+		if v, ok := headers[k]; ok {
+			m.ID = v
+			break
+		}
+	}
+	switch m.Method {
+	case "ERROR":
+		m.Status = headers["message"]
+	case "CONNECTED":
+		m.Status = headers["version"]
+	}
+	nul := bytes.IndexByte(p[bodyAt:], 0)
+	if size, e := strconv.Atoi(headers["content-length"]); e == nil {
+		nul = size
+	}
+	if nul < 0 || bodyAt+nul >= len(p) || p[bodyAt+nul] != 0 {
+		return Message{}, 0, errors.New("stomp: frame without its NUL")
+	}
+	return m, bodyAt + nul + 1, nil
+}
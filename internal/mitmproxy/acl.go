@@ -0,0 +1,192 @@
+package mitmproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+type (
+	// ACL decides who may use the proxy and where it may connect to. The
+	// zero ACL allows everything.
+	ACL struct {
+		// Sources are the client networks served, empty serves every client.
+		// They are matched against the peer of the connection, or against
+		// the client of its PROXY header when ProxyHeaders trusts the peer.
+		Sources []netip.Prefix
+		// Rules are checked in order before every upstream connection, the
+		// first matching rule decides.
+		Rules []ACLRule
+		// DenyByDefault refuses destinations no rule matched.
+		DenyByDefault bool
+	}
+
+	// ACLRule matches a destination, every criterion left empty matches
+	// anything. Hosts and Networks together match when either does.
+	ACLRule struct {
+		Allow bool
+		// Schemes are the client protocols, like httpClient.HttpType for
+		// plain http and httpClient.HttpsType for intercepted requests.
+		Schemes []httpClient.SchemerType
+		// Commands are socks.ConnectCommand for every upstream connection,
+		// http CONNECT included, socks.BindCommand and socks.AssociateCommand.
+		Commands []socks.Command
+		// Hosts are names like example.com, *.example.com matches the
+		// subdomains.
+		Hosts []string
+		// Networks are matched against the resolved addresses, a name is
+		// only dialed at the addresses the rules allow.
+		Networks []netip.Prefix
+		Ports    []PortRange
+	}
+
+	PortRange struct{ From, To uint16 }
+)
+
+// allowSource checks the client address against Sources.
+func (a *ACL) allowSource(addr net.Addr) error {
+	if len(a.Sources) == 0 {
+		return nil
+	}
+	ap, e := netip.ParseAddrPort(addr.String())
+	if e == nil {
+		for _, prefix := range a.Sources {
+			if prefix.Contains(ap.Addr().Unmap()) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: client %s", packet.ErrDenied, addr)
+}
+
+// filtersDestinations reports whether dials have to be checked at all.
+func (a *ACL) filtersDestinations() bool { return len(a.Rules) > 0 || a.DenyByDefault }
+
+// allow checks one destination, ip is invalid when only the name is known.
+func (a *ACL) allow(scheme httpClient.SchemerType, cmd socks.Command, host string, ip netip.Addr, port uint16) error {
+	for _, rule := range a.Rules {
+		if rule.matches(scheme, cmd, host, ip, port) {
+			if rule.Allow {
+				return nil
+			}
+			return a.denied(cmd, host, port)
+		}
+	}
+	if a.DenyByDefault {
+		return a.denied(cmd, host, port)
+	}
+	return nil
+}
+
+func (a *ACL) denied(cmd socks.Command, host string, port uint16) error {
+	return fmt.Errorf("%w: %s %s", packet.ErrDenied, cmd, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+func (r ACLRule) matches(scheme httpClient.SchemerType, cmd socks.Command, host string, ip netip.Addr, port uint16) bool {
+	if len(r.Schemes) > 0 && !slices.Contains(r.Schemes, scheme) {
+		return false
+	}
+	if len(r.Commands) > 0 && !slices.Contains(r.Commands, cmd) {
+		return false
+	}
+	if len(r.Ports) > 0 && !slices.ContainsFunc(r.Ports, func(p PortRange) bool { return p.From <= port && port <= p.To }) {
+		return false
+	}
+	if len(r.Hosts) == 0 && len(r.Networks) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range r.Hosts {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, suffix) || host == pattern {
+			return true
+		}
+	}
+	return ip.IsValid() && slices.ContainsFunc(r.Networks, func(p netip.Prefix) bool { return p.Contains(ip.Unmap()) })
+}
+
+// socksAllow checks socks requests before they run and the destination of
+// every datagram of a UDP association, the addresses of a CONNECT are
+// checked again when it is dialed.
+func (a *ACL) socksAllow(s *packet.Session, r Resolver) socks.AllowFunc {
+	return func(cmd socks.Command, addr string) error {
+		if !a.filtersDestinations() {
+			return nil
+		}
+		host, portString, e := net.SplitHostPort(addr)
+		if e != nil {
+			return e
+		}
+		port, e := strconv.ParseUint(portString, 10, 16)
+		if e != nil {
+			return e
+		}
+		ip, _ := netip.ParseAddr(host)
+		switch {
+		case ip.IsValid():
+		case cmd == socks.ConnectCommand:
+			return nil // the rules see the name together with its addresses on dial
+		case cmd == socks.AssociateCommand:
+			// a datagram is sent to whatever the name resolves to, every
+			// address has to be allowed
+			ips, e := r.LookupNetIP(context.Background(), "ip", host)
+			if e != nil {
+				return e
+			}
+			for _, ip := range ips {
+				if e := a.allow(s.SchemerType, cmd, host, ip, uint16(port)); e != nil {
+					return e
+				}
+			}
+			return nil
+		}
+		return a.allow(s.SchemerType, cmd, host, ip, uint16(port))
+	}
+}
+
+// Refuse answers the request of a client the proxy does not serve with 403.
+func (h *Http) Refuse(err error) error {
+	var e error
+	if h.Request, e = http.ReadRequest(h.ReadWriter.Reader); e != nil {
+		return e
+	}
+	h.Packet = packet.MakeHttpRequestPacket(h.Request, h.Process, h.SchemerType)
+	h.Err = err
+	h.Response = packet.NewErrorResponse(h.Request, err)
+	h.StreamDirection = packet.Outbound
+	h.Status = h.Response.Status
+	if h.EventCallBack == nil {
+		h.SessionEvent(h.Session)
+	} else {
+		h.EventCallBack(h.Session)
+	}
+	if e := packet.WriteResponse(h.Response, h.ReadWriter); e != nil {
+		return e
+	}
+	return err
+}
+
+// Refuse records a connection the proxy does not serve and has no way to
+// answer, it is closed by the caller.
+func (t *Tcp) Refuse(err error) error {
+	t.Request = tcpRequest(t.ClientConn.LocalAddr().String()).WithContext(t.proxy.flowCtx)
+	t.Packet = packet.MakeHttpRequestPacket(t.Request, t.Process, t.SchemerType)
+	t.Err = err
+	t.StreamDirection = packet.Outbound
+	t.Status = err.Error()
+	if t.EventCallBack == nil {
+		t.SessionEvent(t.Session)
+	} else {
+		t.EventCallBack(t.Session)
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestACLRules(t *testing.T) {
+	acl := ACL{
+		Rules: []ACLRule{
+			{Allow: false, Commands: []socks.Command{socks.BindCommand}},
+			{Allow: true, Hosts: []string{"*.example.com"}, Ports: []PortRange{{443, 443}}},
+			{Allow: false, Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			{Allow: false, Schemes: []httpClient.SchemerType{httpClient.Socket4Type}},
+		},
+	}
+	ip := netip.MustParseAddr
+	for _, tt := range []struct {
+		scheme httpClient.SchemerType
+		cmd    socks.Command
+		host   string
+		ip     netip.Addr
+		port   uint16
+		allow  bool
+	}{
+		{httpClient.Socket5Type, socks.BindCommand, "0.0.0.0", ip("0.0.0.0"), 0, false},
+		{httpClient.HttpsType, socks.ConnectCommand, "api.EXAMPLE.com.", ip("10.1.2.3"), 443, true},
+		{httpClient.HttpType, socks.ConnectCommand, "api.example.com", ip("10.1.2.3"), 80, false},
+		{httpClient.HttpType, socks.ConnectCommand, "intranet", ip("192.168.1.1"), 80, true},
+		{httpClient.Socket4Type, socks.ConnectCommand, "intranet", ip("192.168.1.1"), 80, false},
+	} {
+		e := acl.allow(tt.scheme, tt.cmd, tt.host, tt.ip, tt.port)
+		assert.Equal(t, tt.allow, e == nil)
+		if e != nil {
+			assert.True(t, errors.Is(e, packet.ErrDenied))
+		}
+	}
+
+	acl.DenyByDefault = true
+	assert.NotNil(t, acl.allow(httpClient.HttpType, socks.ConnectCommand, "intranet", ip("192.168.1.1"), 80))
+}
+
+func TestACLEnvironmentProxy(t *testing.T) {
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.WriteString(w, "direct"))
+	}))
+	defer direct.Close()
+	envProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.WriteString(w, "via "+r.Host))
+	}))
+	defer envProxy.Close()
+	restore := environmentProxy
+	environmentProxy = http.ProxyURL(mylog.Check2(url.Parse(envProxy.URL)))
+	defer func() { environmentProxy = restore }()
+
+	_, port := mylog.Check3(net.SplitHostPort(direct.Listener.Addr().String()))
+	newProxy := func(fromEnvironment bool) *Proxy {
+		return newTestProxy(t, func(c *Config) {
+			c.ProxyFromEnvironment = fromEnvironment
+			c.DNS.Hosts = map[string][]netip.Addr{
+				"allowed.test": {netip.MustParseAddr("127.0.0.1")},
+				"blocked.test": {netip.MustParseAddr("127.0.0.1")},
+			}
+			c.ACL = ACL{Rules: []ACLRule{{Allow: false, Hosts: []string{"blocked.test"}}}}
+		})
+	}
+	get := func(p *Proxy, host string) (int, string) {
+		resp := mylog.Check2(proxyClient(p).Get("http://" + net.JoinHostPort(host, port) + "/"))
+		body := mylog.Check2(io.ReadAll(resp.Body))
+		mylog.Check(resp.Body.Close())
+		return resp.StatusCode, string(body)
+	}
+
+	// the environment is ignored unless asked for
+	p := newProxy(false)
+	code, body := get(p, "allowed.test")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "direct", body)
+	code, _ = get(p, "blocked.test")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// through the environment proxy the ACL still sees the target
+	p = newProxy(true)
+	code, body = get(p, "allowed.test")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "via allowed.test:"+port, body)
+	code, body = get(p, "blocked.test")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.False(t, strings.HasPrefix(body, "via"))
+}
+
+func TestACL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.WriteString(w, "hello"))
+	}))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1)
+	_, port := mylog.Check3(net.SplitHostPort(backend.Listener.Addr().String()))
+
+	failed := make(chan *packet.Session, 4)
+	newProxy := func(acl ACL) *Proxy {
+		return newTestProxy(t, func(c *Config) {
+			c.ACL = acl
+			c.SessionEventCallBack = func(s *packet.Session) {
+				if s.Failed() {
+					failed <- s
+				}
+			}
+		})
+	}
+	get := func(proxy *url.URL) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy), DisableKeepAlives: true}}
+		return c.Get(target)
+	}
+
+	t.Run("destination", func(t *testing.T) {
+		p := newProxy(ACL{Rules: []ACLRule{{
+			Allow:    false,
+			Networks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+			Ports:    []PortRange{{1024, 65535}},
+		}}})
+		addr := p.Addrs()[0].String()
+
+		resp := mylog.Check2(get(&url.URL{Scheme: "http", Host: addr}))
+		mylog.Check(resp.Body.Close())
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.True(t, errors.Is((<-failed).Err, packet.ErrDenied))
+
+		// a name is refused when the addresses it resolves to are
+		_, e := get(&url.URL{Scheme: "socks5", Host: addr})
+		assert.True(t, strings.Contains(e.Error(), "not allowed"))
+		assert.True(t, errors.Is((<-failed).Err, packet.ErrDenied))
+
+		d := socks.NewSocks4Dialer("tcp", addr)
+		_, e = d.Dial("tcp", net.JoinHostPort(httpClient.Localhost, port))
+		assert.NotNil(t, e)
+		assert.True(t, errors.Is((<-failed).Err, packet.ErrDenied))
+	})
+
+	t.Run("source", func(t *testing.T) {
+		p := newProxy(ACL{Sources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+		addr := p.Addrs()[0].String()
+
+		resp := mylog.Check2(get(&url.URL{Scheme: "http", Host: addr}))
+		mylog.Check(resp.Body.Close())
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.True(t, errors.Is((<-failed).Err, packet.ErrDenied))
+
+		_, e := get(&url.URL{Scheme: "socks5", Host: addr})
+		assert.NotNil(t, e)
+		assert.True(t, errors.Is((<-failed).Err, packet.ErrDenied))
+	})
+
+	t.Run("proxy header", func(t *testing.T) {
+		for _, tt := range []struct {
+			trusted string
+			status  int
+		}{
+			// the balancer is trusted, its header names the client
+			{"127.0.0.0/8", http.StatusOK},
+			// anyone else sending a header is not served at all
+			{"192.0.2.0/24", 0},
+		} {
+			p := newTestProxy(t, func(c *Config) {
+				c.ACL = ACL{Sources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+				c.ProxyHeaders = ProxyHeaders{Accept: true, Trusted: []netip.Prefix{netip.MustParsePrefix(tt.trusted)}}
+			})
+			conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+			host := strings.TrimPrefix(target, "http://")
+			mylog.Check2(io.WriteString(conn, "PROXY TCP4 10.1.2.3 198.51.100.7 51000 8080\r\n"+
+				"GET "+target+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n"))
+			resp, e := http.ReadResponse(bufio.NewReader(conn), nil)
+			if tt.status == 0 {
+				assert.NotNil(t, e)
+			} else {
+				assert.Equal(t, tt.status, resp.StatusCode)
+			}
+			mylog.Check(conn.Close())
+		}
+	})
+}
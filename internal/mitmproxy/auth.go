@@ -0,0 +1,247 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/ddkwork/mitmproxy/internal/ca"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+var errProxyAuth = errors.New("proxy authentication failed")
+
+type (
+	// Authenticator checks the credentials clients send to the proxy.
+	Authenticator interface {
+		Authenticate(user, password string) bool
+	}
+	AuthenticatorFunc func(user, password string) bool
+
+	// Auth requires clients to authenticate, http and CONNECT with Basic
+	// Proxy-Authorization, socks5 with username/password. The user is
+	// recorded on every session of the connection.
+	Auth struct {
+		// Users checks the credentials, nil disables authentication.
+		Users Authenticator
+		// Socks4 accepts socks4 user-ids, socks4 cannot carry a password
+		// so its requests are refused when Users is set and this is nil.
+		Socks4 func(userID string) bool
+		// Realm is announced in the Proxy-Authenticate challenge.
+		Realm string
+	}
+)
+
+func (f AuthenticatorFunc) Authenticate(user, password string) bool { return f(user, password) }
+
+func (a Auth) enabled() bool { return a.Users != nil }
+
+// basic returns the user of a valid Basic Proxy-Authorization header.
+func (a Auth) basic(header string) (string, bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	b, e := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if e != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok || !a.Users.Authenticate(user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// authenticate checks the Proxy-Authorization of a request that came in
+// over plain http, requests inside an intercepted tunnel were authenticated
+// with its CONNECT. The landing page stays reachable so clients can fetch
+// the CA first.
+func (h *Http) authenticate() error {
+	auth := h.proxy.Auth
+	if !auth.enabled() || h.tunneled || CanonicalHost(h.Request.URL.Host) == ca.LandingHost {
+		return nil
+	}
+	user, ok := auth.basic(h.Request.Header.Get("Proxy-Authorization"))
+	h.Request.Header.Del("Proxy-Authorization")
+	if ok {
+		h.User = user
+		return nil
+	}
+
+	h.Err = errProxyAuth
+	h.Response = packet.ProxyUnauthorizedResponse(h.Request, auth.Realm)
+	h.StreamDirection = packet.Outbound
+	h.Status = h.Response.Status
+	if h.EventCallBack == nil {
+		h.SessionEvent(h.Session)
+	} else {
+		h.EventCallBack(h.Session)
+	}
+	if e := packet.WriteResponse(h.Response, h.ReadWriter); e != nil {
+		return e
+	}
+	return h.Err
+}
+
+// socks5Authenticate runs the username/password sub-negotiation of RFC 1929.
+func (a Auth) socks5Authenticate(s *packet.Session) socks.AuthenticateFunc {
+	return func(_ context.Context, conn *socks.Conn, _ socks.AuthMethod) error {
+		req := &socks.UsernamePasswordAuthRequest{}
+		if e := conn.Read(req); e != nil {
+			return e
+		}
+		ok := a.Users.Authenticate(req.Username, req.Password)
+		status := socks.AuthStatusFailure
+		if ok {
+			status = socks.AuthStatusSuccess
+		}
+		if e := conn.Write(&socks.UsernamePasswordAuthResponse{Status: status}); e != nil {
+			return e
+		}
+		if !ok {
+			return fmt.Errorf("%w for %q", errProxyAuth, req.Username)
+		}
+		s.User = req.Username
+		return nil
+	}
+}
+
+// socks4Ident checks the user-id of a socks4 request.
+func (a Auth) socks4Ident(s *packet.Session) socks.IdentFunc {
+	return func(_ context.Context, _ *socks.Conn, req *socks.Socks4Request) error {
+		if a.Socks4 == nil || !a.Socks4(req.UserID) {
+			return fmt.Errorf("%w for user-id %q", errProxyAuth, req.UserID)
+		}
+		s.User = req.UserID
+		return nil
+	}
+}
+
+// Htpasswd authenticates against the entries of an htpasswd file. bcrypt,
+// apr1 (the htpasswd default), {SHA} and plain text entries are understood.
+type Htpasswd map[string]string
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (Htpasswd, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer func() { _ = f.Close() }()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads user:hash lines, blank lines and # comments are skipped.
+func ParseHtpasswd(r io.Reader) (Htpasswd, error) {
+	h := make(Htpasswd)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: want user:hash", n)
+		}
+		h[user] = hash
+	}
+	return h, scanner.Err()
+}
+
+func (h Htpasswd) Authenticate(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, apr1Magic):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, apr1Magic), "$")
+		return constantTimeEqual(apr1(password, salt), hash)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]), hash)
+	}
+	return constantTimeEqual(password, hash)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const apr1Magic = "$apr1$"
+
+// apr1 is Apache's variant of the md5 crypt, salt is at most 8 bytes.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic + salt))
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	for i := range 1000 {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	to64(uint32(sum[11]), 2)
+	return apr1Magic + salt + "$" + string(out)
+}
@@ -0,0 +1,134 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestHtpasswd(t *testing.T) {
+	h := mylog.Check2(ParseHtpasswd(strings.NewReader(`
+# hashes of "secret" in every supported format
+apr:$apr1$r31abcde$SZEN.U5sWGGNcv9YsUrqI.
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+bcrypt:$2a$05$btaMnqoPtqkrv/D0HrlNiOIiU5kPg5kD5nq./AF5cMkjxCua/NTLS
+plain:secret
+`)))
+	for _, user := range []string{"apr", "sha", "bcrypt", "plain"} {
+		assert.True(t, h.Authenticate(user, "secret"))
+		assert.True(t, !h.Authenticate(user, "wrong"))
+	}
+	assert.True(t, !h.Authenticate("nobody", "secret"))
+
+	_, e := ParseHtpasswd(strings.NewReader("no separator"))
+	assert.NotNil(t, e)
+}
+
+func TestAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.WriteString(w, r.Header.Get("Proxy-Authorization")+"hello"))
+	}))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1)
+
+	users := make(chan string, 8)
+	p := newTestProxy(t, func(c *Config) {
+		c.Auth.Users = AuthenticatorFunc(func(user, password string) bool { return user == "alice" && password == "secret" })
+		c.Auth.Socks4 = func(userID string) bool { return userID == "alice" }
+		c.SessionEventCallBack = func(s *packet.Session) {
+			// socks tunnels emit a session per chunk, only the first counts
+			if s.Failed() || s.SchemerType == httpClient.Socket5Type || s.StreamDirection == packet.Outbound && s.Response != nil {
+				select {
+				case users <- s.User:
+				default:
+				}
+			}
+		}
+	})
+	addr := p.Addrs()[0].String()
+	get := func(proxy *url.URL) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy), DisableKeepAlives: true}}
+		return c.Get(target)
+	}
+
+	t.Run("http", func(t *testing.T) {
+		resp := mylog.Check2(get(&url.URL{Scheme: "http", Host: addr}))
+		mylog.Check(resp.Body.Close())
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		assert.Equal(t, `Basic realm="mitmproxy"`, resp.Header.Get("Proxy-Authenticate"))
+		assert.Equal(t, "", <-users)
+
+		resp = mylog.Check2(get(&url.URL{Scheme: "http", Host: addr, User: url.UserPassword("alice", "secret")}))
+		body := mylog.Check2(io.ReadAll(resp.Body))
+		mylog.Check(resp.Body.Close())
+		// the credentials are not forwarded
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, "alice", <-users)
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		host := strings.TrimPrefix(target, "http://")
+		connect := func(auth string) (net.Conn, *bufio.Reader, *http.Response) {
+			conn := mylog.Check2(net.Dial("tcp", addr))
+			mylog.Check2(io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n"+auth+"\r\n"))
+			r := bufio.NewReader(conn)
+			return conn, r, mylog.Check2(http.ReadResponse(r, nil))
+		}
+
+		conn, _, resp := connect("")
+		mylog.Check(conn.Close())
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		assert.Equal(t, "", <-users)
+
+		// plain http inside the tunnel needs no credentials of its own
+		conn, r, resp := connect("Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n")
+		defer func() { mylog.Check(conn.Close()) }()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		mylog.Check2(io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: "+host+"\r\n\r\n"))
+		resp = mylog.Check2(http.ReadResponse(r, nil))
+		body := mylog.Check2(io.ReadAll(resp.Body))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, "alice", <-users)
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		_, e := get(&url.URL{Scheme: "socks5", Host: addr, User: url.UserPassword("alice", "wrong")})
+		assert.NotNil(t, e)
+		assert.Equal(t, "", <-users)
+
+		resp := mylog.Check2(get(&url.URL{Scheme: "socks5", Host: addr, User: url.UserPassword("alice", "secret")}))
+		body := mylog.Check2(io.ReadAll(resp.Body))
+		mylog.Check(resp.Body.Close())
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, "alice", <-users)
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		_, port := mylog.Check3(net.SplitHostPort(backend.Listener.Addr().String()))
+		for _, tt := range []struct {
+			userID string
+			ok     bool
+		}{{"mallory", false}, {"alice", true}} {
+			d := socks.NewSocks4Dialer("tcp", addr, func(o *socks.Socks4DialerOptions) { o.UserID = tt.userID })
+			conn, e := d.DialContext(context.Background(), "tcp", net.JoinHostPort(httpClient.Localhost, port))
+			assert.Equal(t, tt.ok, e == nil)
+			if e == nil {
+				mylog.Check(conn.Close())
+			}
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package mitmproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// chunkMaxLine is how long a status, header or chunk size line may grow
+// before the response is no longer followed.
+const chunkMaxLine = 64 << 10
+
+const (
+	chunkIdle chunkState = iota
+	chunkStatus
+	chunkHeader
+	chunkSize
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+)
+
+type (
+	chunkState int
+
+	// chunkConn is an upstream connection of the transport. The transport
+	// decodes chunked bodies out of sight, the connection follows the
+	// responses read from it and records the chunks they came in.
+	chunkConn struct {
+		net.Conn
+		mu   sync.Mutex
+		scan chunkScanner
+	}
+
+	// chunkScanner parses the framing of the http/1 responses of a
+	// connection as they are read, reads may cut it anywhere. Anything but
+	// a chunked body is skipped until the next request.
+	chunkScanner struct {
+		state chunkState
+		head  bool
+		line  []byte
+		// left is what is left of the data of the current chunk or of the
+		// CRLF after it
+		left    int64
+		status  int
+		chunked bool
+		log     *chunkLog
+	}
+
+	// chunkLog is the chunks of one response body in the order they
+	// arrived.
+	chunkLog struct {
+		mu     sync.Mutex
+		chunks []packet.BodyChunk
+		size   int64
+	}
+
+	// chunkReader reads a chunked body for Response.Write, which makes a
+	// chunk of every write. Through WriteTo each chunk of the server is
+	// written once it is complete, so the client gets the same chunks.
+	chunkReader struct {
+		src  io.Reader
+		log  *chunkLog
+		next int
+		buf  []byte
+	}
+)
+
+// dialTLS opens the https connections of the transport when chunks are
+// recorded. The handshake is done here rather than by the transport so that
+// the chunks of responses are seen decrypted.
+func (p *Proxy) dialTLS(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+	conn, e := p.dialContext(ctx, network, addr)
+	if e != nil {
+		return nil, e
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	// the transport reports its own handshakes to the trace, this one too
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.Timeouts.TLSHandshake)
+	defer cancel()
+	tlsConn := tls.Client(conn, config)
+	e = tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), e)
+	}
+	if e != nil {
+		mylog.CheckIgnore(conn.Close())
+		return nil, e
+	}
+	return &chunkConn{Conn: tlsConn}, nil
+}
+
+// dialTransport opens the plain connections of the transport when chunks
+// are recorded.
+func (p *Proxy) dialTransport(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, e := p.dialContext(ctx, network, addr)
+	if e != nil {
+		return nil, e
+	}
+	return &chunkConn{Conn: conn}, nil
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	n, e := c.Conn.Read(p)
+	c.mu.Lock()
+	c.scan.Write(p[:n])
+	c.mu.Unlock()
+	return n, e
+}
+
+// expect follows the response to the request about to be sent, its chunks
+// go to the returned log.
+func (c *chunkConn) expect(method string) *chunkLog {
+	log := &chunkLog{}
+	c.mu.Lock()
+	c.scan = chunkScanner{state: chunkStatus, head: method == http.MethodHead, log: log}
+	c.mu.Unlock()
+	return log
+}
+
+func (s *chunkScanner) Write(p []byte) {
+	for len(p) > 0 && s.state != chunkIdle {
+		switch s.state {
+		case chunkData, chunkDataEnd:
+			n := min(s.left, int64(len(p)))
+			p = p[n:]
+			if s.left -= n; s.left > 0 {
+				continue
+			}
+			if s.state == chunkData {
+				s.state, s.left = chunkDataEnd, 2
+			} else {
+				s.state = chunkSize
+			}
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.line = append(s.line, p...)
+			if len(s.line) > chunkMaxLine {
+				s.state = chunkIdle
+			}
+			return
+		}
+		line := append(s.line, p[:i]...)
+		p = p[i+1:]
+		s.line = line[:0]
+		s.scanLine(strings.TrimSuffix(string(line), "\r"))
+	}
+}
+
+// scanLine moves on with the framing after a complete line.
+func (s *chunkScanner) scanLine(line string) {
+	switch s.state {
+	case chunkStatus:
+		_, code, _ := strings.Cut(line, " ")
+		code, _, _ = strings.Cut(code, " ")
+		s.status, _ = strconv.Atoi(code)
+		s.chunked = false
+		s.state = chunkHeader
+	case chunkHeader:
+		if line != "" {
+			name, value, _ := strings.Cut(line, ":")
+			if strings.EqualFold(strings.TrimSpace(name), "Transfer-Encoding") {
+				codings := strings.Split(value, ",")
+				s.chunked = strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+			}
+			return
+		}
+		switch {
+		case s.status >= 100 && s.status < 200 && s.status != http.StatusSwitchingProtocols:
+			s.state = chunkStatus // the final response follows
+		case s.chunked && !s.head && s.status != http.StatusNoContent && s.status != http.StatusNotModified:
+			s.state = chunkSize
+		default:
+			s.state = chunkIdle
+		}
+	case chunkSize:
+		size, extension, _ := strings.Cut(line, ";")
+		n, e := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if e != nil || n < 0 {
+			s.state = chunkIdle
+			return
+		}
+		if n == 0 {
+			s.state = chunkTrailer
+			return
+		}
+		s.log.add(n, strings.TrimSpace(extension))
+		s.state, s.left = chunkData, n
+	case chunkTrailer:
+		if line == "" {
+			s.state = chunkIdle
+		}
+	}
+}
+
+func (l *chunkLog) add(size int64, extension string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.chunks = append(l.chunks, packet.BodyChunk{Offset: l.size, Size: size, Extension: extension, Time: time.Now()})
+	l.size += size
+}
+
+// Chunks returns the chunks so far, nil for a nil log.
+func (l *chunkLog) Chunks() []packet.BodyChunk {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]packet.BodyChunk(nil), l.chunks...)
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) { return r.src.Read(p) }
+
+// WriteTo writes each chunk of the log in one write. Bytes the log has no
+// chunk for, like when the connection was not followed, are written as they
+// are read.
+func (r *chunkReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, e := r.src.Read(buf)
+		r.buf = append(r.buf, buf[:n]...)
+		for _, c := range r.log.Chunks()[r.next:] {
+			if c.Size > int64(len(r.buf)) {
+				break
+			}
+			m, e := w.Write(r.buf[:c.Size])
+			written += int64(m)
+			if e != nil {
+				return written, e
+			}
+			r.buf = r.buf[c.Size:]
+			r.next++
+		}
+		if len(r.buf) > 0 && (e != nil || len(r.log.Chunks()) == r.next) {
+			m, e := w.Write(r.buf)
+			written += int64(m)
+			if e != nil {
+				return written, e
+			}
+			r.buf = r.buf[:0]
+		}
+		if e == io.EOF {
+			return written, nil
+		}
+		if e != nil {
+			return written, e
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestChunkScanner(t *testing.T) {
+	responses := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked\r\nTrailer: X-Sum\r\n\r\n" +
+		"3;name=one\r\nabc\r\n10\r\n0123456789abcdef\r\n0\r\nX-Sum: 1\r\n\r\n" +
+		// not followed, the scanner waits for the next request
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nz\r\n0\r\n\r\n"
+	for _, step := range []int{1, 7, len(responses)} {
+		s := chunkScanner{state: chunkStatus, log: &chunkLog{}}
+		for p := responses; len(p) > 0; {
+			n := min(step, len(p))
+			s.Write([]byte(p[:n]))
+			p = p[n:]
+		}
+		chunks := s.log.Chunks()
+		assert.Equal(t, 2, len(chunks))
+		assert.Equal(t, int64(3), chunks[0].Size)
+		assert.Equal(t, "name=one", chunks[0].Extension)
+		assert.Equal(t, int64(3), chunks[1].Offset)
+		assert.Equal(t, int64(16), chunks[1].Size)
+		assert.Equal(t, chunkIdle, s.state)
+	}
+
+	head := chunkScanner{state: chunkStatus, head: true, log: &chunkLog{}}
+	head.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"))
+	assert.Equal(t, chunkIdle, head.state)
+}
+
+// readChunks reads a chunked response off r and returns the size of each of
+// its chunks and its trailer.
+func readChunks(r *bufio.Reader) ([]int, http.Header) {
+	for {
+		if line := mylog.Check2(r.ReadString('\n')); line == "\r\n" {
+			break
+		}
+	}
+	var sizes []int
+	for {
+		line := strings.TrimSpace(mylog.Check2(r.ReadString('\n')))
+		size := mylog.Check2(strconv.ParseInt(line, 16, 64))
+		if size == 0 {
+			break
+		}
+		sizes = append(sizes, int(size))
+		mylog.Check2(io.ReadFull(r, make([]byte, size+2)))
+	}
+	trailer := http.Header{}
+	for {
+		line := strings.TrimSpace(mylog.Check2(r.ReadString('\n')))
+		if line == "" {
+			return sizes, trailer
+		}
+		name, value, _ := strings.Cut(line, ":")
+		trailer.Add(name, strings.TrimSpace(value))
+	}
+}
+
+func TestChunks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		for _, chunk := range []string{"ab", "cde", "f"} {
+			mylog.Check2(io.WriteString(w, chunk))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Sum", "6")
+	}))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1)
+
+	for _, tt := range []struct {
+		record, preserve bool
+	}{{false, false}, {true, false}, {false, true}} {
+		sessions := make(chan *packet.Session, 1)
+		p := newTestProxy(t, func(c *Config) {
+			c.RecordChunks, c.PreserveChunks = tt.record, tt.preserve
+			c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+		})
+		// without either the stock dialers of the transport are left alone
+		followed := p.transport.(*http.Transport).DialTLSContext != nil
+		assert.Equal(t, tt.record || tt.preserve, followed)
+		conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+		mylog.Check2(io.WriteString(conn, "GET "+target+"/chunks HTTP/1.1\r\nHost: "+strings.TrimPrefix(target, "http://")+"\r\n\r\n"))
+		sizes, trailer := readChunks(bufio.NewReader(conn))
+		mylog.Check(conn.Close())
+		assert.Equal(t, "6", trailer.Get("X-Sum"))
+		if tt.preserve {
+			assert.Equal(t, []int{2, 3, 1}, sizes)
+		}
+
+		s := <-sessions
+		assert.Equal(t, "abcdef", string(s.RespBodyDecoder.Payload))
+		assert.Equal(t, "6", s.RespBodyDecoder.Trailer.Get("X-Sum"))
+		chunks := s.RespBodyDecoder.Chunks
+		if !followed {
+			assert.Equal(t, 0, len(chunks))
+			continue
+		}
+		assert.Equal(t, 3, len(chunks))
+		for i, size := range []int64{2, 3, 1} {
+			assert.Equal(t, size, chunks[i].Size)
+			if i > 0 {
+				assert.Equal(t, chunks[i-1].Offset+chunks[i-1].Size, chunks[i].Offset)
+				assert.True(t, !chunks[i].Time.Before(chunks[i-1].Time))
+			}
+		}
+	}
+}
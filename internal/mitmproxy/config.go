@@ -0,0 +1,275 @@
+package mitmproxy
+
+import (
+	"crypto"
+	"crypto/x509"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/ca"
+	"github.com/ddkwork/mitmproxy/internal/dissect"
+	"github.com/ddkwork/mitmproxy/internal/proxyproto"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+type (
+	// Config describes one proxy instance. Nothing in it is shared between
+	// proxies, so several of them can run in the same process.
+	Config struct {
+		// Addrs are the listen addresses, every protocol is served on each of them.
+		Addrs      []string
+		CA         CASource
+		CertServer CertServer
+		Control    Control
+		Timeouts   Timeouts
+		Sniff      Sniffer
+		// Fallback is the host:port connections of an unknown protocol are
+		// relayed to as raw tcp, without it they are closed.
+		Fallback     string
+		ProxyHeaders ProxyHeaders
+		Auth         Auth
+		ACL          ACL
+		DNS          DNS
+		// ProxyFromEnvironment sends http and websocket flows upstream
+		// through the proxy of HTTP_PROXY, HTTPS_PROXY and NO_PROXY. The ACL
+		// is still checked on the targets, DNS and ResolvedIP then apply to
+		// that proxy.
+		ProxyFromEnvironment bool
+		SocksBind            SocksBind
+		// Forwards are static port forwards served next to the proxy.
+		Forwards []Forward
+		StartTLS StartTLS
+		HTTP3    HTTP3
+		// WebSocket configures the websocket relays.
+		WebSocket WebSocketConfig
+		// StreamLimit is how many bytes of each direction of a tunnel are
+		// kept on its session, zero uses DefaultStreamLimit and a negative
+		// limit keeps everything.
+		StreamLimit int64
+		// BodyCapture bounds what sessions keep of http bodies, the bodies
+		// themselves always go through whole.
+		BodyCapture BodyCapture
+		// RecordChunks follows the chunked responses of upstream
+		// connections and keeps their chunks on BodyDecoder.Chunks.
+		RecordChunks bool
+		// PreserveChunks writes chunked responses to the client in the
+		// chunks the server sent, instead of a chunk per read. It records
+		// them too.
+		PreserveChunks bool
+		// Dissectors parse the streams of tunnels into messages emitted as
+		// child sessions, nil leaves tunnels as raw chunks.
+		Dissectors           *dissect.Registry
+		SessionEventCallBack packet.SessionEventCallBack
+	}
+
+	// ProxyHeaders configures HAProxy PROXY protocol headers, for running
+	// behind a tcp load balancer and for chaining proxies.
+	ProxyHeaders struct {
+		// Accept parses a v1 or v2 header before sniffing, connections that
+		// come without one are still served with their own address.
+		Accept bool
+		// Trusted are the peers allowed to send headers, the connection of
+		// any other peer sending one is closed. Empty trusts no peer, a
+		// header would let any client claim any address.
+		Trusted []netip.Prefix
+		// Upstream prefixes every upstream connection with a header of this
+		// version carrying the client address, zero sends none. Upstream
+		// connections are not reused while it is set.
+		Upstream proxyproto.Version
+	}
+
+	// CASource selects where the MITM root comes from. An in-memory
+	// Certificate/PrivateKey pair wins over CertFile/KeyFile, which are
+	// created on first use. With neither set a throwaway CA is generated.
+	CASource struct {
+		Certificate *x509.Certificate
+		PrivateKey  crypto.PrivateKey
+		CertFile    string
+		KeyFile     string
+		// Options are applied when a CA has to be generated.
+		Options []func(*ca.Option)
+	}
+
+	// CertServer is the landing page serving the CA to clients. It is
+	// always reachable through the proxy as ca.LandingHost.
+	CertServer struct {
+		Enabled bool
+		Addr    string
+	}
+
+	// Control is the http endpoint of ControlHandler, it lists and steers
+	// live flows. Keep it on a local address, an empty Addr listens on
+	// DefaultControlAddr.
+	Control struct {
+		Enabled bool
+		Addr    string
+		// Token, when set, is required as a bearer token of every call.
+		Token string
+	}
+
+	// BodyCapture bounds the copy of http bodies kept on sessions.
+	BodyCapture struct {
+		// Limit is how many bytes of a body are kept in memory, zero uses
+		// DefaultBodyLimit and a negative limit keeps everything.
+		Limit int64
+		// SpillDir keeps larger bodies whole in temp files there, they are
+		// truncated when it is empty. BodyDecoder.SpillFile names the files,
+		// they are removed once the exchange is over, read them in
+		// SessionEventCallBack.
+		SpillDir string
+		// KeepSpills leaves the files to the consumer of the sessions.
+		KeepSpills bool
+	}
+
+	// SocksBind configures the listeners opened for socks BIND requests,
+	// like the data connection of active mode FTP.
+	SocksBind struct {
+		// Disabled refuses BIND, the ACL can refuse it per destination too.
+		Disabled bool
+		// Addr is the IP listeners are opened on and announced at, empty
+		// uses the address the client reached the proxy at.
+		Addr string
+		// Ports are the ports listeners are opened on, zero picks any
+		// free port.
+		Ports PortRange
+		// Timeout is how long a listener waits for its connection.
+		Timeout time.Duration
+	}
+
+	Timeouts struct {
+		Dial           time.Duration
+		TLSHandshake   time.Duration
+		ResponseHeader time.Duration
+		Idle           time.Duration
+		// Drain is how long in-flight flows may take to finish once the
+		// context passed to Serve is done.
+		Drain time.Duration
+	}
+)
+
+// DefaultStreamLimit keeps the first 8 MiB of each direction of a tunnel.
+const DefaultStreamLimit = 8 << 20
+
+// DefaultBodyLimit keeps the first 8 MiB of an http body.
+const DefaultBodyLimit = 8 << 20
+
+// DefaultControlAddr is where the control api listens by default.
+const DefaultControlAddr = "127.0.0.1:7778"
+
+// DefaultConfig listens on the historical 127.0.0.1:7890, keeps the CA in
+// the home directory and serves it on 127.0.0.1:7777.
+func DefaultConfig() Config {
+	return Config{
+		Addrs: []string{ca.ProxyServeAddress()},
+		CA: CASource{
+			CertFile: ca.DefaultCertFile(),
+			KeyFile:  ca.DefaultKeyFile(),
+			Options: []func(*ca.Option){func(o *ca.Option) {
+				o.Validity = 365 * 24 * time.Hour
+			}},
+		},
+		CertServer: CertServer{
+			Enabled: true,
+			Addr:    ca.ProxyFileServerAddress(),
+		},
+		Control:              Control{},
+		Timeouts:             DefaultTimeouts(),
+		Sniff:                DefaultSniffer(),
+		Fallback:             "",
+		ProxyHeaders:         ProxyHeaders{},
+		Auth:                 Auth{},
+		ACL:                  ACL{},
+		DNS:                  DNS{},
+		SocksBind:            SocksBind{},
+		Forwards:             nil,
+		StartTLS:             StartTLS{Ports: DefaultStartTLSPorts()},
+		HTTP3:                HTTP3{},
+		WebSocket:            WebSocketConfig{Framings: dissect.DefaultFramings()},
+		StreamLimit:          DefaultStreamLimit,
+		BodyCapture:          BodyCapture{Limit: DefaultBodyLimit},
+		RecordChunks:         false,
+		PreserveChunks:       false,
+		Dissectors:           dissect.Default(),
+		SessionEventCallBack: nil,
+	}
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Dial:           dialTimeout,
+		TLSHandshake:   tlsHandshakeTimeout,
+		ResponseHeader: defaultTimeout,
+		Idle:           defaultTimeout,
+		Drain:          defaultTimeout,
+	}
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Addrs) == 0 {
+		c.Addrs = []string{net.JoinHostPort(httpClient.Localhost, "0")}
+	}
+	d := DefaultTimeouts()
+	if c.Timeouts.Dial == 0 {
+		c.Timeouts.Dial = d.Dial
+	}
+	if c.Timeouts.TLSHandshake == 0 {
+		c.Timeouts.TLSHandshake = d.TLSHandshake
+	}
+	if c.Timeouts.ResponseHeader == 0 {
+		c.Timeouts.ResponseHeader = d.ResponseHeader
+	}
+	if c.Timeouts.Idle == 0 {
+		c.Timeouts.Idle = d.Idle
+	}
+	if c.Timeouts.Drain == 0 {
+		c.Timeouts.Drain = d.Drain
+	}
+	if c.Sniff.FirstByte == 0 {
+		c.Sniff.FirstByte = DefaultSniffer().FirstByte
+	}
+	if c.Sniff.Timeouts == nil {
+		c.Sniff.Timeouts = DefaultSniffer().Timeouts
+	}
+	if c.SocksBind.Timeout == 0 {
+		c.SocksBind.Timeout = defaultTimeout
+	}
+	if c.StartTLS.Ports == nil {
+		c.StartTLS.Ports = DefaultStartTLSPorts()
+	}
+	if c.StreamLimit == 0 {
+		c.StreamLimit = DefaultStreamLimit
+	}
+	if c.BodyCapture.Limit == 0 {
+		c.BodyCapture.Limit = DefaultBodyLimit
+	}
+	if c.Control.Enabled && c.Control.Addr == "" {
+		c.Control.Addr = DefaultControlAddr
+	}
+	if c.Auth.Realm == "" {
+		c.Auth.Realm = "mitmproxy"
+	}
+	if c.CertServer.Enabled && c.CertServer.Addr == "" {
+		c.CertServer.Addr = ca.ProxyFileServerAddress()
+	}
+}
+
+// load returns the root certificate and key described by the source.
+func (s CASource) load() (*x509.Certificate, crypto.PrivateKey) {
+	switch {
+	case s.Certificate != nil && s.PrivateKey != nil:
+		return s.Certificate, s.PrivateKey
+	case s.CertFile != "" && s.KeyFile != "":
+		return ca.LoadOrCreateCA(s.CertFile, s.KeyFile, s.Options...)
+	}
+	return ca.NewCA(s.Options...)
+}
+
+// previous returns the retired roots still published on the landing page.
+func (s CASource) previous() []ca.Previous {
+	if s.Certificate != nil || s.CertFile == "" {
+		return nil
+	}
+	return ca.LoadPreviousCA(s.CertFile)
+}
@@ -0,0 +1,176 @@
+package mitmproxy
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/packet"
+	"github.com/ddkwork/websocket"
+)
+
+// WebSocketRelay describes a live websocket relay.
+type WebSocketRelay struct {
+	ID     uint64    `json:"id"`
+	URL    string    `json:"url"`
+	Client string    `json:"client"`
+	Start  time.Time `json:"start"`
+}
+
+// ErrNoWebSocket is returned for the id of a relay that is not live.
+var ErrNoWebSocket = errors.New("websocket: no such relay")
+
+// WebSocketRelays lists the live websocket relays by id.
+func (p *Proxy) WebSocketRelays() []WebSocketRelay {
+	p.mu.Lock()
+	relays := make([]WebSocketRelay, 0, len(p.webSockets))
+	for id, w := range p.webSockets {
+		relays = append(relays, WebSocketRelay{
+			ID:     id,
+			URL:    w.Request.URL.String(),
+			Client: w.ClientAddr.String(),
+			Start:  w.StartTime,
+		})
+	}
+	p.mu.Unlock()
+	slices.SortFunc(relays, func(a, b WebSocketRelay) int { return cmp.Compare(a.ID, b.ID) })
+	return relays
+}
+
+// InjectWebSocket sends m on the relay id, an Inbound message goes to the
+// client and an Outbound one to the server. Data and control messages can
+// be injected, the message is emitted on the session of the relay with the
+// status injected.
+func (p *Proxy) InjectWebSocket(id uint64, m WebSocketMessage) error {
+	p.mu.Lock()
+	w, ok := p.webSockets[id]
+	p.mu.Unlock()
+	if !ok {
+		return ErrNoWebSocket
+	}
+	return w.inject(m)
+}
+
+// ControlHandler serves the control api of the proxy:
+//
+//	GET  /websockets                   the live relays as json
+//	POST /websockets/{id}/{side}       injects the body as a message to the
+//	                                   client or the server side, ?type= is
+//	                                   text, binary, ping, pong or close,
+//	                                   close takes ?code= and ?reason=
+//	                                   in place of a body
+//
+// Calls need Control.Token as a bearer token when it is set. Calls that
+// address the api by another name than localhost or an ip, and those of
+// browsers from other pages, are refused, so no web page can read or steer
+// flows through it.
+func (p *Proxy) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /websockets", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		mylog.Check(json.NewEncoder(rw).Encode(p.WebSocketRelays()))
+	})
+	mux.HandleFunc("POST /websockets/{id}/{side}", p.injectWebSocket)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if p.Control.Token != "" {
+			token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.Control.Token)) != 1 {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(rw, "bad control token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if !sameOrigin(req) {
+			http.Error(rw, "cross origin call", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
+
+// sameOrigin reports whether req comes from the api itself. It has to be
+// addressed by ip or as localhost whether a browser sent it or not, another
+// name could have been rebound to the api by a page that reads it with
+// same origin calls. A browser has to send it from a page of the api, other
+// clients send no Origin.
+func sameOrigin(req *http.Request) bool {
+	host, _, e := net.SplitHostPort(req.Host)
+	if e != nil {
+		host = strings.Trim(req.Host, "[]")
+	}
+	if host != "localhost" && net.ParseIP(host) == nil {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, e := url.Parse(origin)
+	return e == nil && u.Host == req.Host
+}
+
+var webSocketMessageTypes = map[string]packet.WebsocketMessageType{
+	"":       packet.TextMessage,
+	"text":   packet.TextMessage,
+	"binary": packet.BinaryMessage,
+	"ping":   packet.PingMessage,
+	"pong":   packet.PongMessage,
+	"close":  packet.CloseMessage,
+}
+
+func (p *Proxy) injectWebSocket(rw http.ResponseWriter, req *http.Request) {
+	id, e := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if e != nil {
+		http.Error(rw, "bad relay id", http.StatusBadRequest)
+		return
+	}
+	var m WebSocketMessage
+	switch req.PathValue("side") {
+	case "client":
+		m.StreamDirection = packet.Inbound
+	case "server":
+		m.StreamDirection = packet.Outbound
+	default:
+		http.Error(rw, "side is client or server", http.StatusBadRequest)
+		return
+	}
+	query := req.URL.Query()
+	var ok bool
+	if m.Type, ok = webSocketMessageTypes[query.Get("type")]; !ok {
+		http.Error(rw, "type is text, binary, ping, pong or close", http.StatusBadRequest)
+		return
+	}
+	m.Payload, e = io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if e != nil {
+		http.Error(rw, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.Type == packet.CloseMessage {
+		code := websocket.CloseNormalClosure
+		if s := query.Get("code"); s != "" {
+			if code, e = strconv.Atoi(s); e != nil {
+				http.Error(rw, "bad close code", http.StatusBadRequest)
+				return
+			}
+		}
+		m.Payload = websocket.FormatCloseMessage(code, query.Get("reason"))
+	}
+	switch e = p.InjectWebSocket(id, m); {
+	case errors.Is(e, ErrNoWebSocket):
+		http.Error(rw, e.Error(), http.StatusNotFound)
+	case e != nil:
+		http.Error(rw, e.Error(), http.StatusBadGateway)
+	default:
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
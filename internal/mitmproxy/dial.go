@@ -0,0 +1,239 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/proxyproto"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// dialerFunc adapts a function to the socks.Dialer interface.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+type sessionKey struct{}
+
+// withSession records the session an upstream connection is dialed for.
+func withSession(ctx context.Context, s *packet.Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionDialer dials upstreams on behalf of s and records the address
+// they were reached at.
+func (p *Proxy) sessionDialer(s *packet.Session) dialerFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, e := p.dialContext(withSession(ctx, s), network, addr)
+		if e == nil {
+			s.ResolvedIP = remoteIP(conn)
+		}
+		return conn, e
+	}
+}
+
+// dialContext opens every upstream connection of the proxy.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, _ := ctx.Value(sessionKey{}).(*packet.Session)
+	conn, e := p.dialResolved(ctx, s, network, addr)
+	if e != nil || p.ProxyHeaders.Upstream == 0 {
+		return conn, e
+	}
+	if _, e := upstreamHeader(p.ProxyHeaders.Upstream, s).WriteTo(conn); e != nil {
+		mylog.CheckIgnore(conn.Close())
+		return nil, e
+	}
+	return conn, nil
+}
+
+// dialResolved resolves addr with the resolver of the proxy and connects to
+// the first of its addresses the ACL allows, so that network rules apply
+// to names too.
+func (p *Proxy) dialResolved(ctx context.Context, s *packet.Session, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:   p.Timeouts.Dial,
+		KeepAlive: p.Timeouts.Dial,
+	}
+	return dialAllowed(ctx, p, s, network, addr, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	})
+}
+
+// dialAllowed resolves addr and calls dial with each of its addresses the
+// ACL allows until one succeeds.
+func dialAllowed[C any](ctx context.Context, p *Proxy, s *packet.Session, network, addr string, dial func(ctx context.Context, addr string) (C, error)) (C, error) {
+	var conn C
+	host, portString, e := net.SplitHostPort(addr)
+	if e != nil {
+		return conn, e
+	}
+	port, e := strconv.ParseUint(portString, 10, 16)
+	if e != nil {
+		return conn, e
+	}
+	ips, e := p.lookup(ctx, network, host)
+	if e != nil {
+		return conn, e
+	}
+	var scheme httpClient.SchemerType
+	if s != nil {
+		scheme = s.SchemerType
+	}
+	var err error
+	for _, ip := range ips {
+		if p.ACL.filtersDestinations() {
+			if e := p.ACL.allow(scheme, socks.ConnectCommand, host, ip, uint16(port)); e != nil {
+				if err == nil {
+					err = e
+				}
+				continue
+			}
+		}
+		conn, e := dial(ctx, netip.AddrPortFrom(ip, uint16(port)).String())
+		if e == nil {
+			return conn, nil
+		}
+		if err == nil || errors.Is(err, packet.ErrDenied) {
+			err = e
+		}
+	}
+	return conn, err
+}
+
+// environmentProxy is http.ProxyFromEnvironment, which reads the
+// environment once per process, tests replace it.
+var environmentProxy = http.ProxyFromEnvironment
+
+// upstreamProxy is the Proxy of the http transports, nil unless
+// Config.ProxyFromEnvironment is set.
+func (p *Proxy) upstreamProxy() func(*http.Request) (*url.URL, error) {
+	if !p.ProxyFromEnvironment {
+		return nil
+	}
+	return p.proxyFromEnvironment
+}
+
+// proxyFromEnvironment dials the proxy of the environment instead of the
+// target, so the ACL is checked on the target here. Every address of the
+// target has to be allowed, the other proxy picks one on its own, and a name
+// that does not resolve here is checked by name only.
+func (p *Proxy) proxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	u, e := environmentProxy(req)
+	if u == nil || e != nil || !p.ACL.filtersDestinations() {
+		return u, e
+	}
+	portString := req.URL.Port()
+	if portString == "" {
+		portString = "80"
+		if req.URL.Scheme == "https" {
+			portString = "443"
+		}
+	}
+	port, e := strconv.ParseUint(portString, 10, 16)
+	if e != nil {
+		return nil, e
+	}
+	var scheme httpClient.SchemerType
+	if s, ok := req.Context().Value(sessionKey{}).(*packet.Session); ok {
+		scheme = s.SchemerType
+	}
+	host := req.URL.Hostname()
+	ips, e := p.lookup(req.Context(), "tcp", host)
+	if e != nil {
+		ips = []netip.Addr{{}}
+	}
+	for _, ip := range ips {
+		if e := p.ACL.allow(scheme, socks.ConnectCommand, host, ip, uint16(port)); e != nil {
+			return nil, e
+		}
+	}
+	return u, nil
+}
+
+// remoteIP is the address an upstream connection was made to.
+func remoteIP(conn net.Conn) netip.Addr {
+	ap, e := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if e != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// upstreamHeader describes the client of s to the next hop, connections
+// the proxy opens on its own are sent as Local.
+func upstreamHeader(version proxyproto.Version, s *packet.Session) *proxyproto.Header {
+	h := &proxyproto.Header{Version: version, Command: proxyproto.Local}
+	if s == nil || s.ClientConn == nil {
+		return h
+	}
+	h.Command = proxyproto.Proxy
+	h.Source = s.ClientAddr
+	h.Destination = s.ClientConn.LocalAddr()
+	if version == proxyproto.V2 {
+		for _, t := range slices.Sorted(maps.Keys(s.ProxyTLVs)) {
+			if proxyproto.TLVType(t) != proxyproto.TypeCRC32C { // it covers the old header
+				h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TLVType(t), Value: s.ProxyTLVs[t]})
+			}
+		}
+	}
+	return h
+}
+
+// acceptProxyHeader reads the PROXY header of a connection from a trusted
+// balancer, the returned connection reports the addresses in the header.
+func (p *Proxy) acceptProxyHeader(c net.Conn, r *bufio.Reader) (net.Conn, error) {
+	if !p.ProxyHeaders.trusts(c.RemoteAddr()) {
+		return nil, fmt.Errorf("%w: PROXY header from untrusted %s", errUnsupportedProtocol, c.RemoteAddr())
+	}
+	timeout, ok := p.Sniff.Timeouts[ProxyProtocol]
+	if !ok {
+		timeout = p.Sniff.FirstByte
+	}
+	if e := c.SetReadDeadline(time.Now().Add(timeout)); e != nil {
+		return nil, e
+	}
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+	h, e := proxyproto.Read(r)
+	if e != nil {
+		return nil, e
+	}
+	return &proxyproto.Conn{Conn: c, Header: h}, nil
+}
+
+// sourceAddr is the client address Sources are matched against, the one of
+// a PROXY header only when the peer that sent it is trusted.
+func (p *Proxy) sourceAddr(conn net.Conn) net.Addr {
+	if c, ok := conn.(*proxyproto.Conn); ok && !p.ProxyHeaders.trusts(c.Conn.RemoteAddr()) {
+		return c.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+// trusts reports whether addr may send PROXY headers.
+func (h ProxyHeaders) trusts(addr net.Addr) bool {
+	ap, e := netip.ParseAddrPort(addr.String())
+	if e != nil {
+		return false
+	}
+	for _, prefix := range h.Trusted {
+		if prefix.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package mitmproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+)
+
+type (
+	// Forward relays every connection accepted on Listen to Target as raw
+	// tcp, for protocols that do not say where they are going. The
+	// connections are captured and dissected like any other tunnel.
+	Forward struct {
+		// Listen is the local host:port, like 127.0.0.1:6380.
+		Listen string
+		// Target is the upstream host:port, like redis.internal:6379.
+		Target string
+		// TerminateTLS serves tls to clients with a certificate of the CA.
+		TerminateTLS bool
+		// OriginateTLS speaks tls to Target.
+		OriginateTLS bool
+		// ServerName is the name certified to clients that send no SNI and
+		// the SNI sent to Target, empty is the host of Target.
+		ServerName string
+		// InsecureSkipVerify accepts any certificate from Target.
+		InsecureSkipVerify bool
+	}
+
+	// forwardListener is a listener of a Forward, its connections are not
+	// sniffed.
+	forwardListener struct {
+		net.Listener
+		forward Forward
+	}
+)
+
+func (f Forward) serverName() string {
+	if f.ServerName != "" {
+		return f.ServerName
+	}
+	host, _, e := net.SplitHostPort(f.Target)
+	if e != nil {
+		return f.Target
+	}
+	return host
+}
+
+// layer is TcpTlsType when either end of the forward is tls.
+func (f Forward) layer() httpClient.SchemerType {
+	if f.TerminateTLS || f.OriginateTLS {
+		return httpClient.TcpTlsType
+	}
+	return httpClient.TcpType
+}
+
+// listenForwards opens the listeners of Config.Forwards.
+func (p *Proxy) listenForwards() error {
+	for _, f := range p.Forwards {
+		if f.Target == "" {
+			return fmt.Errorf("forward %s: no target", f.Listen)
+		}
+		l, e := net.Listen("tcp", f.Listen)
+		if e != nil {
+			return fmt.Errorf("forward %s: %w", f.Listen, e)
+		}
+		mylog.Warning("Forward", l.Addr().String()+" -> "+f.Target)
+		p.listeners = append(p.listeners, &forwardListener{Listener: &onceCloseListener{Listener: l}, forward: f})
+	}
+	return nil
+}
+
+// ForwardAddrs returns the addresses the forwards are listening on, in the
+// order of Config.Forwards.
+func (p *Proxy) ForwardAddrs() []net.Addr {
+	var addrs []net.Addr
+	for _, l := range p.listeners {
+		if _, ok := l.(*forwardListener); ok {
+			addrs = append(addrs, l.Addr())
+		}
+	}
+	return addrs
+}
+
+func (p *Proxy) handleForward(conn *trackedConn, f Forward) {
+	defer p.untrack(conn)
+	TcpKeepAlive(conn.Conn)
+	tcp := &Tcp{proxy: p, Session: p.newSession(conn, newReadWriter(conn), f.layer())}
+	serve := func() error { return tcp.ServeForward(f) }
+	if e := p.ACL.allowSource(conn.RemoteAddr()); e != nil {
+		serve = func() error { return tcp.Refuse(e) }
+	}
+	mylog.Call(func() {
+		if e := serve(); e != nil && !isCloseable(e) {
+			mylog.Warning("handleForward", conn.RemoteAddr().String()+" "+e.Error())
+		}
+	})
+}
+
+// ServeForward relays a connection accepted by f, terminating and
+// originating tls as f says. The stream between the two is plain text.
+func (t *Tcp) ServeForward(f Forward) error {
+	setFlow(t.ClientConn, TunnelFlow)
+	t.Request = tcpRequest(f.Target).WithContext(t.proxy.flowCtx)
+	var client net.Conn = &PeekedConn{Conn: t.ClientConn, Reader: t.ReadWriter.Reader}
+	if f.TerminateTLS {
+		tlsConn := tls.Server(client, t.proxy.ca.NewTlsConfigForHost(f.serverName()))
+		if e := t.handshake(tlsConn); e != nil {
+			return t.fail(fmt.Errorf("tls handshake with client: %w", e))
+		}
+		client = tlsConn
+	}
+	server, e := t.dial(f.layer())
+	if e != nil {
+		return e
+	}
+	if f.OriginateTLS {
+		config := t.proxy.upstreamTLSConfig()
+		config.ServerName = f.serverName()
+		config.InsecureSkipVerify = f.InsecureSkipVerify
+		server, e = t.originate(server, config)
+		if e != nil {
+			return e
+		}
+	}
+	return t.relay(client, server)
+}
+
+func (t *Tcp) handshake(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(t.Request.Context(), t.proxy.Timeouts.TLSHandshake)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
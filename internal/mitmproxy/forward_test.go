@@ -0,0 +1,84 @@
+package mitmproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/dissect"
+	"github.com/ddkwork/mitmproxy/internal/testcert"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// echo answers every connection of l with what it receives.
+func echo(l net.Listener) {
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestForward(t *testing.T) {
+	plain := mylog.Check2(net.Listen("tcp", "127.0.0.1:0"))
+	defer plain.Close()
+	go echo(plain)
+	cert := mylog.Check2(tls.X509KeyPair(testcert.LocalhostCert, testcert.LocalhostKey))
+	secure := mylog.Check2(tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer secure.Close()
+	go echo(secure)
+
+	messages := make(chan *packet.Session, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.Dissectors = dissect.Default()
+		c.Forwards = []Forward{
+			{Listen: "127.0.0.1:0", Target: plain.Addr().String()},
+			{Listen: "127.0.0.1:0", Target: secure.Addr().String(), TerminateTLS: true, OriginateTLS: true, ServerName: "redis.test", InsecureSkipVerify: true},
+		}
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.Parent != nil {
+				messages <- s
+			}
+		}
+	})
+	assert.Equal(t, 1, len(p.Addrs()))
+	addrs := p.ForwardAddrs()
+	assert.Equal(t, 2, len(addrs))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA())
+	ping := "*1\r\n$4\r\nPING\r\n"
+	for i, tt := range []struct {
+		dial  func(addr string) net.Conn
+		layer httpClient.SchemerType
+	}{
+		{func(addr string) net.Conn { return mylog.Check2(net.Dial("tcp", addr)) }, httpClient.TcpType},
+		{func(addr string) net.Conn {
+			return mylog.Check2(tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "redis.test"}))
+		}, httpClient.TcpTlsType},
+	} {
+		conn := tt.dial(addrs[i].String())
+		mylog.Check2(io.WriteString(conn, ping))
+		buf := make([]byte, len(ping))
+		mylog.Check2(io.ReadFull(conn, buf))
+		assert.Equal(t, ping, string(buf))
+		mylog.Check(conn.Close())
+
+		for _, direction := range []packet.StreamDirection{packet.Outbound, packet.Inbound} {
+			m := <-messages
+			assert.Equal(t, direction, m.StreamDirection)
+			assert.Equal(t, "redis", m.ContentType)
+			assert.Equal(t, tt.layer, m.Parent.SchemerType)
+		}
+	}
+}
@@ -1,90 +1,148 @@
 package mitmproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/ddkwork/mitmproxy/internal/dissect"
 	"github.com/ddkwork/mitmproxy/internal/socks"
 
 	"github.com/ddkwork/mitmproxy/packet"
 )
 
 type (
+	// Handle serves one client connection, the error tells why the flow
+	// ended abnormally, it has already been answered in the protocol's own
+	// way when that was possible.
 	Handle interface {
-		Serve()
-		ServeTls()
+		Serve() error
+		ServeTls() error
 		packet.SessionEventCallBacker
 	}
 	HandleFunc func(*packet.Session)
 	WebSocket  struct {
-		err error
+		err   error
+		proxy *Proxy
+		// client and server are the legs of the relay once both are up.
+		client, server *wsLeg
+		// mu serializes the events of the two directions.
+		mu sync.Mutex
+		// subprotocol is the Sec-WebSocket-Protocol the server picked.
+		subprotocol string
+		// framing decodes the messages once a framing is picked,
+		// framingTries counts the messages tried to pick one.
+		framing      dissect.FramingParser
+		framingName  string
+		framingTries int
 		*packet.Session
 	}
 	Http struct {
+		proxy     *Proxy
 		transport http.RoundTripper
+		// reqBody and respBody keep what the session shows of the bodies.
+		reqBody, respBody *packet.Capture
+		// chunks are those of the response, nil when its connection is
+		// not followed
+		chunks  *chunkLog
+		timings timingTrace
+		// tunneled is set for the requests inside a CONNECT tunnel, the
+		// CONNECT itself was authenticated
+		tunneled bool
+		*packet.Session
+	}
+	Kcp  struct{ *packet.Session }
+	Pipe struct{ *packet.Session }
+	// Quic serves one request of a quic client, every request of a quic
+	// connection is a session of its own.
+	Quic struct {
+		proxy     *Proxy
+		transport http.RoundTripper
+		writer    http.ResponseWriter
+		// reqBody and respBody keep what the session shows of the bodies.
+		reqBody, respBody *packet.Capture
 		*packet.Session
 	}
-	Kcp     struct{ *packet.Session }
-	Pipe    struct{ *packet.Session }
-	Quic    struct{ *packet.Session }
 	Rpc     struct{ *packet.Session }
 	Socket4 struct {
+		proxy *Proxy
 		*packet.Session
 		*socks.Socks4Handler
 	}
 	Socket5 struct {
+		proxy *Proxy
 		*packet.Session
 		*socks.Socks5Handler
 	}
 	Ssh struct{ *packet.Session }
-	Tcp struct{ *packet.Session }
+	Tcp struct {
+		proxy *Proxy
+		*packet.Session
+	}
 	Udp struct{ *packet.Session }
 )
 
-func NewTcp(s *packet.Session) Handle       { return &Tcp{Session: s} }
-func NewSocket5(s *packet.Session) Handle   { return &Socket5{Session: s} }
-func NewSocket4(s *packet.Session) Handle   { return &Socket4{Session: s} }
-func NewWebSocket(s *packet.Session) Handle { return &WebSocket{Session: s} }
-func NewHttp(s *packet.Session) Handle {
+func NewTcp(p *Proxy, s *packet.Session) Handle       { return &Tcp{proxy: p, Session: s} }
+func NewSocket5(p *Proxy, s *packet.Session) Handle   { return &Socket5{proxy: p, Session: s} }
+func NewSocket4(p *Proxy, s *packet.Session) Handle   { return &Socket4{proxy: p, Session: s} }
+func NewWebSocket(p *Proxy, s *packet.Session) Handle { return &WebSocket{proxy: p, Session: s} }
+func NewHttp(p *Proxy, s *packet.Session) Handle {
 	return &Http{
-		transport: &http.Transport{
-			Proxy:                  http.ProxyFromEnvironment,
-			OnProxyConnectResponse: nil,
-			DialContext:            nil,
-			Dial:                   nil,
-			DialTLSContext:         nil,
-			DialTLS:                nil,
-			TLSClientConfig: &tls.Config{
-				GetClientCertificate: func(info *tls.CertificateRequestInfo) (certificate *tls.Certificate, e error) {
-					return nil, errClientCertRequested
-				},
+		proxy:     p,
+		transport: p.transport,
+		Session:   s,
+	}
+}
+
+// newTransport is the upstream transport shared by all HTTP flows of the proxy.
+func (p *Proxy) newTransport() http.RoundTripper {
+	t := &http.Transport{
+		Proxy:                  p.upstreamProxy(),
+		OnProxyConnectResponse: nil,
+		DialContext:            p.dialContext,
+		Dial:                   nil,
+		DialTLSContext:         nil,
+		DialTLS:                nil,
+		TLSClientConfig: &tls.Config{
+			GetClientCertificate: func(info *tls.CertificateRequestInfo) (certificate *tls.Certificate, e error) {
+				return nil, errClientCertRequested
 			},
-			TLSHandshakeTimeout:    tlsHandshakeTimeout,
-			DisableKeepAlives:      false,
-			DisableCompression:     true,
-			MaxIdleConns:           10,
-			MaxIdleConnsPerHost:    10,
-			MaxConnsPerHost:        10,
-			IdleConnTimeout:        defaultTimeout,
-			ResponseHeaderTimeout:  defaultTimeout,
-			ExpectContinueTimeout:  time.Second,
-			TLSNextProto:           make(map[string]func(string, *tls.Conn) http.RoundTripper),
-			ProxyConnectHeader:     nil,
-			GetProxyConnectHeader:  nil,
-			MaxResponseHeaderBytes: 4096 * 10,
-			WriteBufferSize:        4096 * 10,
-			ReadBufferSize:         4096 * 10,
-			ForceAttemptHTTP2:      false,
 		},
-		Session: s,
+		TLSHandshakeTimeout:    p.Timeouts.TLSHandshake,
+		DisableKeepAlives:      p.ProxyHeaders.Upstream != 0, // headers are per client
+		DisableCompression:     true,
+		MaxIdleConns:           10,
+		MaxIdleConnsPerHost:    10,
+		MaxConnsPerHost:        10,
+		IdleConnTimeout:        p.Timeouts.Idle,
+		ResponseHeaderTimeout:  p.Timeouts.ResponseHeader,
+		ExpectContinueTimeout:  time.Second,
+		TLSNextProto:           make(map[string]func(string, *tls.Conn) http.RoundTripper),
+		ProxyConnectHeader:     nil,
+		GetProxyConnectHeader:  nil,
+		MaxResponseHeaderBytes: 4096 * 10,
+		WriteBufferSize:        4096 * 10,
+		ReadBufferSize:         4096 * 10,
+		ForceAttemptHTTP2:      false,
+	}
+	if p.RecordChunks || p.PreserveChunks {
+		// chunks are seen on connections the proxy dials and decrypts
+		// itself, the tls settings are read when dialing, they may change
+		// after
+		t.DialContext = p.dialTransport
+		t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialTLS(ctx, network, addr, t.TLSClientConfig)
+		}
 	}
+	return t
 }
 
 // todo
 // func NewUdp(s *Session) Handle       { return &Udp{Session: s} }
 // func NewRpc(s *Session) Handle       { return &Rpc{Session: s} }
-// func NewQuic(s *Session) Handle      { return &Quic{Session: s} }
 // func NewPipe(s *Session) Handle      { return &Pipe{Session: s} }
 // func NewKcp(s *Session) Handle       { return &Kcp{Session: s} }
 // func NewSsh(s *Session) Handle       { return &Ssh{Session: s} }
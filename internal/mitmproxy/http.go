@@ -1,12 +1,15 @@
 package mitmproxy
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"time"
 
 	"github.com/ddkwork/mitmproxy/internal/ca"
@@ -41,150 +44,249 @@ func (h *Http) SessionEvent(session *packet.Session) {
 	mylog.Request(session.Request, false)
 }
 
-func (h *Http) Serve() {
+func (h *Http) Serve() error {
 	// defer func() { mylog.Check(h.ClientConn.Close()) }() //todo  use of closed network connection ,连接是在监听结束一次后才关闭的，这里的上一层才有关闭操作啊，why？
 	// 以下的情况可能走
 	// tcp 自己关闭请求连接
 	// wss 自己关闭请求连接
 	// https 只有这个才需要关闭，逻辑上是
 
-	mylog.Call(func() {
-		// 	for {
-		var err1 error
-		h.Request, err1 = http.ReadRequest(h.ReadWriter.Reader)
-		// if mylog.Check(err1) {
-		// 	return
-		// }
-		// if !mylog.Check(err1) {
-		// 	continue
-		// }
-		if err1 != nil {
-			return
+	setFlow(h.ClientConn, IdleFlow)
+	var e error
+	h.Request, e = http.ReadRequest(h.ReadWriter.Reader)
+	if e != nil {
+		if errors.Is(e, io.EOF) { // client closed the connection without a request
+			return nil
 		}
+		return e
+	}
+	h.timings.mark(func(t *packet.Timings) *time.Time { return &t.Start })
+	setFlow(h.ClientConn, HttpFlow)
+	h.Request = h.Request.WithContext(httptrace.WithClientTrace(withSession(h.proxy.flowCtx, h.Session), h.clientTrace()))
+	if e := h.authenticate(); e != nil {
+		return e
+	}
 
-		h.Packet.EditData = packet.EditData{ // todo
-			SchemerType:   h.Session.SchemerType,
-			Method:        h.Request.Method,
-			Host:          h.Request.URL.Host,
-			Path:          h.Request.URL.Path,
-			ContentType:   "",
-			ContentLength: 0,
-			Status:        "",
-			Note:          "",
-			Process:       "",
-			PadTime:       0,
-		}
+	h.Packet.EditData = packet.EditData{ // todo
+		SchemerType:   h.Session.SchemerType,
+		Method:        h.Request.Method,
+		Host:          h.Request.URL.Host,
+		Path:          h.Request.URL.Path,
+		ContentType:   "",
+		ContentLength: 0,
+		Status:        "",
+		Note:          "",
+		Process:       "",
+		PadTime:       0,
+	}
 
-		if packet.IsTcp(h.Request.URL.Hostname()) { // todo test steam
-			mylog.Warning("IsTcp", h.Request.URL.Hostname())
-			NewTcp(h.Session).Serve()
-		}
+	if packet.IsTcp(h.Request.URL.Hostname()) { // todo test steam
+		mylog.Warning("IsTcp", h.Request.URL.Hostname())
+		return NewTcp(h.proxy, h.Session).Serve()
+	}
 
-		aesKey := h.Request.Header.Get("aeskey")
-		if aesKey != "" {
-			h.ReqBodyDecoder.SteamAesKey = stream.NewHexDump(stream.HexDumpString(aesKey)).Bytes()
-		}
-		if websocket.IsWebSocketUpgrade(h.Request) {
-			if h.Request.URL.Host == "" {
-				h.Request.URL.Host = h.Request.Host
-			}
-			mylog.Warning("IsWebSocketUpgrade", h.Request.URL.Hostname())
-			NewWebSocket(h.Session).Serve()
+	aesKey := h.Request.Header.Get("aeskey")
+	if aesKey != "" {
+		h.ReqBodyDecoder.SteamAesKey = stream.NewHexDump(stream.HexDumpString(aesKey)).Bytes()
+	}
+	if websocket.IsWebSocketUpgrade(h.Request) {
+		if h.Request.URL.Host == "" {
+			h.Request.URL.Host = h.Request.Host
 		}
-		PrepareRequest(h.IsTls(), h.Request, h.ClientConn)
-		RemoveHopByHopHeaders(h.Request.Header)
+		mylog.Warning("IsWebSocketUpgrade", h.Request.URL.Hostname())
+		return NewWebSocket(h.proxy, h.Session).Serve()
+	}
+	PrepareRequest(h.IsTls(), h.Request, h.ClientConn)
+	RemoveHopByHopHeaders(h.Request.Header)
 
-		if h.Request.Method == http.MethodConnect { // 默认丢弃MethodConnect包不显示
-			h.ServeTls()
-		}
+	if h.Request.Method == http.MethodConnect { // 默认丢弃MethodConnect包不显示
+		return h.ServeTls()
+	}
 
-		h.StreamDirection = packet.Inbound
-		if h.SchemerType != httpClient.HttpsType {
-			h.SchemerType = httpClient.HttpType
-		}
-		h.Packet = packet.MakeHttpRequestPacket(h.Request, h.Process, h.SchemerType) // invalid Read on closed Row
-		if h.Request.Body != nil {
-			mylog.Check(h.Request.Body.Close())
+	h.StreamDirection = packet.Inbound
+	if h.SchemerType != httpClient.HttpsType {
+		h.SchemerType = httpClient.HttpType
+	}
+	// bodies stream through, the session keeps what BodyCapture allows
+	h.reqBody, h.respBody = h.proxy.newCapture(), h.proxy.newCapture()
+	if h.Request.Body != nil && h.Request.Body != http.NoBody {
+		h.Request.Body = packet.TeeBody(h.Request.Body, h.reqBody)
+	}
+
+	if CanonicalHost(h.Request.URL.Host) == ca.LandingHost {
+		h.Response = serveLocal(h.proxy.landing, h.Request)
+	} else {
+		h.Response, e = h.transport.RoundTrip(h.Request)
+		if e != nil {
+			h.Err = e
+			h.Response = packet.NewErrorResponse(h.Request, e)
 		}
+	}
 
-		h.Response = mylog.Check2(h.transport.RoundTrip(h.Request))
+	h.proxy.stripAltSvc(h.Response)
+	h.Status = h.Response.Status
+	// if h.EventCallBack == nil {
+	// 	h.SessionEvent(h.Session)
+	// } else {
+	// 	h.EventCallBack(h.Session)
+	// }
 
-		h.Status = h.Response.Status
-		// if h.EventCallBack == nil {
-		// 	h.SessionEvent(h.Session)
-		// } else {
-		// 	h.EventCallBack(h.Session)
-		// }
+	return h.writeResponse()
+}
 
-		h.StreamDirection = packet.Outbound
-		h.Packet = packet.MakeHttpResponsePacket(h.Response, h.SchemerType)
-		if h.EventCallBack == nil {
-			h.SessionEvent(h.Session)
-		} else {
-			// 这里gui不应该创建节点显示，应该保存返回的body和头部供给选中行事件显示，
-			// 同样上面的请求也是一样的，应该保存请的body和头部给选中行事件调用显示请求信息
-			h.EventCallBack(h.Session)
-		}
-		packet.WriteResponse(h.Response, h.ReadWriter)
-		mylog.Check(h.Response.Body.Close())
-		// 	}
-	})
+// emitResponse reports the response with what was captured of the bodies
+// so far.
+func (h *Http) emitResponse() {
+	h.StreamDirection = packet.Outbound
+	h.Packet = packet.MakeCapturedResponsePacket(h.Response, h.SchemerType, h.respBody)
+	h.ReqBodyDecoder = packet.MakeCapturedRequestPacket(h.Request, h.Process, h.SchemerType, h.reqBody).ReqBodyDecoder
+	h.ReqBodyDecoder.Trailer = h.Request.Trailer
+	h.Timings = h.timings.Timings()
+	h.PadTime = time.Since(h.Timings.Start)
+	if !h.Timings.Done.IsZero() {
+		h.PadTime = h.Timings.Total()
+	}
+	h.RespBodyDecoder.Chunks = h.chunks.Chunks()
+	h.RespBodyDecoder.Trailer = h.Response.Trailer
+	if h.EventCallBack == nil {
+		h.SessionEvent(h.Session)
+	} else {
+		// 这里gui不应该创建节点显示，应该保存返回的body和头部供给选中行事件显示，
+		// 同样上面的请求也是一样的，应该保存请的body和头部给选中行事件调用显示请求信息
+		h.EventCallBack(h.Session)
+	}
 }
 
-func (h *Http) ServeTls() {
+func (h *Http) ServeTls() error {
 	if h.Request == nil {
-		h.Request = mylog.Check2(http.NewRequest(http.MethodConnect, "http://"+ca.ProxyServeAddress(), nil))
+		h.Request = mylog.Check2(http.NewRequest(http.MethodConnect, "http://"+h.ClientConn.LocalAddr().String(), nil))
 	}
 
 	// defer func() { mylog.CheckIgnore(h.ClientConn.Close()) }() // todo  use of closed network connection ,连接是在监听结束一次后才关闭的，这里的上一层才有关闭操作啊，why？
 	h.Response = packet.NewResponse(http.StatusOK, nil, h.Request)
-	packet.WriteResponse(h.Response, h.ReadWriter)
-	mylog.Check(h.Response.Body.Close())
+	if e := packet.WriteResponse(h.Response, h.ReadWriter); e != nil {
+		return e
+	}
+	mylog.CheckIgnore(h.Response.Body.Close())
 	h.Packet = packet.MakeHttpResponsePacket(h.Response, h.SchemerType)
 	h.StreamDirection = packet.Outbound
 	if packet.IsTcp(h.Request.URL.Hostname()) {
 		// mylog.Warning("IsTcp", h.Request.URL.Hostname())
 		// h.SchemerType = httpClient.TcpType
-		// NewTcp(h.Session).Serve()
+		// NewTcp(h.proxy, h.Session).Serve()
 	}
 
-	b := make([]byte, 1)
-	mylog.Check2(h.ReadWriter.Read(b))
-	buf := make([]byte, h.ReadWriter.Reader.Buffered())
-	mylog.Check2(h.ReadWriter.Read(buf))
-	// s := stream.NewBuffer(b)
-	// s.Write(buf)
-	// mylog.HexDump("", s.Bytes())
+	// the tunnel may carry anything, http is only served when it looks like
+	// http and the rest is relayed as it is
+	target := h.Request.URL.Host
+	protocol, e := h.proxy.Sniff.Sniff(h.ClientConn, h.ReadWriter.Reader)
+	if e != nil {
+		if errors.Is(e, io.EOF) {
+			return nil
+		}
+		return e
+	}
+	peekConn := &PeekedConn{Conn: h.ClientConn, Reader: h.ReadWriter.Reader}
+	// the sessions of the tunnel belong to the user of the CONNECT
+	user := h.User
+	h.tunneled = true
+	if protocol != TlsProtocol {
+		h.Session = h.proxy.newSession(peekConn, newReadWriter(peekConn), httpClient.HttpType)
+		h.User = user
+		if protocol != HttpProtocol {
+			return (&Tcp{proxy: h.proxy, Session: h.Session}).Forward(target)
+		}
+		return h.Serve()
+	}
 
-	peekConn := &PeekedConn{
-		Conn:   h.ClientConn,
-		Reader: io.MultiReader(bytes.NewReader(b), bytes.NewReader(buf), h.ClientConn),
+	mylog.Hex(h.Request.URL.String(), layers.TLSHandshake)
+	tlsClientConn := tls.Server(peekConn, h.proxy.ca.NewTlsConfigForHost(h.Request.URL.Host))
+	h.timings.mark(func(t *packet.Timings) *time.Time { return &t.ClientTLSStart })
+	e = tlsClientConn.Handshake()
+	h.timings.mark(func(t *packet.Timings) *time.Time { return &t.ClientTLSDone })
+	if e != nil {
+		// the client refused our certificate, show the CONNECT as failed
+		h.Err = fmt.Errorf("tls handshake with client: %w", e)
+		h.Timings = h.timings.Timings()
+		if h.EventCallBack == nil {
+			h.SessionEvent(h.Session)
+		} else {
+			h.EventCallBack(h.Session)
+		}
+		return h.Err
+	}
+	h.Session = h.proxy.newSession(tlsClientConn, newReadWriter(tlsClientConn), httpClient.HttpsType)
+	h.User = user
+	if protocol, e = h.proxy.Sniff.Sniff(tlsClientConn, h.ReadWriter.Reader); e != nil {
+		if errors.Is(e, io.EOF) {
+			return nil
+		}
+		return e
+	}
+	if protocol != HttpProtocol { // like imaps or mqtt over tls
+		tcp := &Tcp{proxy: h.proxy, Session: h.Session}
+		tcp.Request = tcpRequest(target).WithContext(h.proxy.flowCtx)
+		return tcp.ServeTls()
 	}
+	return h.Serve()
+}
 
-	// tls 套件解析  todo
+func newReadWriter(conn net.Conn) *bufio.ReadWriter {
+	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+}
 
-	// conn := tls.Client(peekConn, ca.Cfg.NewTlsConfigForHost(h.Request.URL.Host))
-	// clientHello, context := mylog.Check3(conn.readClientHello())
-	// mylog.Check(conn.serverHandshake(context.Background())) // http不设置证书代理https流量，所有协议只需一个监听端口
+// newCapture returns the capture of one http body.
+func (p *Proxy) newCapture() *packet.Capture {
+	return &packet.Capture{Limit: p.BodyCapture.Limit, SpillDir: p.BodyCapture.SpillDir}
+}
 
-	layer := layers.TLSType(b[0])
-	if layer == layers.TLSHandshake {
-		mylog.Hex(h.Request.URL.String(), layer)
-		var tlsClientConn *tls.Conn
+// removeSpills deletes the spill files of an exchange whose session was
+// emitted, unless BodyCapture keeps them.
+func (p *Proxy) removeSpills(captures ...*packet.Capture) {
+	if p.BodyCapture.KeepSpills {
+		return
+	}
+	for _, c := range captures {
+		if e := c.Remove(); e != nil {
+			mylog.Warning("capture", e.Error())
+		}
+	}
+}
 
-		tlsClientConn = tls.Server(peekConn, ca.Cfg.NewTlsConfigForHost(h.Request.URL.Host))
-		// hello, _ := mylog.Check3(tlsClientConn.ClientHello())
-		// mylog.Check(tlsClientConn.ServerHandshake(hello))
-		mylog.Check(tlsClientConn.Handshake())
+// localResponse is the http.ResponseWriter of a handler served inside the
+// proxy, it keeps what the handler wrote for the response of the flow.
+type localResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
 
-		// ServerHandshake use top todo
-		// mylog.Success("https Handshake Success", h.Request.Method, " ", h.Request.URL.String())
-		h.Session = packet.NewSession(tlsClientConn, httpClient.HttpsType, h.EventCallBack)
-		h.Serve()
-		return
+func (w *localResponse) Header() http.Header { return w.header }
+
+func (w *localResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *localResponse) Write(p []byte) (int, error) {
+	if w.status == 0 && w.header.Get("Content-Type") == "" {
+		w.header.Set("Content-Type", http.DetectContentType(p))
 	}
-	h.Session = packet.NewSession(peekConn, httpClient.HttpType, h.EventCallBack)
-	h.Serve()
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// serveLocal answers the request with a handler inside the proxy instead of
+// forwarding it upstream.
+func serveLocal(handler http.Handler, req *http.Request) *http.Response {
+	w := &localResponse{header: make(http.Header)}
+	handler.ServeHTTP(w, req)
+	w.WriteHeader(http.StatusOK)
+	res := packet.NewResponse(w.status, &w.body, req)
+	res.Header = w.header
+	res.ContentLength = int64(w.body.Len())
+	return res
 }
 
 func PrepareRequest(IsTls bool, request *http.Request, ClientConn net.Conn) {
@@ -0,0 +1,165 @@
+package mitmproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/ca"
+	"github.com/ddkwork/mitmproxy/internal/testcert"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestBodyCapture(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.Copy(w, r.Body))
+	}))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1)
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	for _, tt := range []struct {
+		name     string
+		spillDir string
+		keep     bool
+	}{
+		{"truncated", "", false},
+		{"spilled", t.TempDir(), false},
+		{"kept", t.TempDir(), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := make(chan *packet.Session, 1)
+			spilled := make(chan bool, 1)
+			p := newTestProxy(t, func(c *Config) {
+				c.BodyCapture = BodyCapture{Limit: 1024, SpillDir: tt.spillDir, KeepSpills: tt.keep}
+				c.SessionEventCallBack = func(s *packet.Session) {
+					// the files are there while the session is emitted
+					whole := true
+					for _, d := range []packet.BodyDecoder{s.ReqBodyDecoder, s.RespBodyDecoder} {
+						if d.SpillFile != "" {
+							b, e := os.ReadFile(d.SpillFile)
+							whole = whole && e == nil && bytes.Equal(body, b)
+						}
+					}
+					spilled <- whole
+					sessions <- s
+				}
+			})
+			resp := mylog.Check2(proxyClient(p).Post(target+"/echo", "application/octet-stream", bytes.NewReader(body)))
+			got := mylog.Check2(io.ReadAll(resp.Body))
+			mylog.Check(resp.Body.Close())
+			assert.True(t, bytes.Equal(body, got))
+
+			assert.True(t, <-spilled)
+			s := <-sessions
+			for _, d := range []packet.BodyDecoder{s.ReqBodyDecoder, s.RespBodyDecoder} {
+				assert.Equal(t, int64(len(body)), d.Size)
+				assert.Equal(t, int64(1024), d.CapturedSize)
+				assert.True(t, d.Truncated)
+				assert.True(t, bytes.Equal(body[:1024], d.Payload))
+				assert.Equal(t, tt.spillDir != "", d.SpillFile != "")
+			}
+			if tt.spillDir == "" {
+				return
+			}
+			// the exchange is over once the client has the whole response,
+			// the proxy removes the files right after
+			var files []os.DirEntry
+			for range 50 {
+				if files = mylog.Check2(os.ReadDir(tt.spillDir)); (len(files) == 2) == tt.keep {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Equal(t, tt.keep, len(files) == 2)
+			if tt.keep {
+				assert.True(t, bytes.Equal(body, mylog.Check2(os.ReadFile(s.RespBodyDecoder.SpillFile))))
+			} else {
+				assert.Equal(t, 0, len(files))
+			}
+		})
+	}
+}
+
+func TestTimings(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		mylog.Check2(io.WriteString(w, "timed"))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{mylog.Check2(tls.X509KeyPair(testcert.LocalhostCert, testcert.LocalhostKey))}}
+	backend.StartTLS()
+	defer backend.Close()
+	target := strings.Replace(backend.URL, httpClient.Localhost, "example.com", 1)
+
+	sessions := make(chan *packet.Session, 2)
+	p := newTestProxy(t, func(c *Config) {
+		c.DNS.Hosts = map[string][]netip.Addr{"example.com": {netip.MustParseAddr("127.0.0.1")}}
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+	})
+	upstream := x509.NewCertPool()
+	upstream.AppendCertsFromPEM(testcert.LocalhostCert)
+	p.transport.(*http.Transport).TLSClientConfig.RootCAs = upstream
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA())
+	proxyURL := mylog.Check2(url.Parse("http://" + p.Addrs()[0].String()))
+	// a client asking to close makes the proxy close upstream too
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	for _, reused := range []bool{false, true} {
+		resp := mylog.Check2(client.Get(target + "/timed"))
+		mylog.Check2(io.ReadAll(resp.Body))
+		mylog.Check(resp.Body.Close())
+
+		s := <-sessions
+		timings := s.Timings
+		assert.Equal(t, reused, timings.Reused)
+		phases := []time.Time{timings.ClientTLSStart, timings.ClientTLSDone, timings.Start}
+		if !reused {
+			phases = append(phases, timings.DNSStart, timings.DNSDone, timings.ConnectStart,
+				timings.ConnectDone, timings.TLSStart, timings.TLSDone)
+		} else {
+			assert.Equal(t, time.Duration(-1), timings.Connect())
+		}
+		phases = append(phases, timings.GotConn, timings.WroteRequest, timings.FirstByte, timings.Done)
+		for i, phase := range phases {
+			assert.True(t, !phase.IsZero())
+			if i > 0 {
+				assert.True(t, !phase.Before(phases[i-1]))
+			}
+		}
+		assert.True(t, timings.Wait() >= 20*time.Millisecond)
+		assert.Equal(t, timings.Total(), s.PadTime)
+	}
+}
+
+func TestLanding(t *testing.T) {
+	sessions := make(chan *packet.Session, 1)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+	})
+	resp := mylog.Check2(proxyClient(p).Get("http://" + ca.LandingHost + "/cert/pem"))
+	body := mylog.Check2(io.ReadAll(resp.Body))
+	mylog.Check(resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.True(t, bytes.Contains(body, []byte("BEGIN CERTIFICATE")))
+
+	s := <-sessions
+	assert.Equal(t, "200 OK", s.Status)
+	assert.True(t, bytes.Equal(body, s.RespBodyDecoder.Payload))
+}
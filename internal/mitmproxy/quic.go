@@ -0,0 +1,364 @@
+package mitmproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/ca"
+	"github.com/ddkwork/mitmproxy/packet"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type (
+	// HTTP3 configures the udp listeners that terminate quic with
+	// certificates of the CA and serve http/3 to clients. Requests go
+	// upstream over http/3 and over tcp to servers that do not answer quic.
+	// Quic clients cannot log in, Listen fails when Auth is enabled too.
+	HTTP3 struct {
+		Enabled bool
+		// Addrs are the udp listen addresses, empty listens on the port of
+		// every tcp address of the proxy.
+		Addrs []string
+		// TCPUpstream sends every request upstream over tcp. Upstream tcp
+		// connections of quic clients negotiate http/2 when the server
+		// offers it.
+		TCPUpstream bool
+		// StripAltSvc removes Alt-Svc from every response, over tcp too, so
+		// clients never learn about http/3 and stay on tcp.
+		StripAltSvc bool
+	}
+
+	// quicTransport sends requests over http/3 and falls back to tcp
+	// for servers whose quic handshake fails.
+	quicTransport struct {
+		h3  *http3.Transport
+		tcp http.RoundTripper
+
+		mu sync.Mutex
+		// tcpOnly are the hosts quic failed for, until when they are not
+		// tried again
+		tcpOnly map[string]time.Time
+	}
+
+	// quicDialError is a quic handshake that failed, no request went out.
+	quicDialError struct{ err error }
+
+	// quicClient is the client connection of the sessions of a quic
+	// connection. Its streams are served by http3, it only has addresses.
+	quicClient struct{ conn *quic.Conn }
+
+	quicConnKey struct{}
+
+	// untouchedBody is a request body that may be sent again as long as
+	// nothing read it, like after a quic handshake failed. Closing it before
+	// it was read leaves it open for the next try.
+	untouchedBody struct {
+		io.ReadCloser
+		touched atomic.Bool
+	}
+)
+
+// quicRetry is how long a host whose quic handshake failed is reached over
+// tcp only.
+const quicRetry = 10 * time.Minute
+
+var (
+	errQuicClient = errors.New("quic: streams are served by http3")
+	// errQuicAuth refuses HTTP3 next to Auth, quic clients have no
+	// CONNECT to log in with.
+	errQuicAuth = errors.New("http3: quic clients cannot authenticate to the proxy")
+	errBodySent = errors.New("http3: the request body was already sent")
+)
+
+func (e *quicDialError) Error() string { return "quic: " + e.err.Error() }
+func (e *quicDialError) Unwrap() error { return e.err }
+
+func (b *untouchedBody) Read(p []byte) (int, error) {
+	b.touched.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *untouchedBody) Close() error {
+	if !b.touched.Load() {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+func (c quicClient) Read([]byte) (int, error)         { return 0, errQuicClient }
+func (c quicClient) Write([]byte) (int, error)        { return 0, errQuicClient }
+func (c quicClient) Close() error                     { return c.conn.CloseWithError(0, "") }
+func (c quicClient) LocalAddr() net.Addr              { return c.conn.LocalAddr() }
+func (c quicClient) RemoteAddr() net.Addr             { return c.conn.RemoteAddr() }
+func (c quicClient) SetDeadline(time.Time) error      { return nil }
+func (c quicClient) SetReadDeadline(time.Time) error  { return nil }
+func (c quicClient) SetWriteDeadline(time.Time) error { return nil }
+
+// newQuicServer makes the http/3 server of the listeners of HTTP3.
+func (p *Proxy) newQuicServer() *http3.Server {
+	return &http3.Server{
+		TLSConfig:   p.ca.NewTlsConfigForHost(""),
+		QUICConfig:  &quic.Config{HandshakeIdleTimeout: p.Timeouts.TLSHandshake, MaxIdleTimeout: p.Timeouts.Idle},
+		Handler:     http.HandlerFunc(p.serveQuic),
+		IdleTimeout: p.Timeouts.Idle,
+		ConnContext: func(ctx context.Context, c *quic.Conn) context.Context {
+			return context.WithValue(ctx, quicConnKey{}, c)
+		},
+	}
+}
+
+// newQuicTransport is the upstream transport of the requests of quic
+// clients, it shares the tls settings of the tcp transport.
+func (p *Proxy) newQuicTransport() http.RoundTripper {
+	tcp := p.newQuicTCPTransport()
+	if p.HTTP3.TCPUpstream {
+		return tcp
+	}
+	h3 := &http3.Transport{
+		QUICConfig:             &quic.Config{HandshakeIdleTimeout: p.Timeouts.Dial, MaxIdleTimeout: p.Timeouts.Idle},
+		Dial:                   p.dialQuic,
+		MaxResponseHeaderBytes: 4096 * 10,
+		DisableCompression:     true,
+	}
+	if t, ok := p.transport.(*http.Transport); ok {
+		h3.TLSClientConfig = t.TLSClientConfig
+	}
+	return &quicTransport{h3: h3, tcp: tcp, tcpOnly: make(map[string]time.Time)}
+}
+
+// newQuicTCPTransport is a copy of the tcp transport that may negotiate
+// http/2, quic clients already multiplex their requests and the tcp clients
+// stay on http/1.1. Recorded chunks dial tls themselves and keep http/1.1.
+func (p *Proxy) newQuicTCPTransport() http.RoundTripper {
+	t, ok := p.transport.(*http.Transport)
+	if !ok {
+		return p.transport
+	}
+	tcp := t.Clone()
+	tcp.TLSNextProto = nil
+	tcp.ForceAttemptHTTP2 = true
+	return tcp
+}
+
+// dialQuic opens the upstream quic connections of the proxy, resolved and
+// filtered like the tcp ones.
+func (p *Proxy) dialQuic(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	s, _ := ctx.Value(sessionKey{}).(*packet.Session)
+	conn, e := dialAllowed(ctx, p, s, "udp", addr, func(ctx context.Context, addr string) (*quic.Conn, error) {
+		return quic.DialAddrEarly(ctx, addr, tlsConfig, config)
+	})
+	if e != nil {
+		return nil, &quicDialError{err: e}
+	}
+	return conn, nil
+}
+
+func (t *quicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	t.mu.Lock()
+	until, tcpOnly := t.tcpOnly[host]
+	if tcpOnly && time.Now().After(until) {
+		delete(t.tcpOnly, host)
+		tcpOnly = false
+	}
+	t.mu.Unlock()
+	if tcpOnly {
+		return t.tcp.RoundTrip(req)
+	}
+	resp, e := t.h3.RoundTrip(req)
+	var dialErr *quicDialError
+	if e == nil || !errors.As(e, &dialErr) || req.Context().Err() != nil {
+		return resp, e
+	}
+	mylog.Warning("quic", host+" "+e.Error()+", falling back to tcp")
+	t.mu.Lock()
+	t.tcpOnly[host] = time.Now().Add(quicRetry)
+	t.mu.Unlock()
+	if req.GetBody != nil { // the failed round trip closed the body
+		body, e := req.GetBody()
+		if e != nil {
+			return nil, e
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.tcp.RoundTrip(req)
+}
+
+func (t *quicTransport) CloseIdleConnections() {
+	mylog.CheckIgnore(t.h3.Close())
+	if c, ok := t.tcp.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// listenQuic opens the udp listeners of HTTP3.
+func (p *Proxy) listenQuic() error {
+	if !p.HTTP3.Enabled {
+		return nil
+	}
+	if p.Auth.enabled() {
+		return errQuicAuth
+	}
+	addrs := p.HTTP3.Addrs
+	if len(addrs) == 0 {
+		for _, addr := range p.Addrs() {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	for _, addr := range addrs {
+		conn, e := net.ListenPacket("udp", addr)
+		if e != nil {
+			return e
+		}
+		mylog.Warning("HTTP3", conn.LocalAddr().String())
+		p.packetConns = append(p.packetConns, conn)
+	}
+	p.h3 = p.newQuicServer()
+	return nil
+}
+
+// QuicAddrs returns the udp addresses http/3 is served on.
+func (p *Proxy) QuicAddrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(p.packetConns))
+	for _, conn := range p.packetConns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	return addrs
+}
+
+// serveQuic serves one request of a quic client as a session of its own.
+func (p *Proxy) serveQuic(w http.ResponseWriter, r *http.Request) {
+	conn, _ := r.Context().Value(quicConnKey{}).(*quic.Conn)
+	q := &Quic{
+		proxy:     p,
+		transport: p.quicTransport,
+		writer:    w,
+		Session:   p.newSession(quicClient{conn: conn}, nil, httpClient.QuicType),
+	}
+	q.Request = r
+	mylog.Call(func() {
+		if e := q.Serve(); e != nil && !isCloseable(e) {
+			mylog.Warning("serveQuic", r.RemoteAddr+" "+e.Error())
+		}
+	})
+}
+
+func (q *Quic) SessionEvent(session *packet.Session) {
+	if session.StreamDirection == packet.Outbound {
+		mylog.Response(session.Response, false)
+		return
+	}
+	mylog.Request(session.Request, false)
+}
+
+// Serve relays the request of the session upstream and writes the response
+// back to the client, the bodies stream through like those of Http.
+func (q *Quic) Serve() error {
+	q.Request = q.Request.Clone(httptrace.WithClientTrace(withSession(q.Request.Context(), q.Session), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { q.ResolvedIP = remoteIP(info.Conn) },
+	}))
+	q.Request.RequestURI = ""
+	q.Request.URL.Scheme = "https"
+	q.Request.URL.Host = q.Request.Host
+	RemoveHopByHopHeaders(q.Request.Header)
+	q.Method, q.Host, q.Path = q.Request.Method, q.Request.URL.Host, q.Request.URL.Path
+	q.reqBody, q.respBody = q.proxy.newCapture(), q.proxy.newCapture()
+	if q.Request.Body != nil && q.Request.Body != http.NoBody {
+		body := &untouchedBody{ReadCloser: packet.TeeBody(q.Request.Body, q.reqBody)}
+		q.Request.Body = body
+		q.Request.GetBody = func() (io.ReadCloser, error) {
+			if body.touched.Load() {
+				return nil, errBodySent
+			}
+			return body, nil
+		}
+	}
+
+	denied := q.proxy.ACL.allowSource(q.ClientAddr)
+	switch {
+	case denied != nil:
+		q.Err = denied
+		q.Response = packet.NewErrorResponse(q.Request, q.Err)
+	case CanonicalHost(q.Request.URL.Host) == ca.LandingHost:
+		q.Response = serveLocal(q.proxy.landing, q.Request)
+	default:
+		var e error
+		if q.Response, e = q.transport.RoundTrip(q.Request); e != nil {
+			q.Err = e
+			q.Response = packet.NewErrorResponse(q.Request, e)
+		}
+	}
+	q.proxy.stripAltSvc(q.Response)
+	RemoveHopByHopHeaders(q.Response.Header)
+	return q.writeResponse()
+}
+
+// emitResponse reports the response with what was captured of the bodies
+// so far.
+func (q *Quic) emitResponse() {
+	q.Packet = packet.MakeCapturedResponsePacket(q.Response, q.SchemerType, q.respBody)
+	q.ReqBodyDecoder = packet.MakeCapturedRequestPacket(q.Request, q.Process, q.SchemerType, q.reqBody).ReqBodyDecoder
+	q.Status = q.Response.Status
+	q.StreamDirection = packet.Outbound
+	if q.EventCallBack == nil {
+		q.SessionEvent(q.Session)
+	} else {
+		q.EventCallBack(q.Session)
+	}
+}
+
+// writeResponse streams the response to the client as it arrives, event
+// streams are emitted first and their events as children like in
+// Http.writeResponse.
+func (q *Quic) writeResponse() error {
+	body := q.Response.Body
+	defer func() { mylog.CheckIgnore(body.Close()) }()
+	defer q.proxy.removeSpills(q.reqBody, q.respBody)
+	controller := http.NewResponseController(q.writer)
+	r := &flushingReader{src: packet.TeeBody(body, q.respBody), flush: controller.Flush}
+	eventStream := isEventStream(q.Response)
+	if eventStream {
+		q.emitResponse()
+		r.events = newEventWriter(q.Session, q.SessionEvent)
+		defer closeEvents(r.events)
+	}
+	header := q.writer.Header()
+	for k, v := range q.Response.Header {
+		header[k] = v
+	}
+	q.writer.WriteHeader(q.Response.StatusCode)
+	_, e := io.Copy(writerOnly{q.writer}, r)
+	if e == nil {
+		e = controller.Flush()
+	}
+	if !eventStream {
+		q.emitResponse()
+	}
+	if e != nil {
+		return e
+	}
+	return q.Err
+}
+
+// ServeTls is Serve, quic is always encrypted.
+func (q *Quic) ServeTls() error { return q.Serve() }
+
+// stripAltSvc removes the http/3 announcement of a response when HTTP3 says
+// so.
+func (p *Proxy) stripAltSvc(resp *http.Response) {
+	if p.HTTP3.StripAltSvc {
+		resp.Header.Del("Alt-Svc")
+	}
+}
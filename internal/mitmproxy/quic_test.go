@@ -0,0 +1,103 @@
+package mitmproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/testcert"
+	"github.com/ddkwork/mitmproxy/packet"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	cert := mylog.Check2(tls.X509KeyPair(testcert.LocalhostCert, testcert.LocalhostKey))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":443"`)
+		body := mylog.Check2(io.ReadAll(r.Body))
+		mylog.Check2(io.WriteString(w, r.Proto+" "+r.Method+" "+r.URL.Path+" "+string(body)))
+	})
+	h3 := &http3.Server{Handler: handler, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	udp := mylog.Check2(net.ListenPacket("udp", "127.0.0.1:0"))
+	go func() { _ = h3.Serve(udp) }()
+	defer h3.Close()
+	// nothing answers quic on the port of the tcp server
+	tcp := httptest.NewUnstartedServer(handler)
+	tcp.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	tcp.EnableHTTP2 = true
+	tcp.StartTLS()
+	defer tcp.Close()
+
+	sessions := make(chan *packet.Session, 4)
+	p := newTestProxy(t, func(c *Config) {
+		c.HTTP3 = HTTP3{Enabled: true, StripAltSvc: true}
+		c.Timeouts.Dial = 300 * time.Millisecond
+		c.DNS.Hosts = map[string][]netip.Addr{"example.com": {netip.MustParseAddr("127.0.0.1")}}
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+	})
+	upstream := x509.NewCertPool()
+	upstream.AppendCertsFromPEM(testcert.LocalhostCert)
+	p.transport.(*http.Transport).TLSClientConfig.RootCAs = upstream
+	p.quicTransport.(*quicTransport).tcp.(*http.Transport).TLSClientConfig.RootCAs = upstream
+	assert.Equal(t, 1, len(p.QuicAddrs()))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA())
+	client := &http.Client{Transport: &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		// every host is reached through the proxy, like after a redirect
+		// of udp 443
+		Dial: func(ctx context.Context, _ string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+			return quic.DialAddrEarly(ctx, p.QuicAddrs()[0].String(), tlsConfig, config)
+		},
+	}}
+	host := func(addr net.Addr) string {
+		_, port := mylog.Check3(net.SplitHostPort(addr.String()))
+		return net.JoinHostPort("example.com", port)
+	}
+	for _, tt := range []struct {
+		addr string
+		want string
+	}{
+		{host(udp.LocalAddr()), "HTTP/3.0 POST /quic ping"},
+		// the body is sent again over tcp after the quic handshake failed,
+		// the fallback negotiates http/2
+		{host(tcp.Listener.Addr()), "HTTP/2.0 POST /quic ping"},
+	} {
+		resp := mylog.Check2(client.Post("https://"+tt.addr+"/quic", "text/plain", strings.NewReader("ping")))
+		body := mylog.Check2(io.ReadAll(resp.Body))
+		mylog.Check(resp.Body.Close())
+		assert.Equal(t, tt.want, string(body))
+		assert.Equal(t, "", resp.Header.Get("Alt-Svc"))
+
+		s := <-sessions
+		assert.Equal(t, httpClient.QuicType, s.SchemerType)
+		assert.Equal(t, packet.Outbound, s.StreamDirection)
+		assert.Equal(t, "200 OK", s.Status)
+		assert.Equal(t, tt.addr, s.Host)
+		assert.Equal(t, tt.want, string(s.RespBodyDecoder.Payload))
+		assert.Equal(t, "ping", string(s.ReqBodyDecoder.Payload))
+	}
+}
+
+func TestHTTP3Auth(t *testing.T) {
+	cfg := Config{
+		Addrs: []string{"127.0.0.1:0"},
+		HTTP3: HTTP3{Enabled: true},
+		Auth:  Auth{Users: AuthenticatorFunc(func(string, string) bool { return true })},
+	}
+	assert.True(t, errors.Is(NewWithConfig(cfg).Listen(), errQuicAuth))
+}
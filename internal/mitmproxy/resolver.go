@@ -0,0 +1,255 @@
+package mitmproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type (
+	// Resolver looks up the addresses of upstream hosts, *net.Resolver is
+	// one.
+	Resolver interface {
+		LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+	}
+
+	// DNS decides how the names of upstream hosts are resolved, the zero DNS
+	// asks the system resolver. Names are always resolved by the proxy,
+	// socks4a and socks5 clients included.
+	DNS struct {
+		// Hosts are static answers, they win over every server.
+		Hosts map[string][]netip.Addr
+		// Server is the host:port of a DNS server asked instead of the
+		// system resolver.
+		Server string
+		// DoH is the URL of a DNS-over-HTTPS endpoint (RFC 8484), asked
+		// through the upstream transport of the proxy. Its own name is
+		// resolved by Hosts and the system resolver.
+		DoH string
+		// Resolver replaces Server and DoH.
+		Resolver Resolver
+	}
+
+	// lookupFunc adapts a function to the Resolver interface.
+	lookupFunc func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+	hostsResolver struct {
+		hosts map[string][]netip.Addr
+		next  Resolver
+	}
+
+	dohResolver struct {
+		url    string
+		client *http.Client
+	}
+
+	// bootstrapKey marks the requests of the DoH resolver, their dials must
+	// not ask it again.
+	bootstrapKey struct{}
+)
+
+// newResolvers returns the resolver of upstream dials and the one resolving
+// the DoH server.
+func (d DNS) newResolvers(transport http.RoundTripper, timeout time.Duration) (resolver, bootstrap Resolver) {
+	resolver, bootstrap = net.DefaultResolver, net.DefaultResolver
+	switch {
+	case d.Resolver != nil:
+		resolver = d.Resolver
+	case d.DoH != "":
+		resolver = &dohResolver{url: d.DoH, client: &http.Client{Transport: transport, Timeout: timeout}}
+	case d.Server != "":
+		server := d.Server
+		if _, _, e := net.SplitHostPort(server); e != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: timeout}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if len(d.Hosts) > 0 {
+		hosts := make(map[string][]netip.Addr, len(d.Hosts))
+		for name, addrs := range d.Hosts {
+			hosts[canonicalName(name)] = addrs
+		}
+		resolver = hostsResolver{hosts: hosts, next: resolver}
+		bootstrap = hostsResolver{hosts: hosts, next: bootstrap}
+	}
+	return resolver, bootstrap
+}
+
+func (f lookupFunc) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return f(ctx, network, host)
+}
+
+// lookup resolves the host of an upstream dial, IP literals are returned as
+// they are.
+func (p *Proxy) lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if ip, e := netip.ParseAddr(host); e == nil {
+		return []netip.Addr{ip}, nil
+	}
+	r := p.resolver
+	if ctx.Value(bootstrapKey{}) != nil {
+		r = p.bootstrap
+	}
+	// the system resolver reports to the trace on its own, the others do
+	// not, a nested report is kept inside this one
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, e := r.LookupNetIP(ctx, ipNetwork(network), host)
+	if e == nil && len(ips) == 0 {
+		e = notFound(host)
+	}
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: ip.AsSlice(), Zone: ip.Zone()})
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: e})
+	}
+	return ips, e
+}
+
+// detach returns a context canceled with ctx that carries none of its
+// values, for requests the proxy sends on its own while serving a session.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithCancelCause(context.Background())
+	stop := context.AfterFunc(ctx, func() { cancel(context.Cause(ctx)) })
+	return detached, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// ipNetwork maps the network of a dial to the one of its lookup.
+func ipNetwork(network string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return "ip4"
+	case strings.HasSuffix(network, "6"):
+		return "ip6"
+	}
+	return "ip"
+}
+
+func canonicalName(host string) string { return strings.ToLower(strings.TrimSuffix(host, ".")) }
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r hostsResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := r.hosts[canonicalName(host)]
+	if !ok {
+		return r.next.LookupNetIP(ctx, network, host)
+	}
+	ips := make([]netip.Addr, 0, len(addrs))
+	for _, ip := range addrs {
+		if network == "ip" || network == "ip4" && ip.Unmap().Is4() || network == "ip6" && !ip.Unmap().Is4() {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+	return ips, nil
+}
+
+func (r *dohResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	switch network {
+	case "ip4":
+		types = types[:1]
+	case "ip6":
+		types = types[1:]
+	}
+	var ips []netip.Addr
+	var err error
+	for _, t := range types {
+		answer, e := r.query(ctx, host, t)
+		if e != nil {
+			err = e
+			continue
+		}
+		ips = append(ips, answer...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = notFound(host)
+	}
+	return nil, err
+}
+
+// query sends one question with the POST method of RFC 8484.
+func (r *dohResolver) query(ctx context.Context, host string, t dnsmessage.Type) ([]netip.Addr, error) {
+	name, e := dnsmessage.NewName(canonicalName(host) + ".")
+	if e != nil {
+		return nil, e
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true}, // the ID stays 0 for http caches
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	b, e := msg.Pack()
+	if e != nil {
+		return nil, e
+	}
+	// the query is not part of the session it resolves for, its dials and
+	// its trace stay out of it
+	ctx, cancel := detach(ctx)
+	defer cancel()
+	req, e := http.NewRequestWithContext(context.WithValue(ctx, bootstrapKey{}, true), http.MethodPost, r.url, bytes.NewReader(b))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, e := r.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns-over-https %s: %s", r.url, resp.Status)
+	}
+	body, e := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if e != nil {
+		return nil, e
+	}
+	if e := msg.Unpack(body); e != nil {
+		return nil, e
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, notFound(host)
+	default:
+		return nil, &net.DNSError{Err: msg.RCode.String(), Name: host, Server: r.url}
+	}
+	var ips []netip.Addr
+	for _, answer := range msg.Answers {
+		switch rr := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, netip.AddrFrom4(rr.A))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, netip.AddrFrom16(rr.AAAA))
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,107 @@
+package mitmproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// dohHandler answers A questions for name with 127.0.0.1 and everything
+// else with NXDOMAIN.
+func dohHandler(t *testing.T, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+		var msg dnsmessage.Message
+		mylog.Check(msg.Unpack(mylog.Check2(io.ReadAll(r.Body))))
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		switch {
+		case q.Name.String() != name+".":
+			msg.RCode = dnsmessage.RCodeNameError
+		case q.Type == dnsmessage.TypeA:
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}}
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		mylog.Check2(w.Write(mylog.Check2(msg.Pack())))
+	})
+}
+
+func TestResolver(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.WriteString(w, "hello"))
+	}))
+	defer backend.Close()
+	_, port := mylog.Check3(net.SplitHostPort(backend.Listener.Addr().String()))
+	doh := httptest.NewServer(dohHandler(t, "doh.test"))
+	defer doh.Close()
+
+	sessions := make(chan *packet.Session, 16)
+	newProxy := func(dns DNS) *Proxy {
+		return newTestProxy(t, func(c *Config) {
+			c.DNS = dns
+			c.SessionEventCallBack = func(s *packet.Session) {
+				select {
+				case sessions <- s:
+				default:
+				}
+			}
+		})
+	}
+	drain := func() {
+		for len(sessions) > 0 {
+			<-sessions
+		}
+	}
+	get := func(proxy *url.URL, host string) string {
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy), DisableKeepAlives: true}}
+		resp := mylog.Check2(c.Get("http://" + net.JoinHostPort(host, port)))
+		defer func() { mylog.Check(resp.Body.Close()) }()
+		return string(mylog.Check2(io.ReadAll(resp.Body)))
+	}
+	loopback := netip.MustParseAddr("127.0.0.1")
+
+	t.Run("hosts", func(t *testing.T) {
+		p := newProxy(DNS{Hosts: map[string][]netip.Addr{"Static.Test": {loopback}}})
+		assert.Equal(t, "hello", get(&url.URL{Scheme: "http", Host: p.Addrs()[0].String()}, "static.test"))
+		var s *packet.Session
+		for s = <-sessions; s.StreamDirection != packet.Outbound; s = <-sessions {
+		}
+		assert.Equal(t, net.JoinHostPort("static.test", port), s.Host)
+		assert.Equal(t, loopback.String(), s.ResolvedIP.String())
+	})
+
+	t.Run("doh", func(t *testing.T) {
+		drain()
+		p := newProxy(DNS{DoH: doh.URL})
+		addr := p.Addrs()[0].String()
+
+		// socks5 clients leave the name to the proxy
+		assert.Equal(t, "hello", get(&url.URL{Scheme: "socks5", Host: addr}, "doh.test"))
+		s := <-sessions
+		assert.Equal(t, httpClient.Socket5Type, s.SchemerType)
+		assert.Equal(t, net.JoinHostPort("doh.test", port), s.Host)
+		assert.Equal(t, loopback.String(), s.ResolvedIP.String())
+
+		// so do socks4a clients
+		conn := mylog.Check2(socks.NewSocks4Dialer("tcp", addr).Dial("tcp", net.JoinHostPort("doh.test", port)))
+		mylog.Check(conn.Close())
+
+		_, e := socks.NewSocks4Dialer("tcp", addr).Dial("tcp", net.JoinHostPort("unknown.test", port))
+		assert.NotNil(t, e)
+	})
+}
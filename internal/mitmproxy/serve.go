@@ -2,30 +2,63 @@ package mitmproxy
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/x509"
 	"errors"
-	"io"
+	"fmt"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
 	"github.com/ddkwork/mitmproxy/internal/ca"
 	"github.com/ddkwork/mitmproxy/packet"
+	"github.com/quic-go/quic-go/http3"
 )
 
 type (
 	Server interface {
-		ListenAndServe()
-		Handle
+		ListenAndServe(ctx context.Context) error
+		Listen() error
+		Serve(ctx context.Context) error
+		Shutdown(ctx context.Context) (Aborted, error)
+		Addrs() []net.Addr
 	}
 	Proxy struct {
-		dial                 func(string, string) (net.Conn, error)
-		port                 string
-		sessionEventCallBack packet.SessionEventCallBack
+		Config
+		ca        *ca.Config
+		landing   http.Handler
+		transport http.RoundTripper
+		// quicTransport is the upstream of the requests of quic clients.
+		quicTransport http.RoundTripper
+		resolver      Resolver
+		bootstrap     Resolver
+		listeners     []net.Listener
+		// packetConns are the udp listeners of HTTP3, served by h3.
+		packetConns []net.PacketConn
+		h3          *http3.Server
+		certServer  *http.Server
+		// certListener is bound by Listen, certServer serves on it.
+		certListener net.Listener
+		// controlServer serves ControlHandler on Control.Addr, on the
+		// listener Listen binds.
+		controlServer   *http.Server
+		controlListener net.Listener
+
+		mu           sync.Mutex
+		conns        map[*trackedConn]struct{}
+		shuttingDown atomic.Bool
+		// flowCtx is the parent of every upstream request, abort cancels it
+		// once Shutdown is over.
+		flowCtx context.Context
+		abort   context.CancelFunc
+		// webSockets are the live websocket relays by ConnID.
+		webSockets  map[uint64]*WebSocket
+		webSocketID atomic.Uint64
 		keysTemp
-		tcpListener *net.TCPListener
-		err         error
 	}
 	keysTemp struct {
 		SteamAesKey []byte
@@ -36,60 +69,191 @@ func (p *Proxy) SessionEvent(_ *packet.Session) {
 	mylog.Warning("SessionEvent", "未设置数据包的回调函数,将调用各层协议的默认事件输出")
 }
 
+// New creates a proxy with DefaultConfig on the given local port.
 func New(port string, sessionEventCallBack packet.SessionEventCallBack) Server {
-	if port == "" {
-		port = ca.ProxyPort
+	cfg := DefaultConfig()
+	if port != "" {
+		cfg.Addrs = []string{net.JoinHostPort(httpClient.Localhost, port)}
 	}
+	cfg.SessionEventCallBack = sessionEventCallBack
+	return NewWithConfig(cfg)
+}
+
+// NewWithConfig creates a proxy without touching any process wide state, the
+// listeners are only opened by Listen.
+func NewWithConfig(cfg Config) *Proxy {
+	cfg.setDefaults()
+	cert, privateKey := cfg.CA.load()
 	p := &Proxy{
-		dial: (&net.Dialer{
-			Timeout:   dialTimeout,
-			KeepAlive: dialTimeout,
-		}).Dial,
-		port:                 port,
-		sessionEventCallBack: sessionEventCallBack,
-		keysTemp:             keysTemp{},
-		tcpListener:          nil,
-		err:                  nil,
-	}
-	if sessionEventCallBack == nil {
+		Config: cfg,
+		ca: ca.NewConfig(func(o *ca.Options) {
+			o.Certificate = cert
+			o.PrivateKey = privateKey
+		}),
+		landing:    ca.NewLandingHandler(cert, cfg.CA.previous()),
+		conns:      make(map[*trackedConn]struct{}),
+		webSockets: make(map[uint64]*WebSocket),
+		keysTemp:   keysTemp{},
+	}
+	p.flowCtx, p.abort = context.WithCancel(context.Background())
+	p.transport = p.newTransport()
+	p.quicTransport = p.newQuicTransport()
+	p.resolver, p.bootstrap = cfg.DNS.newResolvers(p.transport, cfg.Timeouts.Dial)
+	if cfg.CertServer.Enabled {
+		p.certServer = &http.Server{
+			Addr:              cfg.CertServer.Addr,
+			Handler:           p.landing,
+			ReadHeaderTimeout: cfg.Timeouts.ResponseHeader,
+		}
+	}
+	if cfg.Control.Enabled {
+		p.controlServer = &http.Server{
+			Addr:              cfg.Control.Addr,
+			Handler:           p.ControlHandler(),
+			ReadHeaderTimeout: cfg.Timeouts.ResponseHeader,
+		}
+	}
+	if cfg.SessionEventCallBack == nil {
 		p.SessionEvent(nil)
 	}
 	return p
 }
 
-func (p *Proxy) ListenAndServe() {
-	addr := mylog.Check2(net.ResolveTCPAddr("tcp", ca.ProxyServeAddress()))
-	p.tcpListener = mylog.Check2(net.ListenTCP("tcp", addr))
-	defer func() { mylog.Check(p.tcpListener.Close()) }()
-
-	// go func() {
-	//	return
-	//	udpListenAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(httpClient.Localhost, p.port))
-	//	if ! {
-	//		return
-	//	}
-	//	udpListen, err := net.ListenUDP("udp", udpListenAddr)
-	//	if ! {
-	//		return
-	//	}
-	//	udpListen = udpListen
-	// }()
-	p.Serve()
+// CA returns the root certificate the proxy signs its certificates with.
+func (p *Proxy) CA() *x509.Certificate { return p.ca.CA() }
+
+func (p *Proxy) ListenAndServe(ctx context.Context) error {
+	if e := p.Listen(); e != nil {
+		return e
+	}
+	return p.Serve(ctx)
+}
+
+// Listen opens a listener on every configured address, one for every
+// forward, the udp listeners of HTTP3 and those of the cert server and the
+// control api.
+func (p *Proxy) Listen() error {
+	for _, addr := range p.Config.Addrs {
+		l, e := net.Listen("tcp", addr)
+		if e != nil {
+			p.closeListeners()
+			return e
+		}
+		mylog.Warning("ListenAndServe", l.Addr().String())
+		p.listeners = append(p.listeners, &onceCloseListener{Listener: l})
+	}
+	if e := p.listenForwards(); e != nil {
+		p.closeListeners()
+		return e
+	}
+	if e := p.listenQuic(); e != nil {
+		p.closeListeners()
+		return e
+	}
+	if p.certServer != nil {
+		l, e := net.Listen("tcp", p.CertServer.Addr)
+		if e != nil {
+			p.closeListeners()
+			return fmt.Errorf("cert server %s: %w", p.CertServer.Addr, e)
+		}
+		p.certListener = l
+	}
+	if p.controlServer != nil {
+		l, e := net.Listen("tcp", p.Control.Addr)
+		if e != nil {
+			p.closeListeners()
+			return fmt.Errorf("control %s: %w", p.Control.Addr, e)
+		}
+		p.controlListener = l
+	}
+	return nil
+}
+
+// closeListeners closes what a failed Listen opened.
+func (p *Proxy) closeListeners() {
+	for _, opened := range p.listeners {
+		mylog.CheckIgnore(opened.Close())
+	}
+	for _, opened := range p.packetConns {
+		mylog.CheckIgnore(opened.Close())
+	}
+	for _, opened := range []net.Listener{p.certListener, p.controlListener} {
+		if opened != nil {
+			mylog.CheckIgnore(opened.Close())
+		}
+	}
+	p.listeners, p.packetConns, p.certListener, p.controlListener = nil, nil, nil, nil
+}
+
+// Addrs returns the addresses the proxy is listening on.
+func (p *Proxy) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(p.listeners))
+	for _, l := range p.listeners {
+		if _, ok := l.(*forwardListener); !ok {
+			addrs = append(addrs, l.Addr())
+		}
+	}
+	return addrs
 }
 
-func (p *Proxy) ServeTls() {
-	// TODO implement me
-	panic("implement me")
+// Serve accepts connections on all listeners until they fail, Shutdown is
+// called or ctx is done. In the last case the in-flight flows get
+// Timeouts.Drain to finish before Serve returns. After a shutdown Serve
+// always returns ErrShutdown.
+func (p *Proxy) Serve(ctx context.Context) error {
+	if p.shuttingDown.Load() {
+		return ErrShutdown
+	}
+	drained := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(drained)
+		drainCtx, cancel := context.WithTimeout(context.Background(), p.Timeouts.Drain)
+		defer cancel()
+		_, err := p.Shutdown(drainCtx)
+		mylog.CheckIgnore(err)
+	})
+	if p.certListener != nil {
+		go func() {
+			mylog.Trace("Cert FileServer", "http://"+p.certListener.Addr().String())
+			mylog.CheckIgnore(p.certServer.Serve(p.certListener))
+		}()
+	}
+	if p.controlListener != nil {
+		go func() {
+			mylog.Trace("Control", "http://"+p.controlListener.Addr().String())
+			mylog.CheckIgnore(p.controlServer.Serve(p.controlListener))
+		}()
+	}
+	errs := make(chan error, len(p.listeners)+len(p.packetConns))
+	for _, l := range p.listeners {
+		go func() { errs <- p.serve(l) }()
+	}
+	for _, conn := range p.packetConns {
+		go func() { errs <- p.h3.Serve(conn) }()
+	}
+	var err error
+	for range len(p.listeners) + len(p.packetConns) {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	if !stop() {
+		<-drained
+	}
+	if p.shuttingDown.Load() {
+		return ErrShutdown
+	}
+	return err
 }
 
-func (p *Proxy) Serve() {
+func (p *Proxy) serve(l net.Listener) error {
+	defer func() { mylog.CheckIgnore(l.Close()) }()
 	var delay time.Duration
 	for {
-		clientConn, e := p.tcpListener.Accept()
-		mylog.CheckIgnore(e)
+		clientConn, e := l.Accept()
 		if e != nil {
 			var err net.Error
-			if errors.As(err, &err) && err.Timeout() {
+			if errors.As(e, &err) && err.Timeout() {
 				mylog.CheckIgnore(err)
 				if delay == 0 {
 					delay = 5 * time.Millisecond
@@ -102,68 +266,123 @@ func (p *Proxy) Serve() {
 				time.Sleep(delay)
 				continue
 			}
-			// return
+			if p.shuttingDown.Load() {
+				return ErrShutdown
+			}
+			return e
 		}
 		delay = 0
-		TcpKeepAlive(clientConn)
-		readWriter := bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn))
-		mylog.Check(clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)))
-
-		// gpt说maxPeekLayerBufSize超过三个字节卡顿的原因是没有加锁
-		mylog.Todo("add lock for peek buf")
-		layerBuf, e := readWriter.Reader.Peek(maxPeekLayerBufSize) // before ReadRequest call redder, but peek ways read conn?
-		mylog.CheckIgnore(e)
+		conn := p.track(clientConn)
+		if conn == nil {
+			continue
+		}
+		if f, ok := l.(*forwardListener); ok {
+			go p.handleForward(conn, f.forward)
+		} else {
+			go p.handleConn(conn)
+		}
+	}
+}
+
+func (p *Proxy) handleConn(clientConn *trackedConn) {
+	defer p.untrack(clientConn)
+	TcpKeepAlive(clientConn.Conn)
+	readWriter := bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn))
+	protocol, e := p.Sniff.Sniff(clientConn, readWriter.Reader)
+	if e != nil {
+		if !isCloseable(e) {
+			mylog.Warning("sniff", clientConn.RemoteAddr().String()+" "+e.Error())
+		}
+		return
+	}
+	var conn net.Conn = clientConn
+	if protocol == ProxyProtocol && p.ProxyHeaders.Accept {
+		if conn, e = p.acceptProxyHeader(clientConn, readWriter.Reader); e == nil {
+			protocol, e = p.Sniff.Sniff(conn, readWriter.Reader)
+		}
 		if e != nil {
-			if errors.Is(e, io.EOF) {
-				mylog.Trace("无法读取到协议buffer，建议直接走tcp隧道转发，但是tcp是无头head，首次连接body流可有可无，无法得到目标服务器ip，所以粗腰gui传进来")
+			if !isCloseable(e) {
+				mylog.Warning("sniff", clientConn.RemoteAddr().String()+" "+e.Error())
 			}
-			continue
+			return
 		}
-		mylog.HexDump("layerBuf", layerBuf)
+	}
+	mylog.Trace("sniff", conn.RemoteAddr().String()+" "+protocol.String())
 
-		mylog.Check(clientConn.SetReadDeadline(time.Time{}))
-		isS5 := func(b []byte) bool { return bytes.Contains(b, []byte{5, 1}) }
-		isS4 := func(b []byte) bool { return bytes.Contains(b, []byte{4, 1}) }
-		switch {
-		case bytes.Equal(layerBuf, []byte{0x16, 0x03, 0x01}): // http不设置证书代理https流量，所有协议只需一个监听端口
-			go NewHttp(packet.NewSessionWithReadWriter(clientConn, readWriter, httpClient.HttpsType, p.sessionEventCallBack)).ServeTls()
-		case isS5(layerBuf):
-			go NewSocket5(packet.NewSessionWithReadWriter(clientConn, readWriter, httpClient.Socket5Type, p.sessionEventCallBack)).Serve()
-		case isS4(layerBuf):
-			go NewSocket4(packet.NewSessionWithReadWriter(clientConn, readWriter, httpClient.Socket4Type, p.sessionEventCallBack)).Serve()
-		default:
-			go NewHttp(packet.NewSessionWithReadWriter(clientConn, readWriter, httpClient.HttpType, p.sessionEventCallBack)).Serve()
+	newSession := func(layer httpClient.SchemerType) *packet.Session {
+		return p.newSession(conn, readWriter, layer)
+	}
+	var serve func() error
+	if e := p.ACL.allowSource(p.sourceAddr(conn)); e != nil {
+		serve = p.refuse(protocol, newSession, e)
+	} else {
+		serve = p.handler(protocol, newSession)
+	}
+	// errors end the connection they happened on, the recover only guards
+	// against the panics left in the packet decoders
+	mylog.Call(func() {
+		if e := serve(); e != nil && !isCloseable(e) {
+			mylog.Warning("handleConn", conn.RemoteAddr().String()+" "+e.Error())
 		}
+	})
+}
+
+// newSession starts the session of a client connection.
+func (p *Proxy) newSession(conn net.Conn, readWriter *bufio.ReadWriter, layer httpClient.SchemerType) *packet.Session {
+	s := packet.NewSessionWithReadWriter(conn, readWriter, layer, p.SessionEventCallBack)
+	s.Stream.Limit = p.StreamLimit
+	if p.Dissectors != nil {
+		s.Stream.NewDissector = p.Dissectors.NewDissector
 	}
+	return s
 }
 
-const (
-	maxPeekLayerBufSize = 3
-
-	// tcp代理只支持http转tcp，或者可以用peek是eof支持？但是不知道远程服务器ip和端口，得构造req并从ui传进来？
-	//	if packet.IsTcp(h.Request.URL.Hostname()) {
-	//		mylog.Warning("IsTcp", h.Request.URL.Hostname())
-	//		return NewTcp(h.Session).Serve()
-	//	}
-
-	// 4096 直接等待，不行，还有一种是io多读取器，但是只能http成功，s5的实现代码里面不不知道怎么支持多读
-	// 3是Proxifier的s5包的最大值，s4直接不发，s4代理失败
-	// sock包是发了  04 01 1f，s4代理成功
-	// edge 浏览器发的是 04 01 01 ，s4代理失败
-
-	// 正确设置
-	//	Transport: &http.Transport{
-	//			Proxy: func(request *http.Request) (*url.URL, error) {
-	//				return url.Parse("socks5://" + ca.ProxyServeAddress())
-	//				return url.Parse("socks5://localhost:1080")
-	//			},
-	//		},
-
-	//		Transport: &http.Transport{
-	//			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-	//				//d := socks.NewSocks4Dialer("tcp", "localhost:1080")
-	//				d := socks.NewSocks4Dialer("tcp", ca.ProxyServeAddress())
-	//				return d.DialContext(ctx, network, addr)
-	//			},
-	//		},
-)
+// handler picks what serves a connection of the sniffed protocol.
+func (p *Proxy) handler(protocol Protocol, newSession func(httpClient.SchemerType) *packet.Session) func() error {
+	switch protocol {
+	case TlsProtocol: // http不设置证书代理https流量，所有协议只需一个监听端口
+		if p.Auth.enabled() { // a tls client without CONNECT has no way to log in
+			return func() error { return fmt.Errorf("%w: tls without CONNECT", errProxyAuth) }
+		}
+		return NewHttp(p, newSession(httpClient.HttpsType)).ServeTls
+	case Socks5Protocol:
+		return NewSocket5(p, newSession(httpClient.Socket5Type)).Serve
+	case Socks4Protocol:
+		return NewSocket4(p, newSession(httpClient.Socket4Type)).Serve
+	case HttpProtocol:
+		return NewHttp(p, newSession(httpClient.HttpType)).Serve
+	case ProxyProtocol:
+		return func() error { return fmt.Errorf("%w: %s header", errUnsupportedProtocol, protocol) }
+	case Http2Protocol:
+		// prior knowledge clients go to the fallback, without one they
+		// are refused on a session that shows why
+		if p.Fallback == "" {
+			tcp := &Tcp{proxy: p, Session: newSession(httpClient.TcpType)}
+			return func() error {
+				return tcp.Refuse(fmt.Errorf("%w: %s and no fallback", errUnsupportedProtocol, protocol))
+			}
+		}
+	}
+	if p.Fallback == "" {
+		return func() error { return fmt.Errorf("%w: %s and no fallback", errUnsupportedProtocol, protocol) }
+	}
+	tcp := &Tcp{proxy: p, Session: newSession(httpClient.TcpType)}
+	return func() error { return tcp.Forward(p.Fallback) }
+}
+
+// refuse turns away a client the ACL does not serve, in the way its protocol
+// expects.
+func (p *Proxy) refuse(protocol Protocol, newSession func(httpClient.SchemerType) *packet.Session, err error) func() error {
+	var refuse func(error) error
+	switch protocol {
+	case Socks5Protocol:
+		refuse = (&Socket5{proxy: p, Session: newSession(httpClient.Socket5Type)}).Refuse
+	case Socks4Protocol:
+		refuse = (&Socket4{proxy: p, Session: newSession(httpClient.Socket4Type)}).Refuse
+	case HttpProtocol:
+		refuse = NewHttp(p, newSession(httpClient.HttpType)).(*Http).Refuse
+	default:
+		refuse = (&Tcp{proxy: p, Session: newSession(httpClient.TcpType)}).Refuse
+	}
+	return func() error { return refuse(err) }
+}
@@ -0,0 +1,250 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/proxyproto"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func newTestProxy(t *testing.T, optFns ...func(*Config)) *Proxy {
+	cfg := Config{SessionEventCallBack: func(*packet.Session) {}}
+	for _, fn := range optFns {
+		fn(&cfg)
+	}
+	p := NewWithConfig(cfg)
+	mylog.Check(p.Listen())
+	go func() { mylog.CheckIgnore(p.Serve(t.Context())) }()
+	return p
+}
+
+func proxyClient(p *Proxy) *http.Client {
+	proxyURL := mylog.Check2(url.Parse("http://" + p.Addrs()[0].String()))
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+}
+
+func TestMultipleProxies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mylog.Check2(io.WriteString(w, "hello"))
+	}))
+	defer backend.Close()
+	// IP literal hosts are relayed as raw tcp, address the backend by name
+	target := strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1)
+
+	first := newTestProxy(t)
+	second := newTestProxy(t)
+	assert.NotEqual(t, first.Addrs()[0].String(), second.Addrs()[0].String())
+	assert.NotEqual(t, first.CA().Raw, second.CA().Raw)
+
+	for _, p := range []*Proxy{first, second} {
+		resp := mylog.Check2(proxyClient(p).Get(target))
+		body := mylog.Check2(io.ReadAll(resp.Body))
+		mylog.Check(resp.Body.Close())
+		assert.Equal(t, "hello", string(body))
+	}
+}
+
+func TestCertServerListen(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) {
+		c.CertServer = CertServer{Enabled: true, Addr: "127.0.0.1:0"}
+	})
+	resp := mylog.Check2(http.Get("http://" + p.certListener.Addr().String() + "/"))
+	mylog.Check(resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// a taken port fails Listen and closes what it opened
+	taken := NewWithConfig(Config{
+		SessionEventCallBack: func(*packet.Session) {},
+		CertServer:           CertServer{Enabled: true, Addr: p.certListener.Addr().String()},
+	})
+	assert.NotNil(t, taken.Listen())
+	assert.Equal(t, 0, len(taken.Addrs()))
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		mylog.Check2(io.WriteString(w, "hello"))
+	}))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1)
+
+	t.Run("drain", func(t *testing.T) {
+		p := newTestProxy(t)
+		idle := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+		defer func() { mylog.CheckIgnore(idle.Close()) }()
+
+		done := make(chan string)
+		go func() {
+			resp := mylog.Check2(proxyClient(p).Get(target))
+			body := mylog.Check2(io.ReadAll(resp.Body))
+			mylog.Check(resp.Body.Close())
+			done <- string(body)
+		}()
+		<-started
+		time.AfterFunc(50*time.Millisecond, func() { release <- struct{}{} })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		aborted := mylog.Check2(p.Shutdown(ctx))
+		assert.Equal(t, 0, aborted.Total())
+		assert.Equal(t, "hello", <-done)
+
+		_, e := net.Dial("tcp", p.Addrs()[0].String())
+		assert.NotNil(t, e)
+		assert.True(t, errors.Is(p.Serve(context.Background()), ErrShutdown))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		p := newTestProxy(t)
+		go func() {
+			resp, e := proxyClient(p).Get(target)
+			if e == nil {
+				mylog.Check(resp.Body.Close())
+			}
+		}()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		aborted, e := p.Shutdown(ctx)
+		assert.True(t, errors.Is(e, context.DeadlineExceeded))
+		assert.Equal(t, Aborted{Http: 1}, aborted)
+	})
+}
+
+func TestBadGateway(t *testing.T) {
+	closed := mylog.Check2(net.Listen("tcp", "localhost:0"))
+	_, port := mylog.Check3(net.SplitHostPort(closed.Addr().String()))
+	mylog.Check(closed.Close())
+
+	sessions := make(chan *packet.Session, 1)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.Failed() {
+				sessions <- s
+			}
+		}
+	})
+	resp := mylog.Check2(proxyClient(p).Get("http://localhost:" + port))
+	mylog.Check(resp.Body.Close())
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	s := <-sessions
+	assert.Equal(t, resp.Status, s.Status)
+	assert.NotNil(t, s.Err)
+}
+
+func TestProxyHeaders(t *testing.T) {
+	backend := mylog.Check2(net.Listen("tcp", "localhost:0"))
+	defer func() { mylog.CheckIgnore(backend.Close()) }()
+	upstreamHeader := make(chan string, 1)
+	go func() {
+		c, e := backend.Accept()
+		if e != nil {
+			return
+		}
+		defer func() { mylog.CheckIgnore(c.Close()) }()
+		r := bufio.NewReader(c)
+		upstreamHeader <- mylog.Check2(r.ReadString('\n'))
+		mylog.Check2(http.ReadRequest(r))
+		mylog.Check2(io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+	_, port := mylog.Check3(net.SplitHostPort(backend.Addr().String()))
+
+	sessions := make(chan *packet.Session, 1)
+	p := newTestProxy(t, func(c *Config) {
+		c.ProxyHeaders = ProxyHeaders{
+			Accept:   true,
+			Trusted:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			Upstream: proxyproto.V1,
+		}
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.Response != nil {
+				sessions <- s
+			}
+		}
+	})
+	conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+	defer func() { mylog.CheckIgnore(conn.Close()) }()
+	mylog.Check2(io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.7 51000 8080\r\n"+
+		"GET http://localhost:"+port+"/ HTTP/1.1\r\nHost: localhost:"+port+"\r\n\r\n"))
+	resp := mylog.Check2(http.ReadResponse(bufio.NewReader(conn), nil))
+	body := mylog.Check2(io.ReadAll(resp.Body))
+	assert.Equal(t, "ok", string(body))
+
+	s := <-sessions
+	assert.Equal(t, "192.0.2.1:51000", s.ClientAddr.String())
+	assert.Equal(t, "198.51.100.7:8080", s.ProxyDestination.String())
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.7 51000 8080\r\n", <-upstreamHeader)
+}
+
+func TestProxyHeadersTLVs(t *testing.T) {
+	client, balancer := net.Pipe()
+	defer func() { mylog.CheckIgnore(balancer.Close()) }()
+	conn := &proxyproto.Conn{Conn: client, Header: &proxyproto.Header{
+		Version:     proxyproto.V2,
+		Command:     proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51000},
+		Destination: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 8080},
+		TLVs: []proxyproto.TLV{
+			{Type: proxyproto.TypeAuthority, Value: []byte("example.com")},
+			{Type: proxyproto.TypeCRC32C, Value: []byte{1, 2, 3, 4}},
+			{Type: proxyproto.TypeALPN, Value: []byte("h2")},
+			{Type: proxyproto.TypeALPN, Value: []byte("http/1.1")},
+		},
+	}}
+	s := packet.NewSession(conn, httpClient.HttpType, nil)
+	assert.Equal(t, "198.51.100.7:8080", s.ProxyDestination.String())
+	assert.Equal(t, "h2", string(s.ProxyTLVs[byte(proxyproto.TypeALPN)]))
+	assert.Equal(t, "example.com", string(s.ProxyTLVs[byte(proxyproto.TypeAuthority)]))
+
+	// the checksum of the old header is not forwarded
+	h := upstreamHeader(proxyproto.V2, s)
+	assert.Equal(t, []proxyproto.TLV{
+		{Type: proxyproto.TypeALPN, Value: []byte("h2")},
+		{Type: proxyproto.TypeAuthority, Value: []byte("example.com")},
+	}, h.TLVs)
+	assert.Equal(t, 0, len(upstreamHeader(proxyproto.V1, s).TLVs))
+}
+
+func TestProxyHeadersUntrusted(t *testing.T) {
+	for _, trusted := range [][]netip.Prefix{nil, {netip.MustParsePrefix("192.0.2.0/24")}} {
+		p := newTestProxy(t, func(c *Config) {
+			c.ProxyHeaders = ProxyHeaders{Accept: true, Trusted: trusted}
+		})
+		conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+		mylog.Check2(io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.7 51000 8080\r\n"+
+			"GET http://localhost/ HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		// the connection is closed before anything is served
+		_, e := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NotNil(t, e)
+		mylog.Check(conn.Close())
+	}
+}
+
+func TestServeTlsUnsupported(t *testing.T) {
+	for _, h := range []Handle{&Socket4{}, &Socket5{}, &WebSocket{}} {
+		assert.True(t, errors.Is(h.ServeTls(), errUnsupportedProtocol))
+	}
+}
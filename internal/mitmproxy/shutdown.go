@@ -0,0 +1,208 @@
+package mitmproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/internal/proxyproto"
+)
+
+// FlowKind is what an accepted client connection is carrying right now.
+type FlowKind int32
+
+const (
+	IdleFlow      FlowKind = iota // sniffing or waiting for the next request
+	HttpFlow                      // an http exchange is in flight
+	WebSocketFlow                 // a websocket relay
+	TunnelFlow                    // a tcp or socks tunnel
+)
+
+func (k FlowKind) String() string {
+	switch k {
+	case HttpFlow:
+		return "http"
+	case WebSocketFlow:
+		return "websocket"
+	case TunnelFlow:
+		return "tunnel"
+	}
+	return "idle"
+}
+
+// Aborted counts the flows Shutdown force-closed because they did not finish
+// before its context was done.
+type Aborted struct {
+	Http      int
+	WebSocket int
+	Tunnel    int
+}
+
+func (a Aborted) Total() int { return a.Http + a.WebSocket + a.Tunnel }
+
+// shutdownPollInterval is how often Shutdown looks for idle connections and
+// checks whether every flow has drained.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// trackedConn is an accepted client connection, it stays registered with the
+// proxy until its handler returns.
+type trackedConn struct {
+	net.Conn
+	kind atomic.Int32
+	once sync.Once
+	err  error
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.err = c.Conn.Close() })
+	return c.err
+}
+
+func (c *trackedConn) flow() FlowKind { return FlowKind(c.kind.Load()) }
+
+// onceCloseListener lets Shutdown and the accept loop both close a listener.
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *onceCloseListener) Close() error {
+	l.once.Do(func() { l.err = l.Listener.Close() })
+	return l.err
+}
+
+// setFlow marks the client connection c, or the connection it wraps, as
+// carrying a flow of the given kind.
+func setFlow(c net.Conn, kind FlowKind) {
+	for c != nil {
+		switch conn := c.(type) {
+		case *trackedConn:
+			conn.kind.Store(int32(kind))
+			return
+		case *tls.Conn:
+			c = conn.NetConn()
+		case *PeekedConn:
+			c = conn.Conn
+		case *proxyproto.Conn:
+			c = conn.Conn
+		default:
+			return
+		}
+	}
+}
+
+// track registers an accepted connection, once the proxy is shutting down the
+// connection is closed instead and nil is returned.
+func (p *Proxy) track(c net.Conn) *trackedConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shuttingDown.Load() {
+		mylog.CheckIgnore(c.Close())
+		return nil
+	}
+	conn := &trackedConn{Conn: c}
+	p.conns[conn] = struct{}{}
+	return conn
+}
+
+func (p *Proxy) untrack(c *trackedConn) {
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+	mylog.CheckIgnore(c.Close())
+}
+
+// closeIdle closes every connection without a flow in flight and reports
+// whether no connection is left.
+func (p *Proxy) closeIdle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		if c.flow() == IdleFlow {
+			mylog.CheckIgnore(c.Close())
+			delete(p.conns, c)
+		}
+	}
+	return len(p.conns) == 0
+}
+
+// drain waits until every connection has been closed by its handler.
+func (p *Proxy) drain(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !p.closeIdle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// closeAll force-closes every remaining connection and counts the flows
+// that were cut off.
+func (p *Proxy) closeAll() (aborted Aborted) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		switch c.flow() {
+		case HttpFlow:
+			aborted.Http++
+		case WebSocketFlow:
+			aborted.WebSocket++
+		case TunnelFlow:
+			aborted.Tunnel++
+		}
+		mylog.CheckIgnore(c.Close())
+		delete(p.conns, c)
+	}
+	return aborted
+}
+
+// Shutdown stops accepting connections and closes the idle ones, then waits
+// for in-flight http exchanges, websocket relays and tunnels to finish. When
+// ctx is done first the remaining flows are force-closed, counted in the
+// returned Aborted and ctx.Err() is returned.
+func (p *Proxy) Shutdown(ctx context.Context) (Aborted, error) {
+	p.mu.Lock()
+	p.shuttingDown.Store(true)
+	p.mu.Unlock()
+	for _, l := range p.listeners {
+		mylog.CheckIgnore(l.Close())
+	}
+	defer p.abort()
+	if t, ok := p.quicTransport.(interface{ CloseIdleConnections() }); ok {
+		defer t.CloseIdleConnections()
+	}
+
+	// h3 stops taking requests right away and drains its own
+	h3Done := make(chan error, 1)
+	if p.h3 != nil {
+		go func() { h3Done <- p.h3.Shutdown(ctx) }()
+	} else {
+		h3Done <- nil
+	}
+	err := p.drain(ctx)
+	if e := <-h3Done; e != nil {
+		mylog.CheckIgnore(p.h3.Close())
+	}
+	aborted := p.closeAll()
+	if aborted.Total() > 0 {
+		mylog.Warning("Shutdown", "aborted ", aborted.Http, " http, ", aborted.WebSocket, " websocket, ", aborted.Tunnel, " tunnel flows")
+	}
+	for _, server := range []*http.Server{p.certServer, p.controlServer} {
+		if server != nil {
+			if e := server.Shutdown(ctx); e != nil {
+				mylog.CheckIgnore(server.Close())
+			}
+		}
+	}
+	return aborted, err
+}
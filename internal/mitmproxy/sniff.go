@@ -0,0 +1,199 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// Protocol is what the first bytes of a client connection look like.
+type Protocol int
+
+const (
+	UnknownProtocol Protocol = iota
+	HttpProtocol             // an http/1.x request line
+	Http2Protocol            // the prior knowledge h2c connection preface
+	TlsProtocol              // a tls handshake record of any version
+	Socks4Protocol           // a socks4 or socks4a request
+	Socks5Protocol           // a socks5 method selection greeting
+	ProxyProtocol            // a PROXY protocol v1 or v2 header
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case HttpProtocol:
+		return "http"
+	case Http2Protocol:
+		return "h2c"
+	case TlsProtocol:
+		return "tls"
+	case Socks4Protocol:
+		return "socks4"
+	case Socks5Protocol:
+		return "socks5"
+	case ProxyProtocol:
+		return "proxy protocol"
+	}
+	return "unknown"
+}
+
+var errUnsupportedProtocol = errors.New("unsupported protocol")
+
+var (
+	http2Preface    = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	proxyV1Prefix   = []byte("PROXY ")
+	proxyV2Prefix   = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	httpMethodsPeek = [][]byte{
+		[]byte("GET "),
+		[]byte("POST "),
+		[]byte("PUT "),
+		[]byte("HEAD "),
+		[]byte("DELETE "),
+		[]byte("OPTIONS "),
+		[]byte("PATCH "),
+		[]byte("CONNECT "),
+		[]byte("TRACE "),
+	}
+)
+
+// Sniffer classifies new connections by peeking at their first bytes, it
+// never peeks further than the protocol it is checking needs. The http/2
+// preface is matched whole, the proxy serves no h2c and relays it to
+// Config.Fallback or refuses it.
+type Sniffer struct {
+	// FirstByte bounds the wait for the first byte. Clients that stay
+	// quiet, like those of server speaks first protocols, are unknown.
+	FirstByte time.Duration
+	// Timeouts bound, per protocol, how long the rest of the signature may
+	// take once the first byte pointed at that protocol.
+	Timeouts map[Protocol]time.Duration
+}
+
+func DefaultSniffer() Sniffer {
+	return Sniffer{
+		FirstByte: 5 * time.Second,
+		Timeouts: map[Protocol]time.Duration{
+			HttpProtocol:   5 * time.Second,
+			TlsProtocol:    2 * time.Second,
+			Socks4Protocol: 2 * time.Second,
+			Socks5Protocol: 2 * time.Second,
+			ProxyProtocol:  2 * time.Second,
+		},
+	}
+}
+
+// Sniff returns the protocol of the connection, the peeked bytes stay in r.
+// A connection that sends nothing within FirstByte is UnknownProtocol
+// without an error.
+func (s Sniffer) Sniff(conn net.Conn, r *bufio.Reader) (Protocol, error) {
+	if e := conn.SetReadDeadline(time.Now().Add(s.FirstByte)); e != nil {
+		return UnknownProtocol, e
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	first, e := r.Peek(1)
+	if e != nil {
+		var netErr net.Error
+		if errors.As(e, &netErr) && netErr.Timeout() {
+			return UnknownProtocol, nil
+		}
+		return UnknownProtocol, e
+	}
+
+	guess := HttpProtocol
+	switch first[0] {
+	case 0x16:
+		guess = TlsProtocol
+	case 0x04:
+		guess = Socks4Protocol
+	case 0x05:
+		guess = Socks5Protocol
+	case '\r':
+		guess = ProxyProtocol
+	}
+	if timeout, ok := s.Timeouts[guess]; ok {
+		if e := conn.SetReadDeadline(time.Now().Add(timeout)); e != nil {
+			return UnknownProtocol, e
+		}
+	}
+
+	p, e := sniff(r, first[0])
+	var netErr net.Error
+	if errors.As(e, &netErr) && netErr.Timeout() {
+		// the first byte fitted but the rest never came
+		return UnknownProtocol, nil
+	}
+	return p, e
+}
+
+func sniff(r *bufio.Reader, first byte) (Protocol, error) {
+	switch first {
+	case 0x16:
+		// ContentType handshake, ProtocolVersion 3.0 (ssl 3) up to 3.4
+		b, e := r.Peek(3)
+		if e != nil {
+			return UnknownProtocol, e
+		}
+		if b[1] == 0x03 && b[2] <= 0x04 {
+			return TlsProtocol, nil
+		}
+	case 0x04:
+		// VN CD DSTPORT DSTIP, then the NUL terminated USERID
+		b, e := r.Peek(8)
+		if e != nil {
+			return UnknownProtocol, e
+		}
+		if b[1] == 0x01 || b[1] == 0x02 {
+			return Socks4Protocol, nil
+		}
+	case 0x05:
+		// VER NMETHODS METHODS
+		b, e := r.Peek(2)
+		if e != nil {
+			return UnknownProtocol, e
+		}
+		if b[1] == 0 {
+			return UnknownProtocol, nil
+		}
+		if _, e := r.Peek(2 + int(b[1])); e != nil {
+			return UnknownProtocol, e
+		}
+		return Socks5Protocol, nil
+	case '\r':
+		return matchPrefix(r, ProxyProtocol, proxyV2Prefix)
+	}
+
+	for _, candidate := range []struct {
+		Protocol
+		prefix []byte
+	}{
+		{ProxyProtocol, proxyV1Prefix},
+		{Http2Protocol, http2Preface},
+	} {
+		if p, e := matchPrefix(r, candidate.Protocol, candidate.prefix); p != UnknownProtocol || e != nil {
+			return p, e
+		}
+	}
+	for _, method := range httpMethodsPeek {
+		if p, e := matchPrefix(r, HttpProtocol, method); p != UnknownProtocol || e != nil {
+			return p, e
+		}
+	}
+	return UnknownProtocol, nil
+}
+
+// matchPrefix peeks one byte at a time and gives up at the first one that
+// differs, so a short message of another protocol never blocks it.
+func matchPrefix(r *bufio.Reader, p Protocol, prefix []byte) (Protocol, error) {
+	for n := 1; n <= len(prefix); n++ {
+		b, e := r.Peek(n)
+		if e != nil {
+			return UnknownProtocol, e
+		}
+		if !bytes.Equal(b, prefix[:n]) {
+			return UnknownProtocol, nil
+		}
+	}
+	return p, nil
+}
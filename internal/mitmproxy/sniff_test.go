@@ -0,0 +1,108 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestSniff(t *testing.T) {
+	s := Sniffer{
+		FirstByte: 200 * time.Millisecond,
+		Timeouts:  map[Protocol]time.Duration{},
+	}
+	for _, p := range []Protocol{HttpProtocol, TlsProtocol, Socks4Protocol, Socks5Protocol, ProxyProtocol} {
+		s.Timeouts[p] = 200 * time.Millisecond
+	}
+	for _, tt := range []struct {
+		name string
+		data string
+		want Protocol
+	}{
+		{"tls 1.0 record", "\x16\x03\x01\x02\x00\x01", TlsProtocol},
+		{"tls 1.2 record", "\x16\x03\x03\x00\x7a\x02", TlsProtocol},
+		{"tls 1.3 record", "\x16\x03\x04\x00\x7a\x01", TlsProtocol},
+		{"socks4", "\x04\x01\x00\x50\x7f\x00\x00\x01\x00", Socks4Protocol},
+		{"socks4a", "\x04\x01\x01\xbb\x00\x00\x00\x01user\x00example.com\x00", Socks4Protocol},
+		{"socks5 proxifier", "\x05\x01\x00", Socks5Protocol},
+		{"socks5 two methods", "\x05\x02\x00\x02", Socks5Protocol},
+		{"http get", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", HttpProtocol},
+		{"http connect", "CONNECT example.com:443 HTTP/1.1\r\n\r\n", HttpProtocol},
+		{"http body with socks bytes", "POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\n\x05\x01", HttpProtocol},
+		{"h2c preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", Http2Protocol},
+		{"short h2c preface", "PRI * HTTP/2.0\r\n\r\n", UnknownProtocol},
+		{"proxy v1", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\r\n", ProxyProtocol},
+		{"proxy v2", "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c", ProxyProtocol},
+		{"ssh banner", "SSH-2.0-OpenSSH_9.6\r\n", UnknownProtocol},
+		{"short socks4", "\x04\x01\x00", UnknownProtocol},
+		{"silent client", "", UnknownProtocol},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer func() { mylog.CheckIgnore(client.Close()) }()
+			go func() {
+				if tt.data != "" {
+					mylog.Check2(io.WriteString(client, tt.data))
+				}
+			}()
+			r := bufio.NewReader(server)
+			got := mylog.Check2(s.Sniff(server, r))
+			assert.Equal(t, tt.want, got)
+			if tt.data != "" && got != UnknownProtocol {
+				// the sniffed bytes are still there for the handler
+				b := mylog.Check2(r.Peek(r.Buffered()))
+				assert.Equal(t, tt.data[:len(b)], string(b))
+			}
+			mylog.CheckIgnore(server.Close())
+		})
+	}
+}
+
+func TestSniffFallback(t *testing.T) {
+	backend := mylog.Check2(net.Listen("tcp", "localhost:0"))
+	defer func() { mylog.CheckIgnore(backend.Close()) }()
+	go func() {
+		for {
+			c, e := backend.Accept()
+			if e != nil {
+				return
+			}
+			line := mylog.Check2(bufio.NewReader(c).ReadString('\n'))
+			mylog.Check2(io.WriteString(c, "echo "+line))
+			mylog.CheckIgnore(c.Close())
+		}
+	}()
+
+	p := newTestProxy(t, func(c *Config) { c.Fallback = backend.Addr().String() })
+	// h2c is not served, its preface is relayed like an unknown protocol
+	for _, first := range []string{"SSH-2.0-test\n", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"} {
+		conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+		mylog.Check2(io.WriteString(conn, first))
+		line := mylog.Check2(bufio.NewReader(conn).ReadString('\n'))
+		mylog.CheckIgnore(conn.Close())
+		assert.Equal(t, "echo "+first[:strings.IndexByte(first, '\n')+1], line)
+	}
+}
+
+func TestSniffHttp2Refused(t *testing.T) {
+	sessions := make(chan *packet.Session, 1)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+	})
+	conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+	defer func() { mylog.CheckIgnore(conn.Close()) }()
+	mylog.Check2(io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	s := <-sessions
+	assert.True(t, errors.Is(s.Err, errUnsupportedProtocol))
+	assert.True(t, strings.Contains(s.Status, "h2c"))
+	_, e := conn.Read(make([]byte, 1))
+	assert.NotNil(t, e)
+}
@@ -1,7 +1,10 @@
 package mitmproxy
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/ddkwork/mitmproxy/internal/socks"
@@ -18,76 +21,141 @@ func (s *Socket5) SessionEvent(session *packet.Session) {
 	s.Socks5Handler.EventCallBack(session)
 }
 
-func (s *Socket4) Serve() {
+func (s *Socket4) Serve() error {
+	setFlow(s.ClientConn, TunnelFlow)
+	s.Socks4Handler = s.newHandler()
+	return s.Socks4Handler.Handle()
+}
+
+// Refuse turns away a client the proxy does not serve.
+func (s *Socket4) Refuse(err error) error {
+	s.Socks4Handler = s.newHandler()
+	return s.Socks4Handler.Refuse(err)
+}
+
+func (s *Socket4) newHandler() *socks.Socks4Handler {
 	options := &socks.Options{
-		Dialer: &net.Dialer{
-			Timeout:       dialTimeout,
-			Deadline:      time.Time{},
-			LocalAddr:     nil,
-			DualStack:     false,
-			FallbackDelay: 0,
-			KeepAlive:     dialTimeout,
-			Resolver:      nil,
-			Cancel:        nil,
-			Control:       nil,
-		},
-		Listener:    &net.ListenConfig{},
+		Dialer:      s.proxy.sessionDialer(s.Session),
 		AuthMethods: []socks.AuthMethod{socks.AuthMethodNotRequired},
 	}
+	if s.proxy.Auth.enabled() {
+		options.Ident = s.proxy.Auth.socks4Ident(s.Session)
+	}
 	socksConn := &socks.Conn{
 		Reader:  s.ReadWriter.Reader,
 		Writer:  s.ClientConn,
 		SendBuf: make([]byte, 4096),
 		RecvBuf: make([]byte, 4096),
 	}
+	s.proxy.startTLSRelay(s.Session, socksConn)
 	mylog.Info("Socket4 proxy")
-	s.Socks4Handler = &socks.Socks4Handler{
-		Session: s.Session,
-		Conn:    socksConn,
-		Dialer:  options.Dialer,
+	return &socks.Socks4Handler{
+		Session:  s.Session,
+		Conn:     socksConn,
+		Dialer:   options.Dialer,
+		Listener: s.proxy.bindListener(),
+		Resolver: lookupFunc(s.proxy.lookup),
+		Ident:    options.Ident,
+		Allow:    s.proxy.ACL.socksAllow(s.Session, lookupFunc(s.proxy.lookup)),
 	}
-	mylog.Check(s.Socks4Handler.Handle())
 }
 
-func (s *Socket4) ServeTls() {
-	// TODO implement me
-	panic("implement me")
+// ServeTls refuses the client, socks4 is not served inside tls.
+func (s *Socket4) ServeTls() error {
+	return fmt.Errorf("%w: socks4 over tls", errUnsupportedProtocol)
+}
+
+func (s *Socket5) Serve() error {
+	setFlow(s.ClientConn, TunnelFlow)
+	s.Socks5Handler = s.newHandler()
+	return s.Socks5Handler.Handle()
 }
 
-func (s *Socket5) Serve() {
+// Refuse turns away a client the proxy does not serve.
+func (s *Socket5) Refuse(err error) error {
+	s.Socks5Handler = s.newHandler()
+	return s.Socks5Handler.Refuse(err)
+}
+
+func (s *Socket5) newHandler() *socks.Socks5Handler {
 	options := &socks.Options{
-		Dialer: &net.Dialer{
-			Timeout:       dialTimeout,
-			Deadline:      time.Time{},
-			LocalAddr:     nil,
-			DualStack:     false,
-			FallbackDelay: 0,
-			KeepAlive:     dialTimeout,
-			Resolver:      nil,
-			Cancel:        nil,
-			Control:       nil,
-		},
-		Listener:    &net.ListenConfig{},
+		Dialer:      s.proxy.sessionDialer(s.Session),
 		AuthMethods: []socks.AuthMethod{socks.AuthMethodNotRequired},
 	}
+	if s.proxy.Auth.enabled() {
+		options.AuthMethods = []socks.AuthMethod{socks.AuthMethodUsernamePassword}
+		options.Authenticate = s.proxy.Auth.socks5Authenticate(s.Session)
+	}
 	socksConn := &socks.Conn{
 		Reader:  s.ReadWriter.Reader,
 		Writer:  s.ClientConn,
 		SendBuf: make([]byte, 4096),
 		RecvBuf: make([]byte, 4096),
 	}
+	s.proxy.startTLSRelay(s.Session, socksConn)
 	mylog.Info("Socket5 proxy")
-	s.Socks5Handler = &socks.Socks5Handler{
-		Session:      s.Session,
-		Conn:         socksConn,
-		Dialer:       options.Dialer,
-		AuthMethods:  options.AuthMethods,
-		Authenticate: options.Authenticate,
+	return &socks.Socks5Handler{
+		Session:        s.Session,
+		Conn:           socksConn,
+		Dialer:         options.Dialer,
+		Listener:       s.proxy.bindListener(),
+		AuthMethods:    options.AuthMethods,
+		Authenticate:   options.Authenticate,
+		Allow:          s.proxy.ACL.socksAllow(s.Session, lookupFunc(s.proxy.lookup)),
+		PacketListener: &net.ListenConfig{},
+		Resolver:       lookupFunc(s.proxy.lookup),
+	}
+}
+
+// ServeTls refuses the client, socks5 is not served inside tls.
+func (s *Socket5) ServeTls() error {
+	return fmt.Errorf("%w: socks5 over tls", errUnsupportedProtocol)
+}
+
+// socksBindListener opens the listeners of socks BIND requests as SocksBind
+// describes.
+type socksBindListener struct {
+	SocksBind
+}
+
+func (b socksBindListener) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	host, _, e := net.SplitHostPort(address)
+	if e != nil {
+		return nil, e
+	}
+	if b.Addr != "" {
+		host = b.Addr
+	}
+	var lc net.ListenConfig
+	from, to := b.Ports.From, b.Ports.To
+	if to < from {
+		to = from
+	}
+	var l net.Listener
+	for port := int(from); port <= int(to); port++ {
+		if l, e = lc.Listen(ctx, network, net.JoinHostPort(host, strconv.Itoa(port))); e == nil {
+			break
+		}
+	}
+	if e != nil {
+		return nil, e
+	}
+	if tl, ok := l.(*net.TCPListener); ok {
+		mylog.CheckIgnore(tl.SetDeadline(time.Now().Add(b.Timeout)))
+	}
+	return l, nil
+}
+
+// bindListener is the BIND listener of the handlers, nil when BIND is disabled.
+func (p *Proxy) bindListener() socks.Listener {
+	if p.SocksBind.Disabled {
+		return nil
 	}
-	mylog.Check(s.Socks5Handler.Handle())
+	return socksBindListener{p.SocksBind}
 }
 
-func (s *Socket5) ServeTls() {
-	// TODO implement me
-	panic("implement me")
+// startTLSRelay lets the STARTTLS relays carry the tunnels of c.
+func (p *Proxy) startTLSRelay(s *packet.Session, c *socks.Conn) {
+	client := &PeekedConn{Conn: s.ClientConn, Reader: s.ReadWriter.Reader}
+	c.Relay = func(target net.Conn) error { return p.relayStartTLS(c.Session, client, target, c.SessionEvent) }
 }
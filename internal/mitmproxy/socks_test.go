@@ -0,0 +1,233 @@
+package mitmproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/dissect"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestSocks5Associate(t *testing.T) {
+	echo := mylog.Check2(net.ListenPacket("udp", "127.0.0.1:0"))
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, e := echo.ReadFrom(buf)
+			if e != nil {
+				return
+			}
+			mylog.Check2(echo.WriteTo(buf[:n], addr))
+		}
+	}()
+	denied := netip.MustParseAddrPort("127.0.0.1:9")
+
+	datagrams := make(chan *packet.Session, 8)
+	p := newTestProxy(t, func(c *Config) {
+		c.ACL.Rules = []ACLRule{{Allow: false, Commands: []socks.Command{socks.AssociateCommand}, Ports: []PortRange{{9, 9}}}}
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.SchemerType == httpClient.UdpType {
+				datagrams <- s
+			}
+		}
+	})
+
+	control := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+	defer control.Close()
+	conn := socks.NewConn(control)
+	mylog.Check(conn.Write(&socks.MethodSelectRequest{Methods: []socks.AuthMethod{socks.AuthMethodNotRequired}}))
+	mylog.Check(conn.Read(&socks.MethodSelectResponse{}))
+	mylog.Check(conn.Write(&socks.Socks5Request{CMD: socks.AssociateCommand, Addr: "0.0.0.0:0"}))
+	resp := &socks.Socks5Response{}
+	mylog.Check(conn.Read(resp))
+	assert.Equal(t, socks.Socks5StatusGranted, resp.Status)
+
+	relay := mylog.Check2(net.ResolveUDPAddr("udp", resp.Addr))
+	client := mylog.Check2(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer client.Close()
+	for _, d := range []*socks.UDPDatagram{
+		{Addr: denied.String(), Data: []byte("denied")},
+		{Addr: echo.LocalAddr().String(), Data: []byte("ping")},
+	} {
+		b := mylog.Check2(d.MarshalBinary())
+		mylog.Check2(client.WriteTo(b, relay))
+	}
+
+	s := <-datagrams
+	assert.True(t, errors.Is(s.Err, packet.ErrDenied))
+	assert.Equal(t, denied.String(), s.Host)
+
+	s = <-datagrams
+	assert.Equal(t, packet.Outbound, s.StreamDirection)
+	assert.Equal(t, "ping", string(s.ReqBodyDecoder.Payload))
+	assert.Equal(t, httpClient.Socket5Type, s.Parent.SchemerType)
+
+	s = <-datagrams
+	assert.Equal(t, packet.Inbound, s.StreamDirection)
+	assert.Equal(t, echo.LocalAddr().String(), s.Host)
+	assert.Equal(t, "ping", string(s.RespBodyDecoder.Payload))
+
+	buf := make([]byte, 1500)
+	mylog.Check(client.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	n := mylog.Check2(client.Read(buf))
+	reply := &socks.UDPDatagram{}
+	mylog.Check(reply.UnmarshalBinary(buf[:n]))
+	assert.Equal(t, "ping", string(reply.Data))
+}
+
+func TestSocksBind(t *testing.T) {
+	children := make(chan *packet.Session, 8)
+	p := newTestProxy(t, func(c *Config) {
+		c.SocksBind.Timeout = 500 * time.Millisecond
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.Parent != nil {
+				children <- s
+			}
+		}
+	})
+	bind := func(expected string) (*socks.Conn, net.Conn, string) {
+		control := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+		conn := socks.NewConn(control)
+		mylog.Check(conn.Write(&socks.MethodSelectRequest{Methods: []socks.AuthMethod{socks.AuthMethodNotRequired}}))
+		mylog.Check(conn.Read(&socks.MethodSelectResponse{}))
+		mylog.Check(conn.Write(&socks.Socks5Request{CMD: socks.BindCommand, Addr: expected}))
+		resp := &socks.Socks5Response{}
+		mylog.Check(conn.Read(resp))
+		assert.Equal(t, socks.Socks5StatusGranted, resp.Status)
+		return conn, control, resp.Addr
+	}
+
+	t.Run("inbound", func(t *testing.T) {
+		conn, control, addr := bind("127.0.0.1:0")
+		defer control.Close()
+		server := mylog.Check2(net.Dial("tcp", addr))
+		defer server.Close()
+		resp := &socks.Socks5Response{}
+		mylog.Check(conn.Read(resp))
+		assert.Equal(t, socks.Socks5StatusGranted, resp.Status)
+		assert.Equal(t, server.LocalAddr().String(), resp.Addr)
+
+		mylog.Check2(server.Write([]byte("220 ready")))
+		buf := make([]byte, 9)
+		mylog.Check2(io.ReadFull(conn.Reader, buf))
+		assert.Equal(t, "220 ready", string(buf))
+
+		s := <-children
+		assert.Equal(t, server.LocalAddr().String(), s.Host)
+		assert.Equal(t, socks.BindCommand.String(), s.Method)
+		assert.Equal(t, "127.0.0.1:0", s.Parent.Host)
+	})
+
+	t.Run("unexpected peer", func(t *testing.T) {
+		conn, control, addr := bind("192.0.2.1:0")
+		defer control.Close()
+		server := mylog.Check2(net.Dial("tcp", addr))
+		defer server.Close()
+		resp := &socks.Socks5Response{}
+		mylog.Check(conn.Read(resp))
+		assert.Equal(t, socks.Socks5StatusNotAllowed, resp.Status)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		conn, control, _ := bind("127.0.0.1:0")
+		defer control.Close()
+		resp := &socks.Socks5Response{}
+		mylog.Check(conn.Read(resp))
+		assert.Equal(t, socks.Socks5StatusTTLExpired, resp.Status)
+	})
+}
+
+func TestSocksBindProxyHeader(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) {
+		c.SocksBind.Timeout = 500 * time.Millisecond
+		c.ProxyHeaders = ProxyHeaders{Accept: true, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	})
+	control := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+	defer control.Close()
+	// the header claims an address of the balancer, not one of the proxy
+	mylog.Check2(io.WriteString(control, "PROXY TCP4 192.0.2.1 198.51.100.7 51000 1080\r\n"))
+	conn := socks.NewConn(control)
+	mylog.Check(conn.Write(&socks.MethodSelectRequest{Methods: []socks.AuthMethod{socks.AuthMethodNotRequired}}))
+	mylog.Check(conn.Read(&socks.MethodSelectResponse{}))
+	mylog.Check(conn.Write(&socks.Socks5Request{CMD: socks.BindCommand, Addr: "127.0.0.1:0"}))
+	resp := &socks.Socks5Response{}
+	mylog.Check(conn.Read(resp))
+	assert.Equal(t, socks.Socks5StatusGranted, resp.Status)
+	host, _ := mylog.Check3(net.SplitHostPort(resp.Addr))
+	assert.Equal(t, "127.0.0.1", host)
+}
+
+func TestSocksStream(t *testing.T) {
+	server := mylog.Check2(net.Listen("tcp", "127.0.0.1:0"))
+	defer server.Close()
+	go func() {
+		conn, e := server.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		for _, reply := range []string{"+OK\r\n", "+PONG\r\n"} {
+			if _, e := conn.Read(buf); e != nil {
+				return
+			}
+			mylog.Check2(io.WriteString(conn, reply))
+		}
+	}()
+
+	sessions := make(chan *packet.Session, 16)
+	messages := make(chan *packet.Session, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.StreamLimit = -1
+		c.Dissectors = dissect.Default()
+		c.SessionEventCallBack = func(s *packet.Session) {
+			switch {
+			case s.Parent != nil:
+				messages <- s
+			case s.SchemerType == httpClient.Socket5Type:
+				sessions <- s
+			}
+		}
+	})
+	auth, ping := "*2\r\n$4\r\nAUTH\r\n$1\r\nx\r\n", "*1\r\n$4\r\nPING\r\n"
+	conn := mylog.Check2(socks.NewSocks5Dialer("tcp", p.Addrs()[0].String()).Dial("tcp", server.Addr().String()))
+	buf := make([]byte, 64)
+	for _, request := range []string{auth, ping} {
+		mylog.Check2(io.WriteString(conn, request))
+		mylog.Check2(conn.Read(buf))
+	}
+	mylog.Check(conn.Close())
+
+	s := <-sessions
+	for len(s.Stream.Conversation()) < 4 {
+		s = <-sessions
+	}
+	var got []string
+	for _, segment := range s.Stream.Conversation() {
+		got = append(got, segment.StreamDirection.String()+" "+string(segment.Payload))
+	}
+	assert.Equal(t, []string{
+		packet.Outbound.String() + " " + auth,
+		packet.Inbound.String() + " +OK\r\n",
+		packet.Outbound.String() + " " + ping,
+		packet.Inbound.String() + " +PONG\r\n",
+	}, got)
+	assert.Equal(t, auth+ping, string(mylog.Check2(io.ReadAll(s.Stream.Reader(packet.Outbound)))))
+
+	for _, want := range []string{"AUTH x", "OK", "PING", "PONG"} {
+		m := <-messages
+		assert.Equal(t, "redis", m.ContentType)
+		assert.Equal(t, want, strings.TrimSpace(m.Method+" "+m.Path+m.Status))
+		assert.True(t, m.Parent == s)
+	}
+}
@@ -0,0 +1,273 @@
+package mitmproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// sseMaxLine is how long a line of an event stream may grow before the
+// stream is no longer parsed, it is still relayed.
+const sseMaxLine = 1 << 20
+
+type (
+	// sseEvent is one event of a text/event-stream body.
+	sseEvent struct {
+		ID    string
+		Event string
+		Data  string
+		// Retry is the reconnection time the event set, zero when it set
+		// none.
+		Retry time.Duration
+	}
+
+	// sseParser splits an event stream into events as it is written, lines
+	// may end in \r\n, \n or \r and may be cut anywhere.
+	sseParser struct {
+		emit func(sseEvent)
+		done bool
+		line []byte
+		// skipLF drops the \n of a \r\n cut after its \r
+		skipLF bool
+		data   []byte
+		next   sseEvent
+		// lastID is kept across events like the last event id of a client
+		lastID string
+	}
+
+	// eventWriter takes the body of an event stream as it goes through.
+	eventWriter interface{ Write(p []byte) }
+
+	// gzipEvents decodes a gzip encoded event stream for its parser, the
+	// client still gets the stream encoded.
+	gzipEvents struct {
+		w    *io.PipeWriter
+		done chan struct{}
+	}
+
+	// flushingReader passes a streamed body on to the client, what was
+	// written is flushed before it waits for more.
+	flushingReader struct {
+		src    io.Reader
+		flush  func() error
+		events eventWriter
+	}
+
+	// writerOnly hides ReadFrom of a bufio.Writer, a body is then copied
+	// through a buffer of its own and flushing between reads is safe.
+	writerOnly struct{ io.Writer }
+)
+
+func isEventStream(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+func (r *flushingReader) Read(p []byte) (int, error) {
+	if e := r.flush(); e != nil {
+		return 0, e
+	}
+	n, e := r.src.Read(p)
+	if r.events != nil {
+		r.events.Write(p[:n])
+	}
+	return n, e
+}
+
+func (s *sseParser) Write(p []byte) {
+	for len(p) > 0 && !s.done {
+		if s.skipLF && p[0] == '\n' {
+			p = p[1:]
+		}
+		s.skipLF = false
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			s.line = append(s.line, p...)
+			if len(s.line) > sseMaxLine {
+				mylog.Warning("sse", "line longer than "+strconv.Itoa(sseMaxLine)+" bytes, events are no longer parsed")
+				s.done = true
+			}
+			return
+		}
+		s.line = append(s.line, p[:i]...)
+		s.skipLF = p[i] == '\r'
+		p = p[i+1:]
+		s.field(string(s.line))
+		s.line = s.line[:0]
+	}
+}
+
+func (s *sseParser) field(line string) {
+	if line == "" {
+		s.dispatch()
+		return
+	}
+	if line[0] == ':' { // a comment, like a keep alive
+		return
+	}
+	name, value, _ := strings.Cut(line, ":")
+	value = strings.TrimPrefix(value, " ")
+	switch name {
+	case "event":
+		s.next.Event = value
+	case "data":
+		s.data = append(append(s.data, value...), '\n')
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			s.lastID = value
+		}
+	case "retry":
+		if ms, e := strconv.ParseUint(value, 10, 32); e == nil {
+			s.next.Retry = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+// dispatch emits the event a blank line ended, events without data are
+// dropped like browsers do.
+func (s *sseParser) dispatch() {
+	event := s.next
+	s.next = sseEvent{}
+	if len(s.data) == 0 {
+		return
+	}
+	event.ID = s.lastID
+	event.Data = string(s.data[:len(s.data)-1])
+	if event.Event == "" {
+		event.Event = "message"
+	}
+	s.data = s.data[:0]
+	s.emit(event)
+}
+
+// closeEvents waits for the last events of a stream that is decoded.
+func closeEvents(events eventWriter) {
+	if c, ok := events.(io.Closer); ok {
+		mylog.CheckIgnore(c.Close())
+	}
+}
+
+// writeResponse writes the response to the client while it arrives instead
+// of reading all of it first. An event stream is emitted before its body
+// and each of its events as a child, other responses are emitted once their
+// body went through.
+func (h *Http) writeResponse() error {
+	body := h.Response.Body
+	defer func() { mylog.CheckIgnore(body.Close()) }()
+	defer h.proxy.removeSpills(h.reqBody, h.respBody)
+	r := &flushingReader{src: packet.TeeBody(body, h.respBody), flush: h.ReadWriter.Flush}
+	eventStream := isEventStream(h.Response)
+	if eventStream {
+		h.emitResponse()
+		r.events = newEventWriter(h.Session, h.SessionEvent)
+		defer closeEvents(r.events)
+	}
+	var src io.Reader = r
+	if h.proxy.PreserveChunks && h.chunks != nil {
+		src = &chunkReader{src: r, log: h.chunks}
+	}
+	h.Response.Body = io.NopCloser(src)
+	h.Response.Close = true // one exchange per client connection
+	e := h.Response.Write(writerOnly{h.ReadWriter})
+	if e == nil {
+		e = h.ReadWriter.Flush()
+	}
+	h.timings.mark(func(t *packet.Timings) *time.Time { return &t.Done })
+	if !eventStream {
+		h.emitResponse()
+	}
+	if e != nil {
+		return e
+	}
+	return h.Err
+}
+
+// newEventWriter parses the event stream of s as it goes through, a gzip
+// encoded one is decoded first. The events of other encodings are not
+// parsed, the stream is only relayed.
+func newEventWriter(s *packet.Session, fallback packet.SessionEventCallBack) eventWriter {
+	events := newEventParser(s, fallback)
+	switch encoding := s.Response.Header.Get("Content-Encoding"); strings.ToLower(encoding) {
+	case "", "identity":
+		return events
+	case "gzip", "x-gzip":
+		r, w := io.Pipe()
+		g := &gzipEvents{w: w, done: make(chan struct{})}
+		go func() {
+			defer close(g.done)
+			// unblocks the writes of the rest of a stream that stopped
+			// decoding
+			defer func() { mylog.CheckIgnore(r.Close()) }()
+			zr, e := gzip.NewReader(r)
+			buf := make([]byte, 32<<10)
+			for e == nil {
+				var n int
+				n, e = zr.Read(buf)
+				events.Write(buf[:n])
+			}
+			if e != io.EOF && e != io.ErrUnexpectedEOF { // not a stream cut short
+				mylog.Warning("sse", "events are no longer parsed: "+e.Error())
+			}
+		}()
+		return g
+	default:
+		mylog.Warning("sse", "events of a "+encoding+" encoded stream are not parsed")
+		return nil
+	}
+}
+
+func (g *gzipEvents) Write(p []byte) {
+	if len(p) > 0 {
+		_, _ = g.w.Write(p)
+	}
+}
+
+// Close ends the stream and waits for the events left in it.
+func (g *gzipEvents) Close() error {
+	e := g.w.Close()
+	<-g.done
+	return e
+}
+
+// newEventParser emits the events of the event stream of s as its children
+// numbered from 1, fallback handles them when s has no callback.
+func newEventParser(s *packet.Session, fallback packet.SessionEventCallBack) *sseParser {
+	var seq uint64
+	return &sseParser{emit: func(e sseEvent) {
+		seq++
+		emitEvent(s, seq, e, fallback)
+	}}
+}
+
+// emitEvent sends an event of an event stream as a child of s.
+func emitEvent(s *packet.Session, seq uint64, e sseEvent, fallback packet.SessionEventCallBack) {
+	child := s.NewChild(s.SchemerType)
+	child.Request = s.Request
+	child.Response = s.Response
+	child.StreamDirection = packet.Outbound
+	child.Host = s.Host
+	child.Path = s.Path
+	child.Method = e.Event
+	child.ContentType = "text/event-stream"
+	child.ContentLength = len(e.Data)
+	child.Note = e.ID
+	if e.Retry > 0 {
+		child.Status = "retry " + e.Retry.String()
+	}
+	child.Seq = seq
+	child.Time = time.Now()
+	child.RespBodyDecoder.Payload = []byte(e.Data)
+	if child.EventCallBack == nil {
+		fallback(child)
+	} else {
+		child.EventCallBack(child)
+	}
+}
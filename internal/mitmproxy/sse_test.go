@@ -0,0 +1,112 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+func TestServerSentEvents(t *testing.T) {
+	more := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		mylog.Check2(io.WriteString(w, ": hello\nretry: 3000\nid: 1\ndata: first\n\n"))
+		w.(http.Flusher).Flush()
+		// the rest only comes once the client saw the first event
+		<-more
+		mylog.Check2(io.WriteString(w, "event: update\r\ndata: a\r\ndata: b\r\n\r\nevent: empty\n\ndata: last\n\n"))
+	}))
+	defer backend.Close()
+
+	sessions := make(chan *packet.Session, 8)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+	})
+	resp := mylog.Check2(proxyClient(p).Get(strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1) + "/events"))
+	defer resp.Body.Close()
+	body := bufio.NewReader(resp.Body)
+	for {
+		line := mylog.Check2(body.ReadString('\n'))
+		if line == "\n" {
+			break
+		}
+	}
+	close(more)
+	rest := mylog.Check2(io.ReadAll(body))
+	assert.Equal(t, "event: update\r\ndata: a\r\ndata: b\r\n\r\nevent: empty\n\ndata: last\n\n", string(rest))
+
+	parent := <-sessions
+	assert.True(t, parent.Parent == nil)
+	assert.Equal(t, "200 OK", parent.Status)
+	for i, want := range []struct {
+		event, data, id, status string
+	}{
+		{"message", "first", "1", "retry 3s"},
+		{"update", "a\nb", "1", ""},
+		{"message", "last", "1", ""},
+	} {
+		var s *packet.Session
+		select {
+		case s = <-sessions:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		assert.True(t, s.Parent == parent)
+		assert.Equal(t, uint64(i+1), s.Seq)
+		assert.Equal(t, want.event, s.Method)
+		assert.Equal(t, want.data, string(s.RespBodyDecoder.Payload))
+		assert.Equal(t, want.id, s.Note)
+		assert.Equal(t, want.status, s.Status)
+	}
+}
+
+func TestServerSentEventsGzip(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		for _, event := range []string{"data: first\n\n", "event: update\ndata: second\n\n"} {
+			mylog.Check2(io.WriteString(zw, event))
+			mylog.Check(zw.Flush())
+			w.(http.Flusher).Flush()
+		}
+		mylog.Check(zw.Close())
+	}))
+	defer backend.Close()
+
+	sessions := make(chan *packet.Session, 8)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- s }
+	})
+	resp := mylog.Check2(proxyClient(p).Get(strings.Replace(backend.URL, httpClient.Localhost, "localhost", 1) + "/events"))
+	// the client decodes the stream, it went through encoded
+	body := mylog.Check2(io.ReadAll(resp.Body))
+	mylog.Check(resp.Body.Close())
+	assert.True(t, resp.Uncompressed)
+	assert.Equal(t, "data: first\n\nevent: update\ndata: second\n\n", string(body))
+
+	parent := <-sessions
+	assert.True(t, parent.Parent == nil)
+	for i, want := range []struct{ event, data string }{{"message", "first"}, {"update", "second"}} {
+		var s *packet.Session
+		select {
+		case s = <-sessions:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		assert.True(t, s.Parent == parent)
+		assert.Equal(t, uint64(i+1), s.Seq)
+		assert.Equal(t, want.event, s.Method)
+		assert.Equal(t, want.data, string(s.RespBodyDecoder.Payload))
+	}
+}
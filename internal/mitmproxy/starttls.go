@@ -0,0 +1,288 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+type (
+	// StartTLS configures the relays of plain text protocols that switch to
+	// tls in the middle of a session. The relay answers the switch with a
+	// certificate of the CA and speaks tls to the server itself, so what
+	// follows is captured in plain text too.
+	StartTLS struct {
+		Disabled bool
+		// Ports maps ports to the protocol spoken on them: smtp, imap, pop3
+		// or ftp. Nil uses DefaultStartTLSPorts.
+		Ports map[uint16]string
+	}
+
+	// upgrader knows the command of a protocol that asks for tls and the
+	// reply that grants it.
+	upgrader struct {
+		command func(line []byte) bool
+		// reply reports whether line ends the reply to command and whether
+		// the server agreed.
+		reply func(command, line []byte) (final, ok bool)
+	}
+
+	// lineRelay relays a line protocol one line at a time, so it can stop
+	// right where the tls handshake begins.
+	lineRelay struct {
+		session        *packet.Session
+		upgrader       upgrader
+		fallback       packet.SessionEventCallBack
+		client, server net.Conn
+		clientReader   *bufio.Reader
+		serverReader   *bufio.Reader
+		// command is the upgrade command waiting for its reply, it is set
+		// before upgrading is
+		command []byte
+	}
+)
+
+var upgraders = map[string]upgrader{
+	"smtp": {command: verb("STARTTLS"), reply: replyCode("220")},
+	"pop3": {command: verb("STLS"), reply: func(_, line []byte) (bool, bool) {
+		return true, bytes.HasPrefix(line, []byte("+OK"))
+	}},
+	"ftp": {command: verb("AUTH TLS", "AUTH SSL", "AUTH TLS-C"), reply: replyCode("234")},
+	"imap": {
+		command: func(line []byte) bool {
+			fields := bytes.Fields(line)
+			return len(fields) == 2 && bytes.EqualFold(fields[1], []byte("STARTTLS"))
+		},
+		// the reply is the line tagged like the command, the untagged
+		// lines before it do not end it
+		reply: func(command, line []byte) (bool, bool) {
+			tag := bytes.Fields(command)[0]
+			fields := bytes.Fields(line)
+			if len(fields) < 2 || !bytes.Equal(fields[0], tag) {
+				return false, false
+			}
+			return true, bytes.EqualFold(fields[1], []byte("OK"))
+		},
+	},
+}
+
+// DefaultStartTLSPorts are the plain text ports of the protocols with a
+// STARTTLS relay.
+func DefaultStartTLSPorts() map[uint16]string {
+	return map[uint16]string{
+		21:   "ftp",
+		25:   "smtp",
+		110:  "pop3",
+		143:  "imap",
+		587:  "smtp",
+		2525: "smtp",
+	}
+}
+
+// verb matches a command line that is one of commands.
+func verb(commands ...string) func(line []byte) bool {
+	return func(line []byte) bool {
+		line = bytes.TrimSpace(line)
+		for _, c := range commands {
+			if bytes.EqualFold(line, []byte(c)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// replyCode matches the reply of smtp and ftp, a 3 digit code followed by
+// a dash on every line but the last.
+func replyCode(code string) func(command, line []byte) (bool, bool) {
+	return func(_, line []byte) (bool, bool) {
+		if len(line) < 4 || line[3] == '-' {
+			return false, false
+		}
+		return true, bytes.HasPrefix(line, []byte(code))
+	}
+}
+
+// relayStartTLS relays a tunnel of s to a port with a STARTTLS protocol,
+// every line goes to the stream of s on its own. It returns
+// errors.ErrUnsupported for the tunnels of other ports.
+func (p *Proxy) relayStartTLS(s *packet.Session, client, server net.Conn, fallback packet.SessionEventCallBack) error {
+	if p.StartTLS.Disabled {
+		return errors.ErrUnsupported
+	}
+	host, port, e := net.SplitHostPort(s.Host)
+	if e != nil {
+		return errors.ErrUnsupported
+	}
+	n, e := strconv.ParseUint(port, 10, 16)
+	if e != nil {
+		return errors.ErrUnsupported
+	}
+	u, ok := upgraders[p.StartTLS.Ports[uint16(n)]]
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	defer func() {
+		mylog.CheckIgnore(client.Close())
+		mylog.CheckIgnore(server.Close())
+	}()
+	r := &lineRelay{
+		session:      s,
+		upgrader:     u,
+		fallback:     fallback,
+		client:       client,
+		server:       server,
+		clientReader: bufio.NewReader(client),
+		serverReader: bufio.NewReader(server),
+	}
+	upgraded, e := r.run()
+	if e != nil || !upgraded {
+		return e
+	}
+
+	// what the readers hold already is the start of the handshakes
+	tlsClient := tls.Server(&PeekedConn{Conn: client, Reader: r.clientReader}, p.ca.NewTlsConfigForHost(host))
+	config := p.upstreamTLSConfig()
+	config.ServerName = host
+	tlsServer := tls.Client(&PeekedConn{Conn: server, Reader: r.serverReader}, config)
+	ctx, cancel := context.WithTimeout(p.flowCtx, p.Timeouts.TLSHandshake)
+	defer cancel()
+	if e := tlsClient.HandshakeContext(ctx); e != nil {
+		return r.fail(fmt.Errorf("tls handshake with client: %w", e))
+	}
+	if e := tlsServer.HandshakeContext(ctx); e != nil {
+		return r.fail(fmt.Errorf("tls handshake with %s: %w", s.Host, e))
+	}
+	s.SchemerType = httpClient.TcpTlsType
+	r = &lineRelay{
+		session:      s,
+		fallback:     fallback,
+		client:       tlsClient,
+		server:       tlsServer,
+		clientReader: bufio.NewReader(tlsClient),
+		serverReader: bufio.NewReader(tlsServer),
+	}
+	_, e = r.run()
+	return e
+}
+
+// run relays until either side ends or the server grants tls, in the last
+// case both readers stop right after the reply.
+func (r *lineRelay) run() (upgraded bool, err error) {
+	var upgrading atomic.Bool
+	verdict := make(chan bool, 1)
+	stopped := make(chan struct{})
+	replies := make(chan error, 1)
+	go func() {
+		defer close(stopped)
+		replies <- r.replies(&upgrading, verdict)
+	}()
+	upgraded, err = r.commands(&upgrading, verdict, stopped)
+	if upgraded {
+		return true, <-replies
+	}
+	mylog.CheckIgnore(r.client.Close())
+	mylog.CheckIgnore(r.server.Close())
+	if e := <-replies; err == nil || relayEnded(err) {
+		err = e
+	}
+	if relayEnded(err) {
+		err = nil
+	}
+	return false, err
+}
+
+// relayEnded reports whether err is one side hanging up, which ends a relay
+// without a failure.
+func relayEnded(err error) bool { return isCloseable(err) || errors.Is(err, net.ErrClosed) }
+
+// commands relays the lines of the client, after an upgrade command it
+// waits for the reply before reading on.
+func (r *lineRelay) commands(upgrading *atomic.Bool, verdict <-chan bool, stopped <-chan struct{}) (bool, error) {
+	for {
+		line, e := readLine(r.clientReader)
+		if len(line) > 0 {
+			upgrade := r.upgrader.command != nil && r.upgrader.command(line)
+			if upgrade {
+				r.command = bytes.Clone(line)
+				upgrading.Store(true)
+			}
+			r.session.Record(packet.Outbound, line, r.fallback)
+			if _, e := r.server.Write(line); e != nil {
+				return false, e
+			}
+			if upgrade {
+				select {
+				case ok := <-verdict:
+					if ok {
+						return true, nil
+					}
+				case <-stopped:
+					return false, nil
+				}
+			}
+		}
+		if e != nil {
+			return false, e
+		}
+	}
+}
+
+// replies relays the lines of the server and hands the reply to an upgrade
+// command to commands.
+func (r *lineRelay) replies(upgrading *atomic.Bool, verdict chan<- bool) error {
+	for {
+		line, e := readLine(r.serverReader)
+		if len(line) > 0 {
+			r.session.Record(packet.Inbound, line, r.fallback)
+			if _, e := r.client.Write(line); e != nil {
+				return e
+			}
+			if upgrading.Load() {
+				if final, ok := r.upgrader.reply(r.command, line); final {
+					upgrading.Store(false)
+					verdict <- ok
+					if ok {
+						return nil
+					}
+				}
+			}
+		}
+		if e != nil {
+			return e
+		}
+	}
+}
+
+// fail emits the session as failed with err.
+func (r *lineRelay) fail(err error) error {
+	r.session.Err = err
+	r.session.StreamDirection = packet.Outbound
+	r.session.Status = err.Error()
+	if r.session.EventCallBack == nil {
+		r.fallback(r.session)
+	} else {
+		r.session.EventCallBack(r.session)
+	}
+	return err
+}
+
+// readLine reads up to and including the next newline, lines longer than
+// the buffer come in pieces.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, e := r.ReadSlice('\n')
+	if errors.Is(e, bufio.ErrBufferFull) {
+		e = nil
+	}
+	return line, e
+}
@@ -0,0 +1,135 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/dissect"
+	"github.com/ddkwork/mitmproxy/internal/socks"
+	"github.com/ddkwork/mitmproxy/internal/testcert"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// smtpServer answers every connection of l as a mail server that offers
+// STARTTLS.
+func smtpServer(l net.Listener, config *tls.Config) {
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r, w := bufio.NewReader(conn), conn
+			reply := func(lines ...string) {
+				for _, line := range lines {
+					_, _ = w.Write([]byte(line + "\r\n"))
+				}
+			}
+			reply("220 localhost ESMTP")
+			for {
+				line, e := r.ReadString('\n')
+				if e != nil {
+					return
+				}
+				switch verb, _, _ := strings.Cut(strings.TrimSpace(line), " "); strings.ToUpper(verb) {
+				case "EHLO":
+					reply("250-localhost", "250 STARTTLS")
+				case "STARTTLS":
+					reply("220 go ahead")
+					tlsConn := tls.Server(conn, config)
+					r, w = bufio.NewReader(tlsConn), tlsConn
+				case "QUIT":
+					reply("221 bye")
+					return
+				default:
+					reply("250 ok")
+				}
+			}
+		}()
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	cert := mylog.Check2(tls.X509KeyPair(testcert.LocalhostCert, testcert.LocalhostKey))
+	server := mylog.Check2(net.Listen("tcp", "127.0.0.1:0"))
+	defer server.Close()
+	go smtpServer(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+	target := server.Addr().String()
+	_, port, _ := net.SplitHostPort(target)
+	n := uint16(mylog.Check2(strconv.ParseUint(port, 10, 16)))
+
+	messages := make(chan *packet.Session, 32)
+	p := newTestProxy(t, func(c *Config) {
+		c.StartTLS.Ports = map[uint16]string{n: "smtp"}
+		c.Dissectors = dissect.NewRegistry()
+		c.Dissectors.Register(dissect.Lines{Label: "smtp"}, n)
+		c.Forwards = []Forward{{Listen: "127.0.0.1:0", Target: target}}
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.Parent != nil {
+				messages <- s
+			}
+		}
+	})
+	upstream := x509.NewCertPool()
+	upstream.AppendCertsFromPEM(testcert.LocalhostCert)
+	p.transport.(*http.Transport).TLSClientConfig.RootCAs = upstream
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA())
+
+	for _, dial := range []func() net.Conn{
+		func() net.Conn { return mylog.Check2(net.Dial("tcp", p.ForwardAddrs()[0].String())) },
+		func() net.Conn {
+			return mylog.Check2(socks.NewSocks5Dialer("tcp", p.Addrs()[0].String()).Dial("tcp", target))
+		},
+	} {
+		c := mylog.Check2(smtp.NewClient(dial(), "127.0.0.1"))
+		mylog.Check(c.Hello("localhost"))
+		mylog.Check(c.StartTLS(&tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}))
+		_, secure := c.TLSConnectionState()
+		assert.True(t, secure)
+		mylog.Check(c.Mail("bob@localhost"))
+		mylog.Check(c.Quit())
+
+		type message struct{ method, path, status string }
+		var got []message
+		for len(got) == 0 || got[len(got)-1].status != "221 bye" {
+			m := <-messages
+			assert.Equal(t, "smtp", m.ContentType)
+			got = append(got, message{m.Method, m.Path, m.Status})
+			if m.Method == "MAIL" {
+				assert.Equal(t, httpClient.TcpTlsType, m.Parent.SchemerType)
+			}
+		}
+		want := []message{
+			{status: "220 localhost ESMTP"},
+			{method: "EHLO", path: "localhost"},
+			{status: "250-localhost"},
+			{status: "250 STARTTLS"},
+			{method: "STARTTLS"},
+			{status: "220 go ahead"},
+			{method: "EHLO", path: "localhost"},
+			{status: "250-localhost"},
+			{status: "250 STARTTLS"},
+			{method: "MAIL", path: "FROM:<bob@localhost>"},
+			{status: "250 ok"},
+			{method: "QUIT"},
+			{status: "221 bye"},
+		}
+		assert.Equal(t, len(want), len(got))
+		for i := range want {
+			assert.Equal(t, fmt.Sprint(want[i]), fmt.Sprint(got[i]))
+		}
+	}
+}
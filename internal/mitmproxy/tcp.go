@@ -1,9 +1,11 @@
 package mitmproxy
 
 import (
-	"io"
+	"crypto/tls"
+	"fmt"
 	"net"
-	"time"
+	"net/http"
+	"net/url"
 
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
@@ -19,46 +21,128 @@ func (t *Tcp) SessionEvent(session *packet.Session) {
 	}
 }
 
-func (t *Tcp) ServeTls() {
-	// TODO implement me
-	panic("implement me")
+// ServeTls relays a terminated tls tunnel whose decrypted stream is not
+// http over a new tls connection to t.Request.Host, the sessions carry the
+// plain text.
+func (t *Tcp) ServeTls() error {
+	if t.Request == nil {
+		return fmt.Errorf("%w: tls tunnel without a target", errUnsupportedProtocol)
+	}
+	setFlow(t.ClientConn, TunnelFlow)
+	config := t.proxy.upstreamTLSConfig()
+	config.ServerName = t.Request.URL.Hostname()
+	// the server is offered what the client agreed on, nothing when it
+	// asked for no protocol
+	config.NextProtos = nil
+	if c, ok := t.ClientConn.(*tls.Conn); ok {
+		state := c.ConnectionState()
+		if state.ServerName != "" {
+			config.ServerName = state.ServerName
+		}
+		if state.NegotiatedProtocol != "" {
+			config.NextProtos = []string{state.NegotiatedProtocol}
+		}
+	}
+	server, e := t.dial(httpClient.TcpTlsType)
+	if e != nil {
+		return e
+	}
+	server, e = t.originate(server, config)
+	if e != nil {
+		return e
+	}
+	client := &PeekedConn{Conn: t.ClientConn, Reader: t.ReadWriter.Reader}
+	return t.relay(client, server)
+}
+
+// upstreamTLSConfig is a copy of the tls config of the http transport, raw
+// tls tunnels trust the same servers as https.
+func (p *Proxy) upstreamTLSConfig() *tls.Config {
+	if t, ok := p.transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		return t.TLSClientConfig.Clone()
+	}
+	return &tls.Config{}
+}
+
+// originate speaks tls over server, a failed handshake closes it.
+func (t *Tcp) originate(server net.Conn, config *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(server, config)
+	if e := t.handshake(tlsConn); e != nil {
+		mylog.CheckIgnore(server.Close())
+		return nil, t.fail(fmt.Errorf("tls handshake with %s: %w", t.Request.Host, e))
+	}
+	return tlsConn, nil
 }
 
-func (t *Tcp) Serve() {
-	server := mylog.Check2(net.DialTimeout("tcp", t.Request.Host, 10*time.Second))
+func (t *Tcp) Serve() error {
+	setFlow(t.ClientConn, TunnelFlow)
 	t.Request.Close = false
 	t.Request.URL.Scheme = "tcp"
-	t.SchemerType = httpClient.TcpType
 	RemoveExtraHTTPHostPort(t.Request)
-	t.Packet = packet.MakeHttpRequestPacket(t.Request, t.Process, t.SchemerType)
+	server, e := t.dial(httpClient.TcpType)
+	if e != nil {
+		if we := packet.WriteResponse(t.Response, t.ReadWriter); we != nil {
+			return we
+		}
+		return e
+	}
 
 	// p.RequestEvent(t)
-	if t.Response.ContentLength > 0 {
-		panic(t.Response.ContentLength)
-		// return p.ServeHttp(t)
+	return t.relay(t.ClientConn, server)
+}
+
+// Forward relays a connection nothing could be sniffed from to addr as raw
+// tcp, the bytes peeked while sniffing are sent first.
+func (t *Tcp) Forward(addr string) error {
+	setFlow(t.ClientConn, TunnelFlow)
+	t.Request = tcpRequest(addr).WithContext(t.proxy.flowCtx)
+	server, e := t.dial(httpClient.TcpType)
+	if e != nil { // the client speaks an unknown protocol, no reply fits
+		return e
 	}
-	go t.transfer(t.Session, t.ClientConn, server, packet.Inbound)
-	t.transfer(t.Session, server, t.ClientConn, packet.Outbound)
+	client := &PeekedConn{Conn: t.ClientConn, Reader: t.ReadWriter.Reader}
+	return t.relay(client, server)
 }
 
-func tcpTuner() { // tcp代理是点对点的p2p全双工通信，无头协议，必须知道双方的ip和端口才能代理，俗称隧道
-	// 监听本地端口
-	localAddr := mylog.Check2(net.ResolveTCPAddr("tcp", ":8080"))
-	localListener := mylog.Check2(net.ListenTCP("tcp", localAddr))
+// tcpRequest stands in for the request of a raw tcp relay to addr.
+func tcpRequest(addr string) *http.Request {
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Scheme: "tcp", Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       addr,
+	}
+}
 
-	// 监听代理服务器端口
-	proxyAddr := mylog.Check2(net.ResolveTCPAddr("tcp", "proxyAddr:8080"))
+// dial connects to t.Request.Host as a session of layer. A failure is
+// recorded as a 502 or 504 response on the emitted session.
+func (t *Tcp) dial(layer httpClient.SchemerType) (net.Conn, error) {
+	t.Packet = packet.MakeHttpRequestPacket(t.Request, t.Process, layer)
+	t.SchemerType = layer
+	server, e := t.proxy.sessionDialer(t.Session)(t.Request.Context(), "tcp", t.Request.Host)
+	if e != nil {
+		t.Response = packet.NewErrorResponse(t.Request, e)
+		return nil, t.fail(e)
+	}
+	return server, nil
+}
 
-	// 循环等待本地客户端连接
-	for {
-		localConn, e := localListener.Accept()
-		if e != nil {
-			continue
-		}
-		remoteConn := mylog.Check2(net.DialTCP("tcp", nil, proxyAddr))
-		// defer remoteConn.Close()
-		// defer localConn.Close()
-		go func() { mylog.Check2(io.Copy(localConn, remoteConn)) }()
-		mylog.Check2(io.Copy(remoteConn, localConn))
+// fail emits the session as failed with err.
+func (t *Tcp) fail(err error) error {
+	t.Err = err
+	t.StreamDirection = packet.Outbound
+	t.Status = err.Error()
+	if t.Response != nil {
+		t.Status = t.Response.Status
+	}
+	if t.EventCallBack == nil {
+		t.SessionEvent(t.Session)
+	} else {
+		t.EventCallBack(t.Session)
 	}
+	return err
 }
@@ -0,0 +1,131 @@
+package mitmproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/testcert"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// connect opens a CONNECT tunnel to target through p.
+func connect(p *Proxy, target string) net.Conn {
+	conn := mylog.Check2(net.Dial("tcp", p.Addrs()[0].String()))
+	mylog.Check2(io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"))
+	resp := mylog.Check2(http.ReadResponse(bufio.NewReader(conn), nil))
+	mylog.Check(resp.Body.Close())
+	if resp.StatusCode != http.StatusOK {
+		panic(resp.Status)
+	}
+	return conn
+}
+
+func TestConnectRaw(t *testing.T) {
+	cert := mylog.Check2(tls.X509KeyPair(testcert.LocalhostCert, testcert.LocalhostKey))
+	alpn := make(chan string, 1)
+	secure := mylog.Check2(tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"mqtt"},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			alpn <- state.NegotiatedProtocol
+			return nil
+		},
+	}))
+	defer secure.Close()
+	go echo(secure)
+	greeter := mylog.Check2(net.Listen("tcp", "127.0.0.1:0"))
+	defer greeter.Close()
+	go func() {
+		for {
+			conn, e := greeter.Accept()
+			if e != nil {
+				return
+			}
+			mylog.Check2(io.WriteString(conn, "220 ready\r\n"))
+			go echo(&oneConnListener{conn: conn})
+		}
+	}()
+	_, securePort := mylog.Check3(net.SplitHostPort(secure.Addr().String()))
+	_, greeterPort := mylog.Check3(net.SplitHostPort(greeter.Addr().String()))
+
+	sessions := make(chan *packet.Session, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.Sniff.FirstByte = 100 * time.Millisecond
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.SchemerType == httpClient.TcpType || s.SchemerType == httpClient.TcpTlsType {
+				sessions <- s
+			}
+		}
+	})
+	upstream := x509.NewCertPool()
+	upstream.AppendCertsFromPEM(testcert.LocalhostCert)
+	p.transport.(*http.Transport).TLSClientConfig.RootCAs = upstream
+
+	t.Run("tls", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		roots.AddCert(p.CA())
+		conn := tls.Client(connect(p, net.JoinHostPort("localhost", securePort)), &tls.Config{RootCAs: roots, ServerName: "example.com"})
+		defer conn.Close()
+		mylog.Check2(io.WriteString(conn, "\x00\x01binary"))
+		buf := make([]byte, 8)
+		mylog.Check2(io.ReadFull(conn, buf))
+		assert.Equal(t, "\x00\x01binary", string(buf))
+
+		s := <-sessions
+		assert.Equal(t, httpClient.TcpTlsType, s.SchemerType)
+		assert.Equal(t, "\x00\x01binary", string(mylog.Check2(io.ReadAll(s.Stream.Reader(packet.Outbound)))))
+		assert.Equal(t, "", <-alpn)
+	})
+
+	t.Run("tls alpn", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		roots.AddCert(p.CA())
+		conn := tls.Client(connect(p, net.JoinHostPort("localhost", securePort)), &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: []string{"mqtt"}})
+		defer conn.Close()
+		mylog.Check2(io.WriteString(conn, "\x10\x00mqtt"))
+		buf := make([]byte, 6)
+		mylog.Check2(io.ReadFull(conn, buf))
+		assert.Equal(t, "\x10\x00mqtt", string(buf))
+		assert.Equal(t, "mqtt", conn.ConnectionState().NegotiatedProtocol)
+		assert.Equal(t, "mqtt", <-alpn)
+		<-sessions
+	})
+
+	t.Run("server speaks first", func(t *testing.T) {
+		for len(sessions) > 0 {
+			<-sessions
+		}
+		conn := connect(p, net.JoinHostPort("localhost", greeterPort))
+		defer conn.Close()
+		line := mylog.Check2(bufio.NewReader(conn).ReadString('\n'))
+		assert.Equal(t, "220 ready\r\n", line)
+
+		s := <-sessions
+		assert.Equal(t, httpClient.TcpType, s.SchemerType)
+		assert.Equal(t, packet.Inbound, s.StreamDirection)
+	})
+}
+
+// oneConnListener hands out a single accepted connection.
+type oneConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, net.ErrClosed
+	}
+	c := l.conn
+	l.conn = nil
+	return c, nil
+}
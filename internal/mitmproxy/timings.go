@@ -0,0 +1,98 @@
+package mitmproxy
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// timingTrace records the phases of the exchange of an Http. The hooks of
+// a dial run on a goroutine of the transport, which goes on when the
+// request took an idle connection meanwhile.
+type timingTrace struct {
+	mu sync.Mutex
+	t  packet.Timings
+}
+
+// mark sets a phase to now.
+func (r *timingTrace) mark(phase func(t *packet.Timings) *time.Time) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*phase(&r.t) = now
+}
+
+// dial sets a phase of getting a connection, a start keeps its first time
+// and a done its last. Dials that end after the request got its connection
+// are not the one of the request.
+func (r *timingTrace) dial(phase func(t *packet.Timings) *time.Time, start bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.t.GotConn.IsZero() {
+		return
+	}
+	if p := phase(&r.t); !start || p.IsZero() {
+		*p = now
+	}
+}
+
+func (r *timingTrace) gotConn(reused bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.t.GotConn, r.t.Reused = now, reused
+	if reused { // what was dialed so far went unused
+		r.t.DNSStart, r.t.DNSDone = time.Time{}, time.Time{}
+		r.t.ConnectStart, r.t.ConnectDone = time.Time{}, time.Time{}
+		r.t.TLSStart, r.t.TLSDone = time.Time{}, time.Time{}
+	}
+}
+
+func (r *timingTrace) Timings() packet.Timings {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.t
+}
+
+// clientTrace follows the upstream exchange of h. Pooled connections are
+// not dialed again, GotConn sees them all.
+func (h *Http) clientTrace() *httptrace.ClientTrace {
+	r := &h.timings
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.dial(func(t *packet.Timings) *time.Time { return &t.DNSStart }, true)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.dial(func(t *packet.Timings) *time.Time { return &t.DNSDone }, false)
+		},
+		ConnectStart: func(string, string) {
+			r.dial(func(t *packet.Timings) *time.Time { return &t.ConnectStart }, true)
+		},
+		ConnectDone: func(string, string, error) {
+			r.dial(func(t *packet.Timings) *time.Time { return &t.ConnectDone }, false)
+		},
+		TLSHandshakeStart: func() {
+			r.dial(func(t *packet.Timings) *time.Time { return &t.TLSStart }, true)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.dial(func(t *packet.Timings) *time.Time { return &t.TLSDone }, false)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.gotConn(info.Reused)
+			h.ResolvedIP = remoteIP(info.Conn)
+			if c, ok := info.Conn.(*chunkConn); ok {
+				h.chunks = c.expect(h.Request.Method)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.mark(func(t *packet.Timings) *time.Time { return &t.WroteRequest })
+		},
+		GotFirstResponseByte: func() {
+			r.mark(func(t *packet.Timings) *time.Time { return &t.FirstByte })
+		},
+	}
+}
@@ -4,28 +4,42 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
 
 	"github.com/ddkwork/golibrary/std/mylog"
-	"github.com/ddkwork/golibrary/std/stream"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
 	"github.com/ddkwork/mitmproxy/packet"
 )
 
-func (t *Tcp) transfer(session *packet.Session, destination io.WriteCloser, source io.ReadCloser, direction packet.StreamDirection) {
-	mylog.Call(func() {
-		defer func() {
-			mylog.Check(destination.Close())
-			mylog.Check(source.Close())
-		}()
-		buf := make([]byte, 32*1024)
-		mylog.Check2(t.copyBuffer(session, destination, source, buf, direction))
-	})
+// relay copies between client and server until either side ends, the plain
+// text protocols that can switch to tls get a STARTTLS relay.
+func (t *Tcp) relay(client, server net.Conn) error {
+	if t.SchemerType == httpClient.TcpType {
+		if e := t.proxy.relayStartTLS(t.Session, client, server, t.SessionEvent); !errors.Is(e, errors.ErrUnsupported) {
+			return e
+		}
+	}
+	go t.transfer(t.Session, client, server, packet.Inbound)
+	return t.transfer(t.Session, server, client, packet.Outbound)
+}
+
+func (t *Tcp) transfer(session *packet.Session, destination io.WriteCloser, source io.ReadCloser, direction packet.StreamDirection) error {
+	defer func() {
+		mylog.CheckIgnore(destination.Close())
+		mylog.CheckIgnore(source.Close())
+	}()
+	buf := make([]byte, 32*1024)
+	_, e := t.copyBuffer(session, destination, source, buf, direction)
+	if errors.Is(e, net.ErrClosed) { // the other direction finished first
+		return nil
+	}
+	return e
 }
 
 func (t *Tcp) copyBuffer(s *packet.Session, dst io.Writer, src io.Reader, buf []byte, direction packet.StreamDirection) (int64, error) {
 	if len(buf) == 0 {
 		buf = make([]byte, 32*1024)
 	}
-	messages := make([]*TunnelStream, 0)
 	var written int64
 	for {
 		nr, err := src.Read(buf)
@@ -33,40 +47,7 @@ func (t *Tcp) copyBuffer(s *packet.Session, dst io.Writer, src io.Reader, buf []
 			mylog.Info("Proxy read error during body copy", err)
 		}
 		if nr > 0 {
-			if t.ReqBodyDecoder.SteamAesKey != nil {
-				s.ReqBodyDecoder.SteamAesKey = t.ReqBodyDecoder.SteamAesKey
-			}
-			if nr > 8 && len(messages) == 0 {
-				t.StreamDirection = direction
-				switch direction {
-				case packet.Inbound:
-					t.ReqBodyDecoder.Payload = buf[:nr]
-				case packet.Outbound:
-					t.RespBodyDecoder.Payload = buf[:nr]
-				}
-				if t.EventCallBack == nil {
-					t.SessionEvent(t.Session)
-				} else {
-					t.EventCallBack(t.Session)
-				}
-			} else {
-				messages = append(messages, MakeTcpMessage(buf[:nr], direction))
-				if len(messages) == 2 {
-					t.StreamDirection = direction
-					switch direction {
-					case packet.Inbound:
-						t.ReqBodyDecoder.Payload = stream.NewBuffer(messages[0].Payload).AppendByteSlice(messages[1].Payload)
-					case packet.Outbound:
-						t.RespBodyDecoder.Payload = stream.NewBuffer(messages[0].Payload).AppendByteSlice(messages[1].Payload)
-					}
-					if t.EventCallBack == nil {
-						t.SessionEvent(t.Session)
-					} else {
-						t.EventCallBack(t.Session)
-					}
-					messages = messages[:0]
-				}
-			}
+			s.Record(direction, buf[:nr], t.SessionEvent)
 			nw, werr := dst.Write(buf[:nr])
 			if nw > 0 {
 				written += int64(nw)
@@ -78,23 +59,11 @@ func (t *Tcp) copyBuffer(s *packet.Session, dst io.Writer, src io.Reader, buf []
 				return written, io.ErrShortWrite
 			}
 		}
-		if mylog.Check(err) {
-			return written, nil
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
 		}
-		return written, err
-	}
-}
-
-type TunnelStream struct {
-	packet.StreamDirection
-	Payload []byte
-}
-
-func MakeTcpMessage(buf []byte, direction packet.StreamDirection) *TunnelStream {
-	message := &TunnelStream{
-		StreamDirection: direction,
-		Payload:         make([]byte, len(buf)),
 	}
-	copy(message.Payload, buf)
-	return message
 }
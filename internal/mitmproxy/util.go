@@ -61,8 +61,7 @@ func IsClosing(Request *http.Request, Response *http.Response) bool {
 }
 
 func GetFlushInterval(res *http.Response) time.Duration {
-	resCT := res.Header.Get("Content-Type")
-	if resCT == "text/sessionEventCallBack-stream" {
+	if isEventStream(res) {
 		return -1
 	}
 	if res.ContentLength == -1 {
@@ -85,8 +84,8 @@ func CopyResponse(dst io.Writer, src io.Reader, flushInterval time.Duration) err
 			dst = mlw
 		}
 	}
-	mylog.Check2(CopyBuffer(dst, src, nil))
-	return nil
+	_, e := CopyBuffer(dst, src, nil)
+	return e
 }
 
 func CopyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
@@ -100,19 +99,24 @@ func CopyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
 			mylog.Warning("Proxy read error during body copy: %v", err)
 		}
 		if nr > 0 {
-			nw := mylog.Check2(dst.Write(buf[:nr]))
+			nw, werr := dst.Write(buf[:nr])
 			if nw > 0 {
 				written += int64(nw)
 			}
+			if werr != nil {
+				return written, werr
+			}
 
 			if nr != nw {
 				return written, io.ErrShortWrite
 			}
 		}
-		if mylog.Check(err) {
-			return written, nil
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
 		}
-		return written, err
 	}
 }
 
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ddkwork/websocket"
@@ -16,9 +18,52 @@ import (
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/golibrary/std/stream"
 	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/dissect"
 	"github.com/ddkwork/mitmproxy/packet"
 )
 
+type (
+	// WebSocketConfig configures the websocket relays.
+	WebSocketConfig struct {
+		// DisableCompression relays without permessage-deflate, otherwise
+		// it is negotiated with the client and the server on their own.
+		DisableCompression bool
+		// Hook sees every text and binary message before it is forwarded.
+		Hook WebSocketHook
+		// Framings decode socket.io, stomp and the like out of the
+		// messages, each decoded message is emitted as a child of the
+		// session of the relay. Nil decodes nothing.
+		Framings dissect.Framings
+	}
+
+	// WebSocketMessage is a data message of a relay, Outbound goes from
+	// the client to the server and Inbound the other way.
+	WebSocketMessage struct {
+		packet.StreamDirection
+		Type    packet.WebsocketMessageType
+		Payload []byte
+	}
+
+	// WebSocketHook returns the messages forwarded in place of m: m itself,
+	// an edited copy, nothing to drop it or more to inject messages after
+	// it. A message goes to the side its direction points at, so a hook can
+	// answer the sender of m too.
+	WebSocketHook func(s *packet.Session, m WebSocketMessage) []WebSocketMessage
+
+	// wsLeg is one side of a relay, writes of the two copy loops and of
+	// hooks are serialized.
+	wsLeg struct {
+		mu sync.Mutex
+		*websocket.Conn
+	}
+)
+
+func (l *wsLeg) WriteMessage(messageType int, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Conn.WriteMessage(messageType, data)
+}
+
 func (w *WebSocket) SessionEvent(session *packet.Session) {
 	ss := stream.NewBuffer(session.StreamDirection.String() + " " + session.Request.URL.String())
 	ss.Indent(1)
@@ -32,12 +77,17 @@ func (w *WebSocket) SessionEvent(session *packet.Session) {
 	}
 }
 
-func (w *WebSocket) ServeTls() {
-	// TODO implement me
-	panic("implement me")
+// ServeTls refuses the client, websocket is not served inside tls.
+func (w *WebSocket) ServeTls() error {
+	return fmt.Errorf("%w: websocket over tls", errUnsupportedProtocol)
 }
 
-func (w *WebSocket) Serve() {
+// closeBadGateway is sent to the client when the server side of a relay
+// breaks without a close frame, 1006 itself must not be sent on the wire.
+const closeBadGateway = 1014
+
+func (w *WebSocket) Serve() error {
+	setFlow(w.ClientConn, WebSocketFlow)
 	w.SchemerType = httpClient.WebSocketType
 	w.Request.URL.Scheme = "ws"
 	if w.IsTls() {
@@ -50,8 +100,9 @@ func (w *WebSocket) Serve() {
 		outReq.Body = nil
 	}
 	defer func() {
-		mylog.Check(outReq.Body)
-		mylog.Check(outReq.Body.Close())
+		if outReq.Body != nil {
+			mylog.CheckIgnore(outReq.Body.Close())
+		}
 	}()
 
 	if outReq.Header == nil {
@@ -64,8 +115,19 @@ func (w *WebSocket) Serve() {
 	outReq.Header.Del("Sec-Websocket-Extensions")
 	var wssConn *websocket.Conn
 
-	wssConn, w.Response, w.err = DefaultWSDialer.DialContext(ctx, outReq.URL.String(), outReq.Header)
-	mylog.Check(w.err)
+	dialer := *DefaultWSDialer
+	dialer.Proxy = w.proxy.upstreamProxy()
+	dialer.NetDialContext = w.proxy.sessionDialer(w.Session)
+	dialer.EnableCompression = !w.proxy.WebSocket.DisableCompression
+	wssConn, w.Response, w.err = dialer.DialContext(withSession(ctx, w.Session), outReq.URL.String(), outReq.Header)
+	if w.err != nil {
+		// the client is still waiting for its handshake, answer over http
+		// with the server's refusal or a gateway error
+		if w.Response == nil {
+			w.Response = packet.NewErrorResponse(w.Request, w.err)
+		}
+		return w.fail(w.err)
+	}
 
 	backConnCloseCh := make(chan bool)
 	go func() {
@@ -73,43 +135,127 @@ func (w *WebSocket) Serve() {
 		case <-w.Request.Context().Done():
 		case <-backConnCloseCh:
 		}
-		mylog.Check(wssConn.Close())
+		mylog.CheckIgnore(wssConn.Close())
 	}()
 	defer close(backConnCloseCh)
 	upgradeHeader := http.Header{}
 	if hdr := w.Response.Header.Get("Sec-Websocket-Protocol"); hdr != "" {
 		upgradeHeader.Set("Sec-Websocket-Protocol", hdr)
+		w.subprotocol = hdr
 	}
 	if hdr := w.Response.Header.Get("Set-Cookie"); hdr != "" {
 		upgradeHeader.Set("Set-Cookie", hdr)
 	}
-	conn := mylog.Check2(DefaultWebsocketUpGrader.UpgradeEx(w.ClientConn, w.ReadWriter, w.Request, upgradeHeader))
-	defer func() { mylog.Check(conn.Close()) }()
+	upgrader := *DefaultWebsocketUpGrader
+	upgrader.EnableCompression = !w.proxy.WebSocket.DisableCompression
+	conn, e := upgrader.UpgradeEx(w.ClientConn, w.ReadWriter, w.Request, upgradeHeader)
+	if e != nil {
+		w.Response = packet.NewResponse(http.StatusBadRequest, strings.NewReader(e.Error()), w.Request)
+		w.Response.Close = true
+		return w.fail(e)
+	}
+	defer func() { mylog.CheckIgnore(conn.Close()) }()
 	RemoveExtraHTTPHostPort(w.Request)
-	// w.RequestPacket = MakeHttpRequestPacket(w.Request, w.ProcessName)
-	// w.ResponsePacket = MakeHttpResponsePacket(w.Response)
-	// w.RequestEvent(w)
-	// w.ResponseEvent(w)
-	// src was closed
-	if wssConn == nil || conn == nil {
-		return
-	}
-	errClient := make(chan error, 1)
-	errBackend := make(chan error, 1)
-	go w.copy(wssConn, conn, packet.Outbound, errBackend)
-	go w.copy(conn, wssConn, packet.Inbound, errClient)
+	w.client, w.server = &wsLeg{Conn: conn}, &wsLeg{Conn: wssConn}
+	w.ConnID = w.proxy.webSocketID.Add(1)
+	w.handshake()
+	w.proxy.mu.Lock()
+	w.proxy.webSockets[w.ConnID] = w
+	w.proxy.mu.Unlock()
+	defer func() {
+		w.proxy.mu.Lock()
+		delete(w.proxy.webSockets, w.ConnID)
+		w.proxy.mu.Unlock()
+	}()
+	fromClient := make(chan error, 1)
+	fromServer := make(chan error, 1)
+	go w.copy(w.server, w.client, packet.Outbound, fromClient)
+	go w.copy(w.client, w.server, packet.Inbound, fromServer)
 	var er error
+	initiator, other := packet.Outbound, fromServer
+	select {
+	case er = <-fromClient:
+	case er = <-fromServer:
+		initiator, other = packet.Inbound, fromClient
+	}
+	// the other side answers the close passed on to it
 	select {
-	case er = <-errClient:
-	case er = <-errBackend:
+	case <-other:
+	case <-time.After(time.Second):
 	}
+	w.closed(initiator, er)
+	if websocket.IsCloseError(er, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return nil
+	}
+	return er
+}
+
+// handshake reports the upgrade of the relay with the response of the
+// server, PadTime is how long the handshake took.
+func (w *WebSocket) handshake() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.Packet = packet.MakeHttpResponsePacket(w.Response, w.SchemerType)
+	w.Time = time.Now()
+	w.PadTime = w.Time.Sub(w.StartTime)
+	if w.EventCallBack == nil {
+		w.SessionEvent(w.Session)
+	} else {
+		w.EventCallBack(w.Session)
+	}
+}
+
+// closed reports the end of the relay, initiator is the side whose read
+// failed first and err why.
+func (w *WebSocket) closed(initiator packet.StreamDirection, err error) {
+	end := &packet.WebSocketClose{Code: websocket.CloseAbnormalClosure, Initiator: initiator}
 	var e *websocket.CloseError
-	if !errors.As(e, &e) || e.Code == websocket.CloseAbnormalClosure {
-		mylog.Check(er)
+	if errors.As(err, &e) {
+		end.Code, end.Reason = e.Code, e.Text
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.next()
+	w.StreamDirection = initiator
+	w.WebsocketMessageType = packet.CloseMessage
+	w.WebSocketClose = end
+	w.ReqBodyDecoder.Payload, w.RespBodyDecoder.Payload = nil, nil
+	w.EditData = w.messageData(0, strings.TrimSpace(strconv.Itoa(end.Code)+" "+end.Reason))
+	w.WebsocketStatus = "closed by the client"
+	if initiator == packet.Inbound {
+		w.WebsocketStatus = "closed by the server"
+	}
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		w.Err = err
+		w.WebsocketStatus += ": " + err.Error()
+	}
+	if w.EventCallBack == nil {
+		w.SessionEvent(w.Session)
+	} else {
+		w.EventCallBack(w.Session)
 	}
 }
 
-func (w *WebSocket) copy(dst, src *websocket.Conn, direction packet.StreamDirection, errChan chan error) {
+// fail reports a relay that never got to the websocket stage, the response
+// set by the caller is sent to the client.
+func (w *WebSocket) fail(err error) error {
+	w.Err = err
+	w.StreamDirection = packet.Outbound
+	w.Status = w.Response.Status
+	w.WebsocketStatus = err.Error()
+	if w.EventCallBack == nil {
+		w.SessionEvent(w.Session)
+	} else {
+		w.EventCallBack(w.Session)
+	}
+	defer func() { mylog.CheckIgnore(w.Response.Body.Close()) }()
+	if e := packet.WriteResponse(w.Response, w.ReadWriter); e != nil {
+		return e
+	}
+	return err
+}
+
+func (w *WebSocket) copy(dst, src *wsLeg, direction packet.StreamDirection, errChan chan error) {
 	src.SetPingHandler(func(data string) error {
 		return dst.WriteControl(websocket.PingMessage, []byte(data), time.Time{})
 	})
@@ -117,91 +263,201 @@ func (w *WebSocket) copy(dst, src *websocket.Conn, direction packet.StreamDirect
 		return dst.WriteControl(websocket.PongMessage, []byte(data), time.Time{})
 	})
 	for {
-		// src was closed
-		if src == nil || dst == nil || w == nil {
-			return
-		}
-
 		msgType, msg, err2 := src.ReadMessage()
 		if err2 != nil {
-			m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err2))
+			// pass the close code on to the other side, a connection that
+			// broke without a close frame is reported as going away by the
+			// client or as a bad gateway by the server
+			code, text := websocket.CloseGoingAway, ""
+			if direction == packet.Inbound {
+				code = closeBadGateway
+			}
 			var e *websocket.CloseError
-			if errors.As(e, &err2) {
-				if e != nil {
-					if e.Code == websocket.CloseAbnormalClosure || e.Code == websocket.CloseTLSHandshake {
-						errChan <- e
-						return
-					}
-					if e.Code != websocket.CloseNoStatusReceived {
-						m = websocket.FormatCloseMessage(e.Code, e.Text)
-					}
+			if errors.As(err2, &e) {
+				switch e.Code {
+				case websocket.CloseNoStatusReceived:
+					code = websocket.CloseNormalClosure
+				case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+				default:
+					code, text = e.Code, e.Text
 				}
 			}
-			errChan <- e
-			errChan <- dst.WriteMessage(websocket.CloseMessage, m)
+			mylog.CheckIgnore(dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second)))
+			errChan <- err2
 			return
 		}
-		w.StreamDirection = direction
-		w.WebsocketMessageType = packet.WebsocketMessageType(msgType)
-		switch direction {
-		case packet.Inbound:
-			w.ReqBodyDecoder.Payload = msg
-			switch w.WebsocketMessageType {
-			case packet.TextMessage:
-				w.ReqBodyDecoder.Websocket = string(msg)
-			case packet.BinaryMessage:
-				w.ReqBodyDecoder.Websocket = hex.Dump(msg)
-			case packet.CloseMessage:
-			case packet.PingMessage:
-			case packet.PongMessage:
-
+		m := WebSocketMessage{StreamDirection: direction, Type: packet.WebsocketMessageType(msgType), Payload: msg}
+		forward := []WebSocketMessage{m}
+		if hook := w.proxy.WebSocket.Hook; hook != nil {
+			forward = hook(w.Session, m)
+		}
+		if len(forward) == 0 {
+			w.emit(m, "dropped")
+		}
+		for _, f := range forward {
+			w.emit(f, "")
+			leg := w.server
+			if f.StreamDirection == packet.Inbound {
+				leg = w.client
 			}
-		case packet.Outbound:
-			w.RespBodyDecoder.Payload = msg
-			switch w.WebsocketMessageType {
-			case packet.TextMessage:
-				w.RespBodyDecoder.Websocket = string(msg)
-			case packet.BinaryMessage:
-				w.RespBodyDecoder.Websocket = hex.Dump(msg)
-			case packet.CloseMessage:
-			case packet.PingMessage:
-			case packet.PongMessage:
-
+			if e := leg.WriteMessage(int(f.Type), f.Payload); e != nil {
+				errChan <- e
+				return
 			}
 		}
+	}
+}
 
-		w.EditData = packet.EditData{
-			SchemerType:   w.SchemerType,
-			Method:        w.StreamDirection.String(),
-			Host:          w.Host,
-			Path:          w.Path,
-			ContentType:   w.WebsocketMessageType.String(),
-			ContentLength: len(w.ReqBodyDecoder.Payload),
-			Status:        w.WebsocketStatus, // todo test
-			Note:          w.Note,
-			Process:       w.Process,
-			PadTime:       w.PadTime, // todo
-		}
-		if direction == packet.Outbound {
-			w.PadTime = time.Since(w.StartTime)
-		}
-		var er *websocket.CloseError
-		if er != nil {
-			if errors.As(er, &er) {
-				w.Session.WebsocketStatus = er.Error()
-			}
+// inject writes m to the leg its direction points at as if a peer had sent
+// it and reports it as injected.
+func (w *WebSocket) inject(m WebSocketMessage) error {
+	leg := w.server
+	if m.StreamDirection == packet.Inbound {
+		leg = w.client
+	}
+	var e error
+	switch m.Type {
+	case packet.TextMessage, packet.BinaryMessage:
+		e = leg.WriteMessage(int(m.Type), m.Payload)
+	case packet.PingMessage, packet.PongMessage, packet.CloseMessage:
+		e = leg.WriteControl(int(m.Type), m.Payload, time.Now().Add(time.Second))
+	default:
+		e = fmt.Errorf("websocket: cannot inject %s", m.Type)
+	}
+	if e != nil {
+		return e
+	}
+	w.emit(m, "injected")
+	return nil
+}
+
+// emit reports a message of the relay on its session, the payload goes to
+// the decoder of its direction.
+func (w *WebSocket) emit(m WebSocketMessage, status string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.StreamDirection = m.StreamDirection
+	w.WebsocketMessageType = m.Type
+	decoder := &w.RespBodyDecoder
+	if m.StreamDirection == packet.Inbound {
+		decoder = &w.ReqBodyDecoder
+	}
+	decoder.Payload = m.Payload
+	decoder.Websocket = websocketText(m.Type, m.Payload)
+	messages, framingErr := w.decode(m)
+	if len(messages) > 0 {
+		var labels []string
+		for _, message := range messages {
+			labels = append(labels, message.String())
 		}
+		decoder.Websocket = strings.Join(labels, "\n") + "\n\n" + decoder.Websocket
+	}
 
-		if w.EventCallBack == nil {
-			w.SessionEvent(w.Session)
-		} else {
-			w.EventCallBack(w.Session)
+	w.next()
+	w.EditData = w.messageData(len(m.Payload), status)
+
+	if w.EventCallBack == nil {
+		w.SessionEvent(w.Session)
+	} else {
+		w.EventCallBack(w.Session)
+	}
+	for _, message := range messages {
+		w.emitFramed(m, message, nil)
+	}
+	if framingErr != nil {
+		w.emitFramed(m, dissect.Message{Payload: m.Payload}, framingErr)
+	}
+}
+
+// next stamps the session for the next event of the relay, PadTime is how
+// long after the previous one it came.
+func (w *WebSocket) next() {
+	now := time.Now()
+	w.PadTime = now.Sub(w.Time)
+	w.Time = now
+	w.Seq++
+}
+
+// messageData is the row of a message of the relay.
+func (w *WebSocket) messageData(size int, status string) packet.EditData {
+	return packet.EditData{
+		SchemerType:   w.SchemerType,
+		Method:        w.StreamDirection.String(),
+		Host:          w.Host,
+		Path:          w.Path,
+		ContentType:   w.WebsocketMessageType.String(),
+		ContentLength: size,
+		Status:        status,
+		Note:          w.Note,
+		Process:       w.Process,
+		PadTime:       w.PadTime,
+	}
+}
+
+// framingWindow is how many data messages of a relay are tried against the
+// framings before the relay is given up on.
+const framingWindow = 4
+
+// decode splits a data message into the messages of the framing of the
+// relay, the framing is picked by the subprotocol or the first messages.
+func (w *WebSocket) decode(m WebSocketMessage) ([]dissect.Message, error) {
+	if m.Type != packet.TextMessage && m.Type != packet.BinaryMessage {
+		return nil, nil
+	}
+	if w.framing == nil {
+		if w.framingTries >= framingWindow {
+			return nil, nil
 		}
-		if mylog.Check(dst.WriteMessage(msgType, w.Session.ReqBodyDecoder.Payload)); er != nil {
-			errChan <- er
-			return
+		w.framingTries++
+		framing := w.proxy.WebSocket.Framings.Lookup(w.subprotocol, m.StreamDirection, m.Payload)
+		if framing == nil {
+			return nil, nil
 		}
+		w.framing, w.framingName = framing.New(), framing.Name()
+	}
+	return w.framing.Decode(m.StreamDirection, m.Type == packet.BinaryMessage, m.Payload)
+}
+
+// emitFramed sends a decoded message of m as a child of the session.
+func (w *WebSocket) emitFramed(m WebSocketMessage, message dissect.Message, err error) {
+	child := w.NewChild(w.SchemerType)
+	child.Request = w.Request
+	child.StreamDirection = m.StreamDirection
+	child.WebsocketMessageType = m.Type
+	child.Host = w.Host
+	child.ResolvedIP = w.ResolvedIP
+	child.ContentType = w.framingName
+	child.Method = message.Method
+	child.Path = message.Path
+	child.Status = message.Status
+	child.Note = message.ID
+	child.Seq = w.Seq
+	child.Time = w.Time
+	child.ContentLength = len(message.Payload)
+	child.Err = err
+	if err != nil {
+		child.Status = err.Error()
+	}
+	decoder := &child.RespBodyDecoder
+	if m.StreamDirection == packet.Inbound {
+		decoder = &child.ReqBodyDecoder
+	}
+	decoder.Payload = message.Payload
+	decoder.Websocket = message.String() + "\n\n" + websocketText(m.Type, message.Payload)
+	if child.EventCallBack == nil {
+		w.SessionEvent(child)
+	} else {
+		child.EventCallBack(child)
+	}
+}
+
+// websocketText shows a text payload as it is and a binary one as a hex
+// dump.
+func websocketText(messageType packet.WebsocketMessageType, p []byte) string {
+	if messageType == packet.TextMessage {
+		return string(p)
 	}
+	return hex.Dump(p)
 }
 
 var (
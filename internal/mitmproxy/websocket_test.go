@@ -0,0 +1,346 @@
+package mitmproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/dissect"
+	"github.com/ddkwork/mitmproxy/packet"
+	"github.com/ddkwork/websocket"
+)
+
+// echoWebSocket answers every message with itself and reports the
+// extensions the proxy asked for.
+func echoWebSocket(extensions chan<- string) http.Handler {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extensions <- r.Header.Get("Sec-Websocket-Extensions")
+		conn := mylog.Check2(upgrader.Upgrade(w, r, nil))
+		defer conn.Close()
+		for {
+			msgType, msg, e := conn.ReadMessage()
+			if e != nil {
+				return
+			}
+			if e := conn.WriteMessage(msgType, msg); e != nil {
+				return
+			}
+		}
+	})
+}
+
+// dialWebSocket connects to the websocket at target through p.
+func dialWebSocket(p *Proxy, target string) (*websocket.Conn, *http.Response) {
+	proxyURL := mylog.Check2(url.Parse("http://" + p.Addrs()[0].String()))
+	dialer := websocket.Dialer{Proxy: http.ProxyURL(proxyURL), EnableCompression: true}
+	return mylog.Check3(dialer.Dial(target, nil))
+}
+
+func TestWebSocket(t *testing.T) {
+	extensions := make(chan string, 1)
+	backend := httptest.NewServer(echoWebSocket(extensions))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, "http://"+httpClient.Localhost, "ws://localhost", 1)
+
+	sessions := make(chan packet.Packet, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.WebsocketMessageType != 0 {
+				sessions <- s.Packet
+			}
+		}
+		c.WebSocket.Hook = func(s *packet.Session, m WebSocketMessage) []WebSocketMessage {
+			switch string(m.Payload) {
+			case "drop":
+				return nil
+			case "knock":
+				// answered by the proxy, the server never sees it
+				return []WebSocketMessage{{StreamDirection: packet.Inbound, Type: m.Type, Payload: []byte("who is there")}}
+			}
+			if m.StreamDirection == packet.Inbound {
+				m.Payload = bytes.ToUpper(m.Payload)
+			}
+			return []WebSocketMessage{m}
+		}
+	})
+	conn, resp := dialWebSocket(p, target)
+	defer conn.Close()
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"))
+	assert.True(t, strings.HasPrefix(<-extensions, "permessage-deflate"))
+
+	for _, request := range []string{"drop", "knock", "hello"} {
+		mylog.Check(conn.WriteMessage(websocket.TextMessage, []byte(request)))
+	}
+	for _, want := range []string{"who is there", "HELLO"} {
+		_, msg := mylog.Check3(conn.ReadMessage())
+		assert.Equal(t, want, string(msg))
+	}
+
+	for _, want := range []struct {
+		direction packet.StreamDirection
+		payload   string
+		status    string
+	}{
+		{packet.Outbound, "drop", "dropped"},
+		{packet.Inbound, "who is there", ""},
+		{packet.Outbound, "hello", ""},
+		{packet.Inbound, "HELLO", ""},
+	} {
+		s := <-sessions
+		assert.Equal(t, want.direction, s.StreamDirection)
+		assert.Equal(t, want.status, s.Status)
+		assert.Equal(t, len(want.payload), s.ContentLength)
+		payload := s.RespBodyDecoder.Payload
+		if want.direction == packet.Inbound {
+			payload = s.ReqBodyDecoder.Payload
+		}
+		assert.Equal(t, want.payload, string(payload))
+	}
+}
+
+func TestWebSocketInject(t *testing.T) {
+	backend := httptest.NewServer(echoWebSocket(make(chan string, 1)))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, "http://"+httpClient.Localhost, "ws://localhost", 1)
+
+	sessions := make(chan packet.Session, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.Status == "injected" {
+				sessions <- *s
+			}
+		}
+	})
+	control := httptest.NewServer(p.ControlHandler())
+	defer control.Close()
+	conn, _ := dialWebSocket(p, target)
+	defer conn.Close()
+
+	var relays []WebSocketRelay
+	for range 50 {
+		if relays = p.WebSocketRelays(); len(relays) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(relays))
+	assert.Equal(t, target+"/", relays[0].URL)
+	id := fmt.Sprint(relays[0].ID)
+	inject := func(path string, body string) int {
+		resp := mylog.Check2(http.Post(control.URL+path, "text/plain", strings.NewReader(body)))
+		mylog.Check(resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNotFound, inject("/websockets/999/client", "lost"))
+	assert.Equal(t, http.StatusBadRequest, inject("/websockets/"+id+"/nowhere", "lost"))
+
+	// the echo server answers what is injected toward it
+	assert.Equal(t, http.StatusNoContent, inject("/websockets/"+id+"/client", "to client"))
+	assert.Equal(t, http.StatusNoContent, inject("/websockets/"+id+"/server", "to server"))
+	for _, want := range []string{"to client", "to server"} {
+		_, msg := mylog.Check3(conn.ReadMessage())
+		assert.Equal(t, want, string(msg))
+	}
+	for _, want := range []struct {
+		direction packet.StreamDirection
+		payload   string
+	}{
+		{packet.Inbound, "to client"},
+		{packet.Outbound, "to server"},
+	} {
+		s := <-sessions
+		assert.Equal(t, relays[0].ID, s.ConnID)
+		assert.Equal(t, want.direction, s.StreamDirection)
+		payload := s.RespBodyDecoder.Payload
+		if want.direction == packet.Inbound {
+			payload = s.ReqBodyDecoder.Payload
+		}
+		assert.Equal(t, want.payload, string(payload))
+	}
+
+	assert.Equal(t, http.StatusNoContent, inject("/websockets/"+id+"/client?type=close&code=4000&reason=bye", ""))
+	_, _, e := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(e, 4000))
+	s := <-sessions
+	assert.Equal(t, packet.CloseMessage, s.WebsocketMessageType)
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v12.stomp"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn := mylog.Check2(upgrader.Upgrade(w, r, nil))
+		defer conn.Close()
+		for {
+			if _, _, e := conn.ReadMessage(); e != nil {
+				return
+			}
+			if e := conn.WriteMessage(websocket.TextMessage, []byte("RECEIPT\nreceipt-id:r1\n\n\x00")); e != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, "http://"+httpClient.Localhost, "ws://localhost", 1)
+
+	sessions := make(chan packet.Session, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.WebSocket.Framings = dissect.DefaultFramings()
+		c.SessionEventCallBack = func(s *packet.Session) {
+			if s.WebsocketMessageType == packet.TextMessage {
+				sessions <- *s
+			}
+		}
+	})
+	proxyURL := mylog.Check2(url.Parse("http://" + p.Addrs()[0].String()))
+	dialer := websocket.Dialer{Proxy: http.ProxyURL(proxyURL), Subprotocols: []string{"v12.stomp"}}
+	conn, resp := mylog.Check3(dialer.Dial(target, nil))
+	defer conn.Close()
+	assert.Equal(t, "v12.stomp", resp.Header.Get("Sec-Websocket-Protocol"))
+
+	mylog.Check(conn.WriteMessage(websocket.TextMessage, []byte("SUBSCRIBE\nid:0\ndestination:/topic/a\n\n\x00SEND\ndestination:/app/b\nreceipt:r1\n\nhi\x00")))
+	_, msg := mylog.Check3(conn.ReadMessage())
+	assert.Equal(t, "RECEIPT\nreceipt-id:r1\n\n\x00", string(msg))
+
+	s := <-sessions
+	assert.True(t, s.Parent == nil)
+	assert.True(t, strings.HasPrefix(s.RespBodyDecoder.Websocket, "SUBSCRIBE /topic/a #0\nSEND /app/b #r1\n\n"))
+	for _, want := range []struct {
+		direction packet.StreamDirection
+		method    string
+		path      string
+		id        string
+	}{
+		{packet.Outbound, "SUBSCRIBE", "/topic/a", "0"},
+		{packet.Outbound, "SEND", "/app/b", "r1"},
+		{packet.Inbound, "", "", ""},
+		{packet.Inbound, "RECEIPT", "", "r1"},
+	} {
+		s := <-sessions
+		if want.method == "" { // the message of the server itself
+			assert.True(t, s.Parent == nil)
+			continue
+		}
+		assert.True(t, s.Parent != nil)
+		assert.Equal(t, "stomp", s.ContentType)
+		assert.Equal(t, want.direction, s.StreamDirection)
+		assert.Equal(t, want.method, s.Method)
+		assert.Equal(t, want.path, s.Path)
+		assert.Equal(t, want.id, s.Note)
+	}
+}
+
+func TestWebSocketMetadata(t *testing.T) {
+	backend := httptest.NewServer(echoWebSocket(make(chan string, 1)))
+	defer backend.Close()
+	target := strings.Replace(backend.URL, "http://"+httpClient.Localhost, "ws://localhost", 1)
+
+	sessions := make(chan packet.Session, 16)
+	p := newTestProxy(t, func(c *Config) {
+		c.SessionEventCallBack = func(s *packet.Session) { sessions <- *s }
+	})
+	conn, _ := dialWebSocket(p, target)
+	defer conn.Close()
+	mylog.Check(conn.WriteMessage(websocket.TextMessage, []byte("ping me")))
+	mylog.Check3(conn.ReadMessage())
+	mylog.Check(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "done")))
+
+	handshake := <-sessions
+	assert.True(t, handshake.ConnID != 0)
+	assert.Equal(t, "101 Switching Protocols", handshake.Status)
+	assert.Equal(t, uint64(0), handshake.Seq)
+	last := handshake.Time
+	for i, want := range []struct {
+		direction packet.StreamDirection
+		size      int
+	}{
+		{packet.Outbound, len("ping me")},
+		{packet.Inbound, len("ping me")},
+	} {
+		s := <-sessions
+		assert.Equal(t, handshake.ConnID, s.ConnID)
+		assert.Equal(t, uint64(i+1), s.Seq)
+		assert.Equal(t, want.direction, s.StreamDirection)
+		assert.Equal(t, want.size, s.ContentLength)
+		assert.True(t, !s.Time.Before(last))
+		assert.Equal(t, s.Time.Sub(last), s.PadTime)
+		last = s.Time
+	}
+	end := <-sessions
+	assert.Equal(t, uint64(3), end.Seq)
+	assert.Equal(t, packet.CloseMessage, end.WebsocketMessageType)
+	assert.Equal(t, "4001 done", end.Status)
+	assert.Equal(t, 4001, end.WebSocketClose.Code)
+	assert.Equal(t, "done", end.WebSocketClose.Reason)
+	assert.Equal(t, packet.Outbound, end.WebSocketClose.Initiator)
+}
+
+func TestControlAccess(t *testing.T) {
+	defaults := NewWithConfig(Config{SessionEventCallBack: func(*packet.Session) {}, Control: Control{Enabled: true}})
+	assert.Equal(t, DefaultControlAddr, defaults.Control.Addr)
+	p := newTestProxy(t, func(c *Config) {
+		c.Control = Control{Enabled: true, Addr: "127.0.0.1:0", Token: "secret"}
+	})
+	controlURL := "http://" + p.controlListener.Addr().String()
+
+	// host is what the request is addressed as, like a name rebound to the
+	// address of the api
+	call := func(token, origin, host string) int {
+		req := mylog.Check2(http.NewRequest(http.MethodPost, controlURL+"/websockets/999/client", strings.NewReader("lost")))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		resp := mylog.Check2(http.DefaultClient.Do(req))
+		mylog.Check(resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, call("", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, call("wrong", "", ""))
+	assert.Equal(t, http.StatusNotFound, call("secret", "", ""))
+	assert.Equal(t, http.StatusNotFound, call("secret", controlURL, ""))
+	assert.Equal(t, http.StatusForbidden, call("secret", "https://example.com", ""))
+	assert.Equal(t, http.StatusForbidden, call("secret", "http://example.com", "example.com"))
+
+	// a taken port fails Listen
+	taken := NewWithConfig(Config{
+		SessionEventCallBack: func(*packet.Session) {},
+		Control:              Control{Enabled: true, Addr: p.controlListener.Addr().String()},
+	})
+	assert.NotNil(t, taken.Listen())
+	assert.Equal(t, 0, len(taken.Addrs()))
+}
+
+func TestControlRebound(t *testing.T) {
+	p := newTestProxy(t)
+	control := httptest.NewServer(p.ControlHandler())
+	defer control.Close()
+	get := func(host string) int {
+		req := mylog.Check2(http.NewRequest(http.MethodGet, control.URL+"/websockets", nil))
+		if host != "" {
+			req.Host = host
+		}
+		resp := mylog.Check2(http.DefaultClient.Do(req))
+		mylog.Check(resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get(""))
+	_, port := mylog.Check3(net.SplitHostPort(control.Listener.Addr().String()))
+	assert.Equal(t, http.StatusOK, get("localhost:"+port))
+	// a same origin get of a rebound page sends no Origin
+	assert.Equal(t, http.StatusForbidden, get("rebound.example:"+port))
+}
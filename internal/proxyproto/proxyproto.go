@@ -0,0 +1,396 @@
+// Package proxyproto reads and writes the HAProxy PROXY protocol headers a
+// load balancer puts in front of a tcp stream to pass on the real client
+// address, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+type Version byte
+
+const (
+	V1 Version = 1 // the human readable text header
+	V2 Version = 2 // the binary header with TLVs
+)
+
+type Command byte
+
+const (
+	// Local is sent by the balancer for its own connections, like health
+	// checks, the addresses are those of the connection itself.
+	Local Command = 0x0
+	Proxy Command = 0x1
+)
+
+type TLVType byte
+
+const (
+	TypeALPN      TLVType = 0x01
+	TypeAuthority TLVType = 0x02
+	TypeCRC32C    TLVType = 0x03
+	TypeNoop      TLVType = 0x04
+	TypeUniqueID  TLVType = 0x05
+	TypeSSL       TLVType = 0x20
+	TypeNetNS     TLVType = 0x30
+)
+
+type TLV struct {
+	Type  TLVType
+	Value []byte
+}
+
+// Header is a parsed PROXY header. Source and Destination are nil for the
+// Local command and for v1 UNKNOWN headers.
+type Header struct {
+	Version     Version
+	Command     Command
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no PROXY header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+
+	v1Prefix  = []byte("PROXY ")
+	signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	v1MaxLength  = 107 // the longest possible v1 line, crlf included
+	v2HeaderSize = 16  // signature, version and command, family, length
+
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	protoUnspec = 0x0
+	protoStream = 0x1
+	protoDgram  = 0x2
+)
+
+// Read consumes a v1 or v2 header from r, ErrNoHeader is returned without
+// consuming anything when r does not start with one.
+func Read(r *bufio.Reader) (*Header, error) {
+	b, e := r.Peek(1)
+	if e != nil {
+		return nil, e
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		return readV1(r)
+	case signature[0]:
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	b, e := r.Peek(len(v1Prefix))
+	if e != nil {
+		return nil, e
+	}
+	if !bytes.Equal(b, v1Prefix) {
+		return nil, ErrNoHeader
+	}
+	line := make([]byte, 0, v1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, fmt.Errorf("%w: v1 line longer than %d bytes", ErrInvalidHeader, v1MaxLength)
+		}
+		c, e := r.ReadByte()
+		if e != nil {
+			return nil, e
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+	h := &Header{Version: V1, Command: Proxy}
+	if fields[0] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	src, e := parseV1Addr(fields[0], fields[1], fields[3])
+	if e != nil {
+		return nil, e
+	}
+	dst, e := parseV1Addr(fields[0], fields[2], fields[4])
+	if e != nil {
+		return nil, e
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(family, ip, port string) (net.Addr, error) {
+	addr, e := netip.ParseAddr(ip)
+	if e != nil || addr.Zone() != "" || addr.Is4() != (family == "TCP4") {
+		return nil, fmt.Errorf("%w: address %q", ErrInvalidHeader, ip)
+	}
+	// ports are decimal without leading zeros
+	p, e := strconv.ParseUint(port, 10, 16)
+	if e != nil || strconv.FormatUint(p, 10) != port {
+		return nil, fmt.Errorf("%w: port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	b, e := r.Peek(v2HeaderSize)
+	if e != nil {
+		return nil, e
+	}
+	if !bytes.Equal(b[:len(signature)], signature) {
+		return nil, ErrNoHeader
+	}
+	if b[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, b[12]>>4)
+	}
+	raw := make([]byte, v2HeaderSize+int(binary.BigEndian.Uint16(b[14:16])))
+	if _, e := io.ReadFull(r, raw); e != nil {
+		return nil, e
+	}
+
+	h := &Header{Version: V2, Command: Command(raw[12] & 0xf)}
+	if h.Command != Local && h.Command != Proxy {
+		return nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, h.Command)
+	}
+	family, proto := raw[13]>>4, raw[13]&0xf
+	body := raw[v2HeaderSize:]
+	var size int
+	switch family {
+	case familyUnspec:
+	case familyInet:
+		size = 2*4 + 2*2
+	case familyInet6:
+		size = 2*16 + 2*2
+	case familyUnix:
+		size = 2 * 108
+	default:
+		return nil, fmt.Errorf("%w: address family %d", ErrInvalidHeader, family)
+	}
+	if len(body) < size {
+		return nil, fmt.Errorf("%w: %d address bytes for family %d", ErrInvalidHeader, len(body), family)
+	}
+	if h.Command == Proxy && family != familyUnspec {
+		h.Source, h.Destination = v2Addrs(family, proto, body[:size])
+	}
+
+	for tlvs := body[size:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated tlv", ErrInvalidHeader)
+		}
+		n := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < n {
+			return nil, fmt.Errorf("%w: truncated tlv", ErrInvalidHeader)
+		}
+		tlv := TLV{Type: TLVType(tlvs[0]), Value: tlvs[3:n]}
+		if tlv.Type == TypeCRC32C && !checksumValid(raw, len(raw)-len(tlvs)+3, n-3) {
+			return nil, fmt.Errorf("%w: crc32c mismatch", ErrInvalidHeader)
+		}
+		h.TLVs = append(h.TLVs, tlv)
+		tlvs = tlvs[n:]
+	}
+	return h, nil
+}
+
+func v2Addrs(family, proto byte, b []byte) (src, dst net.Addr) {
+	if family == familyUnix {
+		name := func(b []byte) string { return string(bytes.TrimRight(b, "\x00")) }
+		network := "unix"
+		if proto == protoDgram {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: name(b[:108]), Net: network}, &net.UnixAddr{Name: name(b[108:]), Net: network}
+	}
+	n := (len(b) - 4) / 2
+	srcIP, _ := netip.AddrFromSlice(b[:n])
+	dstIP, _ := netip.AddrFromSlice(b[n : 2*n])
+	srcAddr := netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(b[2*n:]))
+	dstAddr := netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(b[2*n+2:]))
+	if proto == protoDgram {
+		return net.UDPAddrFromAddrPort(srcAddr), net.UDPAddrFromAddrPort(dstAddr)
+	}
+	return net.TCPAddrFromAddrPort(srcAddr), net.TCPAddrFromAddrPort(dstAddr)
+}
+
+// checksumValid checks the CRC32C TLV value at raw[offset:], it covers the
+// whole header with the checksum value itself zeroed.
+func checksumValid(raw []byte, offset, size int) bool {
+	if size != 4 {
+		return false
+	}
+	want := binary.BigEndian.Uint32(raw[offset:])
+	zeroed := bytes.Clone(raw)
+	clear(zeroed[offset : offset+4])
+	return crc32.Checksum(zeroed, crc32.MakeTable(crc32.Castagnoli)) == want
+}
+
+// TLV returns the value of the first TLV of the given type.
+func (h *Header) TLV(t TLVType) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Format encodes the header in its Version, v1 cannot carry TLVs and only
+// knows tcp addresses, anything else is sent as UNKNOWN.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case V1:
+		return h.formatV1(), nil
+	case V2:
+		return h.formatV2()
+	}
+	return nil, fmt.Errorf("proxyproto: unknown version %d", h.Version)
+}
+
+// WriteTo writes the formatted header to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, e := h.Format()
+	if e != nil {
+		return 0, e
+	}
+	n, e := w.Write(b)
+	return int64(n), e
+}
+
+func (h *Header) formatV1() []byte {
+	src, srcOk := h.Source.(*net.TCPAddr)
+	dst, dstOk := h.Destination.(*net.TCPAddr)
+	if h.Command == Local || !srcOk || !dstOk {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	srcAddr, dstAddr := src.AddrPort(), dst.AddrPort()
+	srcIP, dstIP := srcAddr.Addr().Unmap(), dstAddr.Addr().Unmap()
+	family := "TCP4"
+	if srcIP.Is6() || dstIP.Is6() {
+		family = "TCP6"
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP.WithZone(""), dstIP.WithZone(""), srcAddr.Port(), dstAddr.Port())
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	b := bytes.NewBuffer(bytes.Clone(signature))
+	b.WriteByte(0x20 | byte(h.Command))
+	addrs := make([]byte, 0, 2*108)
+	var family, proto byte
+	if h.Command == Proxy {
+		family, proto, addrs = v2Family(h.Source, h.Destination, addrs)
+	}
+	b.WriteByte(family<<4 | proto)
+
+	length := len(addrs)
+	for _, tlv := range h.TLVs {
+		length += 3 + len(tlv.Value)
+	}
+	if length > 0xffff {
+		return nil, fmt.Errorf("proxyproto: header of %d bytes is too long", length)
+	}
+	b.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	b.Write(addrs)
+	for _, tlv := range h.TLVs {
+		b.WriteByte(byte(tlv.Type))
+		b.Write(binary.BigEndian.AppendUint16(nil, uint16(len(tlv.Value))))
+		b.Write(tlv.Value)
+	}
+	return b.Bytes(), nil
+}
+
+// v2Family appends the address block for src and dst, mismatched or
+// unsupported addresses become an unspecified family without addresses.
+func v2Family(src, dst net.Addr, b []byte) (family, proto byte, addrs []byte) {
+	switch src := src.(type) {
+	case *net.TCPAddr, *net.UDPAddr:
+		srcAddr, srcOk := addrPort(src)
+		dstAddr, dstOk := addrPort(dst)
+		if !srcOk || !dstOk {
+			return familyUnspec, protoUnspec, b
+		}
+		proto = protoStream
+		if _, ok := src.(*net.UDPAddr); ok {
+			proto = protoDgram
+		}
+		srcIP, dstIP := srcAddr.Addr().Unmap(), dstAddr.Addr().Unmap()
+		if srcIP.Is4() && dstIP.Is4() {
+			family = familyInet
+			b = append(b, srcIP.AsSlice()...)
+			b = append(b, dstIP.AsSlice()...)
+		} else {
+			family = familyInet6
+			b = append(b, netip.AddrFrom16(srcIP.As16()).AsSlice()...)
+			b = append(b, netip.AddrFrom16(dstIP.As16()).AsSlice()...)
+		}
+		b = binary.BigEndian.AppendUint16(b, srcAddr.Port())
+		b = binary.BigEndian.AppendUint16(b, dstAddr.Port())
+		return family, proto, b
+	case *net.UnixAddr:
+		dst, ok := dst.(*net.UnixAddr)
+		if !ok || len(src.Name) > 108 || len(dst.Name) > 108 {
+			return familyUnspec, protoUnspec, b
+		}
+		proto = protoStream
+		if src.Net == "unixgram" {
+			proto = protoDgram
+		}
+		b = append(b, make([]byte, 2*108)...)
+		copy(b[len(b)-2*108:], src.Name)
+		copy(b[len(b)-108:], dst.Name)
+		return familyUnix, proto, b
+	}
+	return familyUnspec, protoUnspec, b
+}
+
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.AddrPort(), addr.IP != nil
+	case *net.UDPAddr:
+		return addr.AddrPort(), addr.IP != nil
+	}
+	return netip.AddrPort{}, false
+}
+
+// Conn is a connection that arrived with a PROXY header, it reports the
+// addresses from the header instead of those of the balancer.
+type Conn struct {
+	net.Conn
+	Header *Header
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Source != nil {
+		return c.Header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header.Destination != nil {
+		return c.Header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the connection the header arrived on, like tls.Conn does.
+func (c *Conn) NetConn() net.Conn { return c.Conn }
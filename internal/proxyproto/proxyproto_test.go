@@ -0,0 +1,98 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/mitmproxy/internal/proxyproto"
+)
+
+func TestReadV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\nGET / HTTP/1.1\r\n"))
+	h := mylog.Check2(proxyproto.Read(r))
+	assert.Equal(t, proxyproto.V1, h.Version)
+	assert.Equal(t, "192.0.2.1:51000", h.Source.String())
+	assert.Equal(t, "198.51.100.7:443", h.Destination.String())
+	rest := mylog.Check2(r.ReadString('\n'))
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+
+	h = mylog.Check2(proxyproto.Read(bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n"))))
+	assert.Equal(t, "[2001:db8::1]:1", h.Source.String())
+
+	h = mylog.Check2(proxyproto.Read(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))))
+	assert.Nil(t, h.Source)
+
+	for _, bad := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.7 051000 443\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.7 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.7 1\r\n",
+		"PROXY " + strings.Repeat("x", 120) + "\r\n",
+	} {
+		_, e := proxyproto.Read(bufio.NewReader(strings.NewReader(bad)))
+		assert.True(t, errors.Is(e, proxyproto.ErrInvalidHeader))
+	}
+	_, e := proxyproto.Read(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n")))
+	assert.True(t, errors.Is(e, proxyproto.ErrNoHeader))
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	for _, version := range []proxyproto.Version{proxyproto.V1, proxyproto.V2} {
+		in := &proxyproto.Header{Version: version, Command: proxyproto.Proxy, Source: src, Destination: dst}
+		if version == proxyproto.V2 {
+			in.TLVs = []proxyproto.TLV{{Type: proxyproto.TypeAuthority, Value: []byte("example.com")}}
+		}
+		b := new(bytes.Buffer)
+		mylog.Check2(in.WriteTo(b))
+		b.WriteString("payload")
+
+		r := bufio.NewReader(b)
+		out := mylog.Check2(proxyproto.Read(r))
+		assert.Equal(t, version, out.Version)
+		// mixed families are sent as ipv6, the source comes back v4 mapped
+		assert.Equal(t, src.String(), out.Source.String())
+		assert.Equal(t, dst.String(), out.Destination.String())
+		authority, ok := out.TLV(proxyproto.TypeAuthority)
+		assert.Equal(t, version == proxyproto.V2, ok)
+		if ok {
+			assert.Equal(t, "example.com", string(authority))
+		}
+		rest := mylog.Check2(r.ReadString(0))
+		assert.Equal(t, "payload", rest)
+	}
+}
+
+func TestReadV2Checksum(t *testing.T) {
+	h := &proxyproto.Header{
+		Version:     proxyproto.V2,
+		Command:     proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+		Destination: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 80},
+		TLVs:        []proxyproto.TLV{{Type: proxyproto.TypeCRC32C, Value: make([]byte, 4)}},
+	}
+	b := mylog.Check2(h.Format())
+	sum := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(b[len(b)-4:], sum)
+	out := mylog.Check2(proxyproto.Read(bufio.NewReader(bytes.NewReader(b))))
+	assert.Equal(t, "10.0.0.1:1000", out.Source.String())
+
+	b[len(b)-1]++
+	_, e := proxyproto.Read(bufio.NewReader(bytes.NewReader(b)))
+	assert.True(t, errors.Is(e, proxyproto.ErrInvalidHeader))
+}
+
+func TestReadV2Local(t *testing.T) {
+	b := mylog.Check2((&proxyproto.Header{Version: proxyproto.V2, Command: proxyproto.Local}).Format())
+	h := mylog.Check2(proxyproto.Read(bufio.NewReader(bytes.NewReader(b))))
+	assert.Equal(t, proxyproto.Local, h.Command)
+	assert.Nil(t, h.Source)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/netip"
 
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/mitmproxy/packet"
@@ -26,6 +27,9 @@ type Conn struct {
 	Writer  io.Writer
 	SendBuf []byte
 	RecvBuf []byte
+	// Relay carries the traffic of a tunnel in place of Tunnel, it returns
+	// errors.ErrUnsupported for the tunnels it leaves to Tunnel.
+	Relay func(target net.Conn) error
 }
 
 func NewConn(conn net.Conn) *Conn {
@@ -39,19 +43,46 @@ func NewConn(conn net.Conn) *Conn {
 
 func (c *Conn) Peek(n int) ([]byte, error) { return c.Reader.Peek(n) }
 
+// bindHost is the host the client reached the server at, where the
+// listeners for BIND and UDP ASSOCIATE are opened. It is empty when the
+// connection is unknown. Wrapped connections are unwrapped first, the
+// address a PROXY header claims is not one to listen on.
+func (c *Conn) bindHost() string {
+	conn, ok := c.Writer.(net.Conn)
+	if !ok {
+		return ""
+	}
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	if ap, e := netip.ParseAddrPort(conn.LocalAddr().String()); e == nil {
+		return ap.Addr().Unmap().String()
+	}
+	return ""
+}
+
 func (c *Conn) Read(req encoding.BinaryUnmarshaler) error {
 	buff := make([]byte, 1024)
-	n := mylog.Check2(c.Reader.Read(buff))
-	mylog.Check(req.UnmarshalBinary(buff[:n]))
+	n, e := c.Reader.Read(buff)
+	if e != nil {
+		return e
+	}
 	c.RecvBuf = buff[:n]
-	return nil
+	return req.UnmarshalBinary(buff[:n])
 }
 
 func (c *Conn) Write(resp encoding.BinaryMarshaler) error {
-	b := mylog.Check2(resp.MarshalBinary())
+	b, e := resp.MarshalBinary()
+	if e != nil {
+		return e
+	}
 	c.SendBuf = b
-	mylog.Check2(c.Writer.Write(b))
-	return nil
+	_, e = c.Writer.Write(b)
+	return e
 }
 
 func (c *Conn) SessionEvent(session *packet.Session) {
@@ -64,6 +95,11 @@ func (c *Conn) SessionEvent(session *packet.Session) {
 }
 
 func (c *Conn) Tunnel(target net.Conn) error {
+	if c.Relay != nil {
+		if e := c.Relay(target); !errors.Is(e, errors.ErrUnsupported) {
+			return e
+		}
+	}
 	errCh := make(chan error, 2)
 
 	go c.proxy(target, c.Reader, errCh, packet.Outbound)
@@ -79,11 +115,13 @@ func (c *Conn) Tunnel(target net.Conn) error {
 	return nil
 }
 
+// WaitForClose discards what the client sends until the connection is
+// closed or fails.
 func (c *Conn) WaitForClose() {
 	buf := make([]byte, 1)
 
 	for {
-		if _, e := c.Reader.Read(buf[:]); e == io.EOF {
+		if _, e := c.Reader.Read(buf[:]); e != nil {
 			break
 		}
 	}
@@ -93,7 +131,7 @@ func (c *Conn) proxy(dst io.Writer, src io.Reader, errCh chan error, direction p
 	//_, err := io.Copy(dst, src)
 	_, e := c.copyBuffer(dst, src, nil, direction)
 	if tcpConn, ok := dst.(*net.TCPConn); ok {
-		mylog.Check(tcpConn.CloseWrite())
+		mylog.CheckIgnore(tcpConn.CloseWrite())
 	}
 	errCh <- e
 }
@@ -111,30 +149,25 @@ func (c *Conn) copyBuffer(dst io.Writer, src io.Reader, buf []byte, direction pa
 			mylog.Info("Proxy read error during body copy", err)
 		}
 		if nr > 0 {
-			c.Session.StreamDirection = direction
-			switch direction {
-			case packet.Inbound:
-				c.Session.ReqBodyDecoder.Payload = buf[:nr]
-			case packet.Outbound:
-				c.Session.RespBodyDecoder.Payload = buf[:nr]
+			if c.Session != nil {
+				c.Session.Record(direction, buf[:nr], c.SessionEvent)
 			}
-			if c.Session.EventCallBack == nil {
-				c.SessionEvent(c.Session)
-			} else {
-				c.EventCallBack(c.Session)
-			}
-			nw := mylog.Check2(dst.Write(buf[:nr]))
+			nw, werr := dst.Write(buf[:nr])
 			if nw > 0 {
 				written += int64(nw)
 			}
-
+			if werr != nil {
+				return written, werr
+			}
 			if nr != nw {
 				return written, io.ErrShortWrite
 			}
 		}
-		if mylog.Check(err) {
-			return written, nil
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
 		}
-		return written, err
 	}
 }
@@ -1,7 +1,10 @@
 package socks
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding"
 	"errors"
 	"fmt"
 	"io"
@@ -61,20 +64,30 @@ func (d *Socks4Dialer) Dial(network, addr string) (net.Conn, error) {
 }
 
 func (d *Socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn := mylog.Check2(d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress))
+	conn, e := d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	if e != nil {
+		return nil, e
+	}
 	socksConn := NewConn(conn)
-	mylog.Check(socksConn.Write(&Socks4Request{
+	if e := socksConn.Write(&Socks4Request{
 		CMD:    ConnectCommand,
 		Addr:   addr,
 		UserID: d.userID,
-	}))
+	}); e != nil {
+		mylog.CheckIgnore(conn.Close())
+		return nil, e
+	}
 
 	resp := &Socks4Response{}
-	mylog.Check(socksConn.Read(resp))
+	if e := socksConn.readReply(resp, func([]byte) (int, error) { return 8, nil }); e != nil {
+		mylog.CheckIgnore(conn.Close())
+		return nil, e
+	}
 	if resp.Status != Socks4StatusGranted {
+		mylog.CheckIgnore(conn.Close())
 		return nil, fmt.Errorf("socks error: %v", resp.Status)
 	}
-	return conn, nil
+	return socksConn.tunnelConn(conn), nil
 }
 
 type Socks5DialerOptions struct {
@@ -136,37 +149,110 @@ func (d *Socks5Dialer) Dial(network, addr string) (net.Conn, error) {
 }
 
 func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn := mylog.Check2(d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress))
+	conn, e := d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	if e != nil {
+		return nil, e
+	}
 	socksConn := NewConn(conn)
-	mylog.Check(socksConn.Write(&MethodSelectRequest{
+	if e := d.handshake(ctx, socksConn, addr); e != nil {
+		mylog.CheckIgnore(conn.Close())
+		return nil, e
+	}
+	return socksConn.tunnelConn(conn), nil
+}
+
+func (d *Socks5Dialer) handshake(ctx context.Context, socksConn *Conn, addr string) error {
+	if e := socksConn.Write(&MethodSelectRequest{
 		Methods: d.authMethods,
-	}))
+	}); e != nil {
+		return e
+	}
 	methodSelectResp := &MethodSelectResponse{}
-	mylog.Check(socksConn.Read(methodSelectResp))
+	if e := socksConn.Read(methodSelectResp); e != nil {
+		return e
+	}
 	// If the selected METHOD is X'FF', none of the methods listed by the
 	// client are acceptable, and the client MUST close the connection.
 	if methodSelectResp.Method == AuthMethodNoAcceptableMethods {
-		mylog.Check(conn.Close())
-		return nil, errors.New("no authentication method accepted")
+		return errors.New("no authentication method accepted")
 	}
 
 	if d.authenticate != nil {
-		mylog.Check(d.authenticate(ctx, socksConn, methodSelectResp.Method))
+		if e := d.authenticate(ctx, socksConn, methodSelectResp.Method); e != nil {
+			return e
+		}
 	}
-	mylog.Check(socksConn.Write(&Socks5Request{
+	if e := socksConn.Write(&Socks5Request{
 		CMD:  ConnectCommand,
 		Addr: addr,
-	}))
+	}); e != nil {
+		return e
+	}
 	// todo func (pc *persistConn) readResponse(r
 
 	resp := &Socks5Response{}
-	mylog.Check(socksConn.Read(resp))
+	if e := socksConn.readReply(resp, socks5ReplySize); e != nil {
+		return e
+	}
 	if resp.Status != Socks5StatusGranted {
-		return nil, fmt.Errorf("socks error: %v", resp.Status)
+		return fmt.Errorf("socks error: %v", resp.Status)
 	}
-	return conn, nil
+	return nil
 }
 
 func (d *Socks5Dialer) ReadResponse(dst io.Writer, src io.Reader, buf []byte) {
 	// copyBuffer(dst, src, buf, nil, nil) //todo
 }
+
+// readReply reads exactly the reply to a request, size tells its length
+// from its first 5 bytes. What follows the reply is already the tunnel and
+// stays buffered.
+func (c *Conn) readReply(resp encoding.BinaryUnmarshaler, size func(head []byte) (int, error)) error {
+	head, e := c.Reader.Peek(5)
+	if e != nil {
+		return e
+	}
+	n, e := size(head)
+	if e != nil {
+		return e
+	}
+	p, e := c.Reader.Peek(n)
+	if e != nil {
+		return e
+	}
+	c.RecvBuf = bytes.Clone(p)
+	mylog.Check2(c.Reader.Discard(n))
+	return resp.UnmarshalBinary(c.RecvBuf)
+}
+
+// socks5ReplySize is the length of a socks5 reply, it depends on the type
+// of its address.
+func socks5ReplySize(head []byte) (int, error) {
+	switch AddrType(head[3]) {
+	case AddrTypeIPv4:
+		return 4 + net.IPv4len + 2, nil
+	case AddrTypeIPv6:
+		return 4 + net.IPv6len + 2, nil
+	case AddrTypeFQDN:
+		return 4 + 1 + int(head[4]) + 2, nil
+	}
+	return 0, errUnknownAddrType
+}
+
+// bufferedConn reads what was buffered along with the reply of the proxy
+// before reading on from the connection, a target that speaks first can
+// send its greeting in the same read as the reply.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+// tunnelConn returns conn for the tunnel that follows the handshake of c.
+func (c *Conn) tunnelConn(conn net.Conn) net.Conn {
+	if c.Reader.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, reader: c.Reader}
+}
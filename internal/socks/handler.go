@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"slices"
+	"syscall"
 
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/mitmproxy/packet"
@@ -13,18 +15,32 @@ import (
 
 type Socks4Handler struct {
 	*packet.Session
-	Conn     *Conn
-	Dialer   Dialer
-	listener Listener
-	ident    IdentFunc
+	Conn   *Conn
+	Dialer Dialer
+	// Listener opens the listeners of BIND requests, nil refuses BIND.
+	Listener Listener
+	// Resolver looks up the names BIND requests expect a connection from,
+	// nil uses the system resolver.
+	Resolver Resolver
+	Ident    IdentFunc
+	Allow    AllowFunc
 }
 
 func (h *Socks4Handler) Handle() error {
 	req := &Socks4Request{}
-	mylog.Check(h.Conn.Read(req))
+	if e := h.Conn.Read(req); e != nil {
+		return e
+	}
 
-	if h.ident != nil {
-		mylog.Check(h.ident(context.Background(), h.Conn, req))
+	if h.Ident != nil {
+		if e := h.Ident(context.Background(), h.Conn, req); e != nil {
+			return h.reject(req, Socks4StatusInvalidUserID, e)
+		}
+	}
+	if h.Allow != nil {
+		if e := h.Allow(req.CMD, req.Addr); e != nil {
+			return h.reject(req, Socks4StatusRejected, e)
+		}
 	}
 
 	switch req.CMD {
@@ -35,122 +51,156 @@ func (h *Socks4Handler) Handle() error {
 	case AssociateCommand:
 		fallthrough
 	default:
-		mylog.Check(h.Conn.Write(&Socks4Response{
-			Status: Socks4StatusRejected,
-		}))
+		return h.reject(req, Socks4StatusRejected, fmt.Errorf("unsupported command %s", req.CMD))
 	}
+}
+
+// Refuse reads the request of a client the server does not serve at all and
+// rejects it.
+func (h *Socks4Handler) Refuse(err error) error {
+	req := &Socks4Request{}
+	if e := h.Conn.Read(req); e != nil {
+		return e
+	}
+	return h.reject(req, Socks4StatusRejected, err)
+}
 
-	return nil
+// reject answers the request with a failure status and records it as a
+// failed session.
+func (h *Socks4Handler) reject(req *Socks4Request, status Socks4Status, err error) error {
+	e := h.Conn.Write(&Socks4Response{Status: status})
+	failSession(h.Session, h.Conn, req.CMD, req.Addr, status.String(), err)
+	if e != nil {
+		return e
+	}
+	return err
 }
 
 func (h *Socks4Handler) handleConnect(req *Socks4Request) error {
-	target := mylog.Check2(h.Dialer.DialContext(context.Background(), "tcp", req.Addr))
-	//if err != nil {
-	//	writeErr := h.Conn.Write(&Socks4Response{
-	//		Status: Socks4StatusRejected,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//	return err
-	//}
-
-	defer func() {
-		mylog.Check(target.Close())
-	}()
-
-	mylog.Check(h.Conn.Write(&Socks4Response{
+	target, e := h.Dialer.DialContext(context.Background(), "tcp", req.Addr)
+	if e != nil {
+		return h.reject(req, Socks4StatusRejected, e)
+	}
+	defer func() { mylog.CheckIgnore(target.Close()) }()
+
+	if e := h.Conn.Write(&Socks4Response{
 		Status: Socks4StatusGranted,
 		Addr:   "",
-	}))
+	}); e != nil {
+		return e
+	}
+	recordTarget(h.Session, req.CMD, req.Addr)
 	h.Conn.Session = h.Session
 	return h.Conn.Tunnel(target)
 }
 
 func (h *Socks4Handler) handleBind(req *Socks4Request) error {
-	listener := mylog.Check2(h.listener.Listen(context.Background(), "tcp", ":0")) // use a free port
-	//if err != nil {
-	//	writeErr := h.Conn.Write(&Socks4Response{
-	//		Status: Socks4StatusRejected,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//	return err
-	//}
-
-	mylog.Check(h.Conn.Write(&Socks4Response{
+	if h.Listener == nil {
+		return h.reject(req, Socks4StatusRejected, errors.New("bind is not enabled"))
+	}
+	// socks4 replies only carry IPv4, 0.0.0.0 tells the client to use the
+	// address of the server
+	host := h.Conn.bindHost()
+	if ip, e := netip.ParseAddr(host); e != nil || !ip.Is4() {
+		host = "0.0.0.0"
+	}
+	listener, e := h.Listener.Listen(context.Background(), "tcp4", net.JoinHostPort(host, "0"))
+	if e != nil {
+		return h.reject(req, Socks4StatusRejected, e)
+	}
+	defer func() { mylog.CheckIgnore(listener.Close()) }()
+
+	if e := h.Conn.Write(&Socks4Response{
 		Status: Socks4StatusGranted,
 		Addr:   listener.Addr().String(),
-	}))
-
-	conn := mylog.Check2(listener.Accept())
-	//if err != nil {
-	//	writeErr := h.Conn.Write(&Socks4Response{
-	//		Status: Socks4StatusRejected,
-	//		Addr:   conn.RemoteAddr().String(),
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//	return err
-	//}
-
-	mylog.Check(listener.Close())
+	}); e != nil {
+		return e
+	}
+
+	conn, e := listener.Accept()
+	if e != nil {
+		return h.reject(req, Socks4StatusRejected, e)
+	}
+	defer func() { mylog.CheckIgnore(conn.Close()) }()
 
 	// The SOCKS server checks the IP address of the originating host against
 	// the value of DSTIP specified in the client's BIND request.
-	mylog.Check(checkIPAddr(req.Addr, conn.RemoteAddr().String()))
-	//if err != nil {
-	//	mylog.Check(conn.Close())
-	//	writeErr := h.Conn.Write(&Socks4Response{
-	//		Status: Socks4StatusRejected,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//	return nil
-	//}
+	if e := checkPeer(h.Resolver, req.Addr, conn.RemoteAddr()); e != nil {
+		return h.reject(req, Socks4StatusRejected, e)
+	}
 
 	// The SOCKS server sends a second reply packet to the client when the
 	// anticipated connection from the application server is established.
-	mylog.Check(h.Conn.Write(&Socks4Response{
+	if e := h.Conn.Write(&Socks4Response{
 		Status: Socks4StatusGranted,
 		Addr:   "",
-	}))
-	h.Conn.Session = h.Session
+	}); e != nil {
+		return e
+	}
+	h.Conn.Session = bindSession(h.Session, req.CMD, req.Addr, conn)
 	return h.Conn.Tunnel(conn)
 }
 
 type Socks5Handler struct {
 	*packet.Session
-	Conn         *Conn
-	Dialer       Dialer
-	listener     Listener
+	Conn   *Conn
+	Dialer Dialer
+	// Listener opens the listeners of BIND requests, nil refuses BIND.
+	Listener     Listener
 	AuthMethods  []AuthMethod
 	Authenticate AuthenticateFunc
+	Allow        AllowFunc
+	// PacketListener opens the sockets of UDP associations, nil refuses
+	// UDP ASSOCIATE.
+	PacketListener PacketListener
+	// Resolver looks up the names datagrams are sent to and BIND requests
+	// expect a connection from, nil uses the system resolver. Connections
+	// resolve names in Dialer.
+	Resolver Resolver
 }
 
 func (h *Socks5Handler) Handle() error {
 	methodSelectReq := &MethodSelectRequest{}
-	mylog.Check(h.Conn.Read(methodSelectReq))
+	if e := h.Conn.Read(methodSelectReq); e != nil {
+		return e
+	}
 
 	method := h.selectAuthMethod(methodSelectReq.Methods)
 
-	mylog.Check(h.Conn.Write(&MethodSelectResponse{
+	if e := h.Conn.Write(&MethodSelectResponse{
 		Method: method,
-	}))
+	}); e != nil {
+		return e
+	}
 
-	if method == AuthMethodNoAcceptableMethods { // todo
-		return errors.New("no supported authentication method")
+	if method == AuthMethodNoAcceptableMethods {
+		e := errors.New("no supported authentication method")
+		failSession(h.Session, h.Conn, 0, "", "no acceptable authentication methods", e)
+		return e
 	}
 
 	if h.Authenticate != nil {
-		mylog.Check(h.Authenticate(context.Background(), h.Conn, method))
+		if e := h.Authenticate(context.Background(), h.Conn, method); e != nil {
+			failSession(h.Session, h.Conn, 0, "", "authentication failed", e)
+			return e
+		}
 	}
 
 	req := &Socks5Request{}
-	mylog.Check(h.Conn.Read(req))
+	if e := h.Conn.Read(req); e != nil {
+		status := Socks5StatusFailure
+		if errors.Is(e, errUnknownAddrType) {
+			status = Socks5StatusAddrTypeNotSupported
+		}
+		return h.reject(req, status, e)
+	}
+	// the address of UDP ASSOCIATE is the client's, Allow sees the
+	// destination of every datagram instead
+	if h.Allow != nil && req.CMD != AssociateCommand {
+		if e := h.Allow(req.CMD, req.Addr); e != nil {
+			return h.reject(req, Socks5StatusNotAllowed, e)
+		}
+	}
 
 	switch req.CMD {
 	case ConnectCommand:
@@ -158,13 +208,36 @@ func (h *Socks5Handler) Handle() error {
 	case BindCommand:
 		return h.handleBind(req)
 	case AssociateCommand:
-		fallthrough
+		return h.handleAssociate(req)
 	default:
-		mylog.Check(h.Conn.Write(&Socks5Response{
-			Status: Socks5StatusCMDNotSupported,
-		}))
+		return h.reject(req, Socks5StatusCMDNotSupported, fmt.Errorf("unsupported command %s", req.CMD))
 	}
-	return nil
+}
+
+// Refuse answers the method selection of a client the server does not serve
+// at all with no acceptable methods.
+func (h *Socks5Handler) Refuse(err error) error {
+	methodSelectReq := &MethodSelectRequest{}
+	if e := h.Conn.Read(methodSelectReq); e != nil {
+		return e
+	}
+	e := h.Conn.Write(&MethodSelectResponse{Method: AuthMethodNoAcceptableMethods})
+	failSession(h.Session, h.Conn, 0, "", Socks5StatusNotAllowed.String(), err)
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+// reject answers the request with a failure status and records it as a
+// failed session.
+func (h *Socks5Handler) reject(req *Socks5Request, status Socks5Status, err error) error {
+	e := h.Conn.Write(&Socks5Response{Status: status})
+	failSession(h.Session, h.Conn, req.CMD, req.Addr, status.String(), err)
+	if e != nil {
+		return e
+	}
+	return err
 }
 
 func (h *Socks5Handler) selectAuthMethod(authMethods []AuthMethod) AuthMethod {
@@ -178,133 +251,150 @@ func (h *Socks5Handler) selectAuthMethod(authMethods []AuthMethod) AuthMethod {
 }
 
 func (h *Socks5Handler) handleConnect(req *Socks5Request) error {
-	target := mylog.Check2(h.Dialer.DialContext(context.Background(), "tcp", req.Addr))
-	//if err != nil {
-	//	msg := err.Error()
-	//	status := Socks5StatusHostUnreachable
-	//
-	//	if strings.Has(msg, "refused") {
-	//		status = Socks5StatusConnectionRefused
-	//	} else if strings.Has(msg, "network is unreachable") {
-	//		status = Socks5StatusNetworkUnreaachable
-	//	}
-	//
-	//	writeErr := h.Conn.Write(&Socks5Response{Status: status})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//
-	//	mylog.Warning("Connect to %v failed: %v", req.Addr, err)
-	//
-	//	return err
-	//}
-
-	defer func() { mylog.Check(target.Close()) }()
-
-	mylog.Check(h.Conn.Write(&Socks5Response{
+	target, e := h.Dialer.DialContext(context.Background(), "tcp", req.Addr)
+	if e != nil {
+		return h.reject(req, Socks5DialStatus(e), e)
+	}
+	defer func() { mylog.CheckIgnore(target.Close()) }()
+
+	if e := h.Conn.Write(&Socks5Response{
 		Status: Socks5StatusGranted,
 		// In the reply to a CONNECT, BND.PORT contains the port number that the
 		// server assigned to connect to the target host, while BND.ADDR
 		// contains the associated IP address.
 		Addr: target.LocalAddr().String(),
-	}))
+	}); e != nil {
+		return e
+	}
+	recordTarget(h.Session, req.CMD, req.Addr)
 	h.Conn.Session = h.Session
 	return h.Conn.Tunnel(target)
 }
 
 func (h *Socks5Handler) handleBind(req *Socks5Request) error {
-	listener := mylog.Check2(h.listener.Listen(context.Background(), "tcp", ":0"))
-	//if err != nil {
-	//	writeErr := h.Conn.Write(&Socks5Response{
-	//		Status: Socks5StatusFailure,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//
-	//	return err
-	//}
-
-	mylog.Check(h.Conn.Write(&Socks5Response{
+	if h.Listener == nil {
+		return h.reject(req, Socks5StatusCMDNotSupported, errors.New("bind is not enabled"))
+	}
+	listener, e := h.Listener.Listen(context.Background(), "tcp", net.JoinHostPort(h.Conn.bindHost(), "0"))
+	if e != nil {
+		return h.reject(req, Socks5StatusFailure, e)
+	}
+	defer func() { mylog.CheckIgnore(listener.Close()) }()
+
+	if e := h.Conn.Write(&Socks5Response{
 		Status: Socks5StatusGranted,
 		Addr:   listener.Addr().String(),
-	}))
-
-	conn := mylog.Check2(listener.Accept())
-	//if err != nil {
-	//	writeErr := h.Conn.Write(&Socks5Response{
-	//		Status: Socks5StatusFailure,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//
-	//	return err
-	//}
-
-	mylog.Check(listener.Close())
-
-	mylog.Check(checkIPAddr(req.Addr, conn.RemoteAddr().String()))
-	//if err != nil {
-	//	_ = conn.Close()
-	//	writeErr := h.Conn.Write(&Socks5Response{
-	//		Status: Socks5StatusFailure,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//
-	//	return err
-	//}
-
-	mylog.Check(h.Conn.Write(&Socks5Response{
+	}); e != nil {
+		return e
+	}
+
+	conn, e := listener.Accept()
+	if e != nil {
+		return h.reject(req, Socks5DialStatus(e), e)
+	}
+	defer func() { mylog.CheckIgnore(conn.Close()) }()
+
+	if e := checkPeer(h.Resolver, req.Addr, conn.RemoteAddr()); e != nil {
+		return h.reject(req, Socks5StatusNotAllowed, e)
+	}
+
+	if e := h.Conn.Write(&Socks5Response{
 		Status: Socks5StatusGranted,
 		Addr:   conn.RemoteAddr().String(),
-	}))
-	h.Conn.Session = h.Session
+	}); e != nil {
+		return e
+	}
+	h.Conn.Session = bindSession(h.Session, req.CMD, req.Addr, conn)
 	return h.Conn.Tunnel(conn)
 }
 
-func (h *Socks5Handler) handleAssociate(req *Socks5Request) error {
-	var lc net.ListenConfig
-	udpConn := mylog.Check2(lc.ListenPacket(context.Background(), "udp", ":0"))
-	//if err != nil {
-	//	writeErr := h.Conn.Write(&Socks5Response{
-	//		Status: Socks5StatusFailure,
-	//	})
-	//	if writeErr != nil {
-	//		return writeErr
-	//	}
-	//
-	//	return err
-	//}
-
-	defer func() {
-		mylog.Check(udpConn.Close())
-	}()
-
-	mylog.Check(h.Conn.Write(&Socks5Response{
-		Status: Socks5StatusGranted,
-		Addr:   udpConn.LocalAddr().String(),
-	}))
+// Socks5DialStatus maps a failed dial to the reply status RFC 1928 defines
+// for it.
+func Socks5DialStatus(err error) Socks5Status {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, packet.ErrDenied):
+		return Socks5StatusNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Socks5StatusConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return Socks5StatusNetworkUnreaachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return Socks5StatusTTLExpired
+	}
+	return Socks5StatusHostUnreachable
+}
 
-	// A UDP association terminates when the TCP connection that the UDP
-	// ASSOCIATE request arrived on terminates.
-	go func() {
-		h.Conn.WaitForClose()
-		mylog.Check(udpConn.Close())
-	}()
+// recordTarget notes the requested address of a tunnel on its session.
+func recordTarget(s *packet.Session, cmd Command, addr string) {
+	if s == nil {
+		return
+	}
+	s.Method = cmd.String()
+	s.Host = addr
+}
 
-	// TODO
+// failSession fills the session of a refused request and emits it.
+func failSession(s *packet.Session, c *Conn, cmd Command, addr, status string, err error) {
+	mylog.Warning("socks", err)
+	if s == nil {
+		return
+	}
+	s.Err = err
+	s.StreamDirection = packet.Outbound
+	s.Method = cmd.String()
+	s.Host = addr
+	s.Status = status
+	s.RespBodyDecoder.Payload = c.SendBuf
+	if s.EventCallBack == nil {
+		c.SessionEvent(s)
+	} else {
+		s.EventCallBack(s)
+	}
+}
 
-	return nil
+// bindSession is the child session the inbound connection of a BIND is
+// reported with.
+func bindSession(s *packet.Session, cmd Command, addr string, conn net.Conn) *packet.Session {
+	if s == nil {
+		return nil
+	}
+	recordTarget(s, cmd, addr)
+	child := s.NewChild(s.SchemerType)
+	child.Method = cmd.String()
+	child.Host = conn.RemoteAddr().String()
+	if ap, e := netip.ParseAddrPort(child.Host); e == nil {
+		child.ResolvedIP = ap.Addr().Unmap()
+	}
+	return child
 }
 
-func checkIPAddr(expected, actual string) error {
-	expectedIP, _ := mylog.Check3(net.SplitHostPort(expected))
-	actualIP, _ := mylog.Check3(net.SplitHostPort(actual))
-	if expectedIP != actualIP {
-		return fmt.Errorf("ip mismatch. Expected %s. Got %s", expectedIP, actualIP)
+// checkPeer compares the address of the inbound connection of a BIND with
+// the one the request expects, an unspecified address accepts anybody.
+func checkPeer(r Resolver, expected string, actual net.Addr) error {
+	host, _, e := net.SplitHostPort(expected)
+	if e != nil {
+		return e
+	}
+	peer, e := netip.ParseAddrPort(actual.String())
+	if e != nil {
+		return e
+	}
+	ips := make([]netip.Addr, 0, 1)
+	if ip, e := netip.ParseAddr(host); e == nil {
+		ips = append(ips, ip)
+	} else {
+		if r == nil {
+			r = net.DefaultResolver
+		}
+		if ips, e = r.LookupNetIP(context.Background(), "ip", host); e != nil {
+			return e
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsUnspecified() || ip.Unmap() == peer.Addr().Unmap() {
+			return nil
+		}
 	}
-	return nil
+	return fmt.Errorf("ip mismatch. Expected %s. Got %s", host, peer.Addr())
 }
@@ -1,6 +1,7 @@
 package socks
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -19,6 +20,9 @@ type Options struct {
 
 	Listener Listener
 
+	// PacketListener opens the sockets of UDP associations.
+	PacketListener PacketListener
+
 	// Ident specifies the optional ident function.
 	// It must return an error when the ident is failed.
 	Ident IdentFunc
@@ -38,6 +42,7 @@ type Server struct {
 	*Logger
 	dialer       Dialer
 	listener     Listener
+	packetConn   PacketListener
 	ident        IdentFunc
 	authMethods  []AuthMethod
 	authenticate AuthenticateFunc
@@ -45,10 +50,11 @@ type Server struct {
 
 func New(optFns ...func(*Options)) *Server {
 	options := Options{
-		Logger:      golog.NewGoLogger(golog.INFO, log.Default()),
-		Dialer:      &net.Dialer{},
-		Listener:    &net.ListenConfig{},
-		AuthMethods: []AuthMethod{AuthMethodNotRequired},
+		Logger:         golog.NewGoLogger(golog.INFO, log.Default()),
+		Dialer:         &net.Dialer{},
+		Listener:       &net.ListenConfig{},
+		PacketListener: &net.ListenConfig{},
+		AuthMethods:    []AuthMethod{AuthMethodNotRequired},
 	}
 
 	for _, fn := range optFns {
@@ -59,6 +65,7 @@ func New(optFns ...func(*Options)) *Server {
 		Logger:       &Logger{options.Logger},
 		dialer:       options.Dialer,
 		listener:     options.Listener,
+		packetConn:   options.PacketListener,
 		ident:        options.Ident,
 		authMethods:  options.AuthMethods,
 		authenticate: options.Authenticate,
@@ -71,44 +78,60 @@ func ListenAndServe(addr string) error {
 }
 
 func (s *Server) ListenAndServe(addr string) error {
-	l := mylog.Check2(net.Listen("tcp", addr))
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
 	return s.Serve(l)
 }
 
 // Serve serves connections from a listener
 func (s *Server) Serve(l net.Listener) error {
 	defer func() {
-		mylog.Check(l.Close())
+		mylog.CheckIgnore(l.Close())
 	}()
 
 	for {
-		conn := mylog.Check2(l.Accept())
+		conn, e := l.Accept()
+		if e != nil {
+			if errors.Is(e, net.ErrClosed) { // closing the listener stops the server
+				return nil
+			}
+			return e
+		}
 		go func() {
-			mylog.Check(s.handleConnection(conn))
+			mylog.CheckIgnore(s.handleConnection(conn))
 		}()
 	}
 }
 
 func (s *Server) handleConnection(conn net.Conn) error {
 	defer func() {
-		mylog.Check(conn.Close())
+		mylog.CheckIgnore(conn.Close())
 	}()
 	socksConn := NewConn(conn)
-	version := mylog.Check2(socksConn.Peek(3))
+	version, e := socksConn.Peek(3)
+	if e != nil {
+		return e
+	}
 	switch Version(version[0]) {
 	case Socks4Version:
 		socks4Handler := &Socks4Handler{
-			Dialer: s.dialer,
-			Conn:   socksConn,
+			Dialer:   s.dialer,
+			Listener: s.listener,
+			Conn:     socksConn,
+			Ident:    s.ident,
 		}
 
 		return socks4Handler.Handle()
 	case Socks5Version:
 		socks5Handler := &Socks5Handler{
-			Dialer:       s.dialer,
-			Conn:         socksConn,
-			AuthMethods:  s.authMethods,
-			Authenticate: s.authenticate,
+			Dialer:         s.dialer,
+			Listener:       s.listener,
+			Conn:           socksConn,
+			AuthMethods:    s.authMethods,
+			Authenticate:   s.authenticate,
+			PacketListener: s.packetConn,
 		}
 
 		return socks5Handler.Handle()
@@ -10,8 +10,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-
-	"github.com/ddkwork/golibrary/std/mylog"
 )
 
 type Version byte
@@ -107,8 +105,14 @@ func (code Socks5Status) String() string {
 
 type IdentFunc func(context.Context, *Conn, *Socks4Request) error
 
+// AllowFunc decides whether a request may run, a denial is answered with the
+// refusal status of the socks version.
+type AllowFunc func(cmd Command, addr string) error
+
 type AddrType uint8
 
+var errUnknownAddrType = errors.New("unknown address type")
+
 const (
 	AddrTypeIPv4 AddrType = 0x01 // IPv4
 	AddrTypeFQDN AddrType = 0x03 // FQDN
@@ -147,11 +151,16 @@ type Socks4Request struct {
 
 func (req *Socks4Request) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks4Version), byte(req.CMD)}
-	host, port := mylog.Check3(splitHostPort(req.Addr))
+	host, port, e := splitHostPort(req.Addr)
+	if e != nil {
+		return nil, e
+	}
 	dstIP := make([]byte, 4)
 	var domain string
 	if ip := net.ParseIP(host); ip != nil {
-		dstIP = ip.To4()
+		if dstIP = ip.To4(); dstIP == nil {
+			return nil, fmt.Errorf("%w: socks4 cannot address %s", errUnknownAddrType, host)
+		}
 	} else {
 		dstIP[0] = 0
 		dstIP[1] = 0
@@ -181,28 +190,45 @@ func (req *Socks4Request) MarshalBinary() ([]byte, error) {
 func (req *Socks4Request) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if Version(version[0]) != Socks4Version {
 		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
 	}
 
 	cmd := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &cmd))
+	if e := binary.Read(r, binary.BigEndian, &cmd); e != nil {
+		return e
+	}
 
 	req.CMD = Command(cmd[0])
 
 	port := make([]byte, 2)
-	mylog.Check(binary.Read(r, binary.BigEndian, &port))
+	if e := binary.Read(r, binary.BigEndian, &port); e != nil {
+		return e
+	}
 	portNum := (int(port[0]) << 8) | int(port[1])
 	ip := make(net.IP, 4)
-	mylog.Check(binary.Read(r, binary.BigEndian, &ip))
-	userID := mylog.Check2(r.ReadString(0))
+	if e := binary.Read(r, binary.BigEndian, &ip); e != nil {
+		return e
+	}
+	userID, e := r.ReadString(0)
+	if e != nil {
+		return e
+	}
 	req.UserID = strings.TrimSuffix(userID, "\x00")
 	socks4a := ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
 	req.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(portNum))
 	if socks4a {
-		domain := mylog.Check2(r.ReadString(0))
-		req.Addr = net.JoinHostPort(strings.TrimSuffix(domain, "\x00"), strconv.Itoa(portNum))
+		domain, e := r.ReadString(0)
+		if e != nil {
+			return e
+		}
+		if domain = strings.TrimSuffix(domain, "\x00"); domain == "" {
+			return errors.New("socks4a request without a domain")
+		}
+		req.Addr = net.JoinHostPort(domain, strconv.Itoa(portNum))
 	}
 	return nil
 }
@@ -213,28 +239,41 @@ type Socks4Response struct {
 }
 
 func (resp *Socks4Response) MarshalBinary() ([]byte, error) {
-	b := []byte{0, byte(resp.Status)}
+	// the reply is always 8 bytes, an unset address goes out as zeros
+	b := []byte{0, byte(resp.Status), 0, 0, 0, 0, 0, 0}
 	if resp.Addr == "" {
 		return b, nil
 	}
-	host, port := mylog.Check3(splitHostPort(resp.Addr))
-	b = append(b, byte(port>>8), byte(port))
-	ip := net.ParseIP(host)
-	b = append(b, ip.To4()...)
+	host, port, e := splitHostPort(resp.Addr)
+	if e != nil {
+		return nil, e
+	}
+	ip4 := net.ParseIP(host).To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%w: socks4 cannot address %s", errUnknownAddrType, host)
+	}
+	b[2], b[3] = byte(port>>8), byte(port)
+	copy(b[4:], ip4)
 	return b, nil
 }
 
 func (resp *Socks4Response) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p[1:]) // ignore version
 	status := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &status))
+	if e := binary.Read(r, binary.BigEndian, &status); e != nil {
+		return e
+	}
 	resp.Status = Socks4Status(status[0])
-	if len(p) > 2 {
+	if len(p) > 2 && !bytes.Equal(p[2:], make([]byte, len(p)-2)) {
 		port := make([]byte, 2)
-		mylog.Check(binary.Read(r, binary.BigEndian, &port))
+		if e := binary.Read(r, binary.BigEndian, &port); e != nil {
+			return e
+		}
 		portNum := (int(port[0]) << 8) | int(port[1])
 		ip := make(net.IP, 4)
-		mylog.Check(binary.Read(r, binary.BigEndian, &ip))
+		if e := binary.Read(r, binary.BigEndian, &ip); e != nil {
+			return e
+		}
 		resp.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(portNum))
 	}
 	return nil
@@ -257,14 +296,20 @@ func (req *MethodSelectRequest) MarshalBinary() ([]byte, error) {
 func (req *MethodSelectRequest) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if Version(version[0]) != Socks5Version {
 		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
 	}
 	number := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &number))
+	if e := binary.Read(r, binary.BigEndian, &number); e != nil {
+		return e
+	}
 	methods := make([]byte, int(number[0]))
-	mylog.Check(binary.Read(r, binary.BigEndian, &methods))
+	if e := binary.Read(r, binary.BigEndian, &methods); e != nil {
+		return e
+	}
 	for _, m := range methods {
 		req.Methods = append(req.Methods, AuthMethod(m))
 	}
@@ -282,12 +327,16 @@ func (resp *MethodSelectResponse) MarshalBinary() ([]byte, error) {
 func (resp *MethodSelectResponse) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if Version(version[0]) != Socks5Version {
 		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
 	}
 	method := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &method))
+	if e := binary.Read(r, binary.BigEndian, &method); e != nil {
+		return e
+	}
 	resp.Method = AuthMethod(method[0])
 	return nil
 }
@@ -312,18 +361,28 @@ func (req *UsernamePasswordAuthRequest) MarshalBinary() ([]byte, error) {
 func (req *UsernamePasswordAuthRequest) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if UsernamePasswordAuthVersion(version[0]) != UsernamePasswordAuthVersion1 {
 		return fmt.Errorf("unsupported username password version: %d", version[0])
 	}
 	length := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &length))
+	if e := binary.Read(r, binary.BigEndian, &length); e != nil {
+		return e
+	}
 	username := make([]byte, length[0])
-	mylog.Check(binary.Read(r, binary.BigEndian, &username))
-	mylog.Check(binary.Read(r, binary.BigEndian, &length))
+	if e := binary.Read(r, binary.BigEndian, &username); e != nil {
+		return e
+	}
+	if e := binary.Read(r, binary.BigEndian, &length); e != nil {
+		return e
+	}
 	req.Username = string(username)
 	password := make([]byte, length[0])
-	mylog.Check(binary.Read(r, binary.BigEndian, &password))
+	if e := binary.Read(r, binary.BigEndian, &password); e != nil {
+		return e
+	}
 	req.Password = string(password)
 	return nil
 }
@@ -339,12 +398,16 @@ func (resp *UsernamePasswordAuthResponse) MarshalBinary() ([]byte, error) {
 func (resp *UsernamePasswordAuthResponse) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if UsernamePasswordAuthVersion(version[0]) != UsernamePasswordAuthVersion1 {
 		return fmt.Errorf("unsupported username password version: %d", version[0])
 	}
 	status := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &status))
+	if e := binary.Read(r, binary.BigEndian, &status); e != nil {
+		return e
+	}
 	resp.Status = AuthStatus(status[0])
 	return nil
 }
@@ -356,7 +419,15 @@ type Socks5Request struct {
 
 func (req *Socks5Request) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks5Version), byte(req.CMD), 0}
-	host, port := mylog.Check3(splitHostPort(req.Addr))
+	return appendAddr(b, req.Addr)
+}
+
+// appendAddr encodes addr as ATYP, ADDR and PORT.
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, port, e := splitHostPort(addr)
+	if e != nil {
+		return nil, e
+	}
 	if ip := net.ParseIP(host); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
 			b = append(b, byte(AddrTypeIPv4))
@@ -365,7 +436,7 @@ func (req *Socks5Request) MarshalBinary() ([]byte, error) {
 			b = append(b, byte(AddrTypeIPv6))
 			b = append(b, ip6...)
 		} else {
-			return nil, errors.New("unknown address type")
+			return nil, errUnknownAddrType
 		}
 	} else {
 		if len(host) > 255 {
@@ -384,15 +455,24 @@ func (req *Socks5Request) MarshalBinary() ([]byte, error) {
 func (req *Socks5Request) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if Version(version[0]) != Socks5Version {
 		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
 	}
 	cmd := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &cmd))
+	if e := binary.Read(r, binary.BigEndian, &cmd); e != nil {
+		return e
+	}
 	req.CMD = Command(cmd[0])
-	mylog.Check2(r.ReadByte())
-	addr := mylog.Check2(readAddr(r))
+	if _, e := r.ReadByte(); e != nil {
+		return e
+	}
+	addr, e := readAddr(r)
+	if e != nil {
+		return e
+	}
 	req.Addr = addr
 	return nil
 }
@@ -405,34 +485,35 @@ type Socks5Response struct {
 func (resp *Socks5Response) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks5Version), byte(resp.Status), 0}
 	if resp.Addr == "" {
-		return b, nil
-	}
-	host, port := mylog.Check3(splitHostPort(resp.Addr))
-	ip := net.ParseIP(host)
-	if ip4 := ip.To4(); ip4 != nil {
-		b = append(b, byte(AddrTypeIPv4))
-		b = append(b, ip4...)
-	} else if ip6 := ip.To16(); ip6 != nil {
-		b = append(b, byte(AddrTypeIPv6))
-		b = append(b, ip6...)
+		// clients read the whole reply before they look at the status, an
+		// unset address goes out as 0.0.0.0:0
+		return append(b, byte(AddrTypeIPv4), 0, 0, 0, 0, 0, 0), nil
 	}
-	b = append(b, byte(port>>8), byte(port))
-	return b, nil
+	return appendAddr(b, resp.Addr)
 }
 
 func (resp *Socks5Response) UnmarshalBinary(p []byte) error {
 	r := bytes.NewBuffer(p)
 	version := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &version))
+	if e := binary.Read(r, binary.BigEndian, &version); e != nil {
+		return e
+	}
 	if Version(version[0]) != Socks5Version {
 		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
 	}
 	status := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &status))
+	if e := binary.Read(r, binary.BigEndian, &status); e != nil {
+		return e
+	}
 	resp.Status = Socks5Status(status[0])
-	mylog.Check2(r.ReadByte()) // ignore null byte
-	if len(p) > 3 {
-		addr := mylog.Check2(readAddr(r))
+	if _, e := r.ReadByte(); e != nil { // ignore null byte
+		return e
+	}
+	if len(p) > 3 && !bytes.Equal(p[3:], []byte{byte(AddrTypeIPv4), 0, 0, 0, 0, 0, 0}) {
+		addr, e := readAddr(r)
+		if e != nil {
+			return e
+		}
 		resp.Addr = addr
 	}
 	return nil
@@ -440,36 +521,55 @@ func (resp *Socks5Response) UnmarshalBinary(p []byte) error {
 
 func readAddr(r io.Reader) (string, error) {
 	atype := make([]byte, 1)
-	mylog.Check(binary.Read(r, binary.BigEndian, &atype))
+	if e := binary.Read(r, binary.BigEndian, &atype); e != nil {
+		return "", e
+	}
 	var host string
 	switch AddrType(atype[0]) {
 	case AddrTypeIPv4:
 		ip := make(net.IP, net.IPv4len)
-		mylog.Check(binary.Read(r, binary.BigEndian, &ip))
+		if e := binary.Read(r, binary.BigEndian, &ip); e != nil {
+			return "", e
+		}
 		host = ip.String()
 	case AddrTypeIPv6:
 		ip := make(net.IP, net.IPv6len)
-		mylog.Check(binary.Read(r, binary.BigEndian, &ip))
+		if e := binary.Read(r, binary.BigEndian, &ip); e != nil {
+			return "", e
+		}
 		host = ip.String()
 	case AddrTypeFQDN:
 		length := make([]byte, 1)
-		mylog.Check(binary.Read(r, binary.BigEndian, &length))
+		if e := binary.Read(r, binary.BigEndian, &length); e != nil {
+			return "", e
+		}
+		if length[0] == 0 {
+			return "", fmt.Errorf("%w: empty domain", errUnknownAddrType)
+		}
 		fqdn := make([]byte, length[0])
-		mylog.Check(binary.Read(r, binary.BigEndian, &fqdn))
+		if e := binary.Read(r, binary.BigEndian, &fqdn); e != nil {
+			return "", e
+		}
 		host = string(fqdn)
 	default:
-		return "", fmt.Errorf("unknown address type %x", atype[0])
+		return "", fmt.Errorf("%w %x", errUnknownAddrType, atype[0])
 	}
 	port := make([]byte, 2)
-	mylog.Check(binary.Read(r, binary.BigEndian, &port))
+	if e := binary.Read(r, binary.BigEndian, &port); e != nil {
+		return "", e
+	}
 	portNum := (int(port[0]) << 8) | int(port[1])
 	return net.JoinHostPort(host, strconv.Itoa(portNum)), nil
 }
 
 func splitHostPort(address string) (string, uint16, error) {
-	host, port := mylog.Check3(net.SplitHostPort(address))
-	portnum := mylog.Check2(strconv.ParseUint(port, 10, 16))
-	if 1 > portnum || portnum > 0xffff {
+	host, port, e := net.SplitHostPort(address)
+	if e != nil {
+		return "", 0, e
+	}
+	// port 0 is how a UDP ASSOCIATE says the client port is not known yet
+	portnum, e := strconv.ParseUint(port, 10, 16)
+	if e != nil {
 		return "", 0, errors.New("port number out of range " + port)
 	}
 	return host, uint16(portnum), nil
@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/ddkwork/golibrary/std/assert"
 	"github.com/ddkwork/golibrary/std/mylog"
@@ -121,7 +122,8 @@ func TestSocks5WithStdDialer(t *testing.T) {
 				return url.Parse(fmt.Sprintf("socks5://%s:%s@%s", "user", "wrong", listen.Addr()))
 			},
 		}
-		mylog.Check2(cli.Get(testServer.URL)) //nolint: bodyclose //error expected
+		_, e := cli.Get(testServer.URL) //nolint: bodyclose //error expected
+		assert.NotNil(t, e)
 	})
 }
 
@@ -194,6 +196,81 @@ func TestSocks5Connect(t *testing.T) {
 				return d.DialContext(ctx, network, addr)
 			},
 		}
-		mylog.Check2(cli.Get(testServer.URL)) //nolint: bodyclose //error expected
+		_, e := cli.Get(testServer.URL) //nolint: bodyclose //error expected
+		assert.NotNil(t, e)
 	})
 }
+
+func TestSocks5ConnectRefused(t *testing.T) {
+	closed := mylog.Check2(net.Listen("tcp", "localhost:0"))
+	target := closed.Addr().String()
+	mylog.Check(closed.Close())
+
+	listen := mylog.Check2(net.Listen("tcp", "localhost:0"))
+	defer listen.Close()
+	server := New()
+	go func() {
+		mylog.Check(server.Serve(listen))
+	}()
+	_, e := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", target)
+	assert.NotNil(t, e)
+	assert.Equal(t, "socks error: "+Socks5StatusConnectionRefused.String(), e.Error())
+}
+
+func TestSocks5Associate(t *testing.T) {
+	echo := mylog.Check2(net.ListenPacket("udp", "127.0.0.1:0"))
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, e := echo.ReadFrom(buf)
+			if e != nil {
+				return
+			}
+			mylog.Check2(echo.WriteTo(buf[:n], addr))
+		}
+	}()
+
+	listen := mylog.Check2(net.Listen("tcp", "127.0.0.1:0"))
+	defer listen.Close()
+	server := New()
+	go func() {
+		mylog.Check(server.Serve(listen))
+	}()
+
+	control := mylog.Check2(net.Dial("tcp", listen.Addr().String()))
+	conn := NewConn(control)
+	mylog.Check(conn.Write(&MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired}}))
+	mylog.Check(conn.Read(&MethodSelectResponse{}))
+	mylog.Check(conn.Write(&Socks5Request{CMD: AssociateCommand, Addr: "0.0.0.0:0"}))
+	resp := &Socks5Response{}
+	mylog.Check(conn.Read(resp))
+	assert.Equal(t, Socks5StatusGranted, resp.Status)
+
+	relay := mylog.Check2(net.ResolveUDPAddr("udp", resp.Addr))
+	client := mylog.Check2(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer client.Close()
+	send := func(d *UDPDatagram) {
+		b := mylog.Check2(d.MarshalBinary())
+		mylog.Check2(client.WriteTo(b, relay))
+	}
+	// fragments are dropped, the relay does not reassemble them
+	send(&UDPDatagram{Frag: 1, Addr: echo.LocalAddr().String(), Data: []byte("fragment")})
+	send(&UDPDatagram{Addr: echo.LocalAddr().String(), Data: []byte("ping")})
+
+	buf := make([]byte, 1500)
+	mylog.Check(client.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	n := mylog.Check2(client.Read(buf))
+	reply := &UDPDatagram{}
+	mylog.Check(reply.UnmarshalBinary(buf[:n]))
+	assert.Equal(t, echo.LocalAddr().String(), reply.Addr)
+	assert.Equal(t, "ping", string(reply.Data))
+
+	// closing the control connection ends the association
+	mylog.Check(control.Close())
+	time.Sleep(100 * time.Millisecond)
+	send(&UDPDatagram{Addr: echo.LocalAddr().String(), Data: []byte("late")})
+	mylog.Check(client.SetReadDeadline(time.Now().Add(200 * time.Millisecond)))
+	_, e := client.Read(buf)
+	assert.NotNil(t, e)
+}
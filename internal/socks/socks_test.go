@@ -53,6 +53,15 @@ func TestSocks4Request(t *testing.T) {
 		mylog.Check(req2.UnmarshalBinary(b))
 		assert.Equal(t, req, req2)
 	})
+	t.Run("v4a without domain", func(t *testing.T) {
+		b := []byte{byte(Socks4Version), byte(ConnectCommand), 0x1f, 0x90, 0, 0, 0, 1, 0, 0}
+		assert.NotNil(t, (&Socks4Request{}).UnmarshalBinary(b))
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		_, e := (&Socks4Request{CMD: ConnectCommand, Addr: "[::1]:8080"}).MarshalBinary()
+		assert.NotNil(t, e)
+	})
 }
 
 func TestSocks4Response(t *testing.T) {
@@ -68,6 +77,11 @@ func TestSocks4Response(t *testing.T) {
 		assert.Equal(t, resp, resp2)
 	})
 
+	t.Run("reply length", func(t *testing.T) {
+		b := mylog.Check2((&Socks4Response{Status: Socks4StatusRejected}).MarshalBinary())
+		assert.Equal(t, 8, len(b))
+	})
+
 	t.Run("bind", func(t *testing.T) {
 		resp := &Socks4Response{
 			Status: Socks4StatusGranted,
@@ -174,6 +188,10 @@ func TestSocks5Request(t *testing.T) {
 		mylog.Check(req2.UnmarshalBinary(b))
 		assert.Equal(t, req, req2)
 	})
+	t.Run("empty FQDN", func(t *testing.T) {
+		b := []byte{byte(Socks5Version), byte(ConnectCommand), 0, byte(AddrTypeFQDN), 0, 0x1f, 0x90}
+		assert.NotNil(t, (&Socks5Request{}).UnmarshalBinary(b))
+	})
 }
 
 func TestSocks5Response(t *testing.T) {
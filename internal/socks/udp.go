@@ -0,0 +1,283 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/packet"
+)
+
+// Resolver looks up the addresses of the names in requests and datagrams,
+// *net.Resolver is one.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// PacketListener opens the sockets of UDP associations.
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+var errFragmented = errors.New("fragmented datagrams are not supported")
+
+// UDPDatagram is a datagram with the header RFC 1928 puts in front of
+// everything relayed for a UDP association.
+type UDPDatagram struct {
+	Frag byte
+	Addr string
+	Data []byte
+}
+
+func (d *UDPDatagram) MarshalBinary() ([]byte, error) {
+	b, e := appendAddr([]byte{0, 0, d.Frag}, d.Addr)
+	if e != nil {
+		return nil, e
+	}
+	return append(b, d.Data...), nil
+}
+
+func (d *UDPDatagram) UnmarshalBinary(p []byte) error {
+	if len(p) < 4 {
+		return errors.New("short socks datagram")
+	}
+	d.Frag = p[2]
+	r := bytes.NewReader(p[3:])
+	addr, e := readAddr(r)
+	if e != nil {
+		return e
+	}
+	d.Addr = addr
+	d.Data = p[len(p)-r.Len():]
+	return nil
+}
+
+// association is the state of one UDP ASSOCIATE, the client is the first
+// address that sent a datagram from where the request said it would.
+type association struct {
+	mu       sync.Mutex
+	expected netip.AddrPort
+	client   netip.AddrPort
+	peers    map[netip.AddrPort]struct{}
+}
+
+func newAssociation(requested string, control net.Addr) *association {
+	a := &association{peers: make(map[netip.AddrPort]struct{})}
+	if ap, e := netip.ParseAddrPort(requested); e == nil && !ap.Addr().IsUnspecified() {
+		a.expected = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	} else if control != nil {
+		// a client that does not know its address yet sends from the host
+		// of the control connection
+		if c, e := netip.ParseAddrPort(control.String()); e == nil {
+			a.expected = netip.AddrPortFrom(c.Addr().Unmap(), ap.Port())
+		}
+	}
+	return a
+}
+
+// fromClient binds the association on the first datagram and drops the
+// datagrams of everybody else.
+func (a *association) fromClient(src netip.AddrPort) bool {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client.IsValid() {
+		return a.client == src
+	}
+	if a.expected.Addr().IsValid() && a.expected.Addr() != src.Addr() ||
+		a.expected.Port() != 0 && a.expected.Port() != src.Port() {
+		return false
+	}
+	a.client = src
+	return true
+}
+
+// sent remembers a destination, only they may answer the client.
+func (a *association) sent(peer netip.AddrPort) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.peers[netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())] = struct{}{}
+}
+
+func (a *association) replyTo(peer netip.AddrPort) (netip.AddrPort, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.peers[netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())]
+	return a.client, ok
+}
+
+func (h *Socks5Handler) handleAssociate(req *Socks5Request) error {
+	if h.PacketListener == nil {
+		return h.reject(req, Socks5StatusCMDNotSupported, errors.New("associate is not enabled"))
+	}
+	var remote net.Addr
+	if c, ok := h.Conn.Writer.(net.Conn); ok {
+		remote = c.RemoteAddr()
+	}
+	// the relay listens where the client reached the control connection, an
+	// unspecified BND.ADDR would leave it guessing
+	ctx := context.Background()
+	relay, e := h.PacketListener.ListenPacket(ctx, "udp", net.JoinHostPort(h.Conn.bindHost(), "0"))
+	if e != nil {
+		return h.reject(req, Socks5StatusFailure, e)
+	}
+	defer func() { mylog.CheckIgnore(relay.Close()) }()
+	upstream, e := h.PacketListener.ListenPacket(ctx, "udp", ":0")
+	if e != nil {
+		return h.reject(req, Socks5StatusFailure, e)
+	}
+	defer func() { mylog.CheckIgnore(upstream.Close()) }()
+
+	if e := h.Conn.Write(&Socks5Response{
+		Status: Socks5StatusGranted,
+		Addr:   relay.LocalAddr().String(),
+	}); e != nil {
+		return e
+	}
+
+	// A UDP association terminates when the TCP connection that the UDP
+	// ASSOCIATE request arrived on terminates.
+	go func() {
+		h.Conn.WaitForClose()
+		mylog.CheckIgnore(relay.Close())
+		mylog.CheckIgnore(upstream.Close())
+	}()
+
+	a := newAssociation(req.Addr, remote)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.relayReplies(a, relay, upstream)
+	}()
+	h.relayRequests(a, relay, upstream)
+	mylog.CheckIgnore(upstream.Close())
+	<-done
+	return nil
+}
+
+// relayRequests unwraps the datagrams of the client and sends them on.
+func (h *Socks5Handler) relayRequests(a *association, relay, upstream net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, e := relay.ReadFrom(buf)
+		if e != nil {
+			return
+		}
+		from, ok := src.(*net.UDPAddr)
+		if !ok || !a.fromClient(from.AddrPort()) {
+			continue
+		}
+		d := &UDPDatagram{}
+		if e := d.UnmarshalBinary(buf[:n]); e != nil {
+			mylog.Warning("socks udp", src.String()+" "+e.Error())
+			continue
+		}
+		if d.Frag != 0 { // RFC 1928 lets relays without reassembly drop them
+			h.datagram(packet.Outbound, d.Addr, netip.Addr{}, d.Data, errFragmented)
+			continue
+		}
+		dst, e := h.resolveDatagram(d.Addr)
+		if e != nil {
+			h.datagram(packet.Outbound, d.Addr, netip.Addr{}, d.Data, e)
+			continue
+		}
+		a.sent(dst.AddrPort())
+		h.datagram(packet.Outbound, d.Addr, dst.AddrPort().Addr(), d.Data, nil)
+		if _, e := upstream.WriteTo(d.Data, dst); e != nil {
+			mylog.Warning("socks udp", dst.String()+" "+e.Error())
+		}
+	}
+}
+
+// relayReplies wraps what the destinations answer and sends it to the client.
+func (h *Socks5Handler) relayReplies(a *association, relay, upstream net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, e := upstream.ReadFrom(buf)
+		if e != nil {
+			return
+		}
+		from, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		client, ok := a.replyTo(from.AddrPort())
+		if !ok {
+			continue
+		}
+		peer := netip.AddrPortFrom(from.AddrPort().Addr().Unmap(), from.AddrPort().Port())
+		h.datagram(packet.Inbound, peer.String(), peer.Addr(), buf[:n], nil)
+		b, e := (&UDPDatagram{Addr: peer.String(), Data: buf[:n]}).MarshalBinary()
+		if e != nil {
+			continue
+		}
+		if _, e := relay.WriteTo(b, net.UDPAddrFromAddrPort(client)); e != nil {
+			mylog.Warning("socks udp", client.String()+" "+e.Error())
+		}
+	}
+}
+
+// resolveDatagram checks a destination against Allow before resolving it.
+func (h *Socks5Handler) resolveDatagram(addr string) (*net.UDPAddr, error) {
+	if h.Allow != nil {
+		if e := h.Allow(AssociateCommand, addr); e != nil {
+			return nil, e
+		}
+	}
+	host, port, e := splitHostPort(addr)
+	if e != nil {
+		return nil, e
+	}
+	ip, e := netip.ParseAddr(host)
+	if e != nil {
+		var r Resolver = net.DefaultResolver
+		if h.Resolver != nil {
+			r = h.Resolver
+		}
+		ips, e := r.LookupNetIP(context.Background(), "ip", host)
+		if e != nil {
+			return nil, e
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		ip = ips[0]
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
+
+// datagram emits a relayed or dropped datagram as a session of its own.
+func (h *Socks5Handler) datagram(direction packet.StreamDirection, addr string, ip netip.Addr, data []byte, err error) {
+	if err != nil {
+		mylog.Warning("socks udp", addr+" "+err.Error())
+	}
+	if h.Session == nil {
+		return
+	}
+	s := h.Session.NewChild(httpClient.UdpType)
+	s.StreamDirection = direction
+	s.Method = AssociateCommand.String()
+	s.Host = addr
+	s.ResolvedIP = ip
+	s.ContentLength = len(data)
+	s.Err = err
+	if err != nil {
+		s.Status = err.Error()
+	}
+	switch direction {
+	case packet.Outbound:
+		s.ReqBodyDecoder.Payload = bytes.Clone(data)
+	case packet.Inbound:
+		s.RespBodyDecoder.Payload = bytes.Clone(data)
+	}
+	if s.EventCallBack == nil {
+		h.Conn.SessionEvent(s)
+	} else {
+		s.EventCallBack(s)
+	}
+}
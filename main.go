@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"embed"
 	"iter"
@@ -387,7 +388,7 @@ func NewTable() ux.Widget {
 					default:
 						mylog.CheckIgnore(session.SchemerType.String())
 					}
-				}).ListenAndServe()
+				}).ListenAndServe(context.Background())
 			}()
 		},
 		JsonName:   "mitmproxy",
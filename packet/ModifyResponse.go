@@ -3,12 +3,14 @@ package packet
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"time"
-
-	"github.com/ddkwork/golibrary/std/mylog"
 )
 
 func NewResponse(code int, body io.Reader, req *http.Request) *http.Response {
@@ -51,29 +53,42 @@ func OkResponse() *http.Response {
 	return res
 }
 
-func ProxyUnauthorizedResponse() *http.Response {
-	header := make(http.Header)
-	header.Set("Proxy-Authenticate", `Basic realm="Restricted"`)
-	res := &http.Response{
-		Status:     "Proxy Authentication Required",
-		StatusCode: 407,
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     header,
-	}
+// ProxyUnauthorizedResponse asks the client of req for Basic proxy
+// credentials of the given realm.
+func ProxyUnauthorizedResponse(req *http.Request, realm string) *http.Response {
+	res := NewResponse(http.StatusProxyAuthRequired, http.NoBody, req)
+	res.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	res.ContentLength = 0
+	res.Close = true
 	return res
 }
 
-func WriteResponse(Response *http.Response, ReadWriter *bufio.ReadWriter) {
-	mylog.Call(func() {
-		mylog.Check(Response.Write(ReadWriter))
-		mylog.Check(ReadWriter.Flush())
-	})
+func WriteResponse(Response *http.Response, ReadWriter *bufio.ReadWriter) error {
+	if e := Response.Write(ReadWriter); e != nil {
+		return e
+	}
+	return ReadWriter.Flush()
 }
 
+// ErrDenied is returned for connections the proxy's access control refused.
+var ErrDenied = errors.New("denied by access control")
+
+// NewErrorResponse answers a request the proxy could not forward, access
+// control refusals become 403 Forbidden, timeouts 504 Gateway Timeout and
+// everything else 502 Bad Gateway.
 func NewErrorResponse(req *http.Request, err error) *http.Response {
-	res := NewResponse(http.StatusBadGateway, nil, req)
+	code := http.StatusBadGateway
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrDenied):
+		code = http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		code = http.StatusGatewayTimeout
+	}
+	body := err.Error()
+	res := NewResponse(code, strings.NewReader(body), req)
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res.ContentLength = int64(len(body))
 	res.Close = true
 	date := res.Header.Get("Date")
 	if date == "" {
@@ -63,7 +63,7 @@ func makeUnitTest(Request *http.Request, body []byte) string {
 	s.WriteString("if !c.Url(")
 	s.WriteString(strconv.Quote(Request.URL.String()))
 	s.WriteString(").ProxyHttp(")
-	s.WriteString(strconv.Quote(ca.ProxyPort))
+	s.WriteString(strconv.Quote(ca.DefaultProxyPort))
 	s.WriteStringLn(").Row(Row)." + stream.ToCamelUpper(Request.Method) + "().SetHead(head).Request() {")
 	s.WriteStringLn("return")
 	s.WriteStringLn("}")
@@ -131,7 +131,11 @@ func ReadDecompressedBody(header http.Header, body io.Reader) []byte {
 		return nil
 	}
 	if header.Get("Content-Encoding") == "gzip" {
-		gzReader := mylog.Check2(gzip.NewReader(body))
+		raw := mylog.Check2(io.ReadAll(body))
+		if len(raw) == 0 { // like an event stream emitted before its body
+			return raw
+		}
+		gzReader := mylog.Check2(gzip.NewReader(bytes.NewReader(raw)))
 		defer func() { mylog.Check(gzReader.Close()) }()
 		return mylog.Check2(io.ReadAll(gzReader))
 	}
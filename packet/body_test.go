@@ -41,5 +41,5 @@ func UnitTest() {
 	// www.baidu.com
 	head := map[string]string{"Connection": "upgRade", "Upgrade": "WebSocket"}
 	c := httpClient.New()
-	c.Post("https://www.baidu.com").SetProxy(httpClient.HttpsType, net.JoinHostPort(httpClient.Localhost, ca.ProxyPort)).Body(httpClient.LogeventBuf).SetHead(head).Request()
+	c.Post("https://www.baidu.com").SetProxy(httpClient.HttpsType, net.JoinHostPort(httpClient.Localhost, ca.DefaultProxyPort)).Body(httpClient.LogeventBuf).SetHead(head).Request()
 }
@@ -0,0 +1,169 @@
+package packet
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ddkwork/golibrary/std/mylog"
+)
+
+type (
+	// Capture keeps a copy of a body that streams through TeeBody. The
+	// first Limit bytes stay in memory, a larger body is written whole to a
+	// temp file in SpillDir when it is set and only counted otherwise. The
+	// zero Capture keeps everything in memory.
+	Capture struct {
+		// Limit is how many bytes are kept in memory, zero or less keeps
+		// everything.
+		Limit int64
+		// SpillDir is where larger bodies go, the files stay until Remove.
+		SpillDir string
+
+		mu    sync.Mutex
+		buf   bytes.Buffer
+		size  int64
+		file  *os.File
+		spill string
+	}
+
+	teeBody struct {
+		io.ReadCloser
+		capture *Capture
+	}
+)
+
+// TeeBody returns body copying everything read from it into c.
+func TeeBody(body io.ReadCloser, c *Capture) io.ReadCloser {
+	return &teeBody{ReadCloser: body, capture: c}
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, e := t.ReadCloser.Read(p)
+	mylog.Check2(t.capture.Write(p[:n]))
+	if e == io.EOF {
+		t.capture.finish()
+	}
+	return n, e
+}
+
+func (t *teeBody) Close() error {
+	e := t.ReadCloser.Close()
+	t.capture.finish()
+	return e
+}
+
+// Write keeps what fits and spills or counts the rest, it never fails so
+// the body it copies is never cut short by the capture.
+func (c *Capture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += int64(len(p))
+	keep := p
+	if c.Limit > 0 {
+		keep = keep[:min(int64(len(keep)), max(c.Limit-int64(c.buf.Len()), 0))]
+	}
+	c.buf.Write(keep)
+	if c.SpillDir == "" || (c.file == nil && len(keep) == len(p)) {
+		return len(p), nil
+	}
+	if c.file == nil {
+		if c.spill != "" { // the file failed already or the body ended
+			return len(p), nil
+		}
+		file, e := os.CreateTemp(c.SpillDir, "body-*")
+		if e != nil {
+			mylog.Warning("capture", e.Error())
+			c.spill = "-"
+			return len(p), nil
+		}
+		c.file, c.spill = file, file.Name()
+		// what was kept before this write goes first
+		if _, e := c.file.Write(c.buf.Bytes()[:c.buf.Len()-len(keep)]); e != nil {
+			c.failSpill(e)
+			return len(p), nil
+		}
+	}
+	if _, e := c.file.Write(p); e != nil {
+		c.failSpill(e)
+	}
+	return len(p), nil
+}
+
+func (c *Capture) failSpill(e error) {
+	mylog.Warning("capture", e.Error())
+	mylog.CheckIgnore(c.file.Close())
+	mylog.CheckIgnore(os.Remove(c.spill))
+	c.file, c.spill = nil, "-"
+}
+
+// finish closes the spill file, the body has been read.
+func (c *Capture) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		mylog.CheckIgnore(c.file.Close())
+		c.file = nil
+	}
+}
+
+// Remove deletes the spill file, SpillFile is empty afterwards and the rest
+// of the body is no longer spilled.
+func (c *Capture) Remove() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		mylog.CheckIgnore(c.file.Close())
+		c.file = nil
+	}
+	spill := c.spill
+	c.spill = "-"
+	if spill == "" || spill == "-" {
+		return nil
+	}
+	return os.Remove(spill)
+}
+
+// Bytes returns what was kept in memory.
+func (c *Capture) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.buf.Bytes())
+}
+
+// Size is how many bytes went through, kept or not.
+func (c *Capture) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Truncated reports whether Bytes misses the end of the body.
+func (c *Capture) Truncated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size > int64(c.buf.Len())
+}
+
+// SpillFile is the temp file holding the whole body, empty when the body
+// fit or was truncated.
+func (c *Capture) SpillFile() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spill == "-" {
+		return ""
+	}
+	return c.spill
+}
+
+// fill records how much of its body the decoder got.
+func (c *Capture) fill(d *BodyDecoder) {
+	spill := c.SpillFile()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d.Size = c.size
+	d.CapturedSize = int64(c.buf.Len())
+	d.Truncated = c.size > int64(c.buf.Len())
+	d.SpillFile = spill
+}
@@ -0,0 +1,52 @@
+package packet
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+)
+
+func TestCapture(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		capture   *Capture
+		kept      string
+		truncated bool
+		spilled   bool
+	}{
+		{"fits", &Capture{Limit: 64}, "0123456789abcdefghij", false, false},
+		{"truncated", &Capture{Limit: 8}, "01234567", true, false},
+		{"spilled", &Capture{Limit: 8, SpillDir: t.TempDir()}, "01234567", true, true},
+		{"unlimited", &Capture{}, "0123456789abcdefghij", false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := TeeBody(io.NopCloser(strings.NewReader("0123456789abcdefghij")), tt.capture)
+			// small reads cross the limit in the middle of one
+			got := mylog.Check2(io.ReadAll(io.LimitReader(body, 5)))
+			got = append(got, mylog.Check2(io.ReadAll(body))...)
+			mylog.Check(body.Close())
+			assert.Equal(t, "0123456789abcdefghij", string(got))
+
+			var d BodyDecoder
+			tt.capture.fill(&d)
+			assert.Equal(t, tt.kept, string(tt.capture.Bytes()))
+			assert.Equal(t, int64(20), d.Size)
+			assert.Equal(t, int64(len(tt.kept)), d.CapturedSize)
+			assert.Equal(t, tt.truncated, d.Truncated)
+			assert.Equal(t, tt.spilled, d.SpillFile != "")
+			if tt.spilled {
+				assert.Equal(t, "0123456789abcdefghij", string(mylog.Check2(os.ReadFile(d.SpillFile))))
+			}
+			mylog.Check(tt.capture.Remove())
+			assert.Equal(t, "", tt.capture.SpillFile())
+			if tt.spilled {
+				_, e := os.Stat(d.SpillFile)
+				assert.True(t, os.IsNotExist(e))
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package packet
 
 import (
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/ddkwork/websocket"
@@ -43,6 +44,26 @@ type (
 		Acc            string // 收发都有
 		Websocket      string // 收发都有
 		Msgpack        string // 收发都有
+		// Size is the size of the whole body, CapturedSize how much of it
+		// is in Payload. A Truncated body is shown as far as it was
+		// captured, SpillFile holds all of it when it was spilled.
+		Size         int64
+		CapturedSize int64
+		Truncated    bool
+		SpillFile    string
+		// Chunks are the chunks a chunked body came in and Trailer the
+		// trailer that followed them.
+		Chunks  []BodyChunk
+		Trailer http.Header
+	}
+
+	// BodyChunk is one chunk of a chunked body, Time is when its size line
+	// arrived.
+	BodyChunk struct {
+		Offset    int64
+		Size      int64
+		Extension string
+		Time      time.Time
 	}
 )
 
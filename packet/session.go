@@ -5,12 +5,15 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/hex"
+	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"time"
 
 	"github.com/ddkwork/golibrary/std/mylog"
 	"github.com/ddkwork/golibrary/std/stream/net/httpClient"
+	"github.com/ddkwork/mitmproxy/internal/proxyproto"
 )
 
 type (
@@ -22,10 +25,51 @@ type (
 		Packet
 		EventCallBack SessionEventCallBack
 		ClientConn    net.Conn
-		ReadWriter    *bufio.ReadWriter
-		Request       *http.Request
-		Response      *http.Response
-		StartTime     time.Time
+		// ClientAddr is the address of the client, behind a load balancer
+		// that sends PROXY headers it is the source of the header.
+		ClientAddr net.Addr
+		// ProxyDestination is the address the client connected to at the
+		// load balancer and ProxyTLVs are the values the balancer added to
+		// its v2 header by type. Both are empty without a PROXY header.
+		ProxyDestination net.Addr
+		ProxyTLVs        map[byte][]byte
+		// ResolvedIP is the address the upstream host was connected at,
+		// Host keeps the name the client asked for.
+		ResolvedIP netip.Addr
+		// User is the name the client authenticated to the proxy with.
+		User       string
+		ReadWriter *bufio.ReadWriter
+		Request    *http.Request
+		Response   *http.Response
+		StartTime  time.Time
+		// Err is set when the flow failed, the session is still emitted so
+		// failures show up next to the successful flows.
+		Err error
+		// Parent is the session that carried this one, like the socks
+		// association of a datagram.
+		Parent *Session
+		// Stream is what went through the tunnel of the session.
+		Stream *Stream
+		// ConnID identifies the websocket relay of the session, it is zero
+		// for other flows.
+		ConnID uint64
+		// Seq numbers the messages of a websocket relay or the events of an
+		// event stream from 1 in the order they were relayed, Time is when
+		// the message was read.
+		Seq  uint64
+		Time time.Time
+		// WebSocketClose is set on the last event of a websocket relay.
+		WebSocketClose *WebSocketClose
+		// Timings are the phases of an http exchange.
+		Timings Timings
+	}
+
+	// WebSocketClose is how a websocket relay ended. Initiator is the side
+	// that closed first, Outbound is the client and Inbound the server.
+	WebSocketClose struct {
+		Code      int
+		Reason    string
+		Initiator StreamDirection
 	}
 )
 
@@ -55,10 +99,9 @@ func NewSessionWithReadWriter(clientConn net.Conn, readWriter *bufio.ReadWriter,
 		Request:       nil,
 		Response:      nil,
 		StartTime:     time.Now(),
+		Stream:        &Stream{},
 	}
-	if clientConn.LocalAddr() != nil && clientConn.RemoteAddr() != nil {
-		s.Process = FindProcessPath(clientConn.RemoteAddr().Network(), clientConn.LocalAddr().String(), clientConn.RemoteAddr().String())
-	}
+	s.setClient(clientConn)
 	return s
 }
 
@@ -88,21 +131,78 @@ func NewSession(clientConn net.Conn, layer httpClient.SchemerType, event Session
 		Request:       nil,
 		Response:      nil,
 		StartTime:     time.Now(),
+		Stream:        &Stream{},
+	}
+	s.setClient(clientConn)
+	return s
+}
+
+func (s *Session) setClient(clientConn net.Conn) {
+	s.ClientAddr = clientConn.RemoteAddr()
+	if c, ok := clientConn.(*proxyproto.Conn); ok {
+		s.ProxyDestination = c.Header.Destination
+		for _, tlv := range c.Header.TLVs {
+			if _, ok := s.ProxyTLVs[byte(tlv.Type)]; ok {
+				continue // the first of a type wins
+			}
+			if s.ProxyTLVs == nil {
+				s.ProxyTLVs = make(map[byte][]byte)
+			}
+			s.ProxyTLVs[byte(tlv.Type)] = tlv.Value
+		}
+		return // the process runs on another host
 	}
 	if clientConn.LocalAddr() != nil && clientConn.RemoteAddr() != nil {
 		s.Process = FindProcessPath(clientConn.RemoteAddr().Network(), clientConn.LocalAddr().String(), clientConn.RemoteAddr().String())
 	}
-	return s
+}
+
+// NewChild starts a session of the given layer for a flow carried inside s,
+// it is emitted to the same callback and shares the client of s.
+func (s *Session) NewChild(layer httpClient.SchemerType) *Session {
+	child := &Session{
+		Packet: Packet{
+			EditData: EditData{
+				SchemerType: layer,
+				Process:     s.Process,
+			},
+		},
+		EventCallBack:    s.EventCallBack,
+		ClientConn:       s.ClientConn,
+		ClientAddr:       s.ClientAddr,
+		ProxyDestination: s.ProxyDestination,
+		ProxyTLVs:        s.ProxyTLVs,
+		User:             s.User,
+		ReadWriter:       s.ReadWriter,
+		StartTime:        time.Now(),
+		Parent:           s,
+		Stream:           &Stream{Limit: s.Stream.Limit, NewDissector: s.Stream.NewDissector},
+		ConnID:           s.ConnID,
+	}
+	// the aes key of a steam tunnel decrypts the messages of its children
+	child.ReqBodyDecoder.SteamAesKey = s.ReqBodyDecoder.SteamAesKey
+	return child
 }
 
 func (s *Session) RemoteAddr() string { return s.Request.URL.Host }
+func (s *Session) Failed() bool       { return s.Err != nil }
 func (s *Session) IsTls() bool {
 	_, ok := s.ClientConn.(*tls.Conn)
 	return ok
 }
 
-func MakeHttpRequestPacket(request *http.Request, Process string, layer httpClient.SchemerType) (P Packet) {
-	bodyBuffer := new(bytes.Buffer)
+func MakeHttpRequestPacket(request *http.Request, Process string, layer httpClient.SchemerType) Packet {
+	body, backBody := DrainBody(request.Body)
+	request.Body = backBody
+	c := &Capture{}
+	mylog.Check2(io.Copy(c, body))
+	return MakeCapturedRequestPacket(request, Process, layer, c)
+}
+
+// MakeCapturedRequestPacket is MakeHttpRequestPacket for a request whose
+// body went upstream through TeeBody, a truncated body is not decompressed.
+func MakeCapturedRequestPacket(request *http.Request, Process string, layer httpClient.SchemerType, c *Capture) (P Packet) {
+	bodyBuffer := bytes.NewBuffer(c.Bytes())
 	defer func() {
 		// mylog.hexDump("RequestBuffer", bodyBuffer.Payload())
 		P = Packet{
@@ -136,6 +236,7 @@ func MakeHttpRequestPacket(request *http.Request, Process string, layer httpClie
 			WebsocketMessageType: 0,
 			WebsocketStatus:      "",
 		}
+		c.fill(&P.ReqBodyDecoder)
 		Text := decodeText(request, bodyBuffer.Bytes())
 		Json := decodeJson(request, bodyBuffer.Bytes())
 		Html := decodeHtml(request, bodyBuffer.Bytes())
@@ -152,19 +253,30 @@ func MakeHttpRequestPacket(request *http.Request, Process string, layer httpClie
 			P.ReqBodyDecoder.HttpDump += Javascript
 		}
 	}()
-	body, backBody := DrainBody(request.Body)
-	request.Body = backBody
-	mylog.Check2(bodyBuffer.ReadFrom(body))
+	if c.Truncated() {
+		return
+	}
 	mylog.Call(func() {
-		body := ReadDecompressedBody(request.Header, bodyBuffer) // gzip
+		body := ReadDecompressedBody(request.Header, bytes.NewReader(bodyBuffer.Bytes())) // gzip
 		bodyBuffer.Reset()
 		bodyBuffer.Write(body)
 	})
 	return
 }
 
-func MakeHttpResponsePacket(response *http.Response, layer httpClient.SchemerType) (P Packet) {
-	bodyBuffer := new(bytes.Buffer)
+func MakeHttpResponsePacket(response *http.Response, layer httpClient.SchemerType) Packet {
+	body, backBody := DrainBody(response.Body)
+	response.Body = backBody
+	c := &Capture{}
+	mylog.Check2(io.Copy(c, body))
+	return MakeCapturedResponsePacket(response, layer, c)
+}
+
+// MakeCapturedResponsePacket is MakeHttpResponsePacket for a response whose
+// body went to the client through TeeBody, a truncated body is not
+// decompressed.
+func MakeCapturedResponsePacket(response *http.Response, layer httpClient.SchemerType, c *Capture) (P Packet) {
+	bodyBuffer := bytes.NewBuffer(c.Bytes())
 	defer func() {
 		// mylog.hexDump("ResponseBuffer", bodyBuffer.Payload())
 		request := response.Request
@@ -202,6 +314,7 @@ func MakeHttpResponsePacket(response *http.Response, layer httpClient.SchemerTyp
 			WebsocketMessageType: 0,
 			WebsocketStatus:      "",
 		}
+		c.fill(&P.RespBodyDecoder)
 		Text := decodeText(request, bodyBuffer.Bytes())             // todo 解码返回body
 		Json := decodeJson(request, bodyBuffer.Bytes())             // todo 解码返回body
 		Html := decodeHtml(request, bodyBuffer.Bytes())             // todo 解码返回body
@@ -218,10 +331,10 @@ func MakeHttpResponsePacket(response *http.Response, layer httpClient.SchemerTyp
 			P.RespBodyDecoder.HttpDump += Javascript
 		}
 	}()
-	body, backBody := DrainBody(response.Body)
-	response.Body = backBody
-	mylog.Check2(bodyBuffer.ReadFrom(body))
-	decompressedBody := ReadDecompressedBody(response.Header, bodyBuffer) // gzip
+	if c.Truncated() {
+		return
+	}
+	decompressedBody := ReadDecompressedBody(response.Header, bytes.NewReader(bodyBuffer.Bytes())) // gzip
 	bodyBuffer.Reset()
 	bodyBuffer.Write(decompressedBody)
 	return
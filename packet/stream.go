@@ -0,0 +1,171 @@
+package packet
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+type (
+	// Dissector parses what a tunnel carries into messages, Dissect is
+	// called with every chunk in the order they were read and emits the
+	// messages it completes as children of s.
+	Dissector interface {
+		Dissect(s *Session, c Chunk, emit SessionEventCallBack)
+	}
+
+	// Chunk is one read of a tunnel, Offset is where it starts in the bytes
+	// of its direction. Payload is a copy, it stays valid after the read
+	// buffer is reused.
+	Chunk struct {
+		StreamDirection
+		Offset  int64
+		Time    time.Time
+		Payload []byte
+	}
+
+	// Segment is a run of chunks read in the same direction without the
+	// other direction in between, like one request or one reply of a line
+	// protocol.
+	Segment struct {
+		StreamDirection
+		Offset  int64
+		Start   time.Time
+		End     time.Time
+		Payload []byte
+	}
+
+	// Stream keeps both directions of a tunnel in the order they were read.
+	// In a tunnel Outbound is what the client sent and Inbound what the
+	// server sent. The zero Stream keeps everything.
+	Stream struct {
+		// Limit is how many bytes of each direction are kept, what comes
+		// after it is still counted but not kept. Zero or less keeps
+		// everything.
+		Limit int64
+		// NewDissector makes the dissector of the stream when its first
+		// chunk is recorded, nil dissects nothing.
+		NewDissector func() Dissector
+
+		mu        sync.Mutex
+		emit      sync.Mutex
+		dissector Dissector
+		chunks    []Chunk
+		sizes     map[StreamDirection]int64
+		kept      map[StreamDirection]int64
+	}
+)
+
+// Append copies p as the next chunk of direction, the returned chunk
+// carries the whole of p even past Limit.
+func (s *Stream) Append(direction StreamDirection, p []byte) Chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sizes == nil {
+		s.sizes = make(map[StreamDirection]int64)
+		s.kept = make(map[StreamDirection]int64)
+	}
+	c := Chunk{
+		StreamDirection: direction,
+		Offset:          s.sizes[direction],
+		Time:            time.Now(),
+		Payload:         bytes.Clone(p),
+	}
+	s.sizes[direction] += int64(len(p))
+	keep := c.Payload
+	if s.Limit > 0 {
+		keep = keep[:min(int64(len(keep)), max(s.Limit-s.kept[direction], 0))]
+	}
+	if len(keep) > 0 {
+		s.kept[direction] += int64(len(keep))
+		kept := c
+		kept.Payload = keep
+		s.chunks = append(s.chunks, kept)
+	}
+	return c
+}
+
+// Size is how many bytes went through in direction, kept or not.
+func (s *Stream) Size(direction StreamDirection) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes[direction]
+}
+
+// Truncated reports whether Limit dropped bytes of direction.
+func (s *Stream) Truncated(direction StreamDirection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes[direction] > s.kept[direction]
+}
+
+// Chunks returns the kept chunks in the order they were read.
+func (s *Stream) Chunks() []Chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Chunk(nil), s.chunks...)
+}
+
+// Conversation merges the kept chunks into alternating client and server
+// segments.
+func (s *Stream) Conversation() []Segment {
+	var segments []Segment
+	for _, c := range s.Chunks() {
+		if n := len(segments); n > 0 && segments[n-1].StreamDirection == c.StreamDirection {
+			last := &segments[n-1]
+			last.End = c.Time
+			last.Payload = append(last.Payload, c.Payload...)
+			continue
+		}
+		segments = append(segments, Segment{
+			StreamDirection: c.StreamDirection,
+			Offset:          c.Offset,
+			Start:           c.Time,
+			End:             c.Time,
+			Payload:         bytes.Clone(c.Payload),
+		})
+	}
+	return segments
+}
+
+// Reader reads the kept bytes of direction from the start, chunks appended
+// after it was made are not part of it.
+func (s *Stream) Reader(direction StreamDirection) io.Reader {
+	var readers []io.Reader
+	for _, c := range s.Chunks() {
+		if c.StreamDirection == direction {
+			readers = append(readers, bytes.NewReader(c.Payload))
+		}
+	}
+	return io.MultiReader(readers...)
+}
+
+// Record appends a read of a tunnel to the stream of s and emits s with it
+// as the payload of its direction, fallback handles the event when s has no
+// callback. The dissector of the stream sees the chunk right after. Both
+// directions of a tunnel record concurrently, their events are emitted one
+// at a time.
+func (s *Session) Record(direction StreamDirection, p []byte, fallback SessionEventCallBack) {
+	s.Stream.emit.Lock()
+	defer s.Stream.emit.Unlock()
+	c := s.Stream.Append(direction, p)
+	s.StreamDirection = direction
+	switch direction {
+	case Inbound:
+		s.ReqBodyDecoder.Payload = c.Payload
+	case Outbound:
+		s.RespBodyDecoder.Payload = c.Payload
+	}
+	emit := s.EventCallBack
+	if emit == nil {
+		emit = fallback
+	}
+	emit(s)
+	if s.Stream.dissector == nil && s.Stream.NewDissector != nil {
+		s.Stream.dissector = s.Stream.NewDissector()
+	}
+	if s.Stream.dissector != nil {
+		s.Stream.dissector.Dissect(s, c, emit)
+	}
+}
@@ -0,0 +1,43 @@
+package packet
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ddkwork/golibrary/std/assert"
+	"github.com/ddkwork/golibrary/std/mylog"
+)
+
+func TestStream(t *testing.T) {
+	s := &Stream{Limit: 10}
+	buf := []byte("HELO a\r\n")
+	c := s.Append(Outbound, buf)
+	buf[0] = 'X' // the read buffer is reused
+	assert.Equal(t, "HELO a\r\n", string(c.Payload))
+	s.Append(Inbound, []byte("250 "))
+	s.Append(Inbound, []byte("ok\r\n"))
+	c = s.Append(Outbound, []byte("QUIT\r\n"))
+	assert.Equal(t, int64(8), c.Offset)
+	assert.Equal(t, "QUIT\r\n", string(c.Payload))
+
+	segments := s.Conversation()
+	assert.Equal(t, 3, len(segments))
+	assert.Equal(t, Inbound, segments[1].StreamDirection)
+	assert.Equal(t, "250 ok\r\n", string(segments[1].Payload))
+	assert.Equal(t, "QU", string(segments[2].Payload))
+
+	assert.Equal(t, "HELO a\r\nQU", string(mylog.Check2(io.ReadAll(s.Reader(Outbound)))))
+	assert.Equal(t, int64(14), s.Size(Outbound))
+	assert.True(t, s.Truncated(Outbound))
+	assert.True(t, !s.Truncated(Inbound))
+}
+
+func TestNewChild(t *testing.T) {
+	s := &Session{Stream: &Stream{Limit: 10}, User: "alice"}
+	s.ReqBodyDecoder.SteamAesKey = []byte("key")
+	child := s.NewChild(s.SchemerType)
+	assert.True(t, child.Parent == s)
+	assert.Equal(t, "alice", child.User)
+	assert.Equal(t, "key", string(child.ReqBodyDecoder.SteamAesKey))
+	assert.Equal(t, int64(10), child.Stream.Limit)
+}
@@ -0,0 +1,81 @@
+package packet
+
+import "time"
+
+// Timings are the phases of an http exchange, for waterfall display and HAR
+// export. A phase that did not happen is zero, like the dial of a reused
+// connection.
+type Timings struct {
+	// Start is when the request of the client was read.
+	Start time.Time
+	// ClientTLSStart and ClientTLSDone bound the handshake of the proxy
+	// with the client, on the connection the request came in later.
+	ClientTLSStart time.Time
+	ClientTLSDone  time.Time
+	DNSStart       time.Time
+	DNSDone        time.Time
+	// ConnectStart is the first attempt to connect and ConnectDone the
+	// end of the last one.
+	ConnectStart time.Time
+	ConnectDone  time.Time
+	TLSStart     time.Time
+	TLSDone      time.Time
+	// GotConn is when the request had an upstream connection, Reused tells
+	// whether it was an idle one.
+	GotConn      time.Time
+	Reused       bool
+	WroteRequest time.Time
+	FirstByte    time.Time
+	// Done is when the last byte of the response went to the client, it is
+	// zero for responses emitted before their body.
+	Done time.Time
+}
+
+// span is how long from start to end, -1 when either is missing as in HAR.
+func span(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return -1
+	}
+	return end.Sub(start)
+}
+
+// Blocked is how long the request waited before it started to get a
+// connection.
+func (t Timings) Blocked() time.Duration {
+	for _, next := range []time.Time{t.DNSStart, t.ConnectStart, t.GotConn} {
+		if !next.IsZero() {
+			return span(t.Start, next)
+		}
+	}
+	return -1
+}
+
+func (t Timings) DNS() time.Duration { return span(t.DNSStart, t.DNSDone) }
+
+// Connect is how long the upstream connection took, the tls handshake
+// included as in HAR.
+func (t Timings) Connect() time.Duration {
+	if !t.TLSDone.IsZero() {
+		return span(t.ConnectStart, t.TLSDone)
+	}
+	return span(t.ConnectStart, t.ConnectDone)
+}
+
+// SSL is how long the upstream tls handshake took.
+func (t Timings) SSL() time.Duration { return span(t.TLSStart, t.TLSDone) }
+
+// ClientTLS is how long the tls handshake with the client took.
+func (t Timings) ClientTLS() time.Duration { return span(t.ClientTLSStart, t.ClientTLSDone) }
+
+// Send is how long writing the request upstream took.
+func (t Timings) Send() time.Duration { return span(t.GotConn, t.WroteRequest) }
+
+// Wait is how long the server took to answer.
+func (t Timings) Wait() time.Duration { return span(t.WroteRequest, t.FirstByte) }
+
+// Receive is how long the response took from its first byte until it all
+// went to the client.
+func (t Timings) Receive() time.Duration { return span(t.FirstByte, t.Done) }
+
+// Total is how long the exchange took.
+func (t Timings) Total() time.Duration { return span(t.Start, t.Done) }